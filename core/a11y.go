@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/chromedp/cdproto/accessibility"
+	"github.com/chromedp/chromedp"
+)
+
+// a11yNode is one node of the accessibility tree as /a11y reports it. States
+// holds the remaining AX properties (focusable, checked, level, ...) with
+// their JSON values.
+type a11yNode struct {
+	Role        string                     `json:"role"`
+	Name        string                     `json:"name,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Value       json.RawMessage            `json:"value,omitempty"`
+	States      map[string]json.RawMessage `json:"states,omitempty"`
+	Children    []*a11yNode                `json:"children,omitempty"`
+}
+
+// HandleA11y loads a page like a capture would and returns Chrome's
+// accessibility tree as {"url": ..., "tree": [...]}. Nodes Chrome ignores are
+// left out and their children lifted to the nearest reported ancestor.
+func HandleA11y(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "a11y") {
+		return
+	}
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	var nodes []*accessibility.Node
+	var finalURL string
+	err = inspectPage(r.Context(), opts, nil, chromedp.Tasks{
+		chromedp.Location(&finalURL),
+		chromedp.ActionFunc(func(ctx context.Context) (err error) {
+			nodes, err = accessibility.GetFullAXTree().Do(ctx)
+			return err
+		}),
+	})
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"url":  finalURL,
+		"tree": buildA11yTree(nodes),
+	})
+}
+
+// buildA11yTree links the flat node list Chrome returns into trees.
+func buildA11yTree(nodes []*accessibility.Node) []*a11yNode {
+	byID := make(map[accessibility.NodeID]*accessibility.Node, len(nodes))
+	for _, n := range nodes {
+		byID[n.NodeID] = n
+	}
+	var convert func(n *accessibility.Node) []*a11yNode
+	convert = func(n *accessibility.Node) []*a11yNode {
+		var children []*a11yNode
+		for _, id := range n.ChildIDs {
+			if child, ok := byID[id]; ok {
+				children = append(children, convert(child)...)
+			}
+		}
+		if n.Ignored {
+			return children
+		}
+		node := &a11yNode{
+			Role:        axString(n.Role),
+			Name:        axString(n.Name),
+			Description: axString(n.Description),
+			Children:    children,
+		}
+		if n.Value != nil && len(n.Value.Value) > 0 {
+			node.Value = json.RawMessage(n.Value.Value)
+		}
+		for _, p := range n.Properties {
+			if p.Value == nil || len(p.Value.Value) == 0 {
+				continue
+			}
+			if node.States == nil {
+				node.States = make(map[string]json.RawMessage)
+			}
+			node.States[string(p.Name)] = json.RawMessage(p.Value.Value)
+		}
+		return []*a11yNode{node}
+	}
+
+	var tree []*a11yNode
+	for _, n := range nodes {
+		if _, hasParent := byID[n.ParentID]; !hasParent {
+			tree = append(tree, convert(n)...)
+		}
+	}
+	return tree
+}
+
+// axString is the text of an AX value, or its raw JSON when not a string.
+func axString(v *accessibility.Value) string {
+	if v == nil || len(v.Value) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(v.Value, &s) == nil {
+		return s
+	}
+	return string(v.Value)
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"hash/maphash"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// frequencySketch is a count-min sketch with 4-bit saturating counters that
+// are halved every sampleSize increments (the TinyLFU reset), so popularity
+// estimates follow recent traffic rather than all-time totals.
+type frequencySketch struct {
+	mu         sync.Mutex
+	seeds      [4]maphash.Seed
+	rows       [4][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newFrequencySketch(width int) *frequencySketch {
+	size := 64
+	for size < width {
+		size <<= 1
+	}
+	s := &frequencySketch{mask: uint64(size - 1), sampleSize: 10 * size}
+	for i := range s.rows {
+		s.seeds[i] = maphash.MakeSeed()
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+func (s *frequencySketch) increment(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.rows {
+		idx := maphash.String(s.seeds[i], key) & s.mask
+		if s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.sampleSize {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	est := 15
+	for i := range s.rows {
+		est = min(est, int(s.rows[i][maphash.String(s.seeds[i], key)&s.mask]))
+	}
+	return est
+}
+
+var (
+	// Cache admission (CACHE_ADMISSION=all|tinylfu)
+	cacheAdmission     string
+	admissionSketch    *frequencySketch
+	admissionMinHits   int
+	admissionExpensive time.Duration
+)
+
+func init() {
+	cacheAdmission = "all"
+	if os.Getenv("CACHE_ADMISSION") == "tinylfu" {
+		cacheAdmission = "tinylfu"
+	}
+
+	// Admit entries requested at least this often within the sketch window...
+	admissionMinHits = 2
+	if v := os.Getenv("CACHE_ADMISSION_MIN_HITS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val > 0 {
+			admissionMinHits = min(val, 15)
+		}
+	}
+
+	// ...or that took at least this long to render
+	admissionExpensive = 5 * time.Second
+	if v := os.Getenv("CACHE_ADMISSION_EXPENSIVE_MS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val > 0 {
+			admissionExpensive = time.Duration(val) * time.Millisecond
+		}
+	}
+
+	admissionSketch = newFrequencySketch(4096)
+	if cacheAdmission == "tinylfu" {
+		log.Printf("webshot cache admission: tinylfu (min hits %d, expensive >= %v)", admissionMinHits, admissionExpensive)
+	}
+}
+
+// recordCacheAccess feeds every lookup into the frequency sketch.
+func recordCacheAccess(key string) {
+	if cacheAdmission == "tinylfu" {
+		admissionSketch.increment(key)
+	}
+}
+
+// admitToCache decides whether a fresh capture is worth caching: popular or
+// expensive captures are, one-off cheap ones are not.
+func admitToCache(key string, cost time.Duration) bool {
+	if cacheAdmission != "tinylfu" {
+		return true
+	}
+	return admissionSketch.estimate(key) >= admissionMinHits || cost >= admissionExpensive
+}
+
+// admitOverVictim decides whether a new entry may evict a resident one when
+// the cache is full. Each side is valued by its recent popularity times what
+// it costs to render again, so a popular cheap page and a rarely requested
+// expensive one can both hold their place.
+func admitOverVictim(key string, cost time.Duration, victimKey string, victimCost time.Duration) bool {
+	if cacheAdmission != "tinylfu" {
+		return true
+	}
+	return admissionValue(key, cost) > admissionValue(victimKey, victimCost)
+}
+
+func admissionValue(key string, cost time.Duration) float64 {
+	return float64(admissionSketch.estimate(key)+1) * max(cost.Seconds(), 0.1)
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// annotation is a review comment pinned to a rectangle of a stored capture.
+type annotation struct {
+	ID      int       `json:"id"`
+	X       int       `json:"x"`
+	Y       int       `json:"y"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	Note    string    `json:"note"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+}
+
+var (
+	// Review annotations by owner and capture id (the id reported in
+	// X-Capture-ID), keyed as annotationKey returns them
+	annotations     map[string][]annotation
+	annotationsLock sync.RWMutex
+	annotationsFile string
+	nextAnnotation  int
+)
+
+func init() {
+	annotations = make(map[string][]annotation)
+
+	annotationsFile = os.Getenv("ANNOTATIONS_FILE")
+	if annotationsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(annotationsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read ANNOTATIONS_FILE: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &annotations); err != nil {
+		log.Printf("Invalid ANNOTATIONS_FILE, starting empty: %v", err)
+		annotations = make(map[string][]annotation)
+	}
+	for _, list := range annotations {
+		for _, a := range list {
+			nextAnnotation = max(nextAnnotation, a.ID)
+		}
+	}
+}
+
+// saveAnnotations persists the store; callers must hold annotationsLock.
+func saveAnnotations() {
+	if annotationsFile == "" {
+		return
+	}
+	data, err := json.Marshal(annotations)
+	if err == nil {
+		err = os.WriteFile(annotationsFile, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to save annotations: %v", err)
+	}
+}
+
+// annotationKey scopes a capture's annotations to the caller's tenant: capture
+// ids are shared by everyone who captures the same page, their notes are not.
+func annotationKey(ctx context.Context, id string) string {
+	return credentialOwner(ctx) + "/" + id
+}
+
+func validCaptureID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+// HandleAnnotations lists (GET) or adds (POST) the caller's review annotations
+// for /captures/{id}/annotations. The author is the API key that added one.
+func HandleAnnotations(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "annotations") {
+		return
+	}
+
+	id := r.PathValue("id")
+	if !validCaptureID(id) {
+		http.Error(writer, "Invalid capture id", http.StatusBadRequest)
+		return
+	}
+	key := annotationKey(r.Context(), id)
+
+	switch r.Method {
+	case http.MethodGet:
+		annotationsLock.RLock()
+		list := annotations[key]
+		annotationsLock.RUnlock()
+		if list == nil {
+			list = []annotation{}
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(list)
+
+	case http.MethodPost:
+		var a annotation
+		if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 64<<10)).Decode(&a); err != nil {
+			http.Error(writer, "Invalid annotation JSON", http.StatusBadRequest)
+			return
+		}
+		a.Note = strings.TrimSpace(a.Note)
+		if a.Note == "" || a.Width <= 0 || a.Height <= 0 || a.X < 0 || a.Y < 0 {
+			http.Error(writer, "Annotation needs a note and a rectangle with positive size", http.StatusBadRequest)
+			return
+		}
+		a.Author = tenantName(r.Context())
+		a.Created = time.Now().UTC()
+
+		annotationsLock.Lock()
+		nextAnnotation++
+		a.ID = nextAnnotation
+		annotations[key] = append(annotations[key], a)
+		saveAnnotations()
+		annotationsLock.Unlock()
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(a)
+
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKey is a client credential together with the attributes that downstream
+// stages (rate limiting, feature gates) read from the request context.
+type apiKey struct {
+	Key       string   `json:"key"`
+	Name      string   `json:"name"`
+	Tenant    string   `json:"tenant,omitempty"`     // profile in TENANTS_FILE
+	RateLimit float64  `json:"rate_limit,omitempty"` // requests per second, 0 = server default
+	Burst     int      `json:"burst,omitempty"`
+	Features  []string `json:"features,omitempty"` // empty = every feature
+
+	DailyQuota   int64 `json:"daily_quota,omitempty"`   // captures per UTC day, 0 = unlimited
+	MonthlyQuota int64 `json:"monthly_quota,omitempty"` // captures per UTC month, 0 = unlimited
+
+	EgressPerMinute int64 `json:"egress_bytes_per_minute,omitempty"` // renderer downloads, 0 = server default
+	EgressPerDay    int64 `json:"egress_bytes_per_day,omitempty"`
+
+	Priority       string `json:"priority,omitempty"`        // queue tier: high, normal (default) or low
+	MaxConcurrency int    `json:"max_concurrency,omitempty"` // workers held at once, 0 = server default
+}
+
+type apiKeyContextKey struct{}
+
+var (
+	// API keys by secret; authentication is enabled when any key is configured
+	apiKeys     map[string]*apiKey
+	authEnabled bool
+
+	// The same keys by name, which identifies a caller in usage accounting,
+	// queue limits and work done later on its behalf
+	apiKeysByName map[string]*apiKey
+)
+
+func init() {
+	var file []byte
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		var err error
+		if file, err = os.ReadFile(path); err != nil {
+			log.Fatalf("Failed to read API_KEYS_FILE: %v", err)
+		}
+	}
+	var err error
+	if apiKeys, err = parseAPIKeys(os.Getenv("API_KEYS"), file); err != nil {
+		log.Fatalf("Invalid API keys: %v", err)
+	}
+
+	apiKeysByName = make(map[string]*apiKey, len(apiKeys))
+	for _, k := range apiKeys {
+		apiKeysByName[k.Name] = k
+	}
+
+	authEnabled = len(apiKeys) > 0
+	if authEnabled {
+		log.Printf("webshot API-key authentication enabled (%d keys)", len(apiKeys))
+	}
+}
+
+// parseAPIKeys reads API_KEYS (secret1:name1,secret2 for simple deployments)
+// and the JSON array of keys with attributes from API_KEYS_FILE, whose entries
+// replace those of the same secret. Names must be unique.
+func parseAPIKeys(list string, file []byte) (map[string]*apiKey, error) {
+	keys := make(map[string]*apiKey)
+	for _, entry := range strings.Split(list, ",") {
+		secret, name, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if secret == "" {
+			continue
+		}
+		if name == "" {
+			name = defaultKeyName(secret)
+		}
+		keys[secret] = &apiKey{Key: secret, Name: name}
+	}
+
+	if len(file) > 0 {
+		var fileKeys []*apiKey
+		if err := json.Unmarshal(file, &fileKeys); err != nil {
+			return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+		}
+		for _, k := range fileKeys {
+			if k.Key == "" {
+				continue
+			}
+			if k.Name == "" {
+				k.Name = defaultKeyName(k.Key)
+			}
+			if _, ok := priorityNames[k.Priority]; k.Priority != "" && !ok {
+				return nil, fmt.Errorf("API_KEYS_FILE: key %q has unknown priority %q", k.Name, k.Priority)
+			}
+			keys[k.Key] = k
+		}
+	}
+
+	names := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if names[k.Name] {
+			return nil, fmt.Errorf("more than one key is named %q", k.Name)
+		}
+		names[k.Name] = true
+	}
+	return keys, nil
+}
+
+// defaultKeyName names an unnamed key after a hash of its secret, so the name
+// can be shown in usage reports and logs without giving any of it away.
+func defaultKeyName(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "key-" + hex.EncodeToString(sum[:6])
+}
+
+// allows reports whether the key may use feature. Keys without an explicit
+// feature list may use everything.
+func (k *apiKey) allows(feature string) bool {
+	if k == nil || len(k.Features) == 0 {
+		return true
+	}
+	for _, f := range k.Features {
+		if f == feature || f == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// has reports whether feature is explicitly listed on the key; privileged
+// features (cdp, admin, proxy) are never implied by an empty list.
+func (k *apiKey) has(feature string) bool {
+	if k == nil {
+		return false
+	}
+	for _, f := range k.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyFrom returns the authenticated key, or nil when auth is disabled.
+func apiKeyFrom(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// apiKeyNamed finds a configured key by name, for work done later on a
+// caller's behalf (schedules, cluster render jobs).
+func apiKeyNamed(name string) *apiKey {
+	return apiKeysByName[name]
+}
+
+func presentedAPIKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// RequireAPIKey rejects requests without a valid key (X-API-Key header,
+// Authorization: Bearer, or api_key query parameter) and stores the key in
+// the request context for downstream handlers. A valid signed URL stands in
+// for the key that signed it; once signing is configured, anonymous access
+// is refused.
+func RequireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if len(signingSecret) > 0 && r.URL.Query().Has("sig") {
+			key, ok, reason := verifySignedRequest(r)
+			if !ok {
+				http.Error(writer, reason, http.StatusForbidden)
+				return
+			}
+			if key != nil {
+				r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+			}
+			next(writer, r)
+			return
+		}
+
+		if !authEnabled {
+			if len(signingSecret) > 0 {
+				http.Error(writer, "Signed URL required", http.StatusUnauthorized)
+				return
+			}
+			next(writer, r)
+			return
+		}
+
+		key, ok := apiKeys[presentedAPIKey(r)]
+		if !ok {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="webshot"`)
+			http.Error(writer, "Missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		next(writer, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// requireFeature writes a 403 and returns false when the caller's key may not
+// use feature.
+func requireFeature(writer http.ResponseWriter, r *http.Request, feature string) bool {
+	if apiKeyFrom(r.Context()).allows(feature) {
+		return true
+	}
+	http.Error(writer, "API key is not allowed to use "+feature, http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useAPIKeys configures keys for the duration of the test.
+func useAPIKeys(t *testing.T, keys ...*apiKey) {
+	t.Helper()
+	saved, savedByName, savedEnabled := apiKeys, apiKeysByName, authEnabled
+	t.Cleanup(func() { apiKeys, apiKeysByName, authEnabled = saved, savedByName, savedEnabled })
+
+	apiKeys = make(map[string]*apiKey)
+	apiKeysByName = make(map[string]*apiKey)
+	for _, k := range keys {
+		apiKeys[k.Key] = k
+		apiKeysByName[k.Name] = k
+	}
+	authEnabled = len(keys) > 0
+}
+
+// keyContext is a request context authenticated as k.
+func keyContext(k *apiKey) context.Context {
+	return context.WithValue(context.Background(), apiKeyContextKey{}, k)
+}
+
+// useTenant configures a tenant profile for the duration of the test.
+func useTenant(t *testing.T, name string, p *tenantProfile) {
+	t.Helper()
+	saved, had := tenantProfiles[name]
+	t.Cleanup(func() {
+		if had {
+			tenantProfiles[name] = saved
+		} else {
+			delete(tenantProfiles, name)
+		}
+	})
+	var err error
+	if p.domainRules, err = parseURLRules(strings.Join(p.AllowedDomains, ",")); err != nil {
+		t.Fatal(err)
+	}
+	tenantProfiles[name] = p
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys(" s1:alpha, s2 ,,", []byte(`[
+		{"key":"s3","name":"gamma","features":["screenshot"],"priority":"high"},
+		{"key":"s1","name":"alpha-file"},
+		{"key":"","name":"ignored"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("got %d keys, want 3", len(keys))
+	}
+	if k := keys["s1"]; k == nil || k.Name != "alpha-file" {
+		t.Errorf("s1 = %+v, want the API_KEYS_FILE entry", k)
+	}
+	if k := keys["s3"]; k == nil || k.Priority != "high" || len(k.Features) != 1 {
+		t.Errorf("s3 = %+v, want its attributes", k)
+	}
+
+	// Unnamed keys are named by a hash, not a prefix, of the secret
+	name := keys["s2"].Name
+	if !strings.HasPrefix(name, "key-") || strings.Contains(name, "s2") || name != defaultKeyName("s2") {
+		t.Errorf("default name %q", name)
+	}
+	if defaultKeyName("abcd1234") == defaultKeyName("abcd5678") {
+		t.Error("secrets sharing a prefix got the same default name")
+	}
+}
+
+func TestParseAPIKeysRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		file string
+	}{
+		{"duplicate names", "s1:team,s2:team", ""},
+		{"duplicate across sources", "s1:team", `[{"key":"s2","name":"team"}]`},
+		{"unknown priority", "", `[{"key":"s1","priority":"urgent"}]`},
+		{"invalid JSON", "", `{"key":"s1"}`},
+	}
+	for _, tt := range tests {
+		if _, err := parseAPIKeys(tt.list, []byte(tt.file)); err == nil {
+			t.Errorf("%s: parseAPIKeys succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestAPIKeyFeatures(t *testing.T) {
+	var none *apiKey
+	open := &apiKey{}
+	limited := &apiKey{Features: []string{"screenshot", "cdp"}}
+	wildcard := &apiKey{Features: []string{"*"}}
+
+	tests := []struct {
+		key     *apiKey
+		feature string
+		allows  bool
+		has     bool
+	}{
+		{none, "screenshot", true, false},
+		{none, "proxy", true, false},
+		{open, "tiles", true, false},
+		{open, "cdp", true, false},
+		{limited, "screenshot", true, true},
+		{limited, "tiles", false, false},
+		{limited, "cdp", true, true},
+		{wildcard, "tiles", true, false},
+		{wildcard, "proxy", true, false},
+	}
+	for _, tt := range tests {
+		if got := tt.key.allows(tt.feature); got != tt.allows {
+			t.Errorf("%+v allows(%q) = %v, want %v", tt.key, tt.feature, got, tt.allows)
+		}
+		if got := tt.key.has(tt.feature); got != tt.has {
+			t.Errorf("%+v has(%q) = %v, want %v", tt.key, tt.feature, got, tt.has)
+		}
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	key := &apiKey{Key: "secret", Name: "team"}
+	useAPIKeys(t, key)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		query  string
+		ok     bool
+	}{
+		{"header", "X-API-Key", "secret", "", true},
+		{"bearer", "Authorization", "Bearer secret", "", true},
+		{"query", "", "", "api_key=secret", true},
+		{"missing", "", "", "", false},
+		{"wrong key", "X-API-Key", "other", "", false},
+		{"key name", "X-API-Key", "team", "", false},
+		{"basic auth", "Authorization", "Basic secret", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/get?"+tt.query, nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		var got *apiKey
+		w := httptest.NewRecorder()
+		RequireAPIKey(func(w http.ResponseWriter, r *http.Request) { got = apiKeyFrom(r.Context()) })(w, r)
+
+		switch {
+		case tt.ok && got != key:
+			t.Errorf("%s: handler saw key %v, status %d", tt.name, got, w.Code)
+		case !tt.ok && w.Code != http.StatusUnauthorized:
+			t.Errorf("%s: status %d, want 401", tt.name, w.Code)
+		}
+	}
+}
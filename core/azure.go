@@ -0,0 +1,287 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureClient is a minimal Azure Blob Storage client for one container,
+// authorizing requests with the account's Shared Key and presigning with
+// service SAS tokens. AZURE_STORAGE_ENDPOINT points it at Azurite
+// (http://127.0.0.1:10000/devstoreaccount1) or a sovereign cloud.
+type azureClient struct {
+	endpoint  *url.URL
+	account   string
+	key       []byte
+	container string
+	client    *http.Client
+}
+
+const azureVersion = "2020-12-06"
+
+// azureClientForContainer connects to container with the AZURE_STORAGE_*
+// account.
+func azureClientForContainer(container string) (*azureClient, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if account == "" {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT is required")
+	}
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("AZURE_STORAGE_KEY"))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("AZURE_STORAGE_KEY must be the base64 account key")
+	}
+	endpoint := envOr("AZURE_STORAGE_ENDPOINT", "https://"+account+".blob.core.windows.net")
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if container == "" {
+		return nil, fmt.Errorf("container is required")
+	}
+	return &azureClient{endpoint: u, account: account, key: key, container: container, client: &http.Client{Timeout: 60 * time.Second}}, nil
+}
+
+func (c *azureClient) String() string {
+	return c.endpoint.Host + "/" + c.container
+}
+
+func (c *azureClient) ObjectURL(key string) string {
+	return c.objectURL(key).String()
+}
+
+func (c *azureClient) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.container + "/" + key
+	u.RawPath = awsURIEncode(u.Path, false)
+	return &u
+}
+
+// Metadata names must be C# identifiers, so '-' is stored as '_'.
+func (c *azureClient) Put(ctx context.Context, key string, data []byte, contentType string, meta map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.ObjectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range meta {
+		req.Header.Set("X-Ms-Meta-"+strings.ReplaceAll(k, "-", "_"), v)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *azureClient) Get(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ObjectURL(key), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readObject(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, azureMeta(resp.Header), nil
+}
+
+func azureMeta(header http.Header) map[string]string {
+	meta := make(map[string]string)
+	for k, v := range objectMeta(header, "x-ms-meta-") {
+		meta[strings.ReplaceAll(k, "_", "-")] = v
+	}
+	return meta
+}
+
+func (c *azureClient) Head(ctx context.Context, key string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.ObjectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return azureMeta(resp.Header), nil
+}
+
+func (c *azureClient) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	marker := ""
+	for {
+		u := *c.endpoint
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.container
+		q := url.Values{"restype": {"container"}, "comp": {"list"}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Blobs {
+			keys = append(keys, blob.Name)
+		}
+		if page.NextMarker == "" {
+			return keys, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func (c *azureClient) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.ObjectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		if isBlobStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Presign returns the blob URL with a read-only service SAS.
+func (c *azureClient) Presign(key string, expiry time.Duration) (string, error) {
+	expires := time.Now().Add(expiry).UTC().Format("2006-01-02T15:04:05Z")
+	resource := "/blob/" + c.account + "/" + c.container + "/" + key
+	toSign := strings.Join([]string{
+		"r",        // signedPermissions
+		"",         // signedStart
+		expires,    // signedExpiry
+		resource,   // canonicalizedResource
+		"", "", "", // signedIdentifier, signedIP, signedProtocol
+		azureVersion,
+		"b",    // signedResource: blob
+		"", "", // signedSnapshotTime, signedEncryptionScope
+		"", "", "", "", "", // rscc, rscd, rsce, rscl, rsct
+	}, "\n")
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(toSign))
+
+	u := c.objectURL(key)
+	u.RawQuery = url.Values{
+		"sv":  {azureVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"se":  {expires},
+		"sig": {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}.Encode()
+	return u.String(), nil
+}
+
+func (c *azureClient) do(req *http.Request) (*http.Response, error) {
+	c.sign(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, &blobError{service: "azure", status: resp.StatusCode, body: string(msg)}
+	}
+	return resp, nil
+}
+
+// sign adds the Shared Key Authorization header to req.
+func (c *azureClient) sign(req *http.Request) {
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var names []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	resource := "/" + c.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + headers.String() + resource
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+c.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
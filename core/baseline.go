@@ -0,0 +1,283 @@
+package core
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Named baselines for visual regression checks: PUT /baselines/{name}
+// stores a capture, /compare re-captures and diffs against it. Baselines are
+// scoped to the caller's tenant and kept in BASELINE_STORE: "dir" (files
+// under BASELINE_DIR, the default) or "s3" (the S3_* bucket under
+// S3_BASELINE_PREFIX).
+var baselines objectStore
+
+var baselineName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+// baseline is the metadata stored next to the baseline image.
+type baseline struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	Created time.Time `json:"created"`
+}
+
+// comparison is the outcome of /compare.
+type comparison struct {
+	Baseline    string  `json:"baseline"`
+	URL         string  `json:"url"`
+	Threshold   float64 `json:"threshold"`
+	DiffPercent float64 `json:"diff_percent"`
+	Passed      bool    `json:"passed"`
+	Capture     string  `json:"capture,omitempty"`
+	Diff        string  `json:"diff"`
+}
+
+func init() {
+	kind := envOr("BASELINE_STORE", "dir")
+	store, err := openObjectStore(kind, envOr("BASELINE_DIR", "baselines"), envOr("S3_BASELINE_PREFIX", "webshot/baselines/"))
+	if err != nil {
+		log.Fatalf("Invalid BASELINE_STORE configuration: %v", err)
+	}
+	baselines = store
+}
+
+// baselineKey is where the caller's baseline name is stored, without the
+// .png/.json extension.
+func baselineKey(r *http.Request, name string) string {
+	return url.PathEscape(credentialOwner(r.Context())) + "/" + name
+}
+
+func loadBaseline(r *http.Request, name string) (*baseline, []byte, error) {
+	key := baselineKey(r, name)
+	raw, err := baselines.Get(r.Context(), key+".json")
+	if err != nil {
+		return nil, nil, err
+	}
+	var b baseline
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return nil, nil, err
+	}
+	data, err := baselines.Get(r.Context(), key+".png")
+	if err != nil {
+		return nil, nil, err
+	}
+	return &b, data, nil
+}
+
+// HandleBaselines lists the caller's baselines.
+func HandleBaselines(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "baselines") {
+		return
+	}
+	prefix := url.PathEscape(credentialOwner(r.Context())) + "/"
+	keys, err := baselines.List(r.Context(), prefix)
+	if err != nil {
+		log.Printf("Error listing baselines: %v", err)
+		http.Error(writer, "Error listing baselines", http.StatusBadGateway)
+		return
+	}
+	list := []baseline{}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		raw, err := baselines.Get(r.Context(), key)
+		var b baseline
+		if err != nil || json.Unmarshal(raw, &b) != nil {
+			continue
+		}
+		list = append(list, b)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(list)
+}
+
+// HandleBaseline stores a fresh capture of ?url= as baseline {name} (PUT),
+// serves its image (GET) or removes it (DELETE).
+func HandleBaseline(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "baselines") {
+		return
+	}
+	name := r.PathValue("name")
+	if !baselineName.MatchString(name) {
+		http.Error(writer, "Invalid baseline name", http.StatusBadRequest)
+		return
+	}
+	key := baselineKey(r, name)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		b, data, err := loadBaseline(r, name)
+		if errors.Is(err, errObjectNotFound) {
+			http.Error(writer, "Baseline not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error loading baseline %s: %v", key, err)
+			http.Error(writer, "Error loading baseline", http.StatusBadGateway)
+			return
+		}
+		writer.Header().Set("Content-Type", "image/png")
+		writer.Header().Set("X-Baseline-URL", b.URL)
+		serveImage(writer, r, data, b.Created)
+
+	case http.MethodPut:
+		opts, err := parseCaptureOptions(r)
+		if err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+		opts.refresh = true
+		res, err := screenshotFor(r.Context(), opts)
+		if err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+		if res.partial {
+			http.Error(writer, "Capture timed out before the page finished loading", http.StatusGatewayTimeout)
+			return
+		}
+
+		b := baseline{Name: name, URL: opts.url, Width: opts.width, Height: opts.height, Created: time.Now().UTC()}
+		meta, _ := json.Marshal(b)
+		// Image first: a baseline only becomes visible once its metadata lands
+		err = baselines.Put(r.Context(), key+".png", res.data, "image/png")
+		if err == nil {
+			err = baselines.Put(r.Context(), key+".json", meta, "application/json")
+		}
+		if err != nil {
+			log.Printf("Error storing baseline %s: %v", key, err)
+			http.Error(writer, "Error storing baseline", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Stored baseline %s for %s", key, opts.url)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(b)
+
+	case http.MethodDelete:
+		if _, err := baselines.Get(r.Context(), key+".json"); errors.Is(err, errObjectNotFound) {
+			http.Error(writer, "Baseline not found", http.StatusNotFound)
+			return
+		}
+		err := baselines.Delete(r.Context(), key+".json")
+		if err == nil {
+			err = baselines.Delete(r.Context(), key+".png")
+		}
+		if err != nil {
+			log.Printf("Error deleting baseline %s: %v", key, err)
+			http.Error(writer, "Error deleting baseline", http.StatusBadGateway)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleCompare re-captures a page and diffs it against
+// ?baseline=<name>. url, width and height default to the baseline's; the
+// comparison passes when at most ?threshold= percent of pixels differ
+// (default 0.1). The diff visualisation is stored like a capture.
+func HandleCompare(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "baselines") {
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get("baseline")
+	if !baselineName.MatchString(name) {
+		http.Error(writer, "Invalid or missing 'baseline' parameter", http.StatusBadRequest)
+		return
+	}
+	threshold := 0.1
+	if t := query.Get("threshold"); t != "" {
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil || v < 0 || v > 100 {
+			http.Error(writer, "Invalid threshold (percentage 0-100)", http.StatusBadRequest)
+			return
+		}
+		threshold = v
+	}
+
+	b, data, err := loadBaseline(r, name)
+	if errors.Is(err, errObjectNotFound) {
+		http.Error(writer, "Baseline not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading baseline %s: %v", name, err)
+		http.Error(writer, "Error loading baseline", http.StatusBadGateway)
+		return
+	}
+
+	// Capture exactly what the baseline captured unless told otherwise
+	if query.Get("url") == "" {
+		query.Set("url", b.URL)
+	}
+	if query.Get("width") == "" && query.Get("height") == "" {
+		query.Set("width", strconv.Itoa(b.Width))
+		query.Set("height", strconv.Itoa(b.Height))
+	}
+	r.URL.RawQuery = query.Encode()
+
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+	opts.refresh = true
+	res, err := screenshotFor(r.Context(), opts)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	before, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		http.Error(writer, "Error decoding baseline", http.StatusInternalServerError)
+		return
+	}
+	after, _, err := image.Decode(bytes.NewReader(res.data))
+	if err != nil {
+		http.Error(writer, "Error decoding screenshot", http.StatusInternalServerError)
+		return
+	}
+	diff, percent := diffImages(before, after)
+	diffImg, err := pngBytes(&pngEncoder, diff)
+	if err != nil {
+		http.Error(writer, "Error encoding diff", http.StatusInternalServerError)
+		return
+	}
+	sum := md5.Sum(append([]byte("compare;"+baselineKey(r, name)+";"+b.Created.String()+";"+getCacheKey(opts)+";"), diffImg...))
+	diffID := hex.EncodeToString(sum[:])
+	screenCache.set(diffID, &cacheEntry{url: opts.url, data: diffImg, timestamp: time.Now()}, cacheRetention())
+
+	result := comparison{
+		Baseline:    name,
+		URL:         opts.url,
+		Threshold:   threshold,
+		DiffPercent: percent,
+		Passed:      percent <= threshold,
+		Diff:        "/captures/" + diffID,
+	}
+	if !opts.noStore {
+		result.Capture = "/captures/" + getCacheKey(opts)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(result)
+}
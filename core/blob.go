@@ -0,0 +1,108 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// blobClient is one bucket of a cloud object store: an S3 (or compatible)
+// bucket, a Google Cloud Storage bucket or an Azure Blob Storage container.
+// Objects carry string metadata with lower-case names.
+type blobClient interface {
+	Put(ctx context.Context, key string, data []byte, contentType string, meta map[string]string) error
+	// Get and Head report missing objects as *blobError with status 404
+	Get(ctx context.Context, key string) ([]byte, map[string]string, error)
+	Head(ctx context.Context, key string) (map[string]string, error)
+	// List returns every key under prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes key; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// ObjectURL is the unsigned URL of key, Presign one anybody can GET
+	// until expiry
+	ObjectURL(key string) string
+	Presign(key string, expiry time.Duration) (string, error)
+	String() string
+}
+
+// blobError is a request a bucket service answered with an error status.
+type blobError struct {
+	service string
+	status  int
+	body    string
+}
+
+func (e *blobError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.service, e.status, strings.TrimSpace(e.body))
+}
+
+func isBlobStatus(err error, status int) bool {
+	var e *blobError
+	return errors.As(err, &e) && e.status == status
+}
+
+// blobKinds are the bucket backends, by the name configuration selects them
+// with.
+var blobKinds = []string{"s3", "gcs", "azure"}
+
+// defaultBucket is the bucket (container) the kind's configuration names.
+func defaultBucket(kind string) string {
+	switch kind {
+	case "s3":
+		return os.Getenv("S3_BUCKET")
+	case "gcs":
+		return os.Getenv("GCS_BUCKET")
+	case "azure":
+		return os.Getenv("AZURE_CONTAINER")
+	}
+	return ""
+}
+
+// openBlobClient connects to bucket, or the configured default bucket when
+// empty, with kind's endpoint and credentials.
+func openBlobClient(kind, bucket string) (blobClient, error) {
+	if bucket == "" {
+		bucket = defaultBucket(kind)
+	}
+	var client blobClient
+	var err error
+	switch kind {
+	case "s3":
+		client, err = s3ClientForBucket(bucket)
+	case "gcs":
+		client, err = gcsClientForBucket(bucket)
+	case "azure":
+		client, err = azureClientForContainer(bucket)
+	default:
+		return nil, fmt.Errorf("unknown bucket backend %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// readObject reads an object body into a slice of exactly its size: in one
+// allocation when the length is known, otherwise through a pooled buffer,
+// instead of io.ReadAll's doubling.
+func readObject(resp *http.Response) ([]byte, error) {
+	if n := resp.ContentLength; n >= 0 {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(resp.Body, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
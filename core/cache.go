@@ -0,0 +1,539 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureCache stores finished captures by cache key. Backends own expiry:
+// the memory and disk caches are swept periodically, Redis expires keys
+// itself and object stores rely on bucket lifecycle rules.
+type captureCache interface {
+	get(key string) (*cacheEntry, bool)
+	set(key string, entry *cacheEntry, ttl time.Duration)
+	delete(key string)
+	sweep(retention time.Duration)
+	// purge removes every entry whose captured URL matches and reports how
+	// many were removed
+	purge(match func(url string) bool) int
+}
+
+func init() {
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "", "memory":
+		maxBytes := int64(512) << 20
+		if mb := os.Getenv("CACHE_MAX_MB"); mb != "" {
+			if val, err := strconv.Atoi(mb); err == nil && val > 0 {
+				maxBytes = int64(val) << 20
+			}
+		}
+		maxEntries := 1000
+		if n := os.Getenv("CACHE_MAX_ENTRIES"); n != "" {
+			if val, err := strconv.Atoi(n); err == nil && val > 0 {
+				maxEntries = val
+			}
+		}
+		screenCache = newMemoryCache(maxBytes, maxEntries)
+	case "redis":
+		redisURL := os.Getenv("REDIS_URL")
+		if redisURL == "" {
+			redisURL = "redis://localhost:6379"
+		}
+		client, err := newRedisClient(redisURL, 32)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+
+		chunkSize := 512 << 10
+		if cs := os.Getenv("REDIS_CHUNK_BYTES"); cs != "" {
+			if val, err := strconv.Atoi(cs); err == nil && val > 0 {
+				chunkSize = val
+			}
+		}
+
+		if _, err := client.Do("PING"); err != nil {
+			log.Printf("Warning: Redis cache at %s is not reachable yet: %v", client.addr, err)
+		}
+		screenCache = &redisCache{client: client, prefix: "webshot:", chunkSize: chunkSize}
+		log.Printf("webshot cache backend: redis (%s)", client.addr)
+	case "disk":
+		dir := os.Getenv("CACHE_DIR")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "webshot-cache")
+		}
+
+		maxBytes := int64(1024) << 20
+		if mb := os.Getenv("CACHE_DISK_MAX_MB"); mb != "" {
+			if val, err := strconv.Atoi(mb); err == nil && val > 0 {
+				maxBytes = int64(val) << 20
+			}
+		}
+
+		cache, err := newDiskCache(dir, maxBytes)
+		if err != nil {
+			log.Fatalf("Failed to open disk cache at %s: %v", dir, err)
+		}
+		screenCache = cache
+		log.Printf("webshot cache backend: disk (%s, %d entries, max %d MB)", dir, len(cache.entries), maxBytes>>20)
+	case "s3", "gcs", "azure":
+		client, err := openBlobClient(backend, "")
+		if err != nil {
+			log.Fatalf("Invalid %s cache configuration: %v", backend, err)
+		}
+		screenCache = &objectCache{
+			store:    client,
+			prefix:   envOr("S3_PREFIX", "webshot/cache/"),
+			redirect: os.Getenv("S3_REDIRECT") == "true",
+		}
+		log.Printf("webshot cache backend: %s (%s)", backend, client)
+	default:
+		log.Fatalf("Unknown CACHE_BACKEND %q", backend)
+	}
+}
+
+// memoryCache is the per-process cache: an LRU bounded by both total bytes
+// and entry count so unique-URL traffic cannot grow memory without limit.
+type memoryCache struct {
+	maxBytes   int64
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // key -> element holding *memoryEntry
+	lru     *list.List               // front is most recently used
+	size    int64
+}
+
+type memoryEntry struct {
+	key   string
+	entry *cacheEntry
+}
+
+func newMemoryCache(maxBytes int64, maxEntries int) *memoryCache {
+	return &memoryCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *memoryCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*memoryEntry).entry, true
+}
+
+func (c *memoryCache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	size := int64(len(entry.data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.size += size - int64(len(elem.Value.(*memoryEntry).entry.data))
+		elem.Value.(*memoryEntry).entry = entry
+		c.lru.MoveToFront(elem)
+	} else {
+		// When the newcomer would push out resident entries, it has to be
+		// worth more than each of them (see admitOverVictim)
+		need := c.size + size - c.maxBytes
+		count := len(c.entries) + 1 - c.maxEntries
+		for elem := c.lru.Back(); elem != nil && (need > 0 || count > 0); elem = elem.Prev() {
+			victim := elem.Value.(*memoryEntry)
+			if !admitOverVictim(key, entry.cost, victim.key, victim.entry.cost) {
+				return
+			}
+			need -= int64(len(victim.entry.data))
+			count--
+		}
+
+		c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, entry: entry})
+		c.size += size
+	}
+
+	for c.size > c.maxBytes || len(c.entries) > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *memoryCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *memoryCache) sweep(retention time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.Sub(elem.Value.(*memoryEntry).entry.timestamp) > retention {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+func (c *memoryCache) purge(match func(url string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*memoryEntry).entry.url) {
+			c.remove(elem)
+			purged++
+		}
+		elem = next
+	}
+	return purged
+}
+
+// remove drops one entry; callers hold c.mu.
+func (c *memoryCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*memoryEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.entry.data))
+}
+
+// redisCache shares captures between replicas. Metadata lives under
+// <prefix><key>:meta and the image under <prefix><key>:data, or split across
+// <prefix><key>:chunk:<n> when larger than chunkSize so no single value grows
+// past what Redis handles comfortably.
+type redisCache struct {
+	client    *redisClient
+	prefix    string
+	chunkSize int
+}
+
+type redisCacheMeta struct {
+	URL        string            `json:"url,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Cost       time.Duration     `json:"cost"`
+	Moderation *moderationResult `json:"moderation,omitempty"`
+	FinalURL   string            `json:"final_url,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Size       int               `json:"size"`
+	Chunks     int               `json:"chunks"`
+}
+
+func (c *redisCache) get(key string) (*cacheEntry, bool) {
+	raw, err := c.client.Do("GET", c.prefix+key+":meta")
+	if err != nil {
+		if err != errRedisNil {
+			log.Printf("Redis cache get %s: %v", key, err)
+		}
+		return nil, false
+	}
+	var meta redisCacheMeta
+	if err := json.Unmarshal(raw.([]byte), &meta); err != nil {
+		return nil, false
+	}
+
+	var data []byte
+	if meta.Chunks == 0 {
+		reply, err := c.client.Do("GET", c.prefix+key+":data")
+		if err != nil {
+			return nil, false
+		}
+		data = reply.([]byte)
+	} else {
+		args := []interface{}{"MGET"}
+		for i := 0; i < meta.Chunks; i++ {
+			args = append(args, fmt.Sprintf("%s%s:chunk:%d", c.prefix, key, i))
+		}
+		reply, err := c.client.Do(args...)
+		if err != nil {
+			return nil, false
+		}
+		data = make([]byte, 0, meta.Size)
+		for _, part := range reply.([]interface{}) {
+			chunk, ok := part.([]byte)
+			if !ok {
+				return nil, false // a chunk expired or was evicted
+			}
+			data = append(data, chunk...)
+		}
+	}
+	if len(data) != meta.Size {
+		return nil, false
+	}
+
+	return &cacheEntry{
+		url:        meta.URL,
+		data:       data,
+		timestamp:  meta.Timestamp,
+		moderation: meta.Moderation,
+		cost:       meta.Cost,
+		finalURL:   meta.FinalURL,
+		status:     meta.Status,
+	}, true
+}
+
+func (c *redisCache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	ms := ttl.Milliseconds()
+	meta := redisCacheMeta{
+		URL:        entry.url,
+		Timestamp:  entry.timestamp,
+		Cost:       entry.cost,
+		Moderation: entry.moderation,
+		FinalURL:   entry.finalURL,
+		Status:     entry.status,
+		Size:       len(entry.data),
+	}
+
+	var err error
+	if len(entry.data) <= c.chunkSize {
+		_, err = c.client.Do("SET", c.prefix+key+":data", entry.data, "PX", ms)
+	} else {
+		for i := 0; i*c.chunkSize < len(entry.data) && err == nil; i++ {
+			end := min((i+1)*c.chunkSize, len(entry.data))
+			_, err = c.client.Do("SET", fmt.Sprintf("%s%s:chunk:%d", c.prefix, key, i), entry.data[i*c.chunkSize:end], "PX", ms)
+			meta.Chunks++
+		}
+	}
+	if err != nil {
+		log.Printf("Redis cache set %s: %v", key, err)
+		return
+	}
+
+	// Metadata goes last so readers never see a partially written entry
+	raw, _ := json.Marshal(meta)
+	if _, err := c.client.Do("SET", c.prefix+key+":meta", raw, "PX", ms); err != nil {
+		log.Printf("Redis cache set %s: %v", key, err)
+	}
+}
+
+// delete removes the entry with every chunk its metadata lists, or, when the
+// metadata has already gone, whatever chunks are still stored under the key.
+func (c *redisCache) delete(key string) {
+	keys := []interface{}{"DEL", c.prefix + key + ":meta", c.prefix + key + ":data"}
+	var meta redisCacheMeta
+	if raw, err := c.client.Do("GET", c.prefix+key+":meta"); err == nil && json.Unmarshal(raw.([]byte), &meta) == nil {
+		for i := 0; i < meta.Chunks; i++ {
+			keys = append(keys, fmt.Sprintf("%s%s:chunk:%d", c.prefix, key, i))
+		}
+	} else {
+		keys = append(keys, c.chunkKeys(key)...)
+	}
+	if _, err := c.client.Do(keys...); err != nil {
+		log.Printf("Redis cache delete %s: %v", key, err)
+	}
+}
+
+// chunkKeys finds the chunk keys stored for key with SCAN.
+func (c *redisCache) chunkKeys(key string) []interface{} {
+	var found []interface{}
+	cursor := "0"
+	for {
+		reply, err := c.client.Do("SCAN", cursor, "MATCH", c.prefix+key+":chunk:*", "COUNT", 500)
+		if err != nil {
+			log.Printf("Redis cache delete %s: %v", key, err)
+			return found
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return found
+		}
+		next, _ := parts[0].([]byte)
+		keys, _ := parts[1].([]interface{})
+		for _, k := range keys {
+			if name, ok := k.([]byte); ok {
+				found = append(found, string(name))
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return found
+		}
+	}
+}
+
+// purge walks the metadata keys with SCAN, so it is safe to run against a
+// busy shared Redis.
+func (c *redisCache) purge(match func(url string) bool) int {
+	purged := 0
+	cursor := "0"
+	for {
+		reply, err := c.client.Do("SCAN", cursor, "MATCH", c.prefix+"*:meta", "COUNT", 500)
+		if err != nil {
+			log.Printf("Redis cache purge: %v", err)
+			return purged
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return purged
+		}
+		next, _ := parts[0].([]byte)
+		keys, _ := parts[1].([]interface{})
+
+		for _, k := range keys {
+			metaKey, _ := k.([]byte)
+			raw, err := c.client.Do("GET", string(metaKey))
+			if err != nil {
+				continue
+			}
+			var meta redisCacheMeta
+			if json.Unmarshal(raw.([]byte), &meta) != nil || !match(meta.URL) {
+				continue
+			}
+			key := strings.TrimSuffix(strings.TrimPrefix(string(metaKey), c.prefix), ":meta")
+			c.delete(key)
+			purged++
+		}
+
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return purged
+		}
+	}
+}
+
+// sweep is a no-op: Redis expires keys on its own.
+func (c *redisCache) sweep(retention time.Duration) {}
+
+// redirectingCache is implemented by backends that can hand clients a direct,
+// time-limited URL to a stored capture instead of proxying the bytes.
+type redirectingCache interface {
+	redirectURL(key string) (string, bool)
+}
+
+// objectCache stores captures in a bucket (S3 or compatible, GCS, Azure) as
+// <prefix><key>.png, with the cache metadata in object metadata, so a
+// stateless fleet shares one durable cache.
+type objectCache struct {
+	store    blobClient
+	prefix   string
+	redirect bool
+}
+
+func (c *objectCache) get(key string) (*cacheEntry, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data, meta, err := c.store.Get(ctx, c.prefix+key+".png")
+	if err != nil {
+		if !isBlobStatus(err, http.StatusNotFound) && !isBlobStatus(err, http.StatusForbidden) {
+			log.Printf("Object cache get %s: %v", key, err)
+		}
+		return nil, false
+	}
+
+	entry := &cacheEntry{data: data}
+	if u, err := base64.RawURLEncoding.DecodeString(meta["url"]); err == nil {
+		entry.url = string(u)
+	}
+	if entry.timestamp, err = time.Parse(time.RFC3339Nano, meta["timestamp"]); err != nil {
+		return nil, false
+	}
+	if ns, err := strconv.ParseInt(meta["cost"], 10, 64); err == nil {
+		entry.cost = time.Duration(ns)
+	}
+	if m := meta["moderation"]; m != "" {
+		if raw, err := base64.RawURLEncoding.DecodeString(m); err == nil {
+			json.Unmarshal(raw, &entry.moderation)
+		}
+	}
+	if u, err := base64.RawURLEncoding.DecodeString(meta["final-url"]); err == nil {
+		entry.finalURL = string(u)
+	}
+	entry.status, _ = strconv.Atoi(meta["status"])
+	return entry, true
+}
+
+func (c *objectCache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	meta := map[string]string{
+		"url":       base64.RawURLEncoding.EncodeToString([]byte(entry.url)),
+		"timestamp": entry.timestamp.UTC().Format(time.RFC3339Nano),
+		"cost":      strconv.FormatInt(int64(entry.cost), 10),
+		"final-url": base64.RawURLEncoding.EncodeToString([]byte(entry.finalURL)),
+		"status":    strconv.Itoa(entry.status),
+	}
+	if entry.moderation != nil {
+		raw, _ := json.Marshal(entry.moderation)
+		meta["moderation"] = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	if err := c.store.Put(ctx, c.prefix+key+".png", entry.data, "image/png", meta); err != nil {
+		log.Printf("Object cache set %s: %v", key, err)
+	}
+}
+
+func (c *objectCache) delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := c.store.Delete(ctx, c.prefix+key+".png"); err != nil {
+		log.Printf("Object cache delete %s: %v", key, err)
+	}
+}
+
+// purge lists the prefix and reads each object's metadata; it is slow on
+// large buckets but only runs on explicit admin requests.
+func (c *objectCache) purge(match func(url string) bool) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	keys, err := c.store.List(ctx, c.prefix)
+	if err != nil {
+		log.Printf("Object cache purge: %v", err)
+		return 0
+	}
+	purged := 0
+	for _, key := range keys {
+		meta, err := c.store.Head(ctx, key)
+		if err != nil {
+			continue
+		}
+		u, err := base64.RawURLEncoding.DecodeString(meta["url"])
+		if err != nil || !match(string(u)) {
+			continue
+		}
+		if err := c.store.Delete(ctx, key); err != nil {
+			log.Printf("Object cache purge %s: %v", key, err)
+			continue
+		}
+		purged++
+	}
+	return purged
+}
+
+// sweep is a no-op: expire objects with a lifecycle rule on the prefix.
+func (c *objectCache) sweep(retention time.Duration) {}
+
+func (c *objectCache) redirectURL(key string) (string, bool) {
+	if !c.redirect {
+		return "", false
+	}
+	target, err := c.store.Presign(c.prefix+key+".png", 5*time.Minute)
+	if err != nil {
+		log.Printf("Object cache presign %s: %v", key, err)
+		return "", false
+	}
+	return target, true
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func cacheEntryOf(size int, url string) *cacheEntry {
+	return &cacheEntry{url: url, data: bytes.Repeat([]byte{1}, size), timestamp: time.Now()}
+}
+
+func TestMemoryCacheLRU(t *testing.T) {
+	saved := cacheAdmission
+	defer func() { cacheAdmission = saved }()
+	cacheAdmission = "all"
+
+	c := newMemoryCache(100, 3)
+	c.set("a", cacheEntryOf(10, "https://a.test/"), time.Minute)
+	c.set("b", cacheEntryOf(10, "https://b.test/"), time.Minute)
+	c.set("c", cacheEntryOf(10, "https://c.test/"), time.Minute)
+	c.get("a") // b is now the least recently used
+	c.set("d", cacheEntryOf(10, "https://d.test/"), time.Minute)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("entry limit: %s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	// Bytes bound the cache as well as entries
+	c.set("big", cacheEntryOf(90, "https://big.test/"), time.Minute)
+	if c.size > c.maxBytes {
+		t.Errorf("size %d exceeds %d", c.size, c.maxBytes)
+	}
+	if _, ok := c.get("big"); !ok {
+		t.Error("entry that fits was not cached")
+	}
+
+	// Larger than the whole cache: never stored
+	c.set("huge", cacheEntryOf(101, "https://huge.test/"), time.Minute)
+	if _, ok := c.get("huge"); ok {
+		t.Error("oversized entry was cached")
+	}
+
+	// Replacing an entry accounts for the size difference
+	c.set("big", cacheEntryOf(50, "https://big.test/"), time.Minute)
+	var total int64
+	for _, elem := range c.entries {
+		total += int64(len(elem.Value.(*memoryEntry).entry.data))
+	}
+	if c.size != total {
+		t.Errorf("size %d, entries hold %d bytes", c.size, total)
+	}
+}
+
+func TestMemoryCachePurgeAndSweep(t *testing.T) {
+	c := newMemoryCache(1<<20, 100)
+	c.set("a", cacheEntryOf(1, "https://example.com/a"), time.Minute)
+	c.set("b", cacheEntryOf(1, "https://example.com/b"), time.Minute)
+	old := cacheEntryOf(1, "https://other.test/")
+	old.timestamp = time.Now().Add(-time.Hour)
+	c.set("old", old, time.Minute)
+
+	if n := c.purge(func(url string) bool { return url == "https://example.com/a" }); n != 1 {
+		t.Errorf("purge removed %d entries, want 1", n)
+	}
+	c.sweep(time.Minute)
+	for key, want := range map[string]bool{"a": false, "b": true, "old": false} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+	if c.size != 1 {
+		t.Errorf("size %d, want 1", c.size)
+	}
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	// CDP methods callable through /cdp; "Domain.*" allows a whole domain
+	cdpAllowedMethods []string
+)
+
+func init() {
+	cdpAllowedMethods = []string{
+		"Accessibility.getFullAXTree",
+		"DOM.getDocument",
+		"DOM.getOuterHTML",
+		"DOM.querySelector",
+		"DOM.querySelectorAll",
+		"Page.captureScreenshot",
+		"Page.getLayoutMetrics",
+		"Page.printToPDF",
+		"Performance.getMetrics",
+	}
+	if m := os.Getenv("CDP_ALLOWED_METHODS"); m != "" {
+		cdpAllowedMethods = nil
+		for _, method := range strings.Split(m, ",") {
+			if method = strings.TrimSpace(method); method != "" {
+				cdpAllowedMethods = append(cdpAllowedMethods, method)
+			}
+		}
+	}
+}
+
+func cdpMethodAllowed(method string) bool {
+	for _, allowed := range cdpAllowedMethods {
+		if allowed == method {
+			return true
+		}
+		if domain, ok := strings.CutSuffix(allowed, ".*"); ok && strings.HasPrefix(method, domain+".") {
+			return true
+		}
+	}
+	return false
+}
+
+type cdpRequest struct {
+	URL    string          `json:"url"`
+	Width  int             `json:"width"`
+	Height int             `json:"height"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// HandleCDP executes one allow-listed DevTools Protocol command in a fresh
+// browser context, optionally after navigating to url, and returns the raw
+// protocol result. Only keys that explicitly list the "cdp" feature may use it.
+func HandleCDP(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiKeyFrom(r.Context()).has("cdp") {
+		http.Error(writer, "CDP passthrough requires an API key with the cdp feature", http.StatusForbidden)
+		return
+	}
+
+	req := cdpRequest{Width: 1280, Height: 720}
+	if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(writer, "Invalid CDP request JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Width <= 0 || req.Width > 3840 || req.Height <= 0 || req.Height > 2160 {
+		http.Error(writer, "Invalid width/height", http.StatusBadRequest)
+		return
+	}
+	if !cdpMethodAllowed(req.Method) {
+		http.Error(writer, "CDP method not allowed: "+req.Method, http.StatusForbidden)
+		return
+	}
+	if req.URL != "" {
+		if err := checkTargetURL(req.URL); err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+		if err := checkTenantURL(r.Context(), req.URL); err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+	}
+	if len(req.Params) == 0 {
+		req.Params = json.RawMessage("{}")
+	}
+
+	timeout, workerTimeout := defaults.timeout, defaults.workerTimeout
+	worker, err := getWorker(r.Context(), keyPriority(r.Context()), clientID(r), workerTimeout)
+	if err != nil && r.Context().Err() != nil {
+		return // the client went away while queued
+	}
+	if ce, ok := err.(*captureError); ok {
+		writeCaptureError(writer, ce)
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&timeoutRequests, 1)
+		http.Error(writer, "Server busy, please retry later", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseWorker(worker)
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	// Never the worker's shared context: the caller drives the browser
+	ctx, cancel, err := worker.newTab(nil, true)
+	if err != nil {
+		log.Printf("CDP passthrough could not start Chrome: %v", err)
+		http.Error(writer, "Error starting browser", http.StatusInternalServerError)
+		return
+	}
+	defer cancel()
+	ctx, timeoutCancel := context.WithTimeout(ctx, timeout)
+	defer timeoutCancel()
+	defer context.AfterFunc(r.Context(), timeoutCancel)()
+	ctx, block := context.WithCancelCause(ctx)
+	defer block(nil)
+
+	actions := []chromedp.Action{
+		emulation.SetDeviceMetricsOverride(int64(req.Width), int64(req.Height), 1.0, false),
+	}
+	// Redirects and navigations the page or command makes are held to the
+	// URL policy as in a capture (see openTab)
+	intercept := requestInterceptor{policy: navigationPolicy(r.Context())}
+	if intercept.policy != nil {
+		intercept.frame = cdp.FrameID(chromedp.FromContext(ctx).Target.TargetID)
+		intercept.blocked = block
+		actions = append(actions, intercept.enable())
+	}
+	if req.URL != "" {
+		actions = append(actions, chromedp.Navigate(req.URL), chromedp.WaitReady("body", chromedp.ByQuery))
+	}
+
+	var result json.RawMessage
+	actions = append(actions, chromedp.ActionFunc(func(ctx context.Context) error {
+		return cdp.Execute(ctx, req.Method, req.Params, &result)
+	}))
+
+	if err := chromedp.Run(ctx, actions...); err != nil {
+		if ce, ok := context.Cause(ctx).(*captureError); ok {
+			writeCaptureError(writer, ce)
+			return
+		}
+		log.Printf("CDP passthrough %s failed: %v", req.Method, err)
+		status := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusRequestTimeout
+		}
+		http.Error(writer, "CDP command failed: "+err.Error(), status)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"method": req.Method,
+		"result": result,
+	})
+}
@@ -0,0 +1,305 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	// The Chrome or Chromium binary local workers run: CHROME_PATH, else the
+	// first found on PATH or in the usual install locations
+	chromePath string
+	// What it reports for --version, e.g. "Chromium 126.0.6478.126"
+	chromeVersion string
+)
+
+var (
+	chromeNames = []string{"headless-shell", "chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "chrome"}
+
+	chromeLocations = []string{
+		"/headless-shell/headless-shell",
+		"/usr/bin/chromium",
+		"/usr/bin/chromium-browser",
+		"/usr/bin/google-chrome",
+		"/usr/lib/chromium/chromium",
+		"/snap/bin/chromium",
+		"/opt/google/chrome/chrome",
+		"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+		"/Applications/Chromium.app/Contents/MacOS/Chromium",
+		`C:\Program Files\Google\Chrome\Application\chrome.exe`,
+	}
+
+	chromeVersionNumber = regexp.MustCompile(`\b(\d+)\.\d+\.\d+\.\d+\b`)
+)
+
+// chromeFlag is a command-line switch of local workers' Chrome: value is
+// true for a bare --name, false to leave the switch out (even one of
+// chromedp's defaults), or the string after '='.
+type chromeFlag struct {
+	name  string
+	value any
+}
+
+// defaultChromeFlags are added to chromedp's defaults. Whether Chrome is
+// sandboxed and enforces the same-origin policy is up to CHROME_SANDBOX and
+// CHROME_WEB_SECURITY.
+var defaultChromeFlags = []chromeFlag{
+	{"disable-gpu", true},
+	{"disable-dev-shm-usage", true},
+	{"disable-extensions", true},
+	{"disable-background-networking", true},
+	{"disable-default-apps", true},
+	{"disable-sync", true},
+	{"disable-translate", true},
+	{"hide-scrollbars", true},
+	{"metrics-recording-only", true},
+	{"mute-audio", true},
+	{"no-first-run", true},
+	{"safebrowsing-disable-auto-update", true},
+	{"disable-features", "site-per-process,TranslateUI,BlinkGenPropertyTrees"},
+	{"headless", true},
+}
+
+var (
+	// defaultChromeFlags, the sandbox and web security switches, as changed
+	// by CHROME_FLAGS
+	chromeFlags    []chromeFlag
+	chromeFlagSpec string
+
+	// Run Chrome in its sandbox (CHROME_SANDBOX): "auto" when this host
+	// supports it, "true" always (failing startup otherwise) or "false"
+	chromeSandbox string
+	// Whether the sandbox is in use, decided by configureSandbox
+	chromeSandboxed bool
+	// Keep the same-origin policy on (CHROME_WEB_SECURITY=false turns it off)
+	chromeWebSecurity bool
+
+	chromeFlagName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+)
+
+func init() {
+	chromeSandbox = envOr("CHROME_SANDBOX", "auto")
+	if chromeSandbox != "auto" && chromeSandbox != "true" && chromeSandbox != "false" {
+		log.Fatalf("Invalid CHROME_SANDBOX %q: want auto, true or false", chromeSandbox)
+	}
+	chromeWebSecurity = os.Getenv("CHROME_WEB_SECURITY") != "false"
+
+	chromeFlagSpec = os.Getenv("CHROME_FLAGS")
+	flags, err := parseChromeFlags(securityFlags(defaultChromeFlags, chromeSandbox != "false"), chromeFlagSpec)
+	if err != nil {
+		log.Fatalf("Invalid CHROME_FLAGS: %v", err)
+	}
+	chromeFlags = flags
+}
+
+// securityFlags returns base plus the switches turning off the sandbox, if
+// not sandboxed, and the same-origin policy, if CHROME_WEB_SECURITY=false.
+func securityFlags(base []chromeFlag, sandboxed bool) []chromeFlag {
+	flags := slices.Clone(base)
+	if !sandboxed {
+		flags = append(flags, chromeFlag{"no-sandbox", true}, chromeFlag{"disable-setuid-sandbox", true})
+	}
+	if !chromeWebSecurity {
+		flags = append(flags, chromeFlag{"disable-web-security", true})
+	}
+	return flags
+}
+
+// configureSandbox decides whether local workers run sandboxed, once
+// checkChrome found the binary. With CHROME_SANDBOX=auto that is whether a
+// sandboxed headless Chrome actually starts here; the reason it does not is
+// logged, as it usually is a host setting that can be fixed. With
+// CHROME_SANDBOX=true that is an error.
+func configureSandbox() error {
+	if chromeSandbox != "false" {
+		err := trySandbox()
+		switch {
+		case err == nil:
+			chromeSandboxed = true
+		case chromeSandbox == "true":
+			return fmt.Errorf("CHROME_SANDBOX=true but Chrome cannot run sandboxed here: %v", err)
+		default:
+			log.Printf("webshot: running Chrome without its sandbox (%v); set CHROME_SANDBOX=false to silence this", err)
+		}
+	}
+	chromeFlags, _ = parseChromeFlags(securityFlags(defaultChromeFlags, chromeSandboxed), chromeFlagSpec)
+	if chromeSandboxed {
+		log.Printf("webshot running Chrome sandboxed")
+	}
+	return nil
+}
+
+// trySandbox starts a sandboxed headless Chrome on a blank page, explaining
+// a failure with what is known to prevent the sandbox.
+func trySandbox() error {
+	if chromePath == "" {
+		return errors.New("no Chrome binary found")
+	}
+	if os.Geteuid() == 0 {
+		return errors.New("running as root, which Chrome refuses to sandbox; run as an unprivileged user")
+	}
+	dir, err := os.MkdirTemp("", "webshot-sandbox-check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, chromePath,
+		"--headless", "--disable-gpu", "--no-first-run", "--user-data-dir="+dir, "--dump-dom", "about:blank",
+	).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if reason := sandboxObstacle(); reason != "" {
+		return errors.New(reason)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return fmt.Errorf("%v: %s", err, lines[len(lines)-1])
+}
+
+// sandboxObstacle reports the Linux settings that keep unprivileged user
+// namespaces, which Chrome's sandbox needs, from working.
+func sandboxObstacle() string {
+	sysctl := func(name string) string {
+		data, _ := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+		return strings.TrimSpace(string(data))
+	}
+	switch {
+	case sysctl("kernel.unprivileged_userns_clone") == "0":
+		return "unprivileged user namespaces are disabled (sysctl kernel.unprivileged_userns_clone=0)"
+	case sysctl("user.max_user_namespaces") == "0":
+		return "user namespaces are disabled (sysctl user.max_user_namespaces=0)"
+	case sysctl("kernel.apparmor_restrict_unprivileged_userns") == "1":
+		return "AppArmor restricts unprivileged user namespaces (kernel.apparmor_restrict_unprivileged_userns=1); give Chrome an AppArmor profile allowing userns"
+	}
+	return ""
+}
+
+// parseChromeFlags applies spec, switches separated by spaces, to base:
+// "--name" or "--name=value" adds or replaces a switch and "!name" removes
+// one, e.g. "--lang=de --proxy-server=http://proxy:3128 !disable-gpu".
+func parseChromeFlags(base []chromeFlag, spec string) ([]chromeFlag, error) {
+	flags := slices.Clone(base)
+	for _, field := range strings.Fields(spec) {
+		f := chromeFlag{value: true}
+		switch {
+		case strings.HasPrefix(field, "!"):
+			f.name, f.value = strings.TrimPrefix(field[1:], "--"), false
+		case strings.HasPrefix(field, "--"):
+			name, value, ok := strings.Cut(field[2:], "=")
+			f.name = name
+			if ok {
+				f.value = value
+			}
+		default:
+			return nil, fmt.Errorf("%q: want --name, --name=value or !name", field)
+		}
+		if !chromeFlagName.MatchString(f.name) {
+			return nil, fmt.Errorf("%q: invalid switch name", field)
+		}
+		if i := slices.IndexFunc(flags, func(g chromeFlag) bool { return g.name == f.name }); i >= 0 {
+			flags[i] = f
+		} else {
+			flags = append(flags, f)
+		}
+	}
+	return flags, nil
+}
+
+// chromeFlagOptions returns chromeFlags as allocator options.
+func chromeFlagOptions() []chromedp.ExecAllocatorOption {
+	opts := make([]chromedp.ExecAllocatorOption, 0, len(chromeFlags))
+	for _, f := range chromeFlags {
+		opts = append(opts, chromedp.Flag(f.name, f.value))
+	}
+	return opts
+}
+
+// checkChrome finds the Chrome binary and checks that it runs and that its
+// major version is within CHROME_MIN_VERSION..CHROME_MAX_VERSION (0 = no
+// upper bound), returning a diagnostic otherwise: one clear error at startup
+// beats every worker failing on its first capture.
+func checkChrome() error {
+	minVersion := envInt("CHROME_MIN_VERSION", 100, 0, 10000)
+	maxVersion := envInt("CHROME_MAX_VERSION", 0, 0, 10000)
+
+	err := func() error {
+		path, err := findChrome()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, path, "--version").Output()
+		if err != nil {
+			return fmt.Errorf("%s does not run: %v (missing shared libraries? try running it with --version)", path, err)
+		}
+		chromePath, chromeVersion = path, strings.TrimSpace(string(out))
+
+		m := chromeVersionNumber.FindStringSubmatch(chromeVersion)
+		if m == nil {
+			log.Printf("webshot: cannot tell the version of %s from %q, not checking it", path, chromeVersion)
+			return nil
+		}
+		major, _ := strconv.Atoi(m[1])
+		if major < minVersion || (maxVersion > 0 && major > maxVersion) {
+			supported := fmt.Sprintf("%d or newer", minVersion)
+			if maxVersion > 0 {
+				supported = fmt.Sprintf("%d to %d", minVersion, maxVersion)
+			}
+			return fmt.Errorf("%s is %s, supported major versions are %s (CHROME_MIN_VERSION, CHROME_MAX_VERSION)", path, chromeVersion, supported)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	log.Printf("webshot using %s (%s)", chromePath, chromeVersion)
+	return nil
+}
+
+// findChrome returns CHROME_PATH, or the first Chrome or Chromium found.
+func findChrome() (string, error) {
+	if path := os.Getenv("CHROME_PATH"); path != "" {
+		if err := checkExecutable(path); err != nil {
+			return "", fmt.Errorf("CHROME_PATH %s: %v", path, err)
+		}
+		return path, nil
+	}
+	for _, name := range chromeNames {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	for _, path := range chromeLocations {
+		if checkExecutable(path) == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no Chrome or Chromium found: looked for %s on PATH and in %s; install one or set CHROME_PATH",
+		strings.Join(chromeNames, ", "), strings.Join(chromeLocations, ", "))
+}
+
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || (info.Mode().Perm()&0111 == 0 && !strings.HasSuffix(strings.ToLower(path), ".exe")) {
+		return errors.New("not an executable file")
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster mode splits webshot into API nodes and renderer nodes. API nodes
+// (CLUSTER_ROLE=api) answer from the shared cache and coalesce identical
+// requests as usual, but push every capture that needs rendering onto a Redis
+// queue (CLUSTER_REDIS_URL, default REDIS_URL). Renderer nodes
+// (CLUSTER_ROLE=renderer) take jobs off it, run the normal capture pipeline
+// and leave the image in the shared cache (CACHE_BACKEND redis or a bucket)
+// for the API node to serve. Renderer nodes keep serving HTTP themselves.
+var (
+	clusterRole  string
+	clusterRedis *redisClient
+	// Jobs a renderer node runs at once (CLUSTER_CONCURRENCY, default
+	// MAX_CHROME_WORKERS)
+	clusterConcurrency int
+	// How long an API node waits for a renderer to pick a job up, on top of
+	// the capture timeouts (CLUSTER_QUEUE_TIMEOUT_SECONDS)
+	clusterQueueTimeout = 30 * time.Second
+)
+
+const (
+	clusterPrefix = "webshot:cluster:"
+	// How long uncacheable results and replies wait for the API node
+	clusterResultTTL = 5 * time.Minute
+)
+
+// renderJob is a capture sent from an API node to the renderers. Options
+// travel as jobOptions; pointer companions (credential, watermark, proxy)
+// are resolved again on the renderer from the same configuration.
+type renderJob struct {
+	ID       string     `json:"id"`
+	Key      string     `json:"key,omitempty"` // name of the caller's API key
+	CacheKey string     `json:"cache_key"`
+	Deadline time.Time  `json:"deadline"`
+	Options  jobOptions `json:"options"`
+}
+
+type jobOptions struct {
+	URL                string        `json:"url"`
+	Width              int           `json:"width"`
+	Height             int           `json:"height"`
+	Quality            int           `json:"quality"`
+	PreferSpeed        bool          `json:"fast,omitempty"`
+	Budget             time.Duration `json:"budget,omitempty"`
+	TranslateTo        string        `json:"tr,omitempty"`
+	DismissConsent     bool          `json:"consent,omitempty"`
+	Media              string        `json:"media,omitempty"`
+	ReducedMotion      bool          `json:"motion,omitempty"`
+	ForcedColors       bool          `json:"forced,omitempty"`
+	Vision             string        `json:"vision,omitempty"`
+	Timezone           string        `json:"tz,omitempty"`
+	Lang               string        `json:"lang,omitempty"`
+	Geo                string        `json:"geo,omitempty"`
+	MaxRedirects       string        `json:"redirects,omitempty"`
+	SameSite           bool          `json:"onsite,omitempty"`
+	FailOnStatus       []string      `json:"fail_on_status,omitempty"`
+	Resize             string        `json:"resize,omitempty"`
+	WatermarkID        string        `json:"wm,omitempty"`
+	Optimize           bool          `json:"opt,omitempty"`
+	Background         string        `json:"bg,omitempty"`
+	NoScript           bool          `json:"nojs,omitempty"`
+	Isolated           bool          `json:"isolated,omitempty"`
+	Profile            string        `json:"profile,omitempty"`
+	Auth               string        `json:"auth,omitempty"`
+	NoStore            bool          `json:"no_store,omitempty"`
+	BypassBrowserCache bool          `json:"bypass_browser_cache,omitempty"`
+	Partial            bool          `json:"partial,omitempty"`
+	Console            bool          `json:"console,omitempty"`
+	Requests           bool          `json:"requests,omitempty"`
+	TLS                bool          `json:"tls,omitempty"`
+	Redirects          bool          `json:"redirect_chain,omitempty"`
+	Proxy              string        `json:"proxy,omitempty"`
+	ProxyURL           string        `json:"proxy_url,omitempty"` // ad-hoc proxies, which have no credentials
+	Priority           int           `json:"priority"`
+	Client             string        `json:"client,omitempty"`
+}
+
+// renderReply is a renderer's answer; the image is in the shared cache under
+// Image.
+type renderReply struct {
+	Error      *jobError         `json:"error,omitempty"`
+	Image      string            `json:"image,omitempty"`
+	Transient  bool              `json:"transient,omitempty"` // Image is a Redis key, not a cache key
+	Moderation *moderationResult `json:"moderation,omitempty"`
+	Created    time.Time         `json:"created"`
+	Partial    bool              `json:"partial,omitempty"`
+	RenderTime time.Duration     `json:"render_time"`
+	FinalURL   string            `json:"final_url,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Report     *pageReport       `json:"report,omitempty"`
+}
+
+type jobError struct {
+	Status       int               `json:"status"`
+	Message      string            `json:"message"`
+	RetryAfter   time.Duration     `json:"retry_after,omitempty"`
+	TargetStatus int               `json:"target_status,omitempty"`
+	QuarantineID string            `json:"quarantine_id,omitempty"`
+	Moderation   *moderationResult `json:"moderation,omitempty"`
+}
+
+func init() {
+	clusterRole = os.Getenv("CLUSTER_ROLE")
+	switch clusterRole {
+	case "":
+		return
+	case "api", "renderer":
+	default:
+		log.Fatalf("Unknown CLUSTER_ROLE %q (api or renderer)", clusterRole)
+	}
+	switch os.Getenv("CACHE_BACKEND") {
+	case "redis", "s3", "gcs", "azure":
+	default:
+		log.Fatalf("CLUSTER_ROLE needs a shared cache: set CACHE_BACKEND to redis, s3, gcs or azure")
+	}
+
+	clusterQueueTimeout = time.Duration(envInt("CLUSTER_QUEUE_TIMEOUT_SECONDS", 30, 1, 3600)) * time.Second
+	clusterConcurrency = envInt("CLUSTER_CONCURRENCY", 0, 0, 10000)
+	client, err := newRedisClient(envOr("CLUSTER_REDIS_URL", envOr("REDIS_URL", "redis://localhost:6379")), 32)
+	if err != nil {
+		log.Fatalf("Invalid CLUSTER_REDIS_URL: %v", err)
+	}
+	clusterRedis = client
+	log.Printf("webshot cluster role: %s (queue at %s)", clusterRole, client.addr)
+}
+
+// clusterQueue is the Redis list holding jobs of priority p.
+func clusterQueue(p capturePriority) string {
+	for name, prio := range priorityNames {
+		if prio == p {
+			return clusterPrefix + "jobs:" + name
+		}
+	}
+	return clusterPrefix + "jobs:normal"
+}
+
+func (o captureOptions) job() jobOptions {
+	j := jobOptions{
+		URL:                o.url,
+		Width:              o.width,
+		Height:             o.height,
+		Quality:            o.quality,
+		PreferSpeed:        o.preferSpeed,
+		Budget:             o.budget,
+		TranslateTo:        o.translateTo,
+		DismissConsent:     o.dismissConsent,
+		Media:              o.media,
+		ReducedMotion:      o.reducedMotion,
+		ForcedColors:       o.forcedColors,
+		Vision:             o.vision,
+		Timezone:           o.timezone,
+		Lang:               o.lang,
+		Geo:                o.geo,
+		MaxRedirects:       o.maxRedirects,
+		SameSite:           o.sameSite,
+		FailOnStatus:       o.failOnStatus,
+		Resize:             o.resize,
+		WatermarkID:        o.watermarkID,
+		Optimize:           o.optimize,
+		Background:         o.background,
+		NoScript:           o.noScript,
+		Isolated:           o.isolated,
+		Profile:            o.profile,
+		Auth:               o.auth,
+		NoStore:            o.noStore,
+		BypassBrowserCache: o.bypassBrowserCache,
+		Partial:            o.partial,
+		Console:            o.console,
+		Requests:           o.requests,
+		TLS:                o.tls,
+		Redirects:          o.redirects,
+		Proxy:              o.proxy,
+		Priority:           int(o.priority),
+		Client:             o.client,
+	}
+	if o.proxyURL != nil && o.pooledProxy == nil && !strings.HasPrefix(o.proxy, "pool:") {
+		if _, named := proxies[o.proxy]; !named {
+			j.ProxyURL = proxyServer(o.proxyURL)
+		}
+	}
+	return j
+}
+
+// options rebuilds the capture options on a renderer. ctx carries the
+// caller's API key.
+func (j jobOptions) options(ctx context.Context) (captureOptions, error) {
+	opts := newCaptureOptions(ctx, j.URL, j.Width, j.Height)
+	opts.quality = j.Quality
+	opts.preferSpeed, opts.budget = j.PreferSpeed, j.Budget
+	opts.translateTo, opts.dismissConsent, opts.media = j.TranslateTo, j.DismissConsent, j.Media
+	opts.reducedMotion, opts.forcedColors, opts.vision = j.ReducedMotion, j.ForcedColors, j.Vision
+	opts.timezone, opts.lang = j.Timezone, j.Lang
+	opts.maxRedirects, opts.sameSite, opts.failOnStatus = j.MaxRedirects, j.SameSite, j.FailOnStatus
+	opts.resize, opts.optimize, opts.background, opts.noScript = j.Resize, j.Optimize, j.Background, j.NoScript
+	opts.isolated = j.Isolated || defaults.isolated
+	opts.noStore, opts.bypassBrowserCache, opts.partial = j.NoStore, j.BypassBrowserCache, j.Partial
+	opts.console, opts.requests, opts.tls, opts.redirects = j.Console, j.Requests, j.TLS, j.Redirects
+	opts.priority, opts.client = capturePriority(j.Priority), j.Client
+
+	if j.Geo != "" {
+		parts := strings.Split(j.Geo, ",")
+		if len(parts) != 3 {
+			return opts, fmt.Errorf("invalid geo %q", j.Geo)
+		}
+		p, err := parseGeo(parts[0]+","+parts[1], parts[2])
+		if err != nil {
+			return opts, err
+		}
+		opts.geo, opts.geoPoint = j.Geo, p
+	}
+
+	// The renderer must resolve the caller's credential and watermark to
+	// the same ones, or it would render something else
+	if opts.auth != j.Auth {
+		return opts, fmt.Errorf("credential %q is not configured on this renderer", j.Auth)
+	}
+	if opts.watermarkID != j.WatermarkID {
+		return opts, fmt.Errorf("watermark %q is not configured on this renderer", j.WatermarkID)
+	}
+	if j.Profile != "" {
+		_, name, _ := strings.Cut(j.Profile, "/")
+		p, err := sessionProfileFor(ctx, name, opts.url)
+		if err != nil || p.owner+"/"+p.Name != j.Profile {
+			return opts, fmt.Errorf("session profile %q is not configured on this renderer", j.Profile)
+		}
+		opts.session, opts.profile, opts.isolated = p, j.Profile, true
+	}
+
+	switch {
+	case strings.HasPrefix(j.Proxy, "pool:"):
+		p, err := resolveProxyPool(strings.TrimPrefix(j.Proxy, "pool:"), opts.url)
+		if err != nil {
+			return opts, err
+		}
+		opts.proxy, opts.proxyURL, opts.pooledProxy = j.Proxy, p.url, p
+	case j.ProxyURL != "":
+		u, err := parseProxyURL(j.ProxyURL)
+		if err != nil {
+			return opts, err
+		}
+		opts.proxy, opts.proxyURL = j.Proxy, u
+	case j.Proxy != "":
+		var err error
+		if opts.proxy, opts.proxyURL, err = resolveProxy(ctx, j.Proxy); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// renderOnCluster queues opts for a renderer node and waits for the result.
+// Errors are *captureError.
+func renderOnCluster(ctx context.Context, opts captureOptions, cacheKey string) (*screenshotResult, error) {
+	job := renderJob{
+		ID:       randomID(),
+		CacheKey: cacheKey,
+		Deadline: time.Now().Add(clusterQueueTimeout + defaults.workerTimeout + defaults.timeout),
+		Options:  opts.job(),
+	}
+	if key := apiKeyFrom(ctx); key != nil {
+		job.Key = key.Name
+	}
+	data, _ := json.Marshal(job)
+	if _, err := clusterRedis.Do("LPUSH", clusterQueue(opts.priority), data); err != nil {
+		log.Printf("Failed to queue render job for %s: %v", opts.url, err)
+		return nil, &captureError{status: http.StatusServiceUnavailable, message: "Render queue unavailable", retryAfter: 5 * time.Second}
+	}
+
+	replyKey := clusterPrefix + "reply:" + job.ID
+	for {
+		if ctx.Err() != nil {
+			return nil, &captureError{status: http.StatusServiceUnavailable, message: "Capture canceled"}
+		}
+		if time.Now().After(job.Deadline) {
+			atomic.AddInt64(&timeoutRequests, 1)
+			return nil, &captureError{status: http.StatusGatewayTimeout, message: "No renderer finished the capture in time", retryAfter: 5 * time.Second}
+		}
+		reply, err := clusterRedis.Do("BRPOP", replyKey, 5)
+		if err != nil {
+			log.Printf("Failed to wait for render job %s: %v", job.ID, err)
+			return nil, &captureError{status: http.StatusServiceUnavailable, message: "Render queue unavailable", retryAfter: 5 * time.Second}
+		}
+		if items, ok := reply.([]interface{}); ok && len(items) == 2 {
+			raw, _ := items[1].([]byte)
+			return clusterResult(raw)
+		}
+	}
+}
+
+// clusterResult turns a renderer's reply into the result the API node serves.
+func clusterResult(raw []byte) (*screenshotResult, error) {
+	var reply renderReply
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		return nil, &captureError{status: http.StatusBadGateway, message: "Invalid reply from renderer"}
+	}
+	if e := reply.Error; e != nil {
+		return nil, &captureError{
+			status:       e.Status,
+			message:      e.Message,
+			retryAfter:   e.RetryAfter,
+			targetStatus: e.TargetStatus,
+			quarantineID: e.QuarantineID,
+			moderation:   e.Moderation,
+		}
+	}
+	var data []byte
+	if reply.Transient {
+		raw, err := clusterRedis.Do("GET", reply.Image)
+		if err != nil {
+			return nil, &captureError{status: http.StatusBadGateway, message: "Rendered capture missing from the render queue"}
+		}
+		clusterRedis.Do("DEL", reply.Image)
+		data = raw.([]byte)
+	} else {
+		entry, ok := screenCache.get(reply.Image)
+		if !ok {
+			return nil, &captureError{status: http.StatusBadGateway, message: "Rendered capture missing from the shared cache"}
+		}
+		data = entry.data
+	}
+	return &screenshotResult{
+		data:       data,
+		moderation: reply.Moderation,
+		created:    reply.Created,
+		partial:    reply.Partial,
+		renderTime: reply.RenderTime,
+		finalURL:   reply.FinalURL,
+		status:     reply.Status,
+		report:     reply.Report,
+	}, nil
+}
+
+// consumeRenderJobs runs queued jobs on a renderer node until shutdown.
+func consumeRenderJobs() {
+	if clusterRole != "renderer" {
+		return
+	}
+	n := clusterConcurrency
+	if n == 0 {
+		n = maxWorkers
+	}
+	queues := []interface{}{"BRPOP", clusterQueue(priorityHigh), clusterQueue(priorityNormal), clusterQueue(priorityLow), 5}
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				select {
+				case <-shutdownChan:
+					return
+				default:
+				}
+				reply, err := clusterRedis.Do(queues...)
+				if err != nil {
+					log.Printf("Failed to take render job: %v", err)
+					time.Sleep(time.Second)
+					continue
+				}
+				if items, ok := reply.([]interface{}); ok && len(items) == 2 {
+					raw, _ := items[1].([]byte)
+					runRenderJob(raw)
+				}
+			}
+		}()
+	}
+}
+
+func runRenderJob(raw []byte) {
+	var job renderJob
+	if err := json.Unmarshal(raw, &job); err != nil {
+		log.Printf("Dropping invalid render job: %v", err)
+		return
+	}
+	if time.Now().After(job.Deadline) {
+		return // the API node has given up
+	}
+
+	reply := renderJobResult(job)
+	data, _ := json.Marshal(reply)
+	replyKey := clusterPrefix + "reply:" + job.ID
+	if _, err := clusterRedis.Do("LPUSH", replyKey, data); err != nil {
+		log.Printf("Failed to reply to render job %s: %v", job.ID, err)
+		return
+	}
+	clusterRedis.Do("EXPIRE", replyKey, int(clusterResultTTL.Seconds()))
+}
+
+func renderJobResult(job renderJob) *renderReply {
+	ctx := context.Background()
+	if job.Key != "" {
+		key := apiKeyNamed(job.Key)
+		if key == nil {
+			return &renderReply{Error: &jobError{Status: http.StatusInternalServerError, Message: "API key " + job.Key + " is not configured on the renderer"}}
+		}
+		ctx = context.WithValue(ctx, apiKeyContextKey{}, key)
+	}
+	ctx, cancel := context.WithDeadline(ctx, job.Deadline)
+	defer cancel()
+
+	opts, err := job.Options.options(ctx)
+	if err == nil && getCacheKey(opts) != job.CacheKey {
+		// Nodes running different versions disagree on the options
+		err = errors.New("renderer cannot reproduce the capture options")
+	}
+	if err != nil {
+		log.Printf("Rejecting render job for %s: %v", job.Options.URL, err)
+		var ce *captureError
+		if errors.As(err, &ce) {
+			return &renderReply{Error: &jobError{Status: ce.status, Message: ce.message, RetryAfter: ce.retryAfter}}
+		}
+		return &renderReply{Error: &jobError{Status: http.StatusInternalServerError, Message: "Renderer configuration mismatch: " + err.Error()}}
+	}
+
+	res, err := renderCapture(ctx, opts, job.CacheKey)
+	if err != nil {
+		ce, ok := err.(*captureError)
+		if !ok {
+			ce = &captureError{status: http.StatusInternalServerError, message: "Error capturing screenshot"}
+		}
+		return &renderReply{Error: &jobError{
+			Status:       ce.status,
+			Message:      ce.message,
+			RetryAfter:   ce.retryAfter,
+			TargetStatus: ce.targetStatus,
+			QuarantineID: ce.quarantineID,
+			Moderation:   ce.moderation,
+		}}
+	}
+
+	image := job.CacheKey
+	if !res.cached {
+		// Not cached under its key (no-store, partial, not admitted): hand
+		// it over in Redis, which drops it if the API node never reads it
+		image = clusterPrefix + "image:" + job.ID
+		if _, err := clusterRedis.Do("SET", image, res.data, "EX", int(clusterResultTTL.Seconds())); err != nil {
+			log.Printf("Failed to store render job %s result: %v", job.ID, err)
+			return &renderReply{Error: &jobError{Status: http.StatusBadGateway, Message: "Renderer could not hand over the capture"}}
+		}
+	}
+	return &renderReply{
+		Image:      image,
+		Transient:  !res.cached,
+		Moderation: res.moderation,
+		Created:    res.created,
+		Partial:    res.partial,
+		RenderTime: res.renderTime,
+		FinalURL:   res.finalURL,
+		Status:     res.status,
+		Report:     res.report,
+	}
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// consentRule recognises one consent management platform's banner by detect
+// and dismisses it by clicking the first visible click selector (reject
+// buttons are listed before accept buttons) and hiding every hide selector.
+type consentRule struct {
+	Name   string   `json:"name"`
+	Detect string   `json:"detect"`
+	Click  []string `json:"click,omitempty"`
+	Hide   []string `json:"hide,omitempty"`
+}
+
+//go:embed consentrules.json
+var builtinConsentRules []byte
+
+var (
+	// The built-in rules, after any from CONSENT_RULES_FILE, as passed to
+	// dismissConsentJS
+	consentRules     []consentRule
+	consentRulesJSON string
+)
+
+// How long a clicked banner gets to animate out, or its page to reload
+const consentDelay = 500 * time.Millisecond
+
+func init() {
+	if err := json.Unmarshal(builtinConsentRules, &consentRules); err != nil {
+		log.Fatalf("Invalid built-in consent rules: %v", err)
+	}
+
+	if file := os.Getenv("CONSENT_RULES_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("Failed to read CONSENT_RULES_FILE: %v", err)
+		}
+		var extra []consentRule
+		if err := json.Unmarshal(data, &extra); err != nil {
+			log.Fatalf("Invalid CONSENT_RULES_FILE: %v", err)
+		}
+		for i, rule := range extra {
+			if rule.Name == "" || rule.Detect == "" {
+				log.Fatalf("Invalid CONSENT_RULES_FILE: rule %d needs a name and a detect selector", i+1)
+			}
+		}
+		consentRules = append(extra, consentRules...)
+		log.Printf("webshot loaded %d consent rules from %s", len(extra), file)
+	}
+
+	data, _ := json.Marshal(consentRules)
+	consentRulesJSON = string(data)
+}
+
+// Known platforms are handled by their rules. Otherwise banners are found by
+// sampling what is on top across the viewport: a fixed or sticky element (or
+// open <dialog>) that talks about cookies or consent and has an accept or
+// reject button. Clicking is tried before hiding, as many pages also block
+// scrolling or dim the page until consent is given. With hideOnly nothing is
+// clicked, only hidden. It returns how each banner was dealt with.
+const dismissConsentJS = `((rules, hideOnly) => {
+	const consentText = /cookie|consent|gdpr|rgpd|dsgvo|datenschutz|einwilligung|galletas|privacy settings|privacy preferences/i;
+	const rejectText = /^(reject|decline|deny|refuse|disagree|only (strictly )?necessary|necessary only|use necessary|continue without|ablehnen|alle ablehnen|nur (notwendige|erforderliche)|refuser|tout refuser|continuer sans|rechazar|rifiuta|weigeren|afwijzen|recusar|odrzuć)/i;
+	const acceptText = /^(accept|agree|allow|i agree|i accept|got it|ok\b|okay|understood|i understand|alle akzeptieren|akzeptieren|zustimmen|einverstanden|accepter|tout accepter|j'accepte|aceptar|acepto|accetta|accetto|akkoord|accepteren|aceitar|zaakceptuj)/i;
+
+	const shown = el => {
+		const r = el.getBoundingClientRect(), s = getComputedStyle(el);
+		return r.width > 0 && r.height > 0 && s.display !== 'none' && s.visibility !== 'hidden';
+	};
+	const hide = el => el.style.setProperty('display', 'none', 'important');
+	const label = el => (el.innerText || el.value || el.getAttribute('aria-label') || '').trim();
+	const done = [];
+
+	for (const rule of rules) {
+		try {
+			if (!document.querySelector(rule.detect)) continue;
+			let how = 'hide';
+			if (!hideOnly) {
+				const button = (rule.click || []).map(s => document.querySelector(s)).find(b => b && shown(b));
+				if (button) {
+					button.click();
+					how = 'click';
+				}
+			}
+			(rule.hide || []).forEach(s => document.querySelectorAll(s).forEach(hide));
+			done.push(how + ':' + rule.name);
+		} catch (e) {}
+	}
+
+	if (!done.length) {
+		const banners = new Set(document.querySelectorAll('dialog[open]'));
+		for (let x = 0.1; x < 1; x += 0.2) {
+			for (let y = 0.05; y < 1; y += 0.15) {
+				let top = null;
+				for (let el = document.elementFromPoint(innerWidth * x, innerHeight * y); el && el !== document.body; el = el.parentElement) {
+					const p = getComputedStyle(el).position;
+					if (p === 'fixed' || p === 'sticky') top = el;
+				}
+				if (top) banners.add(top);
+			}
+		}
+		for (const banner of banners) {
+			if (!shown(banner) || !consentText.test((banner.innerText || '').slice(0, 5000))) continue;
+			const buttons = [...banner.querySelectorAll('button, a, [role=button], input[type=button], input[type=submit]')]
+				.filter(b => shown(b) && label(b).length <= 40);
+			const button = buttons.find(b => rejectText.test(label(b))) || buttons.find(b => acceptText.test(label(b)));
+			if (!button) continue;
+			if (hideOnly) {
+				hide(banner);
+				done.push('hide:heuristic');
+			} else {
+				button.click();
+				done.push('click:heuristic');
+			}
+		}
+	}
+
+	if (done.length) {
+		// Backdrops left behind, and scrolling the banner blocked
+		for (const el of document.querySelectorAll('body > div')) {
+			const r = el.getBoundingClientRect(), s = getComputedStyle(el);
+			if (s.position === 'fixed' && r.width >= innerWidth * 0.9 && r.height >= innerHeight * 0.9 &&
+				!el.children.length && s.backgroundColor !== 'rgba(0, 0, 0, 0)') hide(el);
+		}
+		for (const el of [document.documentElement, document.body]) {
+			if (el && getComputedStyle(el).overflowY === 'hidden') el.style.setProperty('overflow', 'visible', 'important');
+		}
+	}
+	return done;
+})(%s, %t)`
+
+// dismissConsent clicks away or hides cookie-consent banners (dismiss_consent)
+// once the page is ready, before the screenshot. A page it cannot clear is
+// captured as it is rather than failed.
+func dismissConsent() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var done []string
+		if err := chromedp.Evaluate(fmt.Sprintf(dismissConsentJS, consentRulesJSON, false), &done).Do(ctx); err != nil {
+			return consentError(ctx, err)
+		}
+		if len(done) == 0 {
+			return nil
+		}
+
+		// A clicked banner may fade out or reload the page; hide whatever is
+		// still there afterwards
+		if err := chromedp.Sleep(consentDelay).Do(ctx); err != nil {
+			return err
+		}
+		if err := chromedp.WaitReady("body", chromedp.ByQuery).Do(ctx); err != nil {
+			return consentError(ctx, err)
+		}
+		return consentError(ctx, chromedp.Evaluate(fmt.Sprintf(dismissConsentJS, consentRulesJSON, true), nil).Do(ctx))
+	})
+}
+
+// consentError logs why a banner could not be dismissed, failing the capture
+// only if it timed out or was cancelled.
+func consentError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Printf("Consent banner dismissal failed: %v", err)
+	return nil
+}
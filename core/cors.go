@@ -0,0 +1,101 @@
+package core
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	// CORS settings; disabled unless CORS_ALLOWED_ORIGINS is set
+	corsOrigins          []string
+	corsMethods          string
+	corsHeaders          string
+	corsExposedHeaders   string
+	corsMaxAge           int
+	corsAllowCredentials bool
+)
+
+func init() {
+	for _, o := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			corsOrigins = append(corsOrigins, strings.ToLower(o))
+		}
+	}
+
+	corsMethods = envOr("CORS_ALLOWED_METHODS", "GET, POST, PUT, DELETE, OPTIONS")
+	corsHeaders = envOr("CORS_ALLOWED_HEADERS", "Authorization, Content-Type, X-API-Key")
+	corsExposedHeaders = envOr("CORS_EXPOSED_HEADERS",
+		"ETag, Server-Timing, X-Cache, X-Capture-ID, X-Partial, X-Moderation-Score, X-Moderation-Flagged, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After")
+
+	corsMaxAge = 600
+	if ma := os.Getenv("CORS_MAX_AGE"); ma != "" {
+		if val, err := strconv.Atoi(ma); err == nil && val >= 0 {
+			corsMaxAge = val
+		}
+	}
+	corsAllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// corsOriginAllowed matches origin against the configured list, where entries
+// may be "*" or globs such as https://*.example.com.
+func corsOriginAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range corsOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if ok, _ := path.Match(allowed, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCORS adds CORS headers for allowed origins and answers preflight
+// requests directly, before authentication runs.
+func WithCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(corsOrigins) == 0 || origin == "" {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		writer.Header().Add("Vary", "Origin")
+		if !corsOriginAllowed(origin) {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		h := writer.Header()
+		if len(corsOrigins) == 1 && corsOrigins[0] == "*" && !corsAllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if corsAllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsMethods)
+			h.Set("Access-Control-Allow-Headers", corsHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(writer, r)
+	})
+}
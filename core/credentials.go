@@ -0,0 +1,338 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// oauthCredential is a refresh token registered by a tenant. At capture time
+// it is exchanged for an access token which is injected into requests to the
+// matching sites, either as a header or as a cookie. Passwords and login
+// scripts never enter the service.
+type oauthCredential struct {
+	Name         string   `json:"name"`
+	Match        []string `json:"match"` // same syntax as URL_ALLOWLIST
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	RefreshToken string   `json:"refresh_token"`
+	Scope        string   `json:"scope,omitempty"`
+	Inject       string   `json:"inject,omitempty"`      // "header" (default) or "cookie"
+	HeaderName   string   `json:"header_name,omitempty"` // default Authorization, sent as "Bearer <token>"
+	CookieName   string   `json:"cookie_name,omitempty"`
+
+	owner string
+	rules urlRules
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+const credentialsLabel = "webshot oauth credentials"
+
+var (
+	// Registered OAuth credentials by owner (CREDENTIALS_FILE, sealed with
+	// the master key if there is one)
+	credentials      map[string][]*oauthCredential
+	credentialsLock  sync.RWMutex
+	credentialsFile  string
+	credentialClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	credentials = make(map[string][]*oauthCredential)
+
+	credentialsFile = os.Getenv("CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Failed to read CREDENTIALS_FILE: %v", err)
+		}
+		return
+	}
+	// Plain JSON from before a master key was configured is sealed on the
+	// next save
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if data, err = unseal(credentialsLabel, data); err != nil {
+			log.Fatalf("Failed to read CREDENTIALS_FILE: %v", err)
+		}
+	}
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		log.Fatalf("Invalid CREDENTIALS_FILE: %v", err)
+	}
+	for owner, list := range credentials {
+		for _, c := range list {
+			if err := c.compile(owner); err != nil {
+				log.Fatalf("Invalid credential %s/%s: %v", owner, c.Name, err)
+			}
+		}
+	}
+}
+
+// saveCredentials persists the store; callers must hold credentialsLock.
+func saveCredentials() {
+	if credentialsFile == "" {
+		return
+	}
+	data, err := json.Marshal(credentials)
+	if err == nil && secretsCipher() != nil {
+		data, err = seal(credentialsLabel, data)
+	}
+	if err == nil {
+		err = os.WriteFile(credentialsFile, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to save credentials: %v", err)
+	}
+}
+
+func (c *oauthCredential) compile(owner string) error {
+	c.owner = owner
+	if c.Name == "" || c.RefreshToken == "" || c.ClientID == "" {
+		return fmt.Errorf("name, client_id and refresh_token are required")
+	}
+	if u, err := url.Parse(c.TokenURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("token_url must be an https URL")
+	}
+	if len(c.Match) == 0 {
+		return fmt.Errorf("match must list the sites the token is sent to")
+	}
+	switch c.Inject {
+	case "":
+		c.Inject = "header"
+	case "header":
+	case "cookie":
+		if c.CookieName == "" {
+			return fmt.Errorf("cookie_name is required for cookie injection")
+		}
+	default:
+		return fmt.Errorf("inject must be header or cookie")
+	}
+	if c.HeaderName == "" {
+		c.HeaderName = "Authorization"
+	}
+
+	var err error
+	c.rules, err = parseURLRules(strings.Join(c.Match, ","))
+	return err
+}
+
+func (c *oauthCredential) matches(raw string) bool {
+	return c.rules.match(raw)
+}
+
+// credentialOwner is the tenant profile of the caller's key, falling back to
+// the key itself for keys without one. Tenants and keys are named apart
+// (tenant:<name>, key:<name>) so a key cannot pass for a tenant of its name.
+func credentialOwner(ctx context.Context) string {
+	key := apiKeyFrom(ctx)
+	switch {
+	case key == nil:
+		return "anonymous"
+	case key.Tenant != "":
+		return "tenant:" + key.Tenant
+	default:
+		return "key:" + key.Name
+	}
+}
+
+// credentialFor returns the caller's credential for target, if any.
+func credentialFor(ctx context.Context, target string) *oauthCredential {
+	credentialsLock.RLock()
+	defer credentialsLock.RUnlock()
+	for _, c := range credentials[credentialOwner(ctx)] {
+		if c.matches(target) {
+			return c
+		}
+	}
+	return nil
+}
+
+// token returns a valid access token, exchanging the refresh token when the
+// cached one is missing or about to expire.
+func (c *oauthCredential) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Until(c.expires) > time.Minute {
+		return c.accessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.RefreshToken},
+		"client_id":     {c.ClientID},
+	}
+	if c.ClientSecret != "" {
+		form.Set("client_secret", c.ClientSecret)
+	}
+	if c.Scope != "" {
+		form.Set("scope", c.Scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := credentialClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK || res.AccessToken == "" {
+		if res.Error != "" {
+			return "", fmt.Errorf("token exchange failed: %s", res.Error)
+		}
+		return "", fmt.Errorf("token exchange returned %s", resp.Status)
+	}
+
+	c.accessToken = res.AccessToken
+	c.expires = time.Now().Add(time.Hour)
+	if res.ExpiresIn > 0 {
+		c.expires = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	}
+	// Providers that rotate refresh tokens invalidate the old one
+	if res.RefreshToken != "" && res.RefreshToken != c.RefreshToken {
+		// saveCredentials reads every credential under credentialsLock
+		credentialsLock.Lock()
+		c.RefreshToken = res.RefreshToken
+		saveCredentials()
+		credentialsLock.Unlock()
+	}
+	return c.accessToken, nil
+}
+
+// injectCredential sends the access token to the matching sites only: as a
+// cookie scoped to the target, or as a header that ri adds to matching
+// requests so it never leaks to third-party hosts.
+func injectCredential(c *oauthCredential, target string, ri *requestInterceptor) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		token, err := c.token(ctx)
+		if err != nil {
+			return err
+		}
+
+		if c.Inject == "cookie" {
+			return network.SetCookie(c.CookieName, token).WithURL(target).WithSecure(strings.HasPrefix(target, "https:")).WithHTTPOnly(true).Do(ctx)
+		}
+
+		ri.header, ri.value, ri.match = c.HeaderName, token, c.matches
+		if strings.EqualFold(c.HeaderName, "Authorization") {
+			ri.value = "Bearer " + token
+		}
+		return nil
+	})
+}
+
+// HandleCredentials lists (GET), registers or replaces (POST) and removes
+// (DELETE ?name=) the caller's OAuth credentials. Secrets are never returned.
+func HandleCredentials(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "credentials") {
+		return
+	}
+	owner := credentialOwner(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		type summary struct {
+			Name     string   `json:"name"`
+			Match    []string `json:"match"`
+			TokenURL string   `json:"token_url"`
+			Inject   string   `json:"inject"`
+		}
+		list := []summary{}
+		credentialsLock.RLock()
+		for _, c := range credentials[owner] {
+			list = append(list, summary{c.Name, c.Match, c.TokenURL, c.Inject})
+		}
+		credentialsLock.RUnlock()
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(list)
+
+	case http.MethodPost:
+		var c oauthCredential
+		if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 64<<10)).Decode(&c); err != nil {
+			http.Error(writer, "Invalid credential JSON", http.StatusBadRequest)
+			return
+		}
+		if err := c.compile(owner); err != nil {
+			http.Error(writer, "Invalid credential: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Exchange once up front so broken registrations fail here, not mid-capture
+		if _, err := c.token(r.Context()); err != nil {
+			http.Error(writer, "Credential rejected by token endpoint: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		credentialsLock.Lock()
+		list := credentials[owner]
+		replaced := false
+		for i, existing := range list {
+			if existing.Name == c.Name {
+				list[i], replaced = &c, true
+			}
+		}
+		if !replaced {
+			list = append(list, &c)
+		}
+		credentials[owner] = list
+		saveCredentials()
+		credentialsLock.Unlock()
+
+		writer.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		credentialsLock.Lock()
+		list := credentials[owner]
+		found := false
+		for i, c := range list {
+			if c.Name == name {
+				credentials[owner] = append(list[:i:i], list[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if found {
+			saveCredentials()
+		}
+		credentialsLock.Unlock()
+
+		if !found {
+			http.Error(writer, "Credential not found", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,24 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCredentialOwner(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"no key", context.Background(), "anonymous"},
+		{"key without tenant", keyContext(&apiKey{Name: "acme"}), "key:acme"},
+		{"key of a tenant", keyContext(&apiKey{Name: "ci", Tenant: "acme"}), "tenant:acme"},
+		{"key named like a tenant", keyContext(&apiKey{Name: "tenant:acme"}), "key:tenant:acme"},
+	}
+	for _, tt := range tests {
+		if got := credentialOwner(tt.ctx); got != tt.want {
+			t.Errorf("%s: credentialOwner = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a standard five-field cron expression (minute hour
+// day-of-month month day-of-week) with lists, ranges, steps, month and day
+// names, and the @hourly/@daily/@weekly/@monthly shorthands. As in Vixie
+// cron, when both day fields are restricted a day matching either runs.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64 // bit n set = value n matches
+	domAny, dowAny                bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+}
+
+var cronMonths = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	if full, ok := cronShorthands[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = full
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields", expr)
+	}
+
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron %q: minute: %w", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron %q: hour: %w", expr, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron %q: day of month: %w", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("cron %q: month: %w", expr, err)
+	}
+	days := make(map[string]int, len(weekdays))
+	for name, d := range weekdays {
+		days[name] = int(d)
+	}
+	// 7 is accepted as Sunday
+	if c.dow, err = parseCronField(fields[4], 0, 7, days); err != nil {
+		return nil, fmt.Errorf("cron %q: day of week: %w", expr, err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return &c, nil
+}
+
+func parseCronField(field string, lo, hi int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		first, last := lo, hi
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = value(from); err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				if last, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				last = hi // "5/15" means from 5 to the end
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first matching minute strictly after t, in t's location,
+// or the zero time when none exists within five years (e.g. "0 0 30 2 *").
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronRejects(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Monday
+	from := time.Date(2024, time.January, 15, 10, 30, 20, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * *", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 8 * * mon-fri", time.Date(2024, 1, 16, 8, 0, 0, 0, time.UTC)},
+		{"0 0 1 mar *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matching runs
+		{"0 0 20 * fri", time.Date(2024, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := spec.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next(%v) = %v, want %v", tt.expr, from, got, tt.want)
+		}
+	}
+}
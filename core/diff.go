@@ -0,0 +1,277 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// pixelTolerance is the per-channel difference below which two pixels are
+// considered equal, absorbing anti-aliasing and JPEG noise.
+const pixelTolerance = 24
+
+// The most page pairs one diff run may compare (DIFF_MAX_PAGES)
+var diffMaxPages int
+
+var errDiffQuota = errors.New("capture quota exceeded")
+
+func init() {
+	diffMaxPages = envInt("DIFF_MAX_PAGES", 50, 1, 1000)
+}
+
+// diffImages compares a and b over the union of their bounds and returns a
+// visualisation (faded b with differing pixels in red) and the percentage of
+// pixels that differ.
+func diffImages(a, b image.Image) (*image.RGBA, float64) {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := max(ab.Dx(), bb.Dx()), max(ab.Dy(), bb.Dy())
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	highlight := color.RGBA{R: 255, A: 255}
+	var changed int
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			inA := x < ab.Dx() && y < ab.Dy()
+			inB := x < bb.Dx() && y < bb.Dy()
+			if !inA || !inB {
+				out.SetRGBA(x, y, highlight)
+				changed++
+				continue
+			}
+
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			if channelDelta(r1, r2) > pixelTolerance || channelDelta(g1, g2) > pixelTolerance || channelDelta(b1, b2) > pixelTolerance {
+				out.SetRGBA(x, y, highlight)
+				changed++
+				continue
+			}
+
+			// Unchanged pixels are washed out so the differences stand out
+			gray := uint8((r2>>8)*299/1000 + (g2>>8)*587/1000 + (b2>>8)*114/1000)
+			faded := 255 - (255-gray)/4
+			out.SetRGBA(x, y, color.RGBA{R: faded, G: faded, B: faded, A: 255})
+		}
+	}
+
+	if w == 0 || h == 0 {
+		return out, 0
+	}
+	return out, float64(changed) * 100 / float64(w*h)
+}
+
+func channelDelta(a, b uint32) uint32 {
+	a, b = a>>8, b>>8
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// diffPage is one before/after comparison in a diff run.
+type diffPage struct {
+	Name        string  `json:"name"`
+	Before      string  `json:"before"`
+	After       string  `json:"after"`
+	DiffPercent float64 `json:"diff_percent"`
+	Passed      bool    `json:"passed"`
+	Error       string  `json:"error,omitempty"`
+
+	// Images spooled to the run's directory for the HTML report
+	beforeFile string
+	afterFile  string
+	diffFile   string
+}
+
+// diffRun compares every page pair and records pass/fail against Threshold
+// (maximum percentage of differing pixels).
+type diffRun struct {
+	Threshold float64     `json:"threshold"`
+	Width     int         `json:"width,omitempty"`
+	Height    int         `json:"height,omitempty"`
+	Pages     []*diffPage `json:"pages"`
+	Passed    int         `json:"passed"`
+	Failed    int         `json:"failed"`
+	Started   time.Time   `json:"started"`
+	Duration  float64     `json:"duration_seconds"`
+
+	executionPolicy
+
+	// Where the page images are spooled when they are wanted, removed by
+	// cleanup once the response is written
+	dir string
+}
+
+func (run *diffRun) execute(r *http.Request) {
+	run.Started = time.Now().UTC()
+	for i, page := range run.Pages {
+		if page.Name == "" {
+			page.Name = page.After
+		}
+		if err := run.comparePage(r, i, page); err != nil {
+			page.Error = err.Error()
+		}
+		if page.Passed {
+			run.Passed++
+		} else {
+			run.Failed++
+		}
+	}
+	run.Duration = time.Since(run.Started).Seconds()
+}
+
+// comparePage captures both sides of a page, each charged against the
+// caller's quota, and spools the images rather than keeping them on the page.
+func (run *diffRun) comparePage(r *http.Request, i int, page *diffPage) error {
+	before, err := run.capture(r, page.Before)
+	if err != nil {
+		return err
+	}
+	after, err := run.capture(r, page.After)
+	if err != nil {
+		return err
+	}
+	if page.beforeFile, err = run.spool(i, "before", before.data); err != nil {
+		return err
+	}
+	if page.afterFile, err = run.spool(i, "after", after.data); err != nil {
+		return err
+	}
+
+	beforeImg, _, err := image.Decode(bytes.NewReader(before.data))
+	if err != nil {
+		return err
+	}
+	afterImg, _, err := image.Decode(bytes.NewReader(after.data))
+	if err != nil {
+		return err
+	}
+
+	diff, percent := diffImages(beforeImg, afterImg)
+	diffImg, err := pngBytes(&pngEncoder, diff)
+	if err != nil {
+		return err
+	}
+	if page.diffFile, err = run.spool(i, "diff", diffImg); err != nil {
+		return err
+	}
+	page.DiffPercent = percent
+	page.Passed = percent <= run.Threshold
+	return nil
+}
+
+func (run *diffRun) capture(r *http.Request, target string) (*screenshotResult, error) {
+	if quotaExceeded(r.Context()) {
+		return nil, errDiffQuota
+	}
+	return screenshotFor(r.Context(), newCaptureOptions(r.Context(), target, run.Width, run.Height))
+}
+
+// spool writes one of page i's images to the run's directory, or drops it
+// when no report needs the images.
+func (run *diffRun) spool(i int, kind string, data []byte) (string, error) {
+	if run.dir == "" {
+		return "", nil
+	}
+	path := filepath.Join(run.dir, strconv.Itoa(i)+"-"+kind)
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+func (run *diffRun) cleanup() {
+	if run.dir != "" {
+		os.RemoveAll(run.dir)
+	}
+}
+
+// HandleDiff runs a visual comparison of before/after URL pairs posted as
+// {"threshold":0.5,"pages":[{"name":"home","before":"...","after":"..."}]}.
+// The result is JSON, a self-contained HTML report with format=html, or
+// CI-native JUnit XML / TAP with format=junit / format=tap.
+func HandleDiff(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireFeature(writer, r, "diff") {
+		return
+	}
+
+	run := &diffRun{Threshold: 0.1, Width: 1280, Height: 720}
+	if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 1<<20)).Decode(run); err != nil {
+		http.Error(writer, "Invalid diff run JSON", http.StatusBadRequest)
+		return
+	}
+	if len(run.Pages) == 0 {
+		http.Error(writer, "Diff run needs at least one page", http.StatusBadRequest)
+		return
+	}
+	if len(run.Pages) > diffMaxPages {
+		http.Error(writer, "Diff run has more than "+strconv.Itoa(diffMaxPages)+" pages", http.StatusBadRequest)
+		return
+	}
+	if run.Width <= 0 || run.Width > 3840 || run.Height <= 0 || run.Height > 2160 {
+		http.Error(writer, "Invalid width/height", http.StatusBadRequest)
+		return
+	}
+
+	if err := run.compile(); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if next, ok := run.nextPermitted(now); !ok || next.After(now) {
+		if ok {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(next.Sub(now).Seconds())+1))
+			http.Error(writer, "Outside the allowed execution window, next opening at "+next.Format(time.RFC3339), http.StatusServiceUnavailable)
+		} else {
+			http.Error(writer, "Execution windows never open within the next week", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "html" {
+		dir, err := os.MkdirTemp("", "webshot-diff-")
+		if err != nil {
+			log.Printf("Error creating diff run directory: %v", err)
+			http.Error(writer, "Failed to start diff run", http.StatusInternalServerError)
+			return
+		}
+		run.dir = dir
+		defer run.cleanup()
+	}
+
+	run.execute(r)
+	log.Printf("Diff run finished: %d passed, %d failed in %.1fs", run.Passed, run.Failed, run.Duration)
+
+	switch format {
+	case "html":
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writer.Header().Set("Content-Disposition", `attachment; filename="diff-report.html"`)
+		if err := writeDiffReport(writer, run); err != nil {
+			log.Printf("Error rendering diff report: %v", err)
+		}
+	case "junit":
+		writer.Header().Set("Content-Type", "application/xml")
+		if err := writeDiffJUnit(writer, run); err != nil {
+			log.Printf("Error rendering JUnit report: %v", err)
+		}
+	case "tap":
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := writeDiffTAP(writer, run); err != nil {
+			log.Printf("Error rendering TAP report: %v", err)
+		}
+	default:
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(run)
+	}
+}
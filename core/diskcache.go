@@ -0,0 +1,308 @@
+package core
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache keeps captures on local disk so they survive restarts. Images are
+// content-addressed (blobs/<sha256>) and shared between keys that render the
+// same bytes; per-key metadata lives in meta/<key>.json. Once the blobs
+// exceed maxBytes the least recently used keys are evicted. The LRU order is
+// persisted through the metadata files' modification times.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // key -> element holding *diskEntry
+	lru     *list.List               // front is most recently used
+	blobs   map[string]int           // blob hash -> referencing keys
+	size    int64                    // bytes held in blobs
+}
+
+type diskEntry struct {
+	key  string
+	meta diskCacheMeta
+}
+
+type diskCacheMeta struct {
+	URL        string            `json:"url,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Expires    time.Time         `json:"expires"`
+	Cost       time.Duration     `json:"cost"`
+	Moderation *moderationResult `json:"moderation,omitempty"`
+	FinalURL   string            `json:"final_url,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Blob       string            `json:"blob"`
+	Size       int64             `json:"size"`
+}
+
+// newDiskCache opens dir, rebuilding the index from the metadata left by a
+// previous run.
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		blobs:    make(map[string]int),
+	}
+	for _, sub := range []string{"meta", "blobs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := os.ReadDir(filepath.Join(dir, "meta"))
+	if err != nil {
+		return nil, err
+	}
+	type loaded struct {
+		entry *diskEntry
+		used  time.Time
+	}
+	var found []loaded
+	for _, f := range files {
+		key, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, "meta", f.Name()))
+		if err != nil {
+			continue
+		}
+		var meta diskCacheMeta
+		if json.Unmarshal(raw, &meta) != nil {
+			continue
+		}
+		if _, err := os.Stat(c.blobPath(meta.Blob)); err != nil {
+			os.Remove(filepath.Join(dir, "meta", f.Name()))
+			continue
+		}
+		found = append(found, loaded{&diskEntry{key: key, meta: meta}, info.ModTime()})
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].used.Before(found[j].used) })
+	for _, l := range found {
+		c.entries[l.entry.key] = c.lru.PushFront(l.entry)
+		c.addBlobRef(l.entry.meta)
+	}
+	c.removeOrphanBlobs()
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *diskCache) metaPath(key string) string {
+	return filepath.Join(c.dir, "meta", key+".json")
+}
+
+func (c *diskCache) blobPath(hash string) string {
+	return filepath.Join(c.dir, "blobs", hash)
+}
+
+func (c *diskCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	entry := elem.Value.(*diskEntry)
+	if time.Now().After(entry.meta.Expires) {
+		c.remove(elem)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	meta := entry.meta
+	c.mu.Unlock()
+
+	data, err := os.ReadFile(c.blobPath(meta.Blob))
+	if err != nil || int64(len(data)) != meta.Size {
+		log.Printf("Disk cache read %s: %v", key, err)
+		c.delete(key)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(c.metaPath(key), now, now)
+
+	return &cacheEntry{
+		url:        meta.URL,
+		data:       data,
+		timestamp:  meta.Timestamp,
+		moderation: meta.Moderation,
+		cost:       meta.Cost,
+		finalURL:   meta.FinalURL,
+		status:     meta.Status,
+	}, true
+}
+
+func (c *diskCache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	if int64(len(entry.data)) > c.maxBytes {
+		return
+	}
+	sum := sha256.Sum256(entry.data)
+	meta := diskCacheMeta{
+		URL:        entry.url,
+		Timestamp:  entry.timestamp,
+		Expires:    entry.timestamp.Add(ttl),
+		Cost:       entry.cost,
+		Moderation: entry.moderation,
+		FinalURL:   entry.finalURL,
+		Status:     entry.status,
+		Blob:       hex.EncodeToString(sum[:]),
+		Size:       int64(len(entry.data)),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := os.Stat(c.blobPath(meta.Blob)); err != nil {
+		if err := writeFileAtomic(c.blobPath(meta.Blob), entry.data); err != nil {
+			log.Printf("Disk cache set %s: %v", key, err)
+			return
+		}
+	}
+	raw, _ := json.Marshal(meta)
+	if err := writeFileAtomic(c.metaPath(key), raw); err != nil {
+		log.Printf("Disk cache set %s: %v", key, err)
+		return
+	}
+
+	// Take the new reference first: a re-render often has the same bytes
+	c.addBlobRef(meta)
+	if elem, ok := c.entries[key]; ok {
+		c.dropBlobRef(elem.Value.(*diskEntry).meta)
+		elem.Value.(*diskEntry).meta = meta
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.lru.PushFront(&diskEntry{key: key, meta: meta})
+	}
+	c.evict()
+}
+
+func (c *diskCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *diskCache) sweep(retention time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		meta := elem.Value.(*diskEntry).meta
+		if now.After(meta.Expires) || now.Sub(meta.Timestamp) > retention {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+func (c *diskCache) purge(match func(url string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*diskEntry).meta.URL) {
+			c.remove(elem)
+			purged++
+		}
+		elem = next
+	}
+	return purged
+}
+
+// evict drops least recently used keys until the blobs fit in maxBytes.
+// Callers hold c.mu.
+func (c *diskCache) evict() {
+	for c.size > c.maxBytes {
+		elem := c.lru.Back()
+		if elem == nil {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+// remove forgets one key and its blob reference. Callers hold c.mu.
+func (c *diskCache) remove(elem *list.Element) {
+	entry := elem.Value.(*diskEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	os.Remove(c.metaPath(entry.key))
+	c.dropBlobRef(entry.meta)
+}
+
+func (c *diskCache) addBlobRef(meta diskCacheMeta) {
+	if c.blobs[meta.Blob] == 0 {
+		c.size += meta.Size
+	}
+	c.blobs[meta.Blob]++
+}
+
+func (c *diskCache) dropBlobRef(meta diskCacheMeta) {
+	c.blobs[meta.Blob]--
+	if c.blobs[meta.Blob] <= 0 {
+		delete(c.blobs, meta.Blob)
+		c.size -= meta.Size
+		os.Remove(c.blobPath(meta.Blob))
+	}
+}
+
+// removeOrphanBlobs deletes blobs no metadata refers to, e.g. after a crash
+// between writing the blob and its metadata.
+func (c *diskCache) removeOrphanBlobs() {
+	files, err := os.ReadDir(filepath.Join(c.dir, "blobs"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if _, ok := c.blobs[f.Name()]; !ok {
+			os.Remove(filepath.Join(c.dir, "blobs", f.Name()))
+		}
+	}
+}
+
+// writeFileAtomic writes through a temporary file so readers never see a
+// partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
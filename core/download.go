@@ -0,0 +1,108 @@
+package core
+
+import (
+	"bytes"
+	"image"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contentDisposition is what download= and filename= ask for: the
+// Content-Disposition type and a filename template such as
+// "{host}-{date}.png", filled in once the capture is known.
+type contentDisposition struct {
+	kind     string // attachment or inline
+	template string
+}
+
+const defaultFilename = "{host}-{timestamp}.png"
+
+// filenameVariables are the placeholders a filename may use.
+var filenameVariables = map[string]bool{
+	"host": true, "date": true, "timestamp": true, "id": true, "width": true, "height": true,
+}
+
+// parseContentDisposition reads download and filename; it returns nil when
+// the response needs no Content-Disposition.
+func parseContentDisposition(r *http.Request) (*contentDisposition, error) {
+	q := r.URL.Query()
+	download := q.Get("download")
+	switch download {
+	case "", "true", "false":
+	default:
+		return nil, &captureError{status: http.StatusBadRequest, message: "'download' must be true or false"}
+	}
+	name := q.Get("filename")
+	if download != "true" && name == "" {
+		return nil, nil
+	}
+	if name == "" {
+		name = defaultFilename
+	}
+	if len(name) > 200 {
+		return nil, &captureError{status: http.StatusBadRequest, message: "'filename' is too long"}
+	}
+	for rest := name; ; {
+		_, after, ok := strings.Cut(rest, "{")
+		if !ok {
+			break
+		}
+		variable, tail, ok := strings.Cut(after, "}")
+		if !ok || !filenameVariables[variable] {
+			return nil, &captureError{status: http.StatusBadRequest, message: "'filename' may only use {host}, {date}, {timestamp}, {id}, {width} and {height}"}
+		}
+		rest = tail
+	}
+
+	d := &contentDisposition{kind: "inline", template: name}
+	if download == "true" {
+		d.kind = "attachment"
+	}
+	return d, nil
+}
+
+// set fills in the template for the capture of target and sets the header.
+func (d *contentDisposition) set(writer http.ResponseWriter, target, id string, data []byte, created time.Time) {
+	host := "capture"
+	if u, err := url.Parse(target); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	var cfg image.Config
+	if c, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		cfg = c
+	}
+	created = created.UTC()
+	name := strings.NewReplacer(
+		"{host}", host,
+		"{date}", created.Format("2006-01-02"),
+		"{timestamp}", created.Format("20060102-150405"),
+		"{id}", id,
+		"{width}", strconv.Itoa(cfg.Width),
+		"{height}", strconv.Itoa(cfg.Height),
+	).Replace(d.template)
+
+	// Nothing that could be read as a path or break the header
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name = strings.TrimLeft(name, ". "); name == "" {
+		name = "capture"
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".png") {
+		name += ".png"
+	}
+
+	// FormatMediaType falls back to RFC 2231 filename* for non-ASCII names
+	if header := mime.FormatMediaType(d.kind, map[string]string{"filename": name}); header != "" {
+		writer.Header().Set("Content-Disposition", header)
+	} else {
+		writer.Header().Set("Content-Disposition", d.kind)
+	}
+}
@@ -0,0 +1,766 @@
+//go:build e2e
+
+// End-to-end tests drive real Chrome workers through the capture pipeline
+// against the pages in internal/testsite. Run them with
+//
+//	go test -tags e2e ./core
+//
+// They need a Chrome or Chromium binary on PATH and are skipped otherwise, or
+// when the workers cannot start (e.g. CHROME_SANDBOX=true on a host without
+// the sandbox, or CHROME_PROFILE_DIR not writable).
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"shotlink/internal/testsite"
+)
+
+var (
+	site     *httptest.Server
+	startErr error
+)
+
+func TestMain(m *testing.M) {
+	site = testsite.New()
+	startErr = Start()
+	code := m.Run()
+	site.Close()
+	Shutdown()
+	os.Exit(code)
+}
+
+func requireChrome(t *testing.T) {
+	t.Helper()
+	if startErr != nil {
+		t.Skipf("workers did not start: %v", startErr)
+	}
+	for _, name := range []string{"headless-shell", "chromium", "chromium-browser", "google-chrome", "google-chrome-stable"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return
+		}
+	}
+	t.Skip("no Chrome binary on PATH")
+}
+
+// sitePage returns default 1280x720 options for a test site path.
+func sitePage(path string) captureOptions {
+	return newCaptureOptions(context.Background(), site.URL+path, 1280, 720)
+}
+
+func capture(t *testing.T, opts captureOptions) (*screenshotResult, image.Image) {
+	t.Helper()
+	res, err := screenshotFor(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("capture %s: %v", opts.url, err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(res.data))
+	if err != nil {
+		t.Fatalf("capture %s: undecodable image: %v", opts.url, err)
+	}
+	return res, img
+}
+
+func TestE2ECaptureIsCached(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Static + "?case=cache")
+
+	first, img := capture(t, opts)
+	if first.cacheHit {
+		t.Fatal("first capture was served from cache")
+	}
+	if img.Bounds().Dx() != 1280 {
+		t.Errorf("width = %d, want 1280", img.Bounds().Dx())
+	}
+
+	second, _ := capture(t, opts)
+	if !second.cacheHit {
+		t.Error("second capture missed the cache")
+	}
+	if !bytes.Equal(first.data, second.data) {
+		t.Error("cached capture differs from the original")
+	}
+}
+
+func TestE2EPages(t *testing.T) {
+	requireChrome(t)
+	for _, path := range []string{testsite.SPA, testsite.Lazy, testsite.Slow, testsite.Redirect} {
+		t.Run(path, func(t *testing.T) {
+			capture(t, sitePage(path))
+		})
+	}
+}
+
+func TestE2EHugePageIsCapturedInFull(t *testing.T) {
+	requireChrome(t)
+	_, img := capture(t, sitePage(testsite.Huge))
+	if h := img.Bounds().Dy(); h < 10000 {
+		t.Errorf("height = %d, want the whole 20000px page", h)
+	}
+}
+
+func TestE2EPreferSpeed(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Huge)
+	opts.preferSpeed, opts.budget = true, 2*time.Second
+	_, img := capture(t, opts)
+	if h := img.Bounds().Dy(); h != 720 {
+		t.Errorf("height = %d, want the 720px viewport", h)
+	}
+}
+
+func TestE2ETimeout(t *testing.T) {
+	requireChrome(t)
+	saved := defaults
+	defaults.timeout = 500 * time.Millisecond
+	defer func() { defaults = saved }()
+
+	_, err := screenshotFor(context.Background(), sitePage(testsite.Slow+"?case=timeout"))
+	var ce *captureError
+	if !errors.As(err, &ce) || ce.status != http.StatusRequestTimeout {
+		t.Fatalf("err = %v, want a 408 capture error", err)
+	}
+}
+
+func TestE2EPartialOnTimeout(t *testing.T) {
+	requireChrome(t)
+	saved := defaults
+	defaults.timeout = 500 * time.Millisecond
+	defer func() { defaults = saved }()
+
+	opts := sitePage(testsite.Slow + "?case=partial")
+	opts.partial = true
+	res, _ := capture(t, opts)
+	if !res.partial {
+		t.Fatal("capture past the deadline was not marked partial")
+	}
+	if _, ok := screenCache.get(getCacheKey(opts)); ok {
+		t.Error("partial capture was cached")
+	}
+}
+
+func TestE2EConsole(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Broken)
+	opts.console, opts.refresh = true, true
+	res, _ := capture(t, opts)
+	if res.report == nil {
+		t.Fatal("capture with console=true has no report")
+	}
+	// console.error and the exception; Chrome may also log the missing image
+	if n := res.report.consoleErrors(); n < 2 {
+		t.Errorf("console errors = %d, want at least 2: %+v", n, res.report.Console)
+	}
+	levels := make(map[string]bool)
+	for _, e := range res.report.Console {
+		levels[e.Level] = true
+	}
+	if !levels["log"] || !levels["exception"] {
+		t.Errorf("console = %+v", res.report.Console)
+	}
+}
+
+func TestE2ERequests(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Broken)
+	opts.requests, opts.refresh = true, true
+	res, _ := capture(t, opts)
+	if res.report == nil || len(res.report.Requests) < 2 {
+		t.Fatalf("report = %+v", res.report)
+	}
+	if doc := res.report.Requests[0]; doc.Type != "Document" || doc.Status != http.StatusOK {
+		t.Errorf("first request = %+v", doc)
+	}
+	if n := res.report.failedRequests(); n != 1 {
+		t.Errorf("failed requests = %d, want 1 (the missing image): %+v", n, res.report.Requests)
+	}
+	if len(res.report.Console) > 0 {
+		t.Errorf("console collected without console=true: %+v", res.report.Console)
+	}
+}
+
+func TestE2EMeta(t *testing.T) {
+	requireChrome(t)
+	rec := httptest.NewRecorder()
+	HandleMeta(rec, httptest.NewRequest(http.MethodGet, "/meta?url="+url.QueryEscape(site.URL+testsite.Meta), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var meta pageMeta
+	if err := json.NewDecoder(rec.Body).Decode(&meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "webshot meta page" || meta.Description == "" || meta.Canonical != site.URL+"/meta?canonical" {
+		t.Errorf("title/description/canonical = %q, %q, %q", meta.Title, meta.Description, meta.Canonical)
+	}
+	if meta.OpenGraph["title"] != "Meta page" || meta.OpenGraph["description"] != "Added by script" || meta.Twitter["card"] != "summary_large_image" {
+		t.Errorf("open_graph = %v, twitter = %v", meta.OpenGraph, meta.Twitter)
+	}
+	if meta.Favicon != site.URL+"/image.png?color=0a7" {
+		t.Errorf("favicon = %q", meta.Favicon)
+	}
+}
+
+func TestE2EPreview(t *testing.T) {
+	requireChrome(t)
+	rec := httptest.NewRecorder()
+	HandlePreview(rec, httptest.NewRequest(http.MethodGet, "/preview?thumb_width=320&url="+url.QueryEscape(site.URL+testsite.Meta), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var preview linkPreview
+	if err := json.NewDecoder(rec.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	if preview.Title != "Meta page" || preview.Description != "Added by script" {
+		t.Errorf("title/description = %q, %q, want the OpenGraph tags", preview.Title, preview.Description)
+	}
+	if preview.ImageWidth != 320 || preview.ImageHeight != 180 {
+		t.Errorf("thumbnail = %dx%d, want 320x180", preview.ImageWidth, preview.ImageHeight)
+	}
+}
+
+func TestE2EA11y(t *testing.T) {
+	requireChrome(t)
+	rec := httptest.NewRecorder()
+	HandleA11y(rec, httptest.NewRequest(http.MethodGet, "/a11y?url="+url.QueryEscape(site.URL+testsite.Static), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var res struct {
+		Tree []*a11yNode `json:"tree"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	var find func(nodes []*a11yNode) bool
+	find = func(nodes []*a11yNode) bool {
+		for _, n := range nodes {
+			if n.Role == "heading" && n.Name == "Static page" || find(n.Children) {
+				return true
+			}
+		}
+		return false
+	}
+	if !find(res.Tree) {
+		t.Error("tree has no heading named \"Static page\"")
+	}
+}
+
+func TestE2EPerf(t *testing.T) {
+	requireChrome(t)
+	rec := httptest.NewRecorder()
+	HandlePerf(rec, httptest.NewRequest(http.MethodGet, "/perf?url="+url.QueryEscape(site.URL+testsite.Meta), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var res struct {
+		Timing    pageTiming         `json:"timing"`
+		Resources resourceStats      `json:"resources"`
+		Metrics   map[string]float64 `json:"metrics"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Timing.Load <= 0 || res.Timing.FirstContentfulPaint <= 0 {
+		t.Errorf("timing = %+v", res.Timing)
+	}
+	if res.Resources.Requests < 2 || res.Resources.TransferBytes == 0 {
+		t.Errorf("resources = %+v, want the document and its icon", res.Resources)
+	}
+	if res.Metrics["Nodes"] == 0 {
+		t.Error("no Performance domain metrics")
+	}
+}
+
+func TestE2EOAuthCredentials(t *testing.T) {
+	requireChrome(t)
+	tokenSite := testsite.NewTLS()
+	defer tokenSite.Close()
+
+	savedClient := credentialClient
+	credentialClient = tokenSite.Client()
+	defer func() { credentialClient = savedClient }()
+
+	host, _ := url.Parse(site.URL)
+	for _, inject := range []string{"header", "cookie"} {
+		t.Run(inject, func(t *testing.T) {
+			c := &oauthCredential{
+				Name:         "e2e-" + inject,
+				Match:        []string{host.Hostname()},
+				TokenURL:     tokenSite.URL + testsite.Token,
+				ClientID:     testsite.ClientID,
+				RefreshToken: testsite.RefreshToken,
+				Inject:       inject,
+				CookieName:   testsite.CookieName,
+			}
+			if err := c.compile("anonymous"); err != nil {
+				t.Fatal(err)
+			}
+
+			path := testsite.Auth
+			if inject == "cookie" {
+				path = testsite.Cookie
+			}
+			unauth, _ := capture(t, sitePage(path))
+
+			credentialsLock.Lock()
+			credentials["anonymous"] = []*oauthCredential{c}
+			credentialsLock.Unlock()
+			defer func() {
+				credentialsLock.Lock()
+				delete(credentials, "anonymous")
+				credentialsLock.Unlock()
+			}()
+
+			opts := sitePage(path)
+			if opts.credential != c {
+				t.Fatal("registered credential was not picked up")
+			}
+			authed, _ := capture(t, opts)
+			if bytes.Equal(unauth.data, authed.data) {
+				t.Error("authenticated capture looks like the 401 page")
+			}
+		})
+	}
+}
+
+func TestE2ESessionProfile(t *testing.T) {
+	requireChrome(t)
+	host, _ := url.Parse(site.URL)
+	p := &sessionProfile{Name: "e2e", Match: []string{host.Hostname()}}
+	if err := p.compile("anonymous"); err != nil {
+		t.Fatal(err)
+	}
+	err := p.login(context.Background(), loginScenario{URL: site.URL + testsite.Login, Steps: []loginStep{
+		{Action: "fill", Selector: "#token", Value: testsite.AccessToken},
+		{Action: "click", Selector: "#submit"},
+		{Action: "wait", Selector: "h1"},
+	}}, "e2e")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if len(p.Cookies) == 0 {
+		t.Fatal("login left no cookies in the profile")
+	}
+
+	unauth, _ := capture(t, sitePage(testsite.Cookie))
+	opts := sitePage(testsite.Cookie)
+	opts.session, opts.profile, opts.isolated = p, "anonymous/e2e", true
+	authed, _ := capture(t, opts)
+	if bytes.Equal(unauth.data, authed.data) {
+		t.Error("capture with the session profile looks like the 401 page")
+	}
+}
+
+func TestE2EConditionalGet(t *testing.T) {
+	requireChrome(t)
+	target := "/get?url=" + url.QueryEscape(site.URL+testsite.Static+"?case=etag")
+
+	rec := httptest.NewRecorder()
+	HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" || rec.Header().Get("X-Capture-ID") == "" {
+		t.Fatalf("missing ETag or X-Capture-ID: %v", rec.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	HandleScreenshot(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("revalidation status = %d, want 304", rec.Code)
+	}
+	if rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("revalidation X-Cache = %q, want HIT", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestE2EJSONResponse(t *testing.T) {
+	requireChrome(t)
+	target := "/get?response=json&width=800&height=600&url=" + url.QueryEscape(site.URL+testsite.Redirect+"?case=json")
+
+	for _, wantCache := range []string{"MISS", "HIT"} {
+		rec := httptest.NewRecorder()
+		HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		var body captureResponse
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Cache != wantCache || body.Width != 800 || body.TargetStatus != http.StatusOK {
+			t.Errorf("cache %q, width %d, target status %d", body.Cache, body.Width, body.TargetStatus)
+		}
+		if body.FinalURL != site.URL+"/redirect/step" {
+			t.Errorf("final_url = %q", body.FinalURL)
+		}
+		if data, err := base64.StdEncoding.DecodeString(body.ImageBase64); err != nil || len(data) == 0 {
+			t.Errorf("image_base64 does not decode: %v", err)
+		}
+	}
+}
+
+func TestE2ERedirectLimits(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Redirect + "?case=limits")
+	opts.redirects, opts.refresh = true, true
+	res, _ := capture(t, opts)
+	if len(res.report.Redirects) != 1 || res.report.Redirects[0].Status != http.StatusFound {
+		t.Errorf("redirects = %+v", res.report.Redirects)
+	}
+
+	opts = sitePage(testsite.Redirect + "?case=limits")
+	opts.maxRedirects = "0"
+	_, err := screenshotFor(context.Background(), opts)
+	var ce *captureError
+	if !errors.As(err, &ce) || ce.status != http.StatusBadGateway {
+		t.Errorf("capture with max_redirects=0: %v", err)
+	}
+}
+
+func TestE2EFailOnStatus(t *testing.T) {
+	requireChrome(t)
+	target := "/get?fail_on_status=4xx,5xx&url=" + url.QueryEscape(site.URL+"/missing")
+
+	rec := httptest.NewRecorder()
+	HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("X-Target-Status") != "404" {
+		t.Fatalf("status = %d, X-Target-Status %q", rec.Code, rec.Header().Get("X-Target-Status"))
+	}
+	opts := sitePage("/missing")
+	if _, ok := screenCache.get(getCacheKey(opts)); ok {
+		t.Error("capture of an error page was cached")
+	}
+}
+
+func TestE2ENoScript(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Broken)
+	opts.console, opts.refresh, opts.noScript = true, true, true
+	res, _ := capture(t, opts)
+	for _, e := range res.report.Console {
+		if e.Level == "log" || e.Level == "exception" {
+			t.Errorf("script ran with js=false: %+v", e)
+		}
+	}
+}
+
+func TestE2EIsolatedCapturesStartClean(t *testing.T) {
+	requireChrome(t)
+	for i := range 2 {
+		opts := sitePage(testsite.State)
+		opts.console, opts.refresh, opts.isolated = true, true, true
+		res, _ := capture(t, opts)
+		if len(res.report.Console) == 0 || res.report.Console[0].Text != "visits=0 cookie=" {
+			t.Errorf("capture %d saw state of an earlier one: %+v", i, res.report.Console)
+		}
+	}
+}
+
+func TestE2EDismissConsent(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Consent)
+	opts.console, opts.dismissConsent = true, true
+	res, img := capture(t, opts)
+	if len(res.report.Console) == 0 || res.report.Console[0].Text != "consent=rejected" {
+		t.Errorf("banner was not rejected: %+v", res.report.Console)
+	}
+	r, g, b, _ := img.At(10, img.Bounds().Dy()-10).RGBA()
+	if r>>8 != 0xff || g>>8 != 0xff || b>>8 != 0xff {
+		t.Errorf("bottom-left pixel = #%02x%02x%02x, want the white page", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestE2EResize(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage(testsite.Static + "?case=resize")
+	opts.resize = "320x0"
+	_, img := capture(t, opts)
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 320 || h < 180 {
+		t.Errorf("resized capture is %dx%d, want 320 wide", w, h)
+	}
+}
+
+func TestE2ECropSharesCapture(t *testing.T) {
+	requireChrome(t)
+	base := "/get?url=" + url.QueryEscape(site.URL+testsite.Static+"?case=crop")
+	for i, crop := range []string{"0,0,200,100", "100,50,300,200"} {
+		rec := httptest.NewRecorder()
+		HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, base+"&crop="+crop, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("crop %s: status %d", crop, rec.Code)
+		}
+		if want := []string{"MISS", "HIT"}[i]; rec.Header().Get("X-Cache") != want {
+			t.Errorf("crop %s: X-Cache = %q, want %s", crop, rec.Header().Get("X-Cache"), want)
+		}
+		img, _, err := image.Decode(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if crop == "0,0,200,100" && (img.Bounds().Dx() != 200 || img.Bounds().Dy() != 100) {
+			t.Errorf("crop %s gave %v", crop, img.Bounds())
+		}
+	}
+}
+
+func TestE2EBackground(t *testing.T) {
+	requireChrome(t)
+	opts := sitePage("/missing?case=bg")
+	opts.background = "#0f172a"
+	_, img := capture(t, opts)
+	r, g, b, _ := img.At(img.Bounds().Dx()-1, img.Bounds().Dy()-1).RGBA()
+	if r>>8 != 0x0f || g>>8 != 0x17 || b>>8 != 0x2a {
+		t.Errorf("corner pixel = #%02x%02x%02x, want #0f172a", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestE2EPHash(t *testing.T) {
+	requireChrome(t)
+	rec := httptest.NewRecorder()
+	HandlePHash(rec, httptest.NewRequest(http.MethodGet, "/phash?url="+url.QueryEscape(site.URL+testsite.Meta), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var body struct{ PHash, DHash string }
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.PHash) != 16 || len(body.DHash) != 16 {
+		t.Errorf("phash %q, dhash %q", body.PHash, body.DHash)
+	}
+}
+
+func TestE2EBaselineCompare(t *testing.T) {
+	requireChrome(t)
+	baselines = dirStore(t.TempDir())
+
+	req := httptest.NewRequest(http.MethodPut, "/baselines/home?url="+url.QueryEscape(site.URL+testsite.Static), nil)
+	req.SetPathValue("name", "home")
+	rec := httptest.NewRecorder()
+	HandleBaseline(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT status = %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	compare := func(query string) comparison {
+		rec := httptest.NewRecorder()
+		HandleCompare(rec, httptest.NewRequest(http.MethodGet, "/compare?baseline=home"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("compare%s status = %d, body %q", query, rec.Code, rec.Body.String())
+		}
+		var result comparison
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := screenCache.get(strings.TrimPrefix(result.Diff, "/captures/")); !ok {
+			t.Errorf("diff %q not stored", result.Diff)
+		}
+		return result
+	}
+	if result := compare(""); !result.Passed || result.URL != site.URL+testsite.Static {
+		t.Errorf("unchanged page: %+v", result)
+	}
+	if result := compare("&threshold=0&url=" + url.QueryEscape(site.URL+testsite.Meta)); result.Passed || result.DiffPercent == 0 {
+		t.Errorf("different page: %+v", result)
+	}
+}
+
+func TestE2EScheduledRun(t *testing.T) {
+	requireChrome(t)
+	scheduleImages = dirStore(t.TempDir())
+
+	body := `{"url":"` + site.URL + testsite.Static + `","cron":"@hourly","options":{"width":"800","height":"600"}}`
+	rec := httptest.NewRecorder()
+	HandleSchedules(rec, httptest.NewRequest(http.MethodPost, "/schedules", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var created schedule
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	schedulesLock.Lock()
+	s := findSchedule(credentialOwner(context.Background()), created.ID)
+	schedulesLock.Unlock()
+	s.run(time.Now())
+	if len(s.History) != 1 || s.History[0].Status != "ok" {
+		t.Fatalf("history = %+v", s.History)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, s.History[0].Image, nil)
+	req.SetPathValue("id", s.ID)
+	req.SetPathValue("run", s.History[0].ID)
+	rec = httptest.NewRecorder()
+	HandleScheduleRun(rec, req)
+	img, _, err := image.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("run image: %v (status %d)", err, rec.Code)
+	}
+	if b := img.Bounds(); b.Dx() != 800 {
+		t.Errorf("run image is %dx%d, want 800 wide", b.Dx(), b.Dy())
+	}
+}
+
+func TestE2EMonitorAlertsOnChange(t *testing.T) {
+	requireChrome(t)
+	scheduleImages = dirStore(t.TempDir())
+	alerts := make(chan monitorAlert, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert monitorAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		alerts <- alert
+	}))
+	defer hook.Close()
+
+	body := `{"url":"` + site.URL + testsite.Static + `","cron":"@daily","monitor":{"threshold":1,"webhook":"` + hook.URL + `"}}`
+	rec := httptest.NewRecorder()
+	HandleSchedules(rec, httptest.NewRequest(http.MethodPost, "/schedules", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var created schedule
+	json.NewDecoder(rec.Body).Decode(&created)
+	schedulesLock.Lock()
+	s := findSchedule(credentialOwner(context.Background()), created.ID)
+	schedulesLock.Unlock()
+
+	s.run(time.Now())
+	s.run(time.Now().Add(time.Second))
+	if len(s.History) != 2 || s.History[0].Changed {
+		t.Fatalf("unchanged page: history = %+v", s.History)
+	}
+	s.URL = site.URL + testsite.Meta
+	s.run(time.Now().Add(2 * time.Second))
+	if run := s.History[0]; !run.Changed || run.Diff == "" {
+		t.Fatalf("changed page: run = %+v", run)
+	}
+	select {
+	case alert := <-alerts:
+		if alert.Event != "change_detected" || alert.Schedule != s.ID {
+			t.Errorf("alert = %+v", alert)
+		}
+	default:
+		t.Error("no alert sent")
+	}
+}
+
+func TestE2EUploadToS3(t *testing.T) {
+	requireChrome(t)
+	uploaded := make(map[string][]byte)
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var buf bytes.Buffer
+			buf.ReadFrom(r.Body)
+			uploaded[r.URL.Path] = buf.Bytes()
+		}
+	}))
+	defer bucket.Close()
+	t.Setenv("S3_ENDPOINT", bucket.URL)
+	t.Setenv("S3_BUCKET", "shots")
+
+	target := "/get?store=s3&key_prefix=e2e&url=" + url.QueryEscape(site.URL+testsite.Static+"?case=upload")
+	rec := httptest.NewRecorder()
+	HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body uploadResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Key != "webshot/uploads/e2e/"+body.ID+".png" || body.Width != 1280 {
+		t.Errorf("key %q, width %d", body.Key, body.Width)
+	}
+	if data := uploaded["/shots/"+body.Key]; len(data) != body.Size || !strings.Contains(body.PresignedURL, "X-Amz-Signature=") {
+		t.Errorf("uploaded %d bytes, reported %d; presigned %q", len(data), body.Size, body.PresignedURL)
+	}
+}
+
+func TestE2EStoreLocalFile(t *testing.T) {
+	requireChrome(t)
+	fileStore = dirStore(t.TempDir())
+
+	target := "/get?store=local&url=" + url.QueryEscape(site.URL+testsite.Static+"?case=files")
+	rec := httptest.NewRecorder()
+	HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	var body uploadResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %v", rec.Code, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, body.URL, nil)
+	req.SetPathValue("id", body.Key)
+	file := httptest.NewRecorder()
+	HandleFile(file, req)
+	if file.Code != http.StatusOK || file.Body.Len() != body.Size {
+		t.Errorf("file status %d, %d bytes, want %d", file.Code, file.Body.Len(), body.Size)
+	}
+}
+
+func TestE2EViewportsZip(t *testing.T) {
+	requireChrome(t)
+	target := "/get?viewports=375x667,1024x768&url=" + url.QueryEscape(site.URL+testsite.Static+"?case=viewports")
+	rec := httptest.NewRecorder()
+	HandleScreenshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+		if f.Name != "375x667.png" {
+			continue
+		}
+		rc, _ := f.Open()
+		img, _, err := image.Decode(rc)
+		rc.Close()
+		if err != nil || img.Bounds().Dx() != 375 {
+			t.Errorf("375x667.png: %v", err)
+		}
+	}
+	if strings.Join(names, ",") != "375x667.png,1024x768.png,manifest.json" {
+		t.Errorf("files = %v", names)
+	}
+}
+
+func TestE2EDeepHealth(t *testing.T) {
+	requireChrome(t)
+	rec := httptest.NewRecorder()
+	HandleHealth(rec, httptest.NewRequest(http.MethodGet, "/health?deep=true", nil))
+	var body struct {
+		Status string     `json:"status"`
+		Deep   deepHealth `json:"deep"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("health: %v: %s", err, rec.Body)
+	}
+	if rec.Code != http.StatusOK || !body.Deep.OK || body.Deep.Worker == nil {
+		t.Fatalf("deep health: %d %s", rec.Code, rec.Body)
+	}
+}
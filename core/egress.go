@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// egressWindow counts the bytes a tenant's captures downloaded in the current
+// minute and UTC day.
+type egressWindow struct {
+	minute      time.Time
+	minuteBytes int64
+	day         string
+	dayBytes    int64
+}
+
+var (
+	// Renderer download budgets per tenant (EGRESS_BYTES_PER_MINUTE/DAY; 0 = unlimited)
+	egressPerMinute int64
+	egressPerDay    int64
+	egressWindows   map[string]*egressWindow
+	egressLock      sync.Mutex
+)
+
+func init() {
+	if v := os.Getenv("EGRESS_BYTES_PER_MINUTE"); v != "" {
+		if val, err := strconv.ParseInt(v, 10, 64); err == nil && val > 0 {
+			egressPerMinute = val
+		}
+	}
+	if v := os.Getenv("EGRESS_BYTES_PER_DAY"); v != "" {
+		if val, err := strconv.ParseInt(v, 10, 64); err == nil && val > 0 {
+			egressPerDay = val
+		}
+	}
+	egressWindows = make(map[string]*egressWindow)
+}
+
+// egressMeter accounts network bytes for one capture against its tenant's
+// budget. A nil meter means the tenant is unlimited.
+type egressMeter struct {
+	tenant    string
+	perMinute int64
+	perDay    int64
+	exhausted atomic.Bool
+}
+
+func newEgressMeter(ctx context.Context) *egressMeter {
+	m := &egressMeter{tenant: tenantName(ctx), perMinute: egressPerMinute, perDay: egressPerDay}
+	if key := apiKeyFrom(ctx); key != nil {
+		if key.EgressPerMinute > 0 {
+			m.perMinute = key.EgressPerMinute
+		}
+		if key.EgressPerDay > 0 {
+			m.perDay = key.EgressPerDay
+		}
+	}
+	if m.perMinute == 0 && m.perDay == 0 {
+		return nil
+	}
+	return m
+}
+
+// window returns the tenant's counters for the current period; callers must
+// hold egressLock.
+func (m *egressMeter) window(now time.Time) *egressWindow {
+	w, ok := egressWindows[m.tenant]
+	if !ok {
+		w = &egressWindow{}
+		egressWindows[m.tenant] = w
+	}
+	if minute := now.Truncate(time.Minute); !w.minute.Equal(minute) {
+		w.minute, w.minuteBytes = minute, 0
+	}
+	if day := now.UTC().Format("2006-01-02"); w.day != day {
+		w.day, w.dayBytes = day, 0
+	}
+	return w
+}
+
+// over reports whether the budget is already spent and, if so, how long until
+// the exhausted window resets.
+func (m *egressMeter) over() (bool, time.Duration) {
+	if m == nil {
+		return false, 0
+	}
+	now := time.Now()
+
+	egressLock.Lock()
+	defer egressLock.Unlock()
+	w := m.window(now)
+	if m.perDay > 0 && w.dayBytes >= m.perDay {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return true, midnight.Sub(now)
+	}
+	if m.perMinute > 0 && w.minuteBytes >= m.perMinute {
+		return true, w.minute.Add(time.Minute).Sub(now)
+	}
+	return false, 0
+}
+
+// add records downloaded bytes and returns false once the budget is spent.
+func (m *egressMeter) add(n int64) bool {
+	if m == nil {
+		return true
+	}
+
+	egressLock.Lock()
+	w := m.window(time.Now())
+	w.minuteBytes += n
+	w.dayBytes += n
+	spent := (m.perMinute > 0 && w.minuteBytes > m.perMinute) || (m.perDay > 0 && w.dayBytes > m.perDay)
+	egressLock.Unlock()
+
+	if spent {
+		m.exhausted.Store(true)
+	}
+	return !spent
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"strings"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// prepareTab applies the per-capture browser settings of opts to a fresh tab
+// before it navigates.
+func prepareTab(opts captureOptions) chromedp.Tasks {
+	tasks := chromedp.Tasks{
+		network.SetCacheDisabled(opts.bypassBrowserCache),
+		emulation.SetDeviceMetricsOverride(int64(opts.width), int64(opts.height), 1.0, false),
+	}
+	if opts.timezone != "" {
+		tasks = append(tasks, emulation.SetTimezoneOverride(opts.timezone))
+	}
+	if opts.media != "" || opts.reducedMotion || opts.forcedColors {
+		var features []*emulation.MediaFeature
+		if opts.reducedMotion {
+			features = append(features, &emulation.MediaFeature{Name: "prefers-reduced-motion", Value: "reduce"})
+		}
+		if opts.forcedColors {
+			features = append(features, &emulation.MediaFeature{Name: "forced-colors", Value: "active"})
+		}
+		tasks = append(tasks, emulation.SetEmulatedMedia().WithMedia(opts.media).WithFeatures(features))
+	}
+	if opts.vision != "" {
+		tasks = append(tasks, emulation.SetEmulatedVisionDeficiency(emulation.SetEmulatedVisionDeficiencyType(opts.vision)))
+	}
+	if opts.lang != "" {
+		tasks = append(tasks, emulateLanguage(opts.lang))
+	}
+	if p := opts.geoPoint; p != nil {
+		tasks = append(tasks,
+			grantPermission(browser.PermissionTypeGeolocation),
+			emulation.SetGeolocationOverride().WithLatitude(p.lat).WithLongitude(p.lon).WithAccuracy(p.accuracy))
+	}
+	if opts.background != "" {
+		c, _ := parseHexColor(opts.background)
+		tasks = append(tasks, emulation.SetDefaultBackgroundColorOverride().WithColor(&cdp.RGBA{R: int64(c.R), G: int64(c.G), B: int64(c.B), A: 1}))
+	}
+	if opts.noScript {
+		tasks = append(tasks, emulation.SetScriptExecutionDisabled(true))
+	}
+	return tasks
+}
+
+// visionDeficiencies are the vision= simulations Chrome supports.
+var visionDeficiencies = map[string]bool{
+	"achromatopsia": true, "blurredVision": true, "deuteranopia": true,
+	"protanopia": true, "reducedContrast": true, "tritanopia": true,
+}
+
+// geoPoint is a position for geo=, accuracy in meters.
+type geoPoint struct {
+	lat, lon, accuracy float64
+}
+
+// grantPermission grants the tab's browser context a permission for every
+// origin, so the page gets it without a prompt. resetBrowser revokes it
+// again on shared browser contexts.
+func grantPermission(perm browser.PermissionType) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		c := chromedp.FromContext(ctx)
+		grant := browser.GrantPermissions([]browser.PermissionType{perm})
+		if c.BrowserContextID != "" {
+			grant = grant.WithBrowserContextID(c.BrowserContextID)
+		}
+		return grant.Do(cdp.WithExecutor(ctx, c.Browser))
+	})
+}
+
+// emulateLanguage makes the page see lang as the user's language: in the
+// Accept-Language header and navigator.languages (through the browser's own
+// user agent) and as the default locale of Intl formatting.
+func emulateLanguage(lang string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		_, _, _, ua, _, err := browser.GetVersion().Do(ctx)
+		if err != nil {
+			return err
+		}
+		accept := lang
+		if base, _, ok := strings.Cut(lang, "-"); ok {
+			accept += "," + base + ";q=0.9"
+		}
+		if err := emulation.SetUserAgentOverride(ua).WithAcceptLanguage(accept).Do(ctx); err != nil {
+			return err
+		}
+		return emulation.SetLocaleOverride().WithLocale(strings.ReplaceAll(lang, "-", "_")).Do(ctx)
+	})
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Image processing (resize, crop, watermark, PNG optimization) runs on its
+// own pool of ENCODE_WORKERS goroutines, one per CPU by default. Chrome
+// workers are released before it starts, and bounding it keeps a burst of
+// large captures from starving everything else of CPU.
+var (
+	encodeJobs chan func()
+
+	// Captures waiting for an encoder
+	queuedEncodes int64
+)
+
+func init() {
+	n := envInt("ENCODE_WORKERS", runtime.GOMAXPROCS(0), 1, 1024)
+	encodeJobs = make(chan func())
+	for range n {
+		go func() {
+			for job := range encodeJobs {
+				job()
+			}
+		}()
+	}
+}
+
+// runEncoder runs fn on the encode pool and returns its error. Giving up on
+// the wait when ctx ends is a *captureError; once started, fn runs to the end.
+// A panic in fn fails the capture rather than the pool.
+func runEncoder(ctx context.Context, fn func() error) error {
+	var err error
+	done := make(chan struct{})
+	job := func() {
+		defer close(done)
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("Panic recovered in encoder: %v", rec)
+				err = &captureError{status: http.StatusInternalServerError, message: "Error processing screenshot"}
+			}
+		}()
+		err = fn()
+	}
+
+	defer timingFrom(ctx).since("encode", time.Now())
+	atomic.AddInt64(&queuedEncodes, 1)
+	select {
+	case encodeJobs <- job:
+		atomic.AddInt64(&queuedEncodes, -1)
+	case <-ctx.Done():
+		atomic.AddInt64(&queuedEncodes, -1)
+		return captureCanceled()
+	}
+	<-done
+	return err
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// errorImageTemplate renders the lines of text drawn into on_error=image
+// placeholders (ERROR_IMAGE_TEMPLATE). The first line is the headline; the
+// template sees .Status, .StatusText, .Message and .URL.
+var errorImageTemplate *template.Template
+
+const defaultErrorImageTemplate = `Screenshot unavailable
+{{.Status}} {{.StatusText}}
+{{.Message}}
+
+{{.URL}}`
+
+var (
+	errorImageBackground = color.RGBA{0xf3, 0xf4, 0xf6, 0xff}
+	errorImageHeadline   = color.RGBA{0xb9, 0x1c, 0x1c, 0xff}
+	errorImageText       = color.RGBA{0x37, 0x41, 0x51, 0xff}
+)
+
+func init() {
+	src := defaultErrorImageTemplate
+	if t := os.Getenv("ERROR_IMAGE_TEMPLATE"); t != "" {
+		src = strings.ReplaceAll(t, `\n`, "\n")
+	}
+	var err error
+	if errorImageTemplate, err = template.New("error-image").Parse(src); err != nil {
+		log.Fatalf("Invalid ERROR_IMAGE_TEMPLATE: %v", err)
+	}
+}
+
+// failCapture reports a failed /get, as a placeholder PNG when the caller
+// asked for on_error=image so <img> embeds still have something to show.
+func failCapture(writer http.ResponseWriter, r *http.Request, err error) {
+	ce, ok := err.(*captureError)
+	if !ok || r.URL.Query().Get("on_error") != "image" {
+		writeCaptureError(writer, err)
+		return
+	}
+	width, height := parseDimensions(r)
+	data, err := errorImage(width, height, ce, r.URL.Query().Get("url"))
+	if err != nil {
+		log.Printf("Failed to render error image: %v", err)
+		writeCaptureError(writer, ce)
+		return
+	}
+	setCaptureErrorHeaders(writer, ce)
+	writer.Header().Set("Content-Type", "image/png")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(ce.status)
+	writer.Write(data)
+}
+
+// errorImage draws the template's lines, wrapped and centred, onto a
+// width x height PNG.
+func errorImage(width, height int, ce *captureError, url string) ([]byte, error) {
+	var text bytes.Buffer
+	err := errorImageTemplate.Execute(&text, struct {
+		Status     int
+		StatusText string
+		Message    string
+		URL        string
+	}{ce.status, http.StatusText(ce.status), ce.message, url})
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{errorImageBackground}, image.Point{}, draw.Src)
+
+	// Scale the text with the image, keeping a margin on either side
+	scale := max(1, min(width, height)/360)
+	margin := 8 * scale
+	type line struct {
+		text  string
+		scale int
+		color color.Color
+	}
+	var lines []line
+	for i, raw := range strings.Split(strings.TrimRight(text.String(), "\n"), "\n") {
+		l := line{scale: scale, color: errorImageText}
+		if i == 0 {
+			l.scale, l.color = scale*2, errorImageHeadline
+		}
+		perLine := max(1, (width-2*margin)/(glyphAdvance*l.scale))
+		chars := []rune(raw)
+		for len(chars) > perLine {
+			l.text = string(chars[:perLine])
+			lines = append(lines, l)
+			chars = chars[perLine:]
+		}
+		l.text = string(chars)
+		lines = append(lines, l)
+	}
+
+	total := 0
+	for _, l := range lines {
+		total += (glyphHeight + 4) * l.scale
+	}
+	y := max(margin, (height-total)/2)
+	for _, l := range lines {
+		if y+glyphHeight*l.scale > height {
+			break
+		}
+		drawText(img, (width-textWidth(l.text, l.scale))/2, y, l.text, l.scale, l.color)
+		y += (glyphHeight + 4) * l.scale
+	}
+
+	return pngBytes(&pngEncoder, img)
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Captures uploaded with store=local are kept in FILES_DIR under their
+// content hash, sharded by its first bytes (ab/cd/abcd….png) so no directory
+// grows huge, and served by /files/{id}: durable links without a cloud bucket.
+var fileStore dirStore
+
+var fileID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func init() {
+	fileStore = dirStore(envOr("FILES_DIR", "files"))
+}
+
+func fileKey(id string) string {
+	return id[:2] + "/" + id[2:4] + "/" + id + ".png"
+}
+
+// storeFile keeps data and returns its id; identical captures share a file.
+func storeFile(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:16])
+	if _, err := os.Stat(fileStore.path(fileKey(id))); err == nil {
+		return id, nil
+	}
+	return id, fileStore.Put(context.Background(), fileKey(id), data, "image/png")
+}
+
+// storeLocally is storeUpload's store=local.
+func storeLocally(body *uploadResponse, data []byte) error {
+	id, err := storeFile(data)
+	if err != nil {
+		log.Printf("Storing file: %v", err)
+		return &captureError{status: http.StatusInternalServerError, message: "Failed to store capture"}
+	}
+	body.Key = id
+	body.URL = publicURL + "/files/" + id
+	return nil
+}
+
+// HandleFile serves a stored file straight from disk. The id is the content
+// hash, so it is the ETag and the bytes behind a URL never change and may be
+// cached forever.
+func HandleFile(writer http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(r.PathValue("id"), ".png")
+	if !fileID.MatchString(id) {
+		http.Error(writer, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(fileStore.path(fileKey(id)))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(writer, "File not found", http.StatusNotFound)
+		return
+	}
+	var info fs.FileInfo
+	if err == nil {
+		defer f.Close()
+		info, err = f.Stat()
+	}
+	if err != nil {
+		log.Printf("Reading file %s: %v", id, err)
+		http.Error(writer, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "image/png")
+	writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	writer.Header().Set("ETag", `"`+id+`"`)
+	http.ServeContent(writer, r, "", info.ModTime(), f)
+}
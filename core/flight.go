@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces concurrent captures of the same cache key: the first
+// caller renders, later callers wait for its result instead of taking more
+// workers for identical output.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	res     *screenshotResult
+	err     error
+	waiters int // guarded by flightGroup.mu
+	cancel  context.CancelFunc
+}
+
+var (
+	captureFlights    = &flightGroup{calls: make(map[string]*flightCall)}
+	coalescedRequests int64
+	// Captures abandoned because every client waiting for them hung up
+	canceledRequests int64
+)
+
+// do runs fn once per key at a time. fn runs detached from any single
+// caller's cancellation so one client hanging up does not fail the others;
+// each caller stops waiting when its own ctx ends, and fn's ctx is canceled
+// once the last of them has, returning its worker to the pool.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (*screenshotResult, error)) (*screenshotResult, error) {
+	g.mu.Lock()
+	call, shared := g.calls[key]
+	if !shared {
+		fnCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go func() {
+			defer cancel()
+			call.res, call.err = fn(fnCtx)
+			g.mu.Lock()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	} else {
+		atomic.AddInt64(&coalescedRequests, 1)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		g.mu.Lock()
+		if call.waiters--; call.waiters == 0 {
+			// Nobody wants the result; a new caller starts over
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			call.cancel()
+			atomic.AddInt64(&canceledRequests, 1)
+		}
+		g.mu.Unlock()
+		return nil, captureCanceled()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	res := *call.res
+	return &res, nil
+}
+
+// captureCanceled is the error of a capture whose client went away.
+func captureCanceled() *captureError {
+	return &captureError{status: http.StatusInternalServerError, message: "Capture canceled"}
+}
@@ -0,0 +1,324 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsClient is a minimal Google Cloud Storage client using the XML API with
+// OAuth2 access tokens: those of the service account in GCS_CREDENTIALS_FILE
+// (or GOOGLE_APPLICATION_CREDENTIALS), else of the instance's account from
+// the metadata server on Google Cloud. Signed URLs need a service account key.
+type gcsClient struct {
+	endpoint *url.URL
+	bucket   string
+	auth     *gcsAuth
+	client   *http.Client
+}
+
+// gcsAuth mints and caches access tokens, shared by every gcsClient.
+type gcsAuth struct {
+	email    string
+	key      *rsa.PrivateKey // nil: tokens come from the metadata server
+	tokenURI string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+const (
+	gcsScope       = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+var (
+	gcsAuthOnce sync.Once
+	gcsAccount  *gcsAuth
+	gcsAuthErr  error
+)
+
+// gcsClientForBucket connects to bucket with the GCS_* endpoint and
+// credentials.
+func gcsClientForBucket(bucket string) (*gcsClient, error) {
+	gcsAuthOnce.Do(func() { gcsAccount, gcsAuthErr = loadGCSAuth() })
+	if gcsAuthErr != nil {
+		return nil, gcsAuthErr
+	}
+	endpoint := envOr("GCS_ENDPOINT", "https://storage.googleapis.com")
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	return &gcsClient{endpoint: u, bucket: bucket, auth: gcsAccount, client: &http.Client{Timeout: 60 * time.Second}}, nil
+}
+
+func loadGCSAuth() (*gcsAuth, error) {
+	path := envOr("GCS_CREDENTIALS_FILE", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	if path == "" {
+		return &gcsAuth{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("%s: not a service account key", path)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: invalid private_key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private_key is not an RSA key", path)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &gcsAuth{email: account.ClientEmail, key: key, tokenURI: account.TokenURI}, nil
+}
+
+// accessToken returns a token valid for at least another minute.
+func (a *gcsAuth) accessToken(ctx context.Context, client *http.Client) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > time.Minute {
+		return a.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if a.key != nil {
+		assertion, err := a.jwt(time.Now())
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, a.tokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("gcs token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return "", &blobError{service: "gcs token", status: resp.StatusCode, body: string(msg)}
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("gcs token: invalid response")
+	}
+	a.token = token.AccessToken
+	a.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return a.token, nil
+}
+
+// jwt is the self-signed assertion exchanged for an access token.
+func (a *gcsAuth) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   a.email,
+		"scope": gcsScope,
+		"aud":   a.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig, err := a.sign(unsigned)
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (a *gcsAuth) sign(data string) ([]byte, error) {
+	hash := sha256.Sum256([]byte(data))
+	return rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, hash[:])
+}
+
+func (c *gcsClient) String() string {
+	return c.endpoint.Host + "/" + c.bucket
+}
+
+func (c *gcsClient) ObjectURL(key string) string {
+	return c.objectURL(key).String()
+}
+
+func (c *gcsClient) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = awsURIEncode(u.Path, false)
+	return &u
+}
+
+func (c *gcsClient) Put(ctx context.Context, key string, data []byte, contentType string, meta map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.ObjectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range meta {
+		req.Header.Set("X-Goog-Meta-"+k, v)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *gcsClient) Get(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ObjectURL(key), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readObject(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, objectMeta(resp.Header, "x-goog-meta-"), nil
+}
+
+func (c *gcsClient) Head(ctx context.Context, key string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.ObjectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectMeta(resp.Header, "x-goog-meta-"), nil
+}
+
+func (c *gcsClient) List(ctx context.Context, prefix string) ([]string, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	return listBucketV2(ctx, u, prefix, c.do)
+}
+
+func (c *gcsClient) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.ObjectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		if isBlobStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Presign returns a V4 signed URL (GOOG4-RSA-SHA256), which needs the
+// service account's key; GCS accepts at most seven days.
+func (c *gcsClient) Presign(key string, expiry time.Duration) (string, error) {
+	if c.auth.key == nil {
+		return "", fmt.Errorf("gcs: signing URLs needs a service account key")
+	}
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+	u := c.objectURL(key)
+
+	q := url.Values{}
+	q.Set("X-Goog-Algorithm", "GOOG4-RSA-SHA256")
+	q.Set("X-Goog-Credential", c.auth.email+"/"+scope)
+	q.Set("X-Goog-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Goog-Expires", fmt.Sprint(int(expiry.Seconds())))
+	q.Set("X-Goog-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.RawPath,
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	sig, err := c.auth.sign("GOOG4-RSA-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:]))
+	if err != nil {
+		return "", err
+	}
+	q.Set("X-Goog-Signature", hex.EncodeToString(sig))
+	u.RawQuery = canonicalQuery(q)
+	return u.String(), nil
+}
+
+func (c *gcsClient) do(req *http.Request) (*http.Response, error) {
+	token, err := c.auth.accessToken(req.Context(), c.client)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, &blobError{service: "gcs", status: resp.StatusCode, body: string(msg)}
+	}
+	return resp, nil
+}
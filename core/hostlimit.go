@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Captures allowed to run against one host at a time
+	// (HOST_MAX_CONCURRENCY, 0 = unlimited), so bursts of captures of one
+	// small site neither overload it nor get webshot blocked.
+	hostConcurrency int
+
+	hostSlots     = make(map[string]*hostSlot)
+	hostSlotsLock sync.Mutex
+)
+
+type hostSlot struct {
+	sem   chan struct{}
+	users int // holders and waiters; the slot is dropped at zero
+}
+
+func init() {
+	hostConcurrency = envInt("HOST_MAX_CONCURRENCY", 4, 0, 10000)
+}
+
+// acquireHost waits up to timeout, or until ctx ends, for a capture slot on
+// rawURL's host. The returned release must be called once the capture is
+// done. Failing to get a slot is a 503 *captureError.
+func acquireHost(ctx context.Context, rawURL string, timeout time.Duration) (func(), error) {
+	u, err := url.Parse(rawURL)
+	if hostConcurrency == 0 || err != nil || u.Host == "" {
+		return func() {}, nil
+	}
+	host := strings.ToLower(u.Host)
+
+	hostSlotsLock.Lock()
+	slot, ok := hostSlots[host]
+	if !ok {
+		slot = &hostSlot{sem: make(chan struct{}, hostConcurrency)}
+		hostSlots[host] = slot
+	}
+	slot.users++
+	hostSlotsLock.Unlock()
+
+	leave := func() {
+		hostSlotsLock.Lock()
+		if slot.users--; slot.users == 0 {
+			delete(hostSlots, host)
+		}
+		hostSlotsLock.Unlock()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case slot.sem <- struct{}{}:
+		return func() {
+			<-slot.sem
+			leave()
+		}, nil
+	case <-timer.C:
+		leave()
+		return nil, &captureError{status: http.StatusServiceUnavailable, message: "Too many concurrent captures of " + host + ", please retry later"}
+	case <-ctx.Done():
+		leave()
+		return nil, captureCanceled()
+	case <-shutdownChan:
+		leave()
+		return nil, &captureError{status: http.StatusServiceUnavailable, message: "Server busy, please retry later"}
+	}
+}
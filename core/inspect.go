@@ -0,0 +1,188 @@
+package core
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/inspector"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// workerFor waits for a pooled worker for opts, or until ctx ends. Errors
+// are *captureError.
+func workerFor(ctx context.Context, opts captureOptions, timeout time.Duration) (*chromeWorker, error) {
+	worker, err := getWorker(ctx, opts.priority, opts.client, timeout)
+	if err != nil && ctx.Err() != nil {
+		return nil, captureCanceled()
+	}
+	if err != nil {
+		log.Printf("Failed to get worker for %s: %v", opts.url, err)
+		atomic.AddInt64(&failedRequests, 1)
+		if ce, ok := err.(*captureError); ok {
+			return nil, ce // queue full
+		}
+		atomic.AddInt64(&timeoutRequests, 1)
+		return nil, &captureError{status: http.StatusServiceUnavailable, message: "Server busy, please retry later"}
+	}
+	return worker, nil
+}
+
+// openTab opens a tab for opts on worker with everything a page load needs
+// wired up: the proxy, credential injection, session profile, the URL
+// policy on later navigations and iframes, crash detection and egress
+// metering. ctx is tabCtx bounded by timeout and ended early when parent (the
+// request) is, or with a *captureError cause when a navigation breaks the
+// policy; cancel closes the tab. Callers hold worker.mu.
+func openTab(parent context.Context, worker *chromeWorker, opts captureOptions, timeout time.Duration, meter *egressMeter) (tabCtx, ctx context.Context, cancel func(), err error) {
+	tabCtx, tabCancel, err := worker.newTab(opts.proxyURL, opts.isolated)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, timeoutCancel := context.WithTimeout(withTimingOf(tabCtx, parent), timeout)
+	ctx, block := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(parent, timeoutCancel)
+	cancel = func() {
+		stop()
+		block(nil)
+		timeoutCancel()
+		tabCancel()
+	}
+
+	// A crashed tab never finishes loading; fail now rather than at the
+	// deadline (see transientRenderError)
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if _, ok := ev.(*inspector.EventTargetCrashed); ok {
+			timeoutCancel()
+		}
+	})
+
+	// Account downloaded bytes against the tenant's egress budget and abort
+	// the capture once it is spent
+	if meter != nil {
+		chromedp.ListenTarget(ctx, func(ev interface{}) {
+			if e, ok := ev.(*network.EventLoadingFinished); ok && !meter.add(int64(e.EncodedDataLength)) {
+				timeoutCancel()
+			}
+		})
+	}
+
+	var intercept requestInterceptor
+	if opts.credential != nil {
+		if err := chromedp.Run(ctx, injectCredential(opts.credential, opts.url, &intercept)); err != nil {
+			cancel()
+			return nil, nil, nil, err
+		}
+	}
+	if opts.proxyURL != nil && opts.proxyURL.Scheme != "socks5" {
+		intercept.proxyAuth = opts.proxyURL.User
+	}
+	if intercept.policy = navigationPolicy(parent); intercept.policy != nil {
+		intercept.frame = cdp.FrameID(chromedp.FromContext(ctx).Target.TargetID)
+		intercept.blocked = block
+	}
+	if intercept.active() {
+		if err := chromedp.Run(ctx, intercept.enable()); err != nil {
+			cancel()
+			return nil, nil, nil, err
+		}
+	}
+	if opts.session != nil {
+		if err := chromedp.Run(ctx, opts.session.restore()); err != nil {
+			cancel()
+			return nil, nil, nil, err
+		}
+		closeTab := cancel
+		cancel = func() {
+			opts.session.update(tabCtx)
+			closeTab()
+		}
+	}
+	return tabCtx, ctx, cancel, nil
+}
+
+// inspectPage loads opts.url on a pooled worker the way a capture does and
+// runs extract on the settled page, for endpoints that return data about a
+// page rather than an image. setup, if not nil, runs before navigation, e.g.
+// to enable domains or listen for events. Nothing is cached. Errors are
+// *captureError.
+func inspectPage(ctx context.Context, opts captureOptions, setup, extract chromedp.Action) error {
+	if err := checkTargetURL(opts.url); err != nil {
+		return err
+	}
+	if err := checkTenantURL(ctx, opts.url); err != nil {
+		return err
+	}
+	meter := newEgressMeter(ctx)
+	if over, wait := meter.over(); over {
+		return &captureError{status: http.StatusTooManyRequests, message: "Egress budget exhausted, please retry later", retryAfter: wait}
+	}
+
+	queued := time.Now()
+	release, err := acquireHost(ctx, opts.url, defaults.workerTimeout)
+	if err != nil {
+		atomic.AddInt64(&failedRequests, 1)
+		return err
+	}
+	defer release()
+
+	worker, err := workerFor(ctx, opts, defaults.workerTimeout)
+	if err != nil {
+		return err
+	}
+	timingFrom(ctx).since("queue", queued)
+	err = func() error {
+		worker.mu.Lock()
+		defer worker.mu.Unlock()
+		_, tabCtx, cancel, err := openTab(ctx, worker, opts, defaults.timeout, meter)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		if setup == nil {
+			setup = chromedp.Tasks{}
+		}
+		err = chromedp.Run(tabCtx,
+			prepareTab(opts),
+			setup,
+			chromedp.Navigate(opts.url),
+			chromedp.WaitReady("body", chromedp.ByQuery),
+			chromedp.Sleep(defaults.settleDelay),
+			extract,
+		)
+		if ce, ok := context.Cause(tabCtx).(*captureError); ok && err != nil {
+			err = ce
+		}
+		opts.pooledProxy.record(err)
+		return err
+	}()
+	if err != nil && ctx.Err() == nil && transientRenderError(worker, err) {
+		worker.broken.Store(true)
+	}
+	releaseWorker(worker)
+
+	if err != nil && ctx.Err() != nil {
+		return captureCanceled()
+	}
+	if err != nil {
+		log.Printf("Error inspecting %s: %v", opts.url, err)
+		atomic.AddInt64(&failedRequests, 1)
+		if ce, ok := err.(*captureError); ok {
+			return ce
+		}
+		switch {
+		case meter != nil && meter.exhausted.Load():
+			return &captureError{status: http.StatusTooManyRequests, message: "Egress budget exhausted during capture"}
+		case err == context.DeadlineExceeded:
+			atomic.AddInt64(&timeoutRequests, 1)
+			return &captureError{status: http.StatusRequestTimeout, message: "Timeout - page took too long to load"}
+		}
+		return &captureError{status: http.StatusInternalServerError, message: "Error loading page"}
+	}
+	recordUsage(ctx, 1, 0)
+	return nil
+}
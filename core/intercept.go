@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// requestInterceptor pauses a tab's requests in the Fetch domain to add a
+// credential header to matching requests, to answer proxy authentication
+// challenges and to hold every document, frames and redirects included, to
+// the URL policy. A tab has a single Fetch configuration, so everything that needs
+// interception goes through one interceptor.
+type requestInterceptor struct {
+	header string // added to requests accepted by match
+	value  string
+	match  func(url string) bool
+
+	proxyAuth *url.Userinfo // answers challenges from the capture's proxy
+
+	// policy checks every document the tab loads and fails the ones it
+	// rejects before they are sent. A rejected document in frame, the main
+	// frame, fails the capture: its error is passed to blocked
+	frame   cdp.FrameID
+	policy  func(url string) error
+	blocked context.CancelCauseFunc
+}
+
+func (ri *requestInterceptor) active() bool {
+	return ri.header != "" || ri.proxyAuth != nil || ri.policy != nil
+}
+
+func (ri *requestInterceptor) enable() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		execCtx := cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Target)
+		var challenged sync.Map // requests already given the proxy credentials
+		chromedp.ListenTarget(ctx, func(ev interface{}) {
+			switch e := ev.(type) {
+			case *fetch.EventRequestPaused:
+				go ri.continueRequest(execCtx, e)
+			case *fetch.EventAuthRequired:
+				_, retry := challenged.LoadOrStore(e.RequestID, true)
+				go ri.answerChallenge(execCtx, e, retry)
+			}
+		})
+		// Only documents need pausing when only the policy is enforced
+		pattern := &fetch.RequestPattern{URLPattern: "*", RequestStage: fetch.RequestStageRequest}
+		if ri.header == "" && ri.proxyAuth == nil {
+			pattern.ResourceType = network.ResourceTypeDocument
+		}
+		return fetch.Enable().
+			WithPatterns([]*fetch.RequestPattern{pattern}).
+			WithHandleAuthRequests(ri.proxyAuth != nil).
+			Do(ctx)
+	})
+}
+
+func (ri *requestInterceptor) continueRequest(ctx context.Context, e *fetch.EventRequestPaused) {
+	if ri.policy != nil && e.ResourceType == network.ResourceTypeDocument {
+		if err := ri.policy(e.Request.URL); err != nil {
+			if err := fetch.FailRequest(e.RequestID, network.ErrorReasonBlockedByClient).Do(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to block request %s: %v", e.Request.URL, err)
+			}
+			// A blocked iframe leaves the rest of the page to capture
+			if e.FrameID == ri.frame {
+				ri.blocked(err)
+			}
+			return
+		}
+	}
+	cont := fetch.ContinueRequest(e.RequestID)
+	if ri.header != "" {
+		headers := make([]*fetch.HeaderEntry, 0, len(e.Request.Headers)+1)
+		for name, v := range e.Request.Headers {
+			if !strings.EqualFold(name, ri.header) {
+				headers = append(headers, &fetch.HeaderEntry{Name: name, Value: fmt.Sprint(v)})
+			}
+		}
+		if ri.match(e.Request.URL) {
+			headers = append(headers, &fetch.HeaderEntry{Name: ri.header, Value: ri.value})
+		}
+		cont = cont.WithHeaders(headers)
+	}
+	if err := cont.Do(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Failed to continue request %s: %v", e.Request.URL, err)
+	}
+}
+
+// answerChallenge provides the proxy credentials once per request; a second
+// challenge means they were rejected, so it is cancelled rather than retried
+// forever. Site challenges get Chrome's default handling.
+func (ri *requestInterceptor) answerChallenge(ctx context.Context, e *fetch.EventAuthRequired, retry bool) {
+	resp := &fetch.AuthChallengeResponse{Response: fetch.AuthChallengeResponseResponseDefault}
+	if e.AuthChallenge.Source == fetch.AuthChallengeSourceProxy && ri.proxyAuth != nil {
+		if retry {
+			resp.Response = fetch.AuthChallengeResponseResponseCancelAuth
+		} else {
+			password, _ := ri.proxyAuth.Password()
+			resp = &fetch.AuthChallengeResponse{
+				Response: fetch.AuthChallengeResponseResponseProvideCredentials,
+				Username: ri.proxyAuth.Username(),
+				Password: password,
+			}
+		}
+	}
+	if err := fetch.ContinueWithAuth(e.RequestID, resp).Do(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Failed to answer auth challenge for %s: %v", e.Request.URL, err)
+	}
+}
+
+// navigationPolicy returns the check every document a capture loads must
+// pass, nil if neither a global URL policy nor the tenant's allowed_domains
+// restrict them. The first URL has passed it already; this keeps a redirect,
+// script or iframe from bringing in a page from elsewhere.
+func navigationPolicy(ctx context.Context) func(url string) error {
+	if p := tenantProfileFor(ctx); len(urlAllowRules) == 0 && len(urlDenyRules) == 0 && (p == nil || len(p.domainRules) == 0) {
+		return nil
+	}
+	return func(target string) error {
+		err := checkTargetURL(target)
+		if err == nil {
+			err = checkTenantURL(ctx, target)
+		}
+		if ce, ok := err.(*captureError); ok {
+			return &captureError{status: ce.status, message: "Target navigated to a URL that is not allowed: " + ce.message}
+		}
+		return err
+	}
+}
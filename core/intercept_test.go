@@ -0,0 +1,44 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNavigationPolicy(t *testing.T) {
+	useTenant(t, "acme", &tenantProfile{AllowedDomains: []string{"acme.test"}})
+	acme := keyContext(&apiKey{Name: "ci", Tenant: "acme"})
+
+	allow, deny := urlAllowRules, urlDenyRules
+	defer func() { urlAllowRules, urlDenyRules = allow, deny }()
+	urlAllowRules, urlDenyRules = nil, nil
+
+	if navigationPolicy(context.Background()) != nil {
+		t.Error("policy installed with nothing to enforce")
+	}
+
+	policy := navigationPolicy(acme)
+	if policy == nil {
+		t.Fatal("tenant allowed_domains are not enforced")
+	}
+	if err := policy("https://acme.test/next"); err != nil {
+		t.Errorf("allowed navigation refused: %v", err)
+	}
+	err := policy("https://example.com/")
+	var ce *captureError
+	if !errors.As(err, &ce) || ce.status != http.StatusForbidden || !strings.HasPrefix(ce.message, "Target navigated to a URL that is not allowed") {
+		t.Errorf("navigation elsewhere: %v", err)
+	}
+
+	urlDenyRules, _ = parseURLRules("169.254.169.254")
+	policy = navigationPolicy(context.Background())
+	if policy == nil {
+		t.Fatal("URL_DENYLIST is not enforced")
+	}
+	if err := policy("http://169.254.169.254/latest/meta-data/"); err == nil {
+		t.Error("denied navigation allowed")
+	}
+}
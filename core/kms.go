@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// kmsDecrypt unwraps a data key encrypted by AWS KMS, e.g. the
+// CiphertextBlob of `aws kms generate-data-key --key-spec AES_256`, with the
+// AWS_* credentials. KMS_ENDPOINT overrides the regional endpoint.
+func kmsDecrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	region := envOr("AWS_REGION", envOr("AWS_DEFAULT_REGION", "us-east-1"))
+	endpoint := envOr("KMS_ENDPOINT", fmt.Sprintf("https://kms.%s.amazonaws.com", region))
+	signer := sigV4{
+		service:      "kms",
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if signer.accessKey == "" || signer.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+
+	body, _ := json.Marshal(map[string]string{"CiphertextBlob": base64.StdEncoding.EncodeToString(blob)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	signer.sign(req, body)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, &blobError{service: "kms", status: resp.StatusCode, body: string(msg)}
+	}
+	var res struct {
+		Plaintext []byte `json:"Plaintext"` // base64 in JSON
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || len(res.Plaintext) == 0 {
+		return nil, fmt.Errorf("kms: invalid Decrypt response")
+	}
+	return res.Plaintext, nil
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/chromedp/chromedp"
+)
+
+// pageMeta is what /meta reports about a rendered page.
+type pageMeta struct {
+	URL         string            `json:"url"` // after redirects
+	Title       string            `json:"title"`
+	Description string            `json:"description"`
+	Canonical   string            `json:"canonical,omitempty"`
+	OpenGraph   map[string]string `json:"open_graph"`
+	Twitter     map[string]string `json:"twitter"`
+	Favicon     string            `json:"favicon"`
+}
+
+// metaScript reads pageMeta from the live DOM, so tags added by scripts are
+// seen too. URLs are resolved against the document; the first of repeated
+// tags wins.
+const metaScript = `(() => {
+	const abs = u => { try { return u ? new URL(u, document.baseURI).href : ""; } catch (e) { return ""; } };
+	const attr = (sel, name) => { const el = document.querySelector(sel); return (el && el.getAttribute(name)) || ""; };
+	const tags = prefix => {
+		const out = {};
+		for (const m of document.querySelectorAll("meta[property^='" + prefix + ":'], meta[name^='" + prefix + ":']")) {
+			const key = (m.getAttribute("property") || m.getAttribute("name")).slice(prefix.length + 1);
+			if (key && !(key in out)) out[key] = m.getAttribute("content") || "";
+		}
+		return out;
+	};
+	return {
+		url: location.href,
+		title: document.title,
+		description: attr("meta[name='description' i]", "content"),
+		canonical: abs(attr("link[rel~='canonical' i]", "href")),
+		open_graph: tags("og"),
+		twitter: tags("twitter"),
+		favicon: abs(attr("link[rel~='icon' i]", "href")) || (location.origin + "/favicon.ico"),
+	};
+})()`
+
+// HandleMeta loads a page like a capture would and returns its title,
+// description, canonical URL, OpenGraph and Twitter card tags and favicon.
+func HandleMeta(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "meta") {
+		return
+	}
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	var meta pageMeta
+	if err := inspectPage(r.Context(), opts, nil, chromedp.Evaluate(metaScript, &meta)); err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(meta)
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// moderator scores a captured image. Implementations either call an external
+// API or shell out to a local model; higher scores mean more likely unsafe.
+type moderator interface {
+	Score(ctx context.Context, img []byte) (moderationResult, error)
+}
+
+type moderationResult struct {
+	Score  float64  `json:"score"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+var (
+	// Moderation stage (disabled unless MODERATION_URL or MODERATION_COMMAND is set)
+	captureModerator    moderator
+	moderationAction    string
+	moderationThreshold float64
+	moderationFailOpen  bool
+	quarantineDir       string
+)
+
+func init() {
+	moderationAction = "tag"
+	if a := os.Getenv("MODERATION_ACTION"); a == "quarantine" || a == "refuse" {
+		moderationAction = a
+	}
+
+	moderationThreshold = 0.8
+	if t := os.Getenv("MODERATION_THRESHOLD"); t != "" {
+		if val, err := strconv.ParseFloat(t, 64); err == nil && val >= 0 && val <= 1 {
+			moderationThreshold = val
+		}
+	}
+
+	moderationFailOpen = os.Getenv("MODERATION_FAIL_OPEN") == "true"
+
+	quarantineDir = filepath.Join(os.TempDir(), "webshot-quarantine")
+	if qd := os.Getenv("MODERATION_QUARANTINE_DIR"); qd != "" {
+		quarantineDir = qd
+	}
+
+	if u := os.Getenv("MODERATION_URL"); u != "" {
+		captureModerator = &httpModerator{
+			endpoint: u,
+			apiKey:   os.Getenv("MODERATION_API_KEY"),
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}
+	} else if c := os.Getenv("MODERATION_COMMAND"); c != "" {
+		captureModerator = &commandModerator{args: strings.Fields(c)}
+	}
+
+	if captureModerator != nil {
+		log.Printf("webshot moderation enabled: action=%s threshold=%.2f", moderationAction, moderationThreshold)
+	}
+}
+
+// httpModerator POSTs the raw image to an external scoring API which must
+// answer with {"score": <0..1>, "labels": [...]}.
+type httpModerator struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+func (m *httpModerator) Score(ctx context.Context, img []byte) (moderationResult, error) {
+	var res moderationResult
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(img))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(img))
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("moderation API returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// commandModerator runs a local model: the image is written to stdin and the
+// command prints the same JSON document as the HTTP API on stdout.
+type commandModerator struct {
+	args []string
+}
+
+func (m *commandModerator) Score(ctx context.Context, img []byte) (moderationResult, error) {
+	var res moderationResult
+
+	cmd := exec.CommandContext(ctx, m.args[0], m.args[1:]...)
+	cmd.Stdin = bytes.NewReader(img)
+	out, err := cmd.Output()
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(out, &res)
+	return res, err
+}
+
+// moderateCapture scores buf when a moderator is configured. A nil result
+// means moderation is disabled.
+func moderateCapture(ctx context.Context, buf []byte) (*moderationResult, error) {
+	if captureModerator == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	res, err := captureModerator.Score(ctx, buf)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (m *moderationResult) flagged() bool {
+	return m != nil && m.Score >= moderationThreshold
+}
+
+// setModerationHeaders tags a response with the moderation verdict.
+func setModerationHeaders(writer http.ResponseWriter, m *moderationResult) {
+	if m == nil {
+		return
+	}
+	writer.Header().Set("X-Moderation-Score", strconv.FormatFloat(m.Score, 'f', 3, 64))
+	writer.Header().Set("X-Moderation-Flagged", strconv.FormatBool(m.flagged()))
+	if len(m.Labels) > 0 {
+		writer.Header().Set("X-Moderation-Labels", strings.Join(m.Labels, ","))
+	}
+}
+
+// quarantineCapture stores a flagged image and its verdict on disk for human
+// review instead of serving or caching it.
+func quarantineCapture(id, url string, buf []byte, m *moderationResult) error {
+	if err := os.MkdirAll(quarantineDir, 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(quarantineDir, id+".img"), buf, 0o600); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(map[string]interface{}{
+		"url":       url,
+		"score":     m.Score,
+		"labels":    m.Labels,
+		"timestamp": time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(quarantineDir, id+".json"), meta, 0o600)
+}
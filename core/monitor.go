@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// monitorConfig turns a schedule into a change monitor: every run is diffed
+// against the previous successful one, and when more than Threshold percent
+// of pixels differ an alert is POSTed to Webhook (JSON) and/or Slack (an
+// incoming-webhook URL).
+type monitorConfig struct {
+	Threshold float64 `json:"threshold"`
+	Webhook   string  `json:"webhook,omitempty"`
+	Slack     string  `json:"slack,omitempty"`
+}
+
+// monitorAlert is the JSON body sent to webhooks.
+type monitorAlert struct {
+	Event       string    `json:"event"`
+	Schedule    string    `json:"schedule"`
+	URL         string    `json:"url"`
+	Run         string    `json:"run"`
+	Previous    string    `json:"previous"`
+	DiffPercent float64   `json:"diff_percent"`
+	Threshold   float64   `json:"threshold"`
+	Image       string    `json:"image"`
+	Diff        string    `json:"diff"`
+	DetectedAt  time.Time `json:"detected_at"`
+}
+
+var (
+	// Base URL for links in alerts (PUBLIC_URL), e.g. https://shots.example.com;
+	// links are relative without it
+	publicURL   string
+	alertClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	publicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+}
+
+func (m *monitorConfig) UnmarshalJSON(data []byte) error {
+	type plain monitorConfig
+	p := plain{Threshold: 0.1}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*m = monitorConfig(p)
+	return nil
+}
+
+func (m *monitorConfig) compile() error {
+	if m.Threshold < 0 || m.Threshold > 100 {
+		return fmt.Errorf("monitor threshold must be a percentage between 0 and 100")
+	}
+	if m.Webhook == "" && m.Slack == "" {
+		return fmt.Errorf("monitor needs a webhook or slack URL")
+	}
+	for _, target := range []string{m.Webhook, m.Slack} {
+		if target == "" {
+			continue
+		}
+		if err := checkTargetURL(target); err != nil {
+			return fmt.Errorf("alert URL %q: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// compareRun diffs a successful run against the previous one with an image,
+// stores the diff and alerts when the change exceeds the threshold.
+func (s *schedule) compareRun(run *scheduleRun, data []byte) {
+	schedulesLock.Lock()
+	var previous *scheduleRun
+	for _, r := range s.History {
+		if r.Image != "" {
+			previous = r
+			break
+		}
+	}
+	schedulesLock.Unlock()
+	if previous == nil {
+		return // the first capture is the reference
+	}
+
+	ctx := context.Background()
+	before, err := scheduleImages.Get(ctx, s.imageKey(previous.ID))
+	if err != nil {
+		log.Printf("Monitor %s: loading previous capture: %v", s.ID, err)
+		return
+	}
+	beforeImg, _, err := image.Decode(bytes.NewReader(before))
+	if err != nil {
+		log.Printf("Monitor %s: decoding previous capture: %v", s.ID, err)
+		return
+	}
+	afterImg, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Monitor %s: decoding capture: %v", s.ID, err)
+		return
+	}
+	diff, percent := diffImages(beforeImg, afterImg)
+	run.DiffPercent = &percent
+	run.Changed = percent > s.Monitor.Threshold
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := encodePNG(buf, diff); err == nil {
+		if err := scheduleImages.Put(ctx, s.imageKey(run.ID+".diff"), buf.Bytes(), "image/png"); err == nil {
+			run.Diff = run.Image + "/diff"
+		} else {
+			log.Printf("Monitor %s: storing diff: %v", s.ID, err)
+		}
+	}
+
+	if run.Changed {
+		log.Printf("Monitor %s: %s changed by %.2f%% (threshold %.2f%%)", s.ID, s.URL, percent, s.Monitor.Threshold)
+		alert := monitorAlert{
+			Event:       "change_detected",
+			Schedule:    s.ID,
+			URL:         s.URL,
+			Run:         run.ID,
+			Previous:    previous.ID,
+			DiffPercent: percent,
+			Threshold:   s.Monitor.Threshold,
+			Image:       publicURL + run.Image,
+			Diff:        publicURL + run.Diff,
+			DetectedAt:  time.Now().UTC(),
+		}
+		if err := s.Monitor.send(alert); err != nil {
+			run.AlertError = err.Error()
+			log.Printf("Monitor %s: sending alert: %v", s.ID, err)
+		}
+	}
+}
+
+// send delivers alert to every configured destination.
+func (m *monitorConfig) send(alert monitorAlert) error {
+	var errs []string
+	if m.Webhook != "" {
+		body, _ := json.Marshal(alert)
+		if err := postAlert(m.Webhook, body); err != nil {
+			errs = append(errs, "webhook: "+err.Error())
+		}
+	}
+	if m.Slack != "" {
+		text := fmt.Sprintf(":warning: Visual change detected on %s: %.2f%% of pixels changed (threshold %.2f%%)",
+			alert.URL, alert.DiffPercent, alert.Threshold)
+		if publicURL != "" {
+			text += fmt.Sprintf("\n<%s|Capture> · <%s|Diff>", alert.Image, alert.Diff)
+		}
+		body, _ := json.Marshal(map[string]string{"text": text})
+		if err := postAlert(m.Slack, body); err != nil {
+			errs = append(errs, "slack: "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func postAlert(target string, body []byte) error {
+	resp, err := alertClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// failedCapture is a remembered capture failure for one cache key.
+type failedCapture struct {
+	url     string
+	err     captureError
+	expires time.Time
+}
+
+var (
+	// Failed captures (timeouts, unreachable targets) are answered from here
+	// for NEGATIVE_CACHE_SECONDS instead of tying up a worker again
+	negativeCache    sync.Map // cache key -> *failedCapture
+	negativeCacheTTL time.Duration
+)
+
+func init() {
+	negativeCacheTTL = time.Duration(envInt("NEGATIVE_CACHE_SECONDS", 30, 0, 3600)) * time.Second
+}
+
+// rememberFailure stores err for key; only failures of the target itself are
+// worth remembering, not busy workers, quotas or moderation outcomes.
+func rememberFailure(key, url string, err *captureError) {
+	if negativeCacheTTL == 0 {
+		return
+	}
+	negativeCache.Store(key, &failedCapture{url: url, err: *err, expires: time.Now().Add(negativeCacheTTL)})
+}
+
+// cachedFailure returns a copy of the remembered failure for key, if fresh.
+func cachedFailure(key string) (*captureError, bool) {
+	value, ok := negativeCache.Load(key)
+	if !ok {
+		return nil, false
+	}
+	f := value.(*failedCapture)
+	if time.Now().After(f.expires) {
+		negativeCache.CompareAndDelete(key, value)
+		return nil, false
+	}
+	err := f.err
+	err.cached = true
+	err.retryAfter = time.Until(f.expires)
+	return &err, true
+}
+
+func sweepFailures() {
+	now := time.Now()
+	negativeCache.Range(func(key, value interface{}) bool {
+		if now.After(value.(*failedCapture).expires) {
+			negativeCache.Delete(key)
+		}
+		return true
+	})
+}
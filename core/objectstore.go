@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// objectStore keeps named blobs that must outlive the capture cache, such as
+// baselines: in a local directory or under a prefix of the S3_*, GCS_* or
+// AZURE_* bucket.
+type objectStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns errObjectNotFound for missing keys
+	Get(ctx context.Context, key string) ([]byte, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var errObjectNotFound = errors.New("object not found")
+
+// openObjectStore opens a "dir" store rooted at dir or an "s3", "gcs" or
+// "azure" store under prefix.
+func openObjectStore(kind, dir, prefix string) (objectStore, error) {
+	if kind == "dir" {
+		return dirStore(dir), nil
+	}
+	client, err := openBlobClient(kind, "")
+	if err != nil {
+		return nil, err
+	}
+	return &bucketStore{client: client, prefix: prefix}, nil
+}
+
+// dirStore keeps each object in a file under the directory, created on the
+// first Put; keys use "/" as separator.
+type dirStore string
+
+func (d dirStore) path(key string) string {
+	return filepath.Join(string(d), filepath.FromSlash(key))
+}
+
+func (d dirStore) Put(_ context.Context, key string, data []byte, _ string) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write then rename so readers never see a partial object
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d dirStore) Get(_ context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	return data, err
+}
+
+func (d dirStore) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(string(d), func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == string(d) {
+			return fs.SkipAll // nothing stored yet
+		}
+		if err != nil || entry.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (d dirStore) Delete(_ context.Context, key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+type bucketStore struct {
+	client blobClient
+	prefix string
+}
+
+func (s *bucketStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.client.Put(ctx, s.prefix+key, data, contentType, nil)
+}
+
+func (s *bucketStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := s.client.Get(ctx, s.prefix+key)
+	if isBlobStatus(err, http.StatusNotFound) {
+		return nil, errObjectNotFound
+	}
+	return data, err
+}
+
+func (s *bucketStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.client.List(ctx, s.prefix+prefix)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.prefix)
+	}
+	return keys, err
+}
+
+func (s *bucketStore) Delete(ctx context.Context, key string) error {
+	return s.client.Delete(ctx, s.prefix+key)
+}
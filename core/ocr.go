@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// textRecognizer extracts the text shown in a captured image, like moderator
+// either through an external API or a local command.
+type textRecognizer interface {
+	Recognize(ctx context.Context, img []byte) (string, error)
+}
+
+var (
+	// OCR stage (disabled unless OCR_URL or OCR_COMMAND is set)
+	captureRecognizer textRecognizer
+
+	// Recognized text by capture id, kept for the cache duration
+	captureTexts sync.Map // map[string]*recognizedText
+)
+
+type recognizedText struct {
+	text    string
+	sum     [sha256.Size]byte // of the image, which a refresh may replace
+	created time.Time
+}
+
+func init() {
+	if u := os.Getenv("OCR_URL"); u != "" {
+		captureRecognizer = &httpRecognizer{
+			endpoint: u,
+			apiKey:   os.Getenv("OCR_API_KEY"),
+			client:   &http.Client{Timeout: 30 * time.Second},
+		}
+	} else if c := os.Getenv("OCR_COMMAND"); c != "" {
+		captureRecognizer = &commandRecognizer{args: strings.Fields(c)}
+	}
+	if captureRecognizer != nil {
+		log.Printf("webshot OCR enabled")
+	}
+}
+
+// httpRecognizer POSTs the raw image to an OCR API which must answer with
+// {"text": "..."}.
+type httpRecognizer struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+func (o *httpRecognizer) Recognize(ctx context.Context, img []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(img))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(img))
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OCR API returned %s", resp.Status)
+	}
+	var res struct {
+		Text string `json:"text"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res.Text, err
+}
+
+// commandRecognizer runs a local engine such as "tesseract stdin stdout": the
+// image is written to stdin and the text read from stdout.
+type commandRecognizer struct {
+	args []string
+}
+
+func (o *commandRecognizer) Recognize(ctx context.Context, img []byte) (string, error) {
+	cmd := exec.CommandContext(ctx, o.args[0], o.args[1:]...)
+	cmd.Stdin = bytes.NewReader(img)
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// captureText returns the text in img, capture id, recognizing it unless it
+// was already for the same image. Errors are *captureError.
+func captureText(ctx context.Context, id string, img []byte) (string, error) {
+	if captureRecognizer == nil {
+		return "", &captureError{status: http.StatusNotImplemented, message: "OCR is not configured"}
+	}
+	sweepCaptureTexts()
+	sum := sha256.Sum256(img)
+	if v, ok := captureTexts.Load(id); ok && v.(*recognizedText).sum == sum {
+		return v.(*recognizedText).text, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	text, err := captureRecognizer.Recognize(ctx, img)
+	if err != nil {
+		log.Printf("OCR failed for capture %s: %v", id, err)
+		return "", &captureError{status: http.StatusBadGateway, message: "Text recognition failed"}
+	}
+	captureTexts.Store(id, &recognizedText{text: text, sum: sum, created: time.Now()})
+	return text, nil
+}
+
+func sweepCaptureTexts() {
+	captureTexts.Range(func(key, value interface{}) bool {
+		if time.Since(value.(*recognizedText).created) > defaults.cacheTTL {
+			captureTexts.Delete(key)
+		}
+		return true
+	})
+}
+
+// HandleCaptureText returns the text recognized in a capture as
+// {"id": ..., "text": ...}: recognized by /get?ocr=true, or now from the
+// stored capture.
+func HandleCaptureText(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "ocr") {
+		return
+	}
+	id := r.PathValue("id")
+	var text string
+	if entry, ok := screenCache.get(id); ok {
+		var err error
+		if text, err = captureText(r.Context(), id, entry.data); err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+	} else if v, ok := captureTexts.Load(id); ok {
+		text = v.(*recognizedText).text // capture was not cached
+	} else {
+		http.Error(writer, "Capture not found or expired", http.StatusNotFound)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]string{"id": id, "text": text})
+}
@@ -0,0 +1,471 @@
+package core
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezone= validation must not depend on the host's zoneinfo
+)
+
+// captureOptions describes one capture. Every field carries a `key` tag:
+// fields that change the rendered output name their part of the cache key,
+// fields that do not are tagged "-". getCacheKey is built from the tags, so a
+// new option cannot silently share cache entries with its other variants;
+// init refuses to start if a field is left untagged.
+type captureOptions struct {
+	url     string `key:"url"`
+	width   int    `key:"w"`
+	height  int    `key:"h"`
+	quality int    `key:"q"`
+
+	// preferSpeed captures the viewport at first meaningful paint instead of
+	// waiting for the full page; budget caps how long to wait for that paint.
+	preferSpeed bool          `key:"fast"`
+	budget      time.Duration `key:"budget"`
+
+	// translateTo machine-translates the page's text before capture
+	translateTo string `key:"tr"`
+
+	// dismissConsent clicks away or hides cookie-consent banners before capture
+	dismissConsent bool `key:"consent"`
+
+	// media is the CSS media type to emulate, "print" or "" for screen
+	media string `key:"media"`
+
+	// Media features to emulate for accessibility review:
+	// prefers-reduced-motion: reduce and forced-colors: active
+	reducedMotion bool `key:"motion"`
+	forcedColors  bool `key:"forced"`
+
+	// vision simulates a colour vision deficiency (see visionDeficiencies)
+	vision string `key:"vision"`
+
+	// timezone is the IANA zone the page sees, e.g. Europe/Berlin
+	timezone string `key:"tz"`
+
+	// lang is the language the page sees (Accept-Language, navigator and
+	// Intl locale), e.g. de-DE
+	lang string `key:"lang"`
+
+	// geo is the position the Geolocation API reports, as normalised
+	// "lat,lon,accuracy"; geoPoint holds it parsed
+	geo      string    `key:"geo"`
+	geoPoint *geoPoint `key:"-"`
+
+	// maxRedirects (a number, "" for no limit) and sameSite fail the capture
+	// when the page redirects more often or to another host. They are keyed
+	// because a capture taken without them may have done either.
+	maxRedirects string `key:"redirects"`
+	sameSite     bool   `key:"onsite"`
+
+	// failOnStatus lists target statuses (404) and classes (5xx) that fail
+	// the capture instead of returning a picture of the error page
+	failOnStatus []string `key:"-"`
+
+	// resize is the box ("WxH", 0 for no limit) the image is scaled down to
+	// fit, keeping its aspect ratio, before it is cached
+	resize string `key:"resize"`
+
+	// crop is cut from the (cached) image when serving it, so every crop of
+	// a page shares one capture
+	crop image.Rectangle `key:"-"`
+
+	// watermark is the caller's tenant watermark, drawn before caching;
+	// watermarkID names its configuration so tenants never share captures
+	watermark   *watermark `key:"-"`
+	watermarkID string     `key:"wm"`
+
+	// optimize recompresses the image losslessly before caching (optimizePNG)
+	optimize bool `key:"opt"`
+
+	// background is the colour (#rrggbb) behind pages that set none
+	background string `key:"bg"`
+
+	// noScript renders the page with JavaScript disabled (js=false)
+	noScript bool `key:"nojs"`
+
+	// isolated renders in a fresh incognito browser context. It is keyed so
+	// isolated captures never reuse one that could have seen state left by
+	// another capture.
+	isolated bool `key:"iso"`
+
+	// session is the caller's session profile (profile=), restored into the
+	// capture's isolated context and updated from it; profile names it
+	// (owner/name) so captures of different sessions are never shared.
+	session *sessionProfile `key:"-"`
+	profile string          `key:"profile"`
+
+	// credential is the caller's registered OAuth credential for url, if any;
+	// auth names it (owner/name) so authenticated captures are never shared.
+	credential *oauthCredential `key:"-"`
+	auth       string           `key:"auth"`
+
+	// Cache policy for this request: refresh skips the lookup (a fresh
+	// capture replaces the entry), noStore also keeps the result out of the
+	// cache, and ttl overrides the tenant's freshness when non-zero.
+	refresh bool          `key:"-"`
+	noStore bool          `key:"-"`
+	ttl     time.Duration `key:"-"`
+
+	// bypassBrowserCache disables Chrome's HTTP cache for this capture; it
+	// changes what is downloaded, not what is rendered.
+	bypassBrowserCache bool `key:"-"`
+
+	// partial returns what is rendered at the deadline instead of failing;
+	// such captures are never cached, so the key is unaffected.
+	partial bool `key:"-"`
+
+	// console, requests, tls and redirects collect console messages and
+	// uncaught exceptions, the requests the page made, the site's TLS
+	// connection and certificates and the redirect chain in the capture's
+	// pageReport. Reports only come from fresh captures.
+	console   bool `key:"-"`
+	requests  bool `key:"-"`
+	tls       bool `key:"-"`
+	redirects bool `key:"-"`
+
+	// proxy routes the capture through proxyURL; it names the proxy (see
+	// resolveProxy) or pool since the egress location can change the page.
+	// pooledProxy is set when proxyURL was picked from a pool.
+	proxy       string       `key:"proxy"`
+	proxyURL    *url.URL     `key:"-"`
+	pooledProxy *pooledProxy `key:"-"`
+
+	// priority and client (see clientID) place this capture in the worker
+	// queue
+	priority capturePriority `key:"-"`
+	client   string          `key:"-"`
+}
+
+func init() {
+	t := reflect.TypeOf(captureOptions{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("key")
+		if !ok || tag == "" {
+			log.Fatalf("captureOptions.%s has no cache key tag", f.Name)
+		}
+		switch f.Type.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		default:
+			if tag != "-" {
+				log.Fatalf("captureOptions.%s: %s fields cannot be part of the cache key", f.Name, f.Type)
+			}
+		}
+	}
+}
+
+// newCaptureOptions returns the options for a plain capture of url with the
+// service defaults and the caller's credential, if one matches.
+func newCaptureOptions(ctx context.Context, url string, width, height int) captureOptions {
+	opts := captureOptions{url: url, width: width, height: height, quality: defaults.quality, isolated: defaults.isolated, priority: keyPriority(ctx)}
+	if key := apiKeyFrom(ctx); key != nil {
+		opts.client = "key:" + key.Name
+	}
+	if opts.credential = credentialFor(ctx, url); opts.credential != nil {
+		opts.auth = opts.credential.owner + "/" + opts.credential.Name
+	}
+	if p := tenantProfileFor(ctx); p != nil && p.Watermark != nil {
+		opts.watermark, opts.watermarkID = p.Watermark, p.Watermark.id
+	}
+	return opts
+}
+
+// getCacheKey hashes every keyed option that is set. Zero values are left
+// out, so introducing an option does not invalidate existing entries.
+func getCacheKey(opts captureOptions) string {
+	var b strings.Builder
+	v := reflect.ValueOf(opts)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("key")
+		if tag == "-" || v.Field(i).IsZero() {
+			continue
+		}
+		f := v.Field(i)
+		var part string
+		switch f.Kind() {
+		case reflect.String:
+			part = f.String()
+		case reflect.Bool:
+			part = strconv.FormatBool(f.Bool())
+		default:
+			part = strconv.FormatInt(f.Int(), 10)
+		}
+		fmt.Fprintf(&b, "%s=%q;", tag, part)
+	}
+	hash := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(hash[:])
+}
+
+// parseGeo reads geo=lat,lon and geo_accuracy= (meters, default 100).
+func parseGeo(geo, accuracy string) (*geoPoint, error) {
+	p := &geoPoint{accuracy: 100}
+	lat, lon, ok := strings.Cut(geo, ",")
+	var err error
+	if ok {
+		if p.lat, err = strconv.ParseFloat(strings.TrimSpace(lat), 64); err == nil {
+			p.lon, err = strconv.ParseFloat(strings.TrimSpace(lon), 64)
+		}
+	}
+	if !ok || err != nil || !(p.lat >= -90 && p.lat <= 90) || !(p.lon >= -180 && p.lon <= 180) {
+		return nil, &captureError{status: http.StatusBadRequest, message: "'geo' must be latitude,longitude, e.g. 52.52,13.40"}
+	}
+	if accuracy != "" {
+		if p.accuracy, err = strconv.ParseFloat(accuracy, 64); err != nil || !(p.accuracy > 0 && p.accuracy <= 100000) {
+			return nil, &captureError{status: http.StatusBadRequest, message: "'geo_accuracy' must be between 0 and 100000 meters"}
+		}
+	}
+	return p, nil
+}
+
+// A fail_on_status entry: a status code or a class such as 5xx
+var statusRule = regexp.MustCompile(`^[1-5]([0-9][0-9]|xx)$`)
+
+// rejectsStatus reports whether the target answering with status fails the
+// capture. An unknown status (0) never does.
+func (opts captureOptions) rejectsStatus(status int) bool {
+	code := strconv.Itoa(status)
+	for _, rule := range opts.failOnStatus {
+		if status != 0 && (rule == code || rule[1:] == "xx" && rule[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsReport reports whether the capture should collect a pageReport.
+func (opts captureOptions) wantsReport() bool {
+	return opts.console || opts.requests || opts.tls || opts.redirects
+}
+
+// parseCaptureOptions reads the capture parameters shared by every
+// screenshot-producing endpoint. Errors are *captureError.
+func parseCaptureOptions(r *http.Request) (captureOptions, error) {
+	query := r.URL.Query()
+	if query.Get("url") == "" {
+		return captureOptions{}, &captureError{status: http.StatusBadRequest, message: "'url' parameter is required"}
+	}
+	width, height := parseDimensions(r)
+	opts := newCaptureOptions(r.Context(), query.Get("url"), width, height)
+	opts.client = clientID(r)
+
+	opts.preferSpeed = query.Get("prefer_speed") == "true"
+	if opts.preferSpeed {
+		opts.budget = 3 * time.Second
+		if b := query.Get("budget_ms"); b != "" {
+			val, err := strconv.Atoi(b)
+			if err != nil || val <= 0 || val > 30000 {
+				return opts, &captureError{status: http.StatusBadRequest, message: "'budget_ms' must be between 1 and 30000"}
+			}
+			opts.budget = time.Duration(val) * time.Millisecond
+		}
+	}
+
+	if opts.translateTo = query.Get("translate_to"); opts.translateTo != "" {
+		switch {
+		case translateURL == "":
+			return opts, &captureError{status: http.StatusNotImplemented, message: "Translation is not configured"}
+		case !languageCode.MatchString(opts.translateTo):
+			return opts, &captureError{status: http.StatusBadRequest, message: "'translate_to' must be a language code such as 'de' or 'pt-BR'"}
+		case opts.preferSpeed:
+			return opts, &captureError{status: http.StatusBadRequest, message: "'translate_to' cannot be combined with 'prefer_speed'"}
+		}
+	}
+
+	switch query.Get("dismiss_consent") {
+	case "", "false":
+	case "true":
+		opts.dismissConsent = true
+	default:
+		return opts, &captureError{status: http.StatusBadRequest, message: "'dismiss_consent' must be true or false"}
+	}
+
+	switch m := query.Get("media"); m {
+	case "", "screen":
+	case "print":
+		opts.media = m
+	default:
+		return opts, &captureError{status: http.StatusBadRequest, message: "'media' must be screen or print"}
+	}
+	opts.reducedMotion = query.Get("reduced_motion") == "true"
+	opts.forcedColors = query.Get("forced_colors") == "true"
+	if opts.vision = query.Get("vision"); opts.vision != "" && !visionDeficiencies[opts.vision] {
+		return opts, &captureError{status: http.StatusBadRequest, message: "'vision' must be one of achromatopsia, blurredVision, deuteranopia, protanopia, reducedContrast or tritanopia"}
+	}
+
+	if opts.timezone = query.Get("timezone"); opts.timezone != "" {
+		if _, err := time.LoadLocation(opts.timezone); err != nil || opts.timezone == "Local" {
+			return opts, &captureError{status: http.StatusBadRequest, message: "'timezone' must be an IANA time zone such as 'Europe/Berlin'"}
+		}
+	}
+
+	if opts.lang = query.Get("lang"); opts.lang != "" && !languageCode.MatchString(opts.lang) {
+		return opts, &captureError{status: http.StatusBadRequest, message: "'lang' must be a language tag such as 'de' or 'de-DE'"}
+	}
+
+	if resize, thumb := query.Get("resize"), query.Get("thumb_width"); resize != "" || thumb != "" {
+		var w, h int
+		var err error
+		switch {
+		case resize != "" && thumb != "":
+			return opts, &captureError{status: http.StatusBadRequest, message: "'resize' cannot be combined with 'thumb_width'"}
+		case thumb != "":
+			w, err = strconv.Atoi(thumb)
+		default:
+			if ws, hs, ok := strings.Cut(resize, "x"); !ok {
+				err = strconv.ErrSyntax
+			} else if w, err = strconv.Atoi(ws); err == nil {
+				h, err = strconv.Atoi(hs)
+			}
+		}
+		if err != nil || w < 0 || w > 3840 || h < 0 || h > 16384 || w+h == 0 {
+			return opts, &captureError{status: http.StatusBadRequest, message: "'resize' must be WxH and 'thumb_width' a width, at most 3840x16384"}
+		}
+		opts.resize = fmt.Sprintf("%dx%d", w, h)
+	}
+
+	if c := query.Get("crop"); c != "" {
+		parts := strings.Split(c, ",")
+		var vals [4]int
+		err := strconv.ErrSyntax
+		if len(parts) == 4 {
+			for i, part := range parts {
+				if vals[i], err = strconv.Atoi(part); err != nil {
+					break
+				}
+			}
+		}
+		x, y, w, h := vals[0], vals[1], vals[2], vals[3]
+		if err != nil || x < 0 || y < 0 || w <= 0 || h <= 0 {
+			return opts, &captureError{status: http.StatusBadRequest, message: "'crop' must be x,y,width,height"}
+		}
+		opts.crop = image.Rect(x, y, x+w, y+h)
+	}
+
+	opts.optimize = query.Get("optimize") == "true"
+
+	if bg := query.Get("bg"); bg != "" {
+		c, err := parseHexColor(bg)
+		if err != nil {
+			return opts, &captureError{status: http.StatusBadRequest, message: "'bg' must be a colour such as #0f172a"}
+		}
+		opts.background = fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+
+	switch query.Get("js") {
+	case "", "true":
+	case "false":
+		opts.noScript = true
+	default:
+		return opts, &captureError{status: http.StatusBadRequest, message: "'js' must be true or false"}
+	}
+
+	switch query.Get("isolated") {
+	case "":
+	case "true":
+		opts.isolated = true
+	case "false":
+		if defaults.isolated {
+			return opts, &captureError{status: http.StatusBadRequest, message: "Captures are always isolated on this service"}
+		}
+	default:
+		return opts, &captureError{status: http.StatusBadRequest, message: "'isolated' must be true or false"}
+	}
+	if name := query.Get("profile"); name != "" {
+		p, err := sessionProfileFor(r.Context(), name, opts.url)
+		if err != nil {
+			return opts, err
+		}
+		opts.session, opts.profile, opts.isolated = p, p.owner+"/"+p.Name, true
+	}
+
+	if g := query.Get("geo"); g != "" {
+		p, err := parseGeo(g, query.Get("geo_accuracy"))
+		if err != nil {
+			return opts, err
+		}
+		opts.geo, opts.geoPoint = fmt.Sprintf("%g,%g,%g", p.lat, p.lon, p.accuracy), p
+	}
+
+	if m := query.Get("max_redirects"); m != "" {
+		val, err := strconv.Atoi(m)
+		if err != nil || val < 0 || val > 20 {
+			return opts, &captureError{status: http.StatusBadRequest, message: "'max_redirects' must be between 0 and 20"}
+		}
+		opts.maxRedirects = strconv.Itoa(val)
+	}
+	opts.sameSite = query.Get("fail_on_redirect_offsite") == "true"
+
+	if f := query.Get("fail_on_status"); f != "" {
+		for _, rule := range strings.Split(strings.ToLower(f), ",") {
+			rule = strings.TrimSpace(rule)
+			if !statusRule.MatchString(rule) {
+				return opts, &captureError{status: http.StatusBadRequest, message: "'fail_on_status' must list statuses or classes such as 404,5xx"}
+			}
+			opts.failOnStatus = append(opts.failOnStatus, rule)
+		}
+	}
+
+	opts.refresh = query.Get("refresh") == "true" || query.Get("cache") == "false"
+	opts.noStore = query.Get("cache") == "false"
+	if t := query.Get("ttl"); t != "" {
+		limit := maxCacheTTL()
+		val, err := strconv.Atoi(t)
+		if err != nil || val <= 0 || time.Duration(val)*time.Second > limit {
+			return opts, &captureError{status: http.StatusBadRequest, message: fmt.Sprintf("'ttl' must be between 1 and %d seconds", int(limit.Seconds()))}
+		}
+		opts.ttl = time.Duration(val) * time.Second
+	}
+
+	opts.bypassBrowserCache = query.Get("browser_cache") == "false"
+	opts.partial = query.Get("partial") == "true"
+
+	opts.console = query.Get("console") == "true"
+	opts.requests = query.Get("requests") == "true"
+	opts.tls = query.Get("tls") == "true"
+	opts.redirects = query.Get("redirect_chain") == "true"
+	if opts.wantsReport() {
+		opts.refresh = true
+	}
+
+	if p := query.Get("proxy"); p != "" {
+		var err error
+		if opts.proxy, opts.proxyURL, err = resolveProxy(r.Context(), p); err != nil {
+			return opts, err
+		}
+	}
+	if name := query.Get("proxy_pool"); name != "" {
+		if opts.proxy != "" {
+			return opts, &captureError{status: http.StatusBadRequest, message: "'proxy' cannot be combined with 'proxy_pool'"}
+		}
+		p, err := resolveProxyPool(name, opts.url)
+		if err != nil {
+			return opts, err
+		}
+		opts.proxy, opts.proxyURL, opts.pooledProxy = "pool:"+name, p.url, p
+	}
+
+	if p := query.Get("priority"); p != "" {
+		prio, ok := priorityNames[p]
+		if !ok {
+			return opts, &captureError{status: http.StatusBadRequest, message: "'priority' must be one of high, normal or low"}
+		}
+		// Keys may always lower their priority, never raise it above their tier
+		if authEnabled && prio > opts.priority {
+			return opts, &captureError{status: http.StatusForbidden, message: "API key may not use priority=" + p}
+		}
+		opts.priority = prio
+	}
+	return opts, nil
+}
@@ -0,0 +1,36 @@
+package core
+
+import (
+	"image"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseCrop(t *testing.T) {
+	tests := []struct {
+		crop string
+		want image.Rectangle // empty = rejected
+	}{
+		{"0,0,10,10", image.Rect(0, 0, 10, 10)},
+		{"5,6,100,50", image.Rect(5, 6, 105, 56)},
+		{"0,0,10,10garbage", image.Rectangle{}},
+		{"1,2,3,4,5", image.Rectangle{}},
+		{"1,2,3", image.Rectangle{}},
+		{"1,2,3,", image.Rectangle{}},
+		{"1, 2,3,4", image.Rectangle{}},
+		{"-1,0,10,10", image.Rectangle{}},
+		{"0,0,0,10", image.Rectangle{}},
+		{"0x0,0,10,10", image.Rectangle{}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/get?url=https://example.com&crop="+url.QueryEscape(tt.crop), nil)
+		opts, err := parseCaptureOptions(r)
+		switch {
+		case tt.want.Empty() && err == nil:
+			t.Errorf("crop=%q accepted as %v", tt.crop, opts.crop)
+		case !tt.want.Empty() && (err != nil || opts.crop != tt.want):
+			t.Errorf("crop=%q: %v, %v; want %v", tt.crop, opts.crop, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package core
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	cdplog "github.com/chromedp/cdproto/log"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/security"
+	"github.com/chromedp/chromedp"
+)
+
+// Entries kept per report section; a page logging in a loop must not grow
+// the response without bound
+const reportMaxEntries = 200
+
+// pageReport is what a fresh capture observed about the page besides the
+// image. The main document's final URL and status are always recorded and
+// cached with the image; the sections are collected for the diagnostics
+// options of captureOptions only. Cached captures have no sections, so
+// asking for one skips the cache lookup.
+type pageReport struct {
+	mu sync.Mutex
+
+	frame    cdp.FrameID // the tab's main frame
+	finalURL string
+	status   int64
+
+	// Redirects of the main document so far, enforced against the limits
+	// by aborting the capture
+	docURL       string
+	hops         int
+	maxRedirects int    // -1 for no limit
+	site         string // host the capture must stay on, if set
+	abort        context.CancelCauseFunc
+
+	Console   []consoleEntry `json:"console,omitempty"`
+	Requests  []requestEntry `json:"requests,omitempty"`
+	TLS       *tlsReport     `json:"tls,omitempty"`
+	Redirects []redirectHop  `json:"redirects,omitempty"`
+
+	console    bool
+	tls        bool
+	redirects  bool
+	requestIDs map[network.RequestID]int // index in Requests; nil when not collecting
+}
+
+// consoleEntry is a console call, an uncaught exception (level "exception")
+// or a browser message such as a failed resource load.
+type consoleEntry struct {
+	Level  string `json:"level"`
+	Text   string `json:"text"`
+	Source string `json:"source,omitempty"` // url:line when known
+}
+
+// requestEntry summarises one request the page made. Status is 0 and Error
+// set when no response arrived; Size is what went over the wire.
+type requestEntry struct {
+	URL      string  `json:"url"`
+	Method   string  `json:"method"`
+	Type     string  `json:"type"`
+	Status   int64   `json:"status,omitempty"`
+	Size     int64   `json:"size"`
+	TimeMS   float64 `json:"time_ms"`
+	Error    string  `json:"error,omitempty"`
+	Redirect bool    `json:"redirect,omitempty"` // answered with a redirect, followed by the next entry
+
+	started *cdp.MonotonicTime
+}
+
+// tlsReport describes the connection the page was loaded over, as Chrome's
+// Security domain last reported it. Chain starts with the site's certificate.
+type tlsReport struct {
+	SecurityState string     `json:"security_state"` // secure, neutral, insecure, ...
+	Protocol      string     `json:"protocol,omitempty"`
+	KeyExchange   string     `json:"key_exchange,omitempty"`
+	Cipher        string     `json:"cipher,omitempty"`
+	Error         string     `json:"error,omitempty"` // certificate error Chrome found
+	Chain         []certInfo `json:"chain,omitempty"`
+}
+
+// redirectHop is a main document URL the page moved on from, by an HTTP
+// redirect or, with no status, a script or meta refresh navigation.
+type redirectHop struct {
+	URL    string `json:"url"`
+	Status int64  `json:"status,omitempty"`
+}
+
+type certInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+}
+
+// newReport returns an empty report for the sections opts asks for. Its
+// enable action collects from the tab's events.
+func (opts captureOptions) newReport() *pageReport {
+	rep := &pageReport{console: opts.console, tls: opts.tls, redirects: opts.redirects, maxRedirects: -1}
+	if opts.maxRedirects != "" {
+		rep.maxRedirects, _ = strconv.Atoi(opts.maxRedirects)
+	}
+	if u, err := url.Parse(opts.url); err == nil && opts.sameSite {
+		rep.site = u.Hostname()
+	}
+	if opts.requests {
+		rep.requestIDs = make(map[network.RequestID]int)
+	}
+	return rep
+}
+
+// enable starts collecting on the tab. chromedp enables the Runtime, Log and
+// Network domains on every tab; Security is only enabled when needed. A
+// redirect breaking the limits cancels the capture through abort, with a
+// *captureError as the cause.
+func (rep *pageReport) enable(abort context.CancelCauseFunc) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		// A page target's main frame shares its id
+		rep.mu.Lock()
+		rep.frame = cdp.FrameID(chromedp.FromContext(ctx).Target.TargetID)
+		rep.abort = abort
+		rep.mu.Unlock()
+		chromedp.ListenTarget(ctx, rep.listen)
+		if rep.tls {
+			return security.Enable().Do(ctx)
+		}
+		return nil
+	})
+}
+
+func (rep *pageReport) listen(ev interface{}) {
+	switch e := ev.(type) {
+	case *runtime.EventConsoleAPICalled:
+		if !rep.console {
+			return
+		}
+		args := make([]string, 0, len(e.Args))
+		for _, a := range e.Args {
+			args = append(args, remoteObjectText(a))
+		}
+		level := string(e.Type)
+		if level == "warning" {
+			level = "warn"
+		}
+		rep.addConsole(consoleEntry{Level: level, Text: strings.Join(args, " "), Source: stackSource(e.StackTrace)})
+	case *runtime.EventExceptionThrown:
+		if !rep.console {
+			return
+		}
+		d := e.ExceptionDetails
+		text := d.Text
+		if d.Exception != nil && d.Exception.Description != "" {
+			text = d.Exception.Description
+		}
+		source := ""
+		if d.URL != "" {
+			source = fmt.Sprintf("%s:%d", d.URL, d.LineNumber+1)
+		}
+		rep.addConsole(consoleEntry{Level: "exception", Text: text, Source: source})
+	case *cdplog.EventEntryAdded:
+		if !rep.console {
+			return
+		}
+		source := e.Entry.URL
+		if source != "" && e.Entry.LineNumber > 0 {
+			source = fmt.Sprintf("%s:%d", source, e.Entry.LineNumber+1)
+		}
+		rep.addConsole(consoleEntry{Level: string(e.Entry.Level), Text: e.Entry.Text, Source: source})
+	case *security.EventVisibleSecurityStateChanged:
+		if rep.tls {
+			tls := newTLSReport(e.VisibleSecurityState)
+			rep.mu.Lock()
+			rep.TLS = tls
+			rep.mu.Unlock()
+		}
+	case *network.EventRequestWillBeSent:
+		if e.Type == network.ResourceTypeDocument {
+			rep.navigated(e)
+		}
+		if rep.requestIDs != nil {
+			rep.addRequest(e)
+		}
+	case *network.EventResponseReceived:
+		if e.Type == network.ResourceTypeDocument {
+			rep.mu.Lock()
+			if e.FrameID == rep.frame {
+				rep.finalURL, rep.status = e.Response.URL, e.Response.Status
+			}
+			rep.mu.Unlock()
+		}
+		rep.updateRequest(e.RequestID, func(req *requestEntry) {
+			req.Status = e.Response.Status
+		})
+	case *network.EventLoadingFinished:
+		rep.updateRequest(e.RequestID, func(req *requestEntry) {
+			req.Size = int64(e.EncodedDataLength)
+			req.TimeMS = elapsedMS(req.started, e.Timestamp)
+		})
+	case *network.EventLoadingFailed:
+		rep.updateRequest(e.RequestID, func(req *requestEntry) {
+			req.Error = e.ErrorText
+			if e.BlockedReason != "" {
+				req.Error = "blocked: " + string(e.BlockedReason)
+			}
+			req.TimeMS = elapsedMS(req.started, e.Timestamp)
+		})
+	}
+}
+
+// navigated follows the main document from URL to URL.
+func (rep *pageReport) navigated(e *network.EventRequestWillBeSent) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if e.FrameID != rep.frame {
+		return
+	}
+	first := rep.docURL == ""
+	from := rep.docURL
+	rep.docURL = e.Request.URL
+	if first {
+		return
+	}
+	hop := redirectHop{URL: from}
+	if e.RedirectResponse != nil {
+		hop.URL, hop.Status = e.RedirectResponse.URL, e.RedirectResponse.Status
+	}
+	rep.hops++
+	if rep.redirects && len(rep.Redirects) < reportMaxEntries {
+		rep.Redirects = append(rep.Redirects, hop)
+	}
+
+	var failure *captureError
+	if rep.maxRedirects >= 0 && rep.hops > rep.maxRedirects {
+		failure = &captureError{status: http.StatusBadGateway, message: fmt.Sprintf("Target redirected more than %d times", rep.maxRedirects)}
+	} else if rep.site != "" {
+		if u, err := url.Parse(e.Request.URL); err != nil || !strings.EqualFold(u.Hostname(), rep.site) {
+			failure = &captureError{status: http.StatusBadGateway, message: "Target redirected off-site to " + e.Request.URL}
+		}
+	}
+	if failure != nil && rep.abort != nil {
+		rep.abort(failure)
+	}
+}
+
+func (rep *pageReport) addRequest(e *network.EventRequestWillBeSent) {
+	if strings.HasPrefix(e.Request.URL, "data:") || strings.HasPrefix(e.Request.URL, "blob:") {
+		return
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	// A redirect reuses the request id: close the hop and start the next one
+	if i, ok := rep.requestIDs[e.RequestID]; ok && e.RedirectResponse != nil {
+		hop := &rep.Requests[i]
+		hop.Status, hop.Redirect = e.RedirectResponse.Status, true
+		hop.Size = int64(e.RedirectResponse.EncodedDataLength)
+		hop.TimeMS = elapsedMS(hop.started, e.Timestamp)
+		delete(rep.requestIDs, e.RequestID)
+	}
+	if len(rep.Requests) >= reportMaxEntries {
+		return
+	}
+	u := e.Request.URL
+	if len(u) > 1000 {
+		u = u[:1000] + "…"
+	}
+	rep.requestIDs[e.RequestID] = len(rep.Requests)
+	rep.Requests = append(rep.Requests, requestEntry{URL: u, Method: e.Request.Method, Type: string(e.Type), started: e.Timestamp})
+}
+
+func (rep *pageReport) updateRequest(id network.RequestID, update func(*requestEntry)) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if i, ok := rep.requestIDs[id]; ok {
+		update(&rep.Requests[i])
+	}
+}
+
+// document returns the main document's URL after redirects and its HTTP
+// status, zero if no response arrived.
+func (rep *pageReport) document() (finalURL string, status int) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.finalURL, int(rep.status)
+}
+
+// failedRequests counts requests that got no response or an error status.
+func (rep *pageReport) failedRequests() int {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	n := 0
+	for _, req := range rep.Requests {
+		if req.Error != "" || req.Status >= 400 {
+			n++
+		}
+	}
+	return n
+}
+
+func newTLSReport(state *security.VisibleSecurityState) *tlsReport {
+	tls := &tlsReport{SecurityState: string(state.SecurityState)}
+	cs := state.CertificateSecurityState
+	if cs == nil {
+		return tls
+	}
+	tls.Protocol, tls.KeyExchange, tls.Cipher = cs.Protocol, cs.KeyExchange, cs.Cipher
+	tls.Error = cs.CertificateNetworkError
+	// The chain comes as base64 DER; Chrome's own summary covers the leaf
+	// if it cannot be parsed
+	for _, b64 := range cs.Certificate {
+		der, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			break
+		}
+		tls.Chain = append(tls.Chain, certInfo{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			NotBefore: cert.NotBefore.UTC(),
+			NotAfter:  cert.NotAfter.UTC(),
+			DNSNames:  cert.DNSNames,
+		})
+	}
+	if len(tls.Chain) == 0 && cs.ValidTo != nil {
+		from := time.Time{}
+		if cs.ValidFrom != nil {
+			from = cs.ValidFrom.Time().UTC()
+		}
+		tls.Chain = []certInfo{{Subject: cs.SubjectName, Issuer: cs.Issuer, NotBefore: from, NotAfter: cs.ValidTo.Time().UTC()}}
+	}
+	return tls
+}
+
+// certExpiry is when the site's certificate expires, zero if unknown.
+func (rep *pageReport) certExpiry() time.Time {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if rep.TLS == nil || len(rep.TLS.Chain) == 0 {
+		return time.Time{}
+	}
+	return rep.TLS.Chain[0].NotAfter
+}
+
+func elapsedMS(from, to *cdp.MonotonicTime) float64 {
+	if from == nil || to == nil {
+		return 0
+	}
+	return float64(to.Time().Sub(from.Time()).Microseconds()) / 1000
+}
+
+func (rep *pageReport) addConsole(e consoleEntry) {
+	if len(e.Text) > 1000 {
+		e.Text = e.Text[:1000] + "…"
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if len(rep.Console) < reportMaxEntries {
+		rep.Console = append(rep.Console, e)
+	}
+}
+
+// consoleErrors counts error messages and uncaught exceptions.
+func (rep *pageReport) consoleErrors() int {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	n := 0
+	for _, e := range rep.Console {
+		if e.Level == "error" || e.Level == "exception" {
+			n++
+		}
+	}
+	return n
+}
+
+// remoteObjectText formats a console argument the way DevTools prints it.
+func remoteObjectText(o *runtime.RemoteObject) string {
+	if len(o.Value) > 0 {
+		var s string
+		if json.Unmarshal(o.Value, &s) == nil {
+			return s
+		}
+		return string(o.Value)
+	}
+	if o.UnserializableValue != "" {
+		return string(o.UnserializableValue)
+	}
+	if o.Description != "" {
+		return o.Description
+	}
+	return string(o.Type)
+}
+
+func stackSource(st *runtime.StackTrace) string {
+	if st == nil || len(st.CallFrames) == 0 || st.CallFrames[0].URL == "" {
+		return ""
+	}
+	f := st.CallFrames[0]
+	return fmt.Sprintf("%s:%d", f.URL, f.LineNumber+1)
+}
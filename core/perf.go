@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/performance"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// pageTiming holds the browser's own timings for the main document, in
+// milliseconds since navigation start; zero when the page never reached
+// that point.
+type pageTiming struct {
+	TTFB                   float64 `json:"ttfb_ms"`
+	DOMContentLoaded       float64 `json:"dom_content_loaded_ms"`
+	Load                   float64 `json:"load_ms"`
+	FirstContentfulPaint   float64 `json:"first_contentful_paint_ms"`
+	LargestContentfulPaint float64 `json:"largest_contentful_paint_ms"`
+}
+
+type resourceStats struct {
+	Requests      int   `json:"requests"`
+	Failed        int   `json:"failed"`
+	TransferBytes int64 `json:"transfer_bytes"`
+}
+
+// pageResources counts what the page downloaded, in total and per resource
+// type (Document, Script, Image, ...), as seen by the Network domain, so
+// cross-origin sizes are included.
+type pageResources struct {
+	resourceStats
+	ByType map[string]*resourceStats `json:"by_type"`
+
+	mu    sync.Mutex
+	types map[network.RequestID]string
+}
+
+// timingScript reads navigation and paint timing. LCP is only reported to
+// observers, which get the buffered entries at once.
+const timingScript = `new Promise(resolve => {
+	const nav = performance.getEntriesByType("navigation")[0] || {};
+	const fcp = performance.getEntriesByName("first-contentful-paint")[0];
+	const timing = {
+		ttfb_ms: nav.responseStart || 0,
+		dom_content_loaded_ms: nav.domContentLoadedEventEnd || 0,
+		load_ms: nav.loadEventEnd || 0,
+		first_contentful_paint_ms: fcp ? fcp.startTime : 0,
+		largest_contentful_paint_ms: 0,
+	};
+	try {
+		new PerformanceObserver(list => {
+			const entries = list.getEntries();
+			timing.largest_contentful_paint_ms = entries[entries.length - 1].startTime;
+		}).observe({type: "largest-contentful-paint", buffered: true});
+	} catch (e) {}
+	setTimeout(() => resolve(timing), 0);
+})`
+
+func (p *pageResources) listen(ev interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := func(id network.RequestID) *resourceStats {
+		t := p.types[id]
+		if p.ByType[t] == nil {
+			p.ByType[t] = &resourceStats{}
+		}
+		return p.ByType[t]
+	}
+	switch e := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		if _, seen := p.types[e.RequestID]; seen {
+			return // a redirect reuses the request id
+		}
+		p.types[e.RequestID] = string(e.Type)
+		p.Requests++
+		stats(e.RequestID).Requests++
+	case *network.EventLoadingFinished:
+		p.TransferBytes += int64(e.EncodedDataLength)
+		stats(e.RequestID).TransferBytes += int64(e.EncodedDataLength)
+	case *network.EventLoadingFailed:
+		p.Failed++
+		stats(e.RequestID).Failed++
+	}
+}
+
+// HandlePerf loads a page like a capture would and reports its timings
+// (TTFB, DOMContentLoaded, load, FCP, LCP), what it downloaded and Chrome's
+// Performance domain metrics (JS heap, DOM nodes, layout and script time).
+func HandlePerf(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "perf") {
+		return
+	}
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	var finalURL string
+	var timing pageTiming
+	var metrics []*performance.Metric
+	resources := &pageResources{ByType: make(map[string]*resourceStats), types: make(map[network.RequestID]string)}
+	setup := chromedp.ActionFunc(func(ctx context.Context) error {
+		chromedp.ListenTarget(ctx, resources.listen)
+		return performance.Enable().Do(ctx)
+	})
+	err = inspectPage(r.Context(), opts, setup, chromedp.Tasks{
+		chromedp.Location(&finalURL),
+		chromedp.Evaluate(timingScript, &timing, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+			return p.WithAwaitPromise(true)
+		}),
+		chromedp.ActionFunc(func(ctx context.Context) (err error) {
+			metrics, err = performance.GetMetrics().Do(ctx)
+			return err
+		}),
+	})
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	byName := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		byName[m.Name] = m.Value
+	}
+	resources.mu.Lock()
+	defer resources.mu.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"url":       finalURL,
+		"timing":    timing,
+		"resources": resources,
+		"metrics":   byName,
+	})
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// HandlePHash captures a page like /get and answers with perceptual hashes of
+// the image instead of the image: 64-bit pHash (DCT) and dHash (gradient) as
+// hex. Similar renderings have hashes a small Hamming distance apart, so
+// callers can detect changes and group near-duplicates from 16 characters.
+func HandlePHash(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "phash") {
+		return
+	}
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+	res, err := screenshotFor(r.Context(), opts)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(res.data))
+	if err != nil {
+		http.Error(writer, "Error decoding screenshot", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"url":    opts.url,
+		"id":     getCacheKey(opts),
+		"phash":  fmt.Sprintf("%016x", pHash(img)),
+		"dhash":  fmt.Sprintf("%016x", dHash(img)),
+		"cached": res.cacheHit,
+	})
+}
+
+// grayscale shrinks img to w x h and returns its luma, row by row.
+func grayscale(img image.Image, w, h int) []float64 {
+	small := scaleImage(img, w, h)
+	luma := make([]float64, w*h)
+	for i := range luma {
+		p := small.Pix[i*4 : i*4+3]
+		luma[i] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+	}
+	return luma
+}
+
+// dHash sets a bit for every pixel of a 9x8 thumbnail brighter than its
+// right neighbour.
+func dHash(img image.Image) uint64 {
+	luma := grayscale(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luma[y*9+x] > luma[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// pHash takes the 8x8 lowest frequencies of a 32x32 thumbnail's DCT and sets
+// a bit for every one above their median.
+func pHash(img image.Image) uint64 {
+	const n = 32
+	luma := grayscale(img, n, n)
+
+	var cos [8][n]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < n; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * n))
+		}
+	}
+	// Rows first, then columns; only the low frequencies are needed
+	var rows [n][8]float64
+	for y := 0; y < n; y++ {
+		for u := 0; u < 8; u++ {
+			for x := 0; x < n; x++ {
+				rows[y][u] += luma[y*n+x] * cos[u][x]
+			}
+		}
+	}
+	var coeffs [64]float64
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			for y := 0; y < n; y++ {
+				coeffs[v*8+u] += rows[y][u] * cos[v][y]
+			}
+		}
+	}
+
+	// The DC term is the average brightness; it would dominate the median
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for _, c := range coeffs {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
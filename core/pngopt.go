@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// pngEncoder encodes every PNG the service produces itself (resized,
+// cropped, watermarked, tiled and diff images); Chrome encodes captures.
+// PNG_COMPRESSION trades CPU for size: default, speed, best or none.
+var pngEncoder png.Encoder
+
+// Encoding scratch space is pooled: the zlib state and output buffer of a
+// full-page capture run to megabytes, and allocating them afresh for every
+// request is most of what the GC does under load. Encoded images outlive the
+// request (in the cache), so they are copied out at their exact size.
+var (
+	pngEncoderBuffers, optimizeBuffers pngBufferPool
+	scratchBuffers                     = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+// Buffers grown beyond this are left to the GC rather than pinned in the pool
+const maxPooledBuffer = 32 << 20
+
+type pngBufferPool struct{ pool sync.Pool }
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	b, _ := p.pool.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *pngBufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := scratchBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		scratchBuffers.Put(buf)
+	}
+}
+
+func init() {
+	pngEncoder.BufferPool = &pngEncoderBuffers
+	switch level := os.Getenv("PNG_COMPRESSION"); level {
+	case "", "default":
+		pngEncoder.CompressionLevel = png.DefaultCompression
+	case "speed":
+		pngEncoder.CompressionLevel = png.BestSpeed
+	case "best":
+		pngEncoder.CompressionLevel = png.BestCompression
+	case "none":
+		pngEncoder.CompressionLevel = png.NoCompression
+	default:
+		log.Fatalf("Invalid PNG_COMPRESSION %q: want default, speed, best or none", level)
+	}
+}
+
+func encodePNG(w io.Writer, img image.Image) error {
+	return pngEncoder.Encode(w, img)
+}
+
+// pngBytes encodes img with enc in pooled scratch space.
+func pngBytes(enc *png.Encoder, img image.Image) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := enc.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// optimizePNG re-encodes a capture losslessly at the best zlib level, as an
+// 8-bit palette image when it is opaque and has at most 256 colours (flat
+// designs, text pages). The original is kept when that is not smaller.
+func optimizePNG(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := toPaletted(img); ok {
+		img = p
+	}
+	enc := png.Encoder{CompressionLevel: png.BestCompression, BufferPool: &optimizeBuffers}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := enc.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// toPaletted converts an opaque image with at most 256 colours to a
+// paletted one without changing any pixel.
+func toPaletted(img image.Image) (*image.Paletted, bool) {
+	src := toRGBA(img)
+	b := src.Bounds()
+	index := make(map[color.RGBA]uint8, 256)
+	var palette color.Palette
+	out := image.NewPaletted(b, nil)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := src.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}
+			i += 4
+			if c.A != 0xff {
+				return nil, false
+			}
+			idx, ok := index[c]
+			if !ok {
+				if len(palette) == 256 {
+					return nil, false
+				}
+				idx = uint8(len(palette))
+				index[c] = idx
+				palette = append(palette, c)
+			}
+			out.SetColorIndex(x, y, idx)
+		}
+	}
+	out.Palette = palette
+	return out, true
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// linkPreview is the /preview document: what a chat or CMS needs to unfurl a
+// link.
+type linkPreview struct {
+	URL         string `json:"url"`
+	FinalURL    string `json:"final_url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	SiteName    string `json:"site_name,omitempty"`
+	Favicon     string `json:"favicon"`
+	Image       string `json:"image"` // data: URL, or /captures/<id> with image=url
+	ImageWidth  int    `json:"image_width"`
+	ImageHeight int    `json:"image_height"`
+}
+
+// HandlePreview loads a page once and returns its title and description
+// (OpenGraph tags preferred), final URL and a thumbnail of the viewport,
+// thumb_width pixels wide (default 400). The thumbnail is inlined as a data
+// URL, or with image=url stored like a capture and linked.
+func HandlePreview(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "preview") {
+		return
+	}
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+	query := r.URL.Query()
+	thumbWidth := 400
+	if tw := query.Get("thumb_width"); tw != "" {
+		if thumbWidth, err = strconv.Atoi(tw); err != nil || thumbWidth < 16 || thumbWidth > opts.width {
+			http.Error(writer, fmt.Sprintf("'thumb_width' must be between 16 and %d", opts.width), http.StatusBadRequest)
+			return
+		}
+	}
+	inline := true
+	switch query.Get("image") {
+	case "", "inline":
+	case "url":
+		inline = false
+	default:
+		http.Error(writer, "'image' must be inline or url", http.StatusBadRequest)
+		return
+	}
+
+	var meta pageMeta
+	var shot []byte
+	err = inspectPage(r.Context(), opts, nil, chromedp.Tasks{
+		chromedp.Evaluate(metaScript, &meta),
+		chromedp.CaptureScreenshot(&shot),
+	})
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(shot))
+	if err != nil {
+		http.Error(writer, "Error encoding thumbnail", http.StatusInternalServerError)
+		return
+	}
+	b := img.Bounds()
+	thumbHeight := max(1, b.Dy()*thumbWidth/b.Dx())
+	thumb := scaleImage(img, thumbWidth, thumbHeight)
+	if opts.watermark != nil {
+		opts.watermark.apply(thumb)
+	}
+	thumbPNG, err := pngBytes(&pngEncoder, thumb)
+	if err != nil {
+		http.Error(writer, "Error encoding thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	preview := linkPreview{
+		URL:         opts.url,
+		FinalURL:    meta.URL,
+		Title:       cmp.Or(meta.OpenGraph["title"], meta.Title),
+		Description: cmp.Or(meta.OpenGraph["description"], meta.Description),
+		SiteName:    meta.OpenGraph["site_name"],
+		Favicon:     meta.Favicon,
+		ImageWidth:  thumbWidth,
+		ImageHeight: thumbHeight,
+	}
+	if inline {
+		preview.Image = "data:image/png;base64," + base64.StdEncoding.EncodeToString(thumbPNG)
+	} else {
+		sum := md5.Sum(append([]byte("preview;"+getCacheKey(opts)+";"), thumbPNG...))
+		id := hex.EncodeToString(sum[:])
+		screenCache.set(id, &cacheEntry{url: opts.url, data: thumbPNG, timestamp: time.Now()}, cacheRetention())
+		preview.Image = "/captures/" + id
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(preview)
+}
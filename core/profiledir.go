@@ -0,0 +1,110 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	// Where local workers' Chrome profiles live (CHROME_PROFILE_DIR): each
+	// process gets a run directory "<pid>-*" in it, each worker a directory in
+	// that, removed when the worker stops
+	profileRoot string
+	// This process's run directory, empty if it could not be created
+	profileRunDir string
+
+	// "worker" (CHROME_PROFILE_ISOLATION default) keeps a profile for the
+	// life of a worker; "capture" recycles the worker after every capture,
+	// so no capture sees cookies, storage or cache left by another
+	profileIsolation string
+)
+
+func init() {
+	profileRoot = envOr("CHROME_PROFILE_DIR", filepath.Join(os.TempDir(), "webshot-profiles"))
+	profileIsolation = envOr("CHROME_PROFILE_ISOLATION", "worker")
+	if profileIsolation != "worker" && profileIsolation != "capture" {
+		log.Fatalf("Invalid CHROME_PROFILE_ISOLATION %q: want worker or capture", profileIsolation)
+	}
+}
+
+// setupProfileDirs removes the run directories of processes that are gone,
+// e.g. killed before they could clean up, and creates this one's.
+func setupProfileDirs() error {
+	err := func() error {
+		if err := os.MkdirAll(profileRoot, 0o700); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(profileRoot)
+		if err != nil {
+			return err
+		}
+		removed := 0
+		for _, entry := range entries {
+			pid, _, ok := strings.Cut(entry.Name(), "-")
+			if n, err := strconv.Atoi(pid); ok && err == nil && !processAlive(n) {
+				if err := os.RemoveAll(filepath.Join(profileRoot, entry.Name())); err != nil {
+					log.Printf("webshot: cannot remove stale Chrome profiles %s: %v", entry.Name(), err)
+					continue
+				}
+				removed++
+			}
+		}
+		if removed > 0 {
+			log.Printf("webshot removed Chrome profiles of %d earlier runs from %s", removed, profileRoot)
+		}
+		profileRunDir, err = os.MkdirTemp(profileRoot, fmt.Sprintf("%d-", os.Getpid()))
+		return err
+	}()
+	if err != nil {
+		return fmt.Errorf("Chrome profiles in %s (CHROME_PROFILE_DIR): %v", profileRoot, err)
+	}
+	return nil
+}
+
+// processAlive reports whether pid is another running process. Our own pid
+// counts as gone: in a restarted container it belonged to the previous run.
+func processAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
+
+// newProfileDir creates worker id's user data directory, with a tmp
+// directory inside for Chrome's own temporary files (TMPDIR). It returns ""
+// when there is no run directory, leaving the profile to chromedp.
+func newProfileDir(id int) (string, error) {
+	if profileRunDir == "" {
+		return "", nil
+	}
+	dir, err := os.MkdirTemp(profileRunDir, fmt.Sprintf("worker-%d-", id))
+	if err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0o700); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// removeProfileDir deletes a stopped worker's profile.
+func removeProfileDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Error removing Chrome profile %s: %v", dir, err)
+	}
+}
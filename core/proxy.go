@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Named proxies captures may use with proxy=<name> (PROXIES, comma separated
+// name=url pairs), so callers need not know the proxy address or credentials.
+var proxies map[string]*url.URL
+
+func init() {
+	proxies = make(map[string]*url.URL)
+	for _, entry := range strings.Split(os.Getenv("PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(entry, "=")
+		u, err := parseProxyURL(raw)
+		if !ok || name == "" || err != nil {
+			log.Fatalf("Invalid PROXIES entry %q: want name=scheme://[user:pass@]host:port", entry)
+		}
+		proxies[name] = u
+	}
+}
+
+// parseProxyURL accepts an http, https or socks5 proxy URL with an optional
+// user:pass and nothing after the port.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, &captureError{status: http.StatusBadRequest, message: "Proxy must be an http, https or socks5 URL"}
+	}
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, &captureError{status: http.StatusBadRequest, message: "Proxy must be of the form scheme://[user:pass@]host:port"}
+	}
+	return u, nil
+}
+
+// resolveProxy looks up a proxy= value: a PROXIES name, or a proxy URL if the
+// caller's key explicitly lists the "proxy" feature. The returned id identifies the
+// proxy in cache keys without its credentials. Errors are *captureError.
+func resolveProxy(ctx context.Context, value string) (id string, u *url.URL, err error) {
+	if u, ok := proxies[value]; ok {
+		return value, u, checkProxyUsable(u)
+	}
+	if !strings.Contains(value, "://") {
+		return "", nil, &captureError{status: http.StatusBadRequest, message: "Unknown proxy " + value}
+	}
+	if !apiKeyFrom(ctx).has("proxy") {
+		return "", nil, &captureError{status: http.StatusForbidden, message: "Proxy URLs require an API key with the proxy feature"}
+	}
+	if u, err = parseProxyURL(value); err != nil {
+		if _, ok := err.(*captureError); !ok {
+			err = &captureError{status: http.StatusBadRequest, message: "Invalid 'proxy' parameter"}
+		}
+		return "", nil, err
+	}
+	if u.User != nil && clusterRole == "api" {
+		// Render jobs wait in Redis, where credentials do not belong
+		return "", nil, &captureError{status: http.StatusNotImplemented, message: "Proxies with credentials must be configured in PROXIES in cluster mode"}
+	}
+	return proxyServer(u), u, checkProxyUsable(u)
+}
+
+// checkProxyUsable rejects authenticated SOCKS5 proxies on remote Chrome,
+// which cannot reach the local relay they need (see socksRelay).
+func checkProxyUsable(u *url.URL) error {
+	if u.Scheme == "socks5" && u.User != nil && len(renderBackends) > 0 {
+		return &captureError{status: http.StatusNotImplemented, message: "SOCKS5 proxies with credentials need local Chrome workers"}
+	}
+	return nil
+}
+
+// proxyServer is u in the form Chrome's proxy settings take.
+func proxyServer(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
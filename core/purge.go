@@ -0,0 +1,50 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// HandlePurge invalidates cached captures (and tile sets built from them)
+// immediately: DELETE /cache?url=<URL> removes every variant of one page,
+// DELETE /cache?pattern=<rule> every page matching a URL_ALLOWLIST-style
+// rule. Only admin keys may purge.
+func HandlePurge(writer http.ResponseWriter, r *http.Request) {
+	if key := apiKeyFrom(r.Context()); authEnabled && !key.has("admin") {
+		http.Error(writer, "Purging the cache requires an admin key", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	var match func(url string) bool
+	switch {
+	case query.Get("url") != "":
+		target := normalizeTargetURL(query.Get("url"))
+		match = func(url string) bool { return normalizeTargetURL(url) == target }
+	case query.Get("pattern") != "":
+		rules, err := parseURLRules(query.Get("pattern"))
+		if err != nil || len(rules) == 0 {
+			http.Error(writer, "Invalid 'pattern' parameter", http.StatusBadRequest)
+			return
+		}
+		match = rules.match
+	default:
+		http.Error(writer, "'url' or 'pattern' parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	purged := screenCache.purge(match)
+	negativeCache.Range(func(key, value interface{}) bool {
+		if match(value.(*failedCapture).url) {
+			negativeCache.Delete(key)
+		}
+		return true
+	})
+
+	tiles := tileSets.purge(match)
+
+	log.Printf("Cache purge by %s: %d captures, %d tile sets", tenantName(r.Context()), purged, tiles)
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]int{"purged": purged, "tile_sets": tiles})
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capturePriority orders requests waiting for a worker. Interactive captures
+// default to normal; bulk work should ask for low so it never delays them.
+type capturePriority int
+
+const (
+	priorityLow capturePriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityNames = map[string]capturePriority{"low": priorityLow, "normal": priorityNormal, "high": priorityHigh}
+
+// keyPriority is the queue tier of the request's API key, normal without one.
+func keyPriority(ctx context.Context) capturePriority {
+	if k := apiKeyFrom(ctx); k != nil && k.Priority != "" {
+		return priorityNames[k.Priority]
+	}
+	return priorityNormal
+}
+
+// captureQueue holds the requests waiting for a worker. Freed workers go to
+// the highest priority waiter; within a priority, to the client with the
+// fewest workers in use, then the one served least recently, oldest request
+// first, so one flooding client cannot monopolise the pool. Clients at their
+// concurrency limit wait their turn.
+var captureQueue = &workerQueue{active: make(map[string]int), served: make(map[string]uint64)}
+
+var (
+	// maxQueueDepth bounds how many requests may wait (CAPTURE_QUEUE_MAX_DEPTH,
+	// 0 = unbounded); beyond it requests are turned away with 429 at once.
+	maxQueueDepth int
+
+	// Workers one client may hold at once (CLIENT_MAX_CONCURRENCY, 0 = no
+	// limit); keys may override it with max_concurrency.
+	clientMaxConcurrency int
+)
+
+type workerQueue struct {
+	mu      sync.Mutex
+	waiters []*workerWaiter
+	active  map[string]int    // workers in use per client
+	served  map[string]uint64 // dispatch tick each client was last served at
+	seq     uint64
+	ticks   uint64
+	avgHold time.Duration // moving average of how long a request holds a worker
+}
+
+type workerWaiter struct {
+	prio   capturePriority
+	client string
+	seq    uint64
+	ch     chan *chromeWorker // receives the assigned worker
+}
+
+// clientID identifies the caller for rate limiting and fair scheduling: the
+// API key's name (never its secret, as ids travel in render jobs), or the
+// client IP when the request is anonymous.
+func clientID(r *http.Request) string {
+	if key := apiKeyFrom(r.Context()); key != nil {
+		return "key:" + key.Name
+	}
+	return "ip:" + clientIP(r)
+}
+
+func clientConcurrencyLimit(client string) int {
+	if name, ok := strings.CutPrefix(client, "key:"); ok {
+		if k := apiKeyNamed(name); k != nil && k.MaxConcurrency > 0 {
+			return k.MaxConcurrency
+		}
+	}
+	return clientMaxConcurrency
+}
+
+// enqueue queues a waiter for the caller and assigns it a worker at once if
+// one is idle and nobody is ahead. A full queue is a 429 *captureError
+// carrying the estimated wait.
+func (q *workerQueue) enqueue(prio capturePriority, client string) (*workerWaiter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if maxQueueDepth > 0 && len(q.waiters) >= maxQueueDepth {
+		wait := q.estimatedWait()
+		return nil, &captureError{
+			status:     http.StatusTooManyRequests,
+			message:    fmt.Sprintf("Capture queue is full, estimated wait %ds", int(math.Ceil(wait.Seconds()))),
+			retryAfter: wait,
+		}
+	}
+	q.seq++
+	w := &workerWaiter{prio: prio, client: client, seq: q.seq, ch: make(chan *chromeWorker, 1)}
+	q.waiters = append(q.waiters, w)
+	q.dispatch()
+	return w, nil
+}
+
+// dispatch pairs idle workers with eligible waiters. Callers hold q.mu.
+func (q *workerQueue) dispatch() {
+	for len(workerPool) > 0 {
+		best := -1
+		for i, w := range q.waiters {
+			if limit := clientConcurrencyLimit(w.client); limit > 0 && q.active[w.client] >= limit {
+				continue
+			}
+			if best < 0 || q.ahead(w, q.waiters[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return
+		}
+		var worker *chromeWorker
+		select {
+		case worker = <-workerPool:
+		default:
+			return // taken by a health check or idle sweep
+		}
+		w := q.waiters[best]
+		q.waiters = append(q.waiters[:best], q.waiters[best+1:]...)
+		q.active[w.client]++
+		q.ticks++
+		q.served[w.client] = q.ticks
+		worker.client, worker.acquired = w.client, time.Now()
+		w.ch <- worker
+	}
+}
+
+// ahead reports whether a should be served before b.
+func (q *workerQueue) ahead(a, b *workerWaiter) bool {
+	if a.prio != b.prio {
+		return a.prio > b.prio
+	}
+	if na, nb := q.active[a.client], q.active[b.client]; na != nb {
+		return na < nb
+	}
+	if sa, sb := q.served[a.client], q.served[b.client]; sa != sb {
+		return sa < sb
+	}
+	return a.seq < b.seq
+}
+
+// waiting reports whether client has queued requests. Callers hold q.mu.
+func (q *workerQueue) waiting(client string) bool {
+	for _, w := range q.waiters {
+		if w.client == client {
+			return true
+		}
+	}
+	return false
+}
+
+// estimatedWait is how long the queue takes to drain at the current
+// throughput, i.e. one average hold time per round of workers. Callers hold
+// q.mu.
+func (q *workerQueue) estimatedWait() time.Duration {
+	hold := q.avgHold
+	if hold == 0 {
+		hold = defaults.settleDelay + time.Second
+	}
+	rounds := (len(q.waiters) + 1 + maxWorkers - 1) / maxWorkers
+	return max(time.Duration(rounds)*hold, time.Second)
+}
+
+// finished records that worker's client is done with it and folds the hold
+// time into the average.
+func (q *workerQueue) finished(worker *chromeWorker) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active[worker.client]--; q.active[worker.client] <= 0 {
+		delete(q.active, worker.client)
+		if !q.waiting(worker.client) {
+			delete(q.served, worker.client)
+		}
+	}
+	held := time.Since(worker.acquired)
+	if q.avgHold == 0 {
+		q.avgHold = held
+	} else {
+		q.avgHold += (held - q.avgHold) / 8
+	}
+	// The client may be back under its limit with workers sitting idle
+	q.dispatch()
+}
+
+// cancel dequeues a waiter that gave up. If a worker was assigned to it in
+// the meantime, that worker is returned and now belongs to the caller.
+func (q *workerQueue) cancel(w *workerWaiter) *chromeWorker {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.waiters {
+		if queued == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return nil
+		}
+	}
+	return <-w.ch
+}
+
+// handOff returns a free worker to the idle pool and gives it to the best
+// eligible waiter, if any.
+func handOff(worker *chromeWorker) {
+	q := captureQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case workerPool <- worker:
+	default:
+		// Pool is full (shouldn't happen, but defensive)
+		log.Printf("Warning: Worker pool full, worker %d not returned", worker.id)
+	}
+	q.dispatch()
+}
+
+// queuedRequests is the number of requests waiting for a worker.
+func queuedRequests() int {
+	captureQueue.mu.Lock()
+	defer captureQueue.mu.Unlock()
+	return len(captureQueue.waiters)
+}
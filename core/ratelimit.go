@@ -0,0 +1,129 @@
+package core
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+// take refills the bucket and tries to spend one token. It returns whether the
+// request is allowed, the tokens left, and how long until a token is available.
+func (b *tokenBucket) take(now time.Time) (bool, float64, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, b.tokens, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, b.tokens, wait
+}
+
+var (
+	// Per-client token buckets (RATE_LIMIT_RPS / RATE_LIMIT_BURST; 0 disables)
+	rateLimitRPS      float64
+	rateLimitBurst    int
+	trustProxyHeaders bool
+	rateBuckets       map[string]*tokenBucket
+	rateBucketsLock   sync.Mutex
+	rateBucketsSwept  time.Time
+)
+
+func init() {
+	if rps := os.Getenv("RATE_LIMIT_RPS"); rps != "" {
+		if val, err := strconv.ParseFloat(rps, 64); err == nil && val > 0 {
+			rateLimitRPS = val
+		}
+	}
+
+	rateLimitBurst = int(math.Ceil(rateLimitRPS * 2))
+	if b := os.Getenv("RATE_LIMIT_BURST"); b != "" {
+		if val, err := strconv.Atoi(b); err == nil && val > 0 {
+			rateLimitBurst = val
+		}
+	}
+
+	trustProxyHeaders = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+	rateBuckets = make(map[string]*tokenBucket)
+}
+
+// clientIP returns the caller's address, honouring X-Forwarded-For only when
+// the service is configured to sit behind a trusted proxy.
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimit applies a token bucket per API key (or per client IP when the
+// request is anonymous). Keys may carry their own rate_limit and burst.
+func RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		rate, burst := rateLimitRPS, rateLimitBurst
+		id := clientID(r)
+		if key := apiKeyFrom(r.Context()); key != nil {
+			if key.RateLimit > 0 {
+				rate = key.RateLimit
+				burst = max(key.Burst, int(math.Ceil(rate)))
+			}
+		}
+		if rate <= 0 {
+			next(writer, r)
+			return
+		}
+		burst = max(burst, 1)
+
+		now := time.Now()
+		rateBucketsLock.Lock()
+		if now.Sub(rateBucketsSwept) > time.Minute {
+			// Full buckets carry no state worth keeping
+			for k, b := range rateBuckets {
+				if now.Sub(b.last).Seconds()*b.rate >= b.burst {
+					delete(rateBuckets, k)
+				}
+			}
+			rateBucketsSwept = now
+		}
+		bucket, ok := rateBuckets[id]
+		if !ok || bucket.rate != rate || bucket.burst != float64(burst) {
+			bucket = &tokenBucket{tokens: float64(burst), rate: rate, burst: float64(burst), last: now}
+			rateBuckets[id] = bucket
+		}
+		allowed, remaining, wait := bucket.take(now)
+		reset := time.Duration((bucket.burst - bucket.tokens) / rate * float64(time.Second))
+		rateBucketsLock.Unlock()
+
+		writer.Header().Set("X-RateLimit-Limit", strconv.Itoa(burst))
+		writer.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		writer.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+
+		if !allowed {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(writer, "Rate limit exceeded, please retry later", http.StatusTooManyRequests)
+			return
+		}
+		next(writer, r)
+	}
+}
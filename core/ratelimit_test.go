@@ -0,0 +1,36 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := &tokenBucket{tokens: 2, rate: 1, burst: 2, last: start}
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := b.take(start); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	ok, left, wait := b.take(start)
+	if ok {
+		t.Fatal("request beyond the burst was allowed")
+	}
+	if left != 0 || wait != time.Second {
+		t.Errorf("empty bucket: %v tokens, wait %v; want 0 and 1s", left, wait)
+	}
+
+	if ok, _, _ := b.take(start.Add(500 * time.Millisecond)); ok {
+		t.Error("half a token was spent")
+	}
+	if ok, _, _ := b.take(start.Add(time.Second)); !ok {
+		t.Error("refilled token was refused")
+	}
+
+	// Refills stop at the burst
+	if ok, left, _ := b.take(start.Add(time.Hour)); !ok || left != 1 {
+		t.Errorf("after an hour: allowed %v with %v tokens left, want true and 1", ok, left)
+	}
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisClient is a minimal RESP2 client with a small connection pool; it
+// covers the handful of commands webshot needs without an external driver.
+type redisClient struct {
+	addr     string
+	host     string
+	username string
+	password string
+	db       int
+	useTLS   bool
+	conns    chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// errRedisNil is returned for nil bulk replies (missing keys).
+var errRedisNil = errors.New("redis: nil")
+
+// newRedisClient parses redis://[[username]:password@]host[:port][/db]
+// (rediss:// for TLS); IPv6 hosts are bracketed as in any URL.
+func newRedisClient(rawURL string, poolSize int) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported redis URL scheme %q", u.Scheme)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	c := &redisClient{
+		addr:   net.JoinHostPort(u.Hostname(), port),
+		host:   u.Hostname(),
+		useTLS: u.Scheme == "rediss",
+		conns:  make(chan *redisConn, poolSize),
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if c.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: c.host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	if c.password != "" {
+		// An ACL user (Redis 6+) authenticates with its name, the default
+		// user with the password alone
+		auth := []interface{}{"AUTH", c.password}
+		if c.username != "" {
+			auth = []interface{}{"AUTH", c.username, c.password}
+		}
+		if _, err := rc.do(auth...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Do runs one command on a pooled connection. Replies are string, []byte,
+// int64, []interface{} or nil; server errors are returned as errors.
+func (c *redisClient) Do(args ...interface{}) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.conns:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+	var serverErr redisError
+	if err != nil && !errors.As(err, &serverErr) && err != errRedisNil {
+		// Connection state is unknown after I/O errors
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.conns <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) do(args ...interface{}) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		default:
+			s = fmt.Sprint(v)
+		}
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = rc.readReply()
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+		err   error
+	}{
+		{"simple string", "+OK\r\n", "OK", nil},
+		{"integer", ":42\r\n", int64(42), nil},
+		{"bulk", "$5\r\nhe\r\nl\r\n", []byte("he\r\nl"), nil},
+		{"empty bulk", "$0\r\n\r\n", []byte{}, nil},
+		{"nil bulk", "$-1\r\n", nil, errRedisNil},
+		{"array", "*3\r\n$1\r\na\r\n$-1\r\n:7\r\n", []interface{}{[]byte("a"), nil, int64(7)}, nil},
+		{"nested array", "*2\r\n$1\r\n0\r\n*1\r\n$1\r\nk\r\n", []interface{}{[]byte("0"), []interface{}{[]byte("k")}}, nil},
+		{"nil array", "*-1\r\n", nil, nil},
+		{"server error", "-WRONGPASS invalid password\r\n", nil, redisError("WRONGPASS invalid password")},
+	}
+	for _, tt := range tests {
+		rc := &redisConn{rd: bufio.NewReader(strings.NewReader(tt.input))}
+		got, err := rc.readReply()
+		if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: readReply = %#v, %v; want %#v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+
+	for _, input := range []string{"", "\r\n", "?what\r\n", "$5\r\nab", ":x\r\n", "*2\r\n+OK\r\n"} {
+		rc := &redisConn{rd: bufio.NewReader(strings.NewReader(input))}
+		if _, err := rc.readReply(); err == nil {
+			t.Errorf("readReply(%q) succeeded", input)
+		}
+	}
+}
+
+func TestNewRedisClient(t *testing.T) {
+	tests := []struct {
+		url                      string
+		addr, host, user, passwd string
+		db                       int
+		tls                      bool
+	}{
+		{"redis://localhost", "localhost:6379", "localhost", "", "", 0, false},
+		{"redis://:pw@10.0.0.1:7000/3", "10.0.0.1:7000", "10.0.0.1", "", "pw", 3, false},
+		{"rediss://app:pw@cache.example.com", "cache.example.com:6379", "cache.example.com", "app", "pw", 0, true},
+		{"redis://[::1]:6380", "[::1]:6380", "::1", "", "", 0, false},
+		{"redis://[2001:db8::7]", "[2001:db8::7]:6379", "2001:db8::7", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		c, err := newRedisClient(tt.url, 1)
+		if err != nil {
+			t.Errorf("newRedisClient(%q): %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || c.host != tt.host || c.username != tt.user || c.password != tt.passwd || c.db != tt.db || c.useTLS != tt.tls {
+			t.Errorf("newRedisClient(%q) = %+v", tt.url, c)
+		}
+	}
+
+	for _, raw := range []string{"http://localhost", "redis://localhost/db", "::"} {
+		if _, err := newRedisClient(raw, 1); err == nil {
+			t.Errorf("newRedisClient(%q) succeeded", raw)
+		}
+	}
+}
+
+// fakeRedis serves the commands webshot uses from a map, recording them.
+type fakeRedis struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	commands [][]string
+	user     string // ACL user AUTH must name, "default" for AUTH <password>
+	password string
+}
+
+func startFakeRedis(t *testing.T, user, password string) (*fakeRedis, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeRedis{data: make(map[string][]byte), user: user, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = rd.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			io.ReadFull(rd, buf)
+			args[i] = string(buf[:size])
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			user, pass := "default", args[len(args)-1]
+			if len(args) == 3 {
+				user = args[1]
+			}
+			if authed = user == f.user && pass == f.password; authed {
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "SET":
+			f.data[args[1]] = []byte(args[2])
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			reply = f.bulk(args[1])
+		case cmd == "MGET":
+			reply = fmt.Sprintf("*%d\r\n", len(args)-1)
+			for _, k := range args[1:] {
+				reply += f.bulk(k)
+			}
+		case cmd == "DEL":
+			deleted := 0
+			for _, k := range args[1:] {
+				if _, ok := f.data[k]; ok {
+					delete(f.data, k)
+					deleted++
+				}
+			}
+			reply = fmt.Sprintf(":%d\r\n", deleted)
+		case cmd == "SCAN":
+			var keys []string
+			for k := range f.data {
+				if ok, _ := path.Match(args[3], k); ok {
+					keys = append(keys, k)
+				}
+			}
+			reply = fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+			for _, k := range keys {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(k), k)
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		io.WriteString(conn, reply)
+	}
+}
+
+// bulk answers GET key; callers hold f.mu.
+func (f *fakeRedis) bulk(key string) string {
+	v, ok := f.data[key]
+	if !ok {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+}
+
+func (f *fakeRedis) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.data {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestRedisClientAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverUser string
+		url        string
+		ok         bool
+	}{
+		{"password only", "default", "redis://:secret@%s", true},
+		{"ACL user", "app", "redis://app:secret@%s", true},
+		{"ACL user missing", "app", "redis://:secret@%s", false},
+		{"wrong password", "default", "redis://:nope@%s", false},
+	}
+	for _, tt := range tests {
+		_, addr := startFakeRedis(t, tt.serverUser, "secret")
+		c, err := newRedisClient(fmt.Sprintf(tt.url, addr), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Do("PING")
+		var serverErr redisError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !tt.ok && !errors.As(err, &serverErr):
+			t.Errorf("%s: PING = %v, want an authentication error", tt.name, err)
+		}
+	}
+}
+
+func TestRedisCacheChunks(t *testing.T) {
+	fake, addr := startFakeRedis(t, "", "")
+	client, err := newRedisClient("redis://"+addr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &redisCache{client: client, prefix: "webshot:", chunkSize: 4}
+
+	entry := &cacheEntry{url: "https://example.com/", data: []byte("0123456789"), timestamp: time.Now().UTC()}
+	c.set("k", entry, time.Minute)
+	if n := len(fake.keys()); n != 4 {
+		t.Errorf("stored %d keys (%v), want metadata and 3 chunks", n, fake.keys())
+	}
+	got, ok := c.get("k")
+	if !ok || string(got.data) != "0123456789" || got.url != entry.url {
+		t.Fatalf("get = %+v, %v", got, ok)
+	}
+
+	c.delete("k")
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Errorf("delete left %v behind", keys)
+	}
+
+	// Chunks whose metadata already expired are found by SCAN
+	c.set("k", entry, time.Minute)
+	client.Do("DEL", "webshot:k:meta")
+	c.delete("k")
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Errorf("delete without metadata left %v behind", keys)
+	}
+
+	// A chunk that expired early fails the read rather than returning a
+	// truncated image
+	c.set("k", entry, time.Minute)
+	client.Do("DEL", "webshot:k:chunk:1")
+	if _, ok := c.get("k"); ok {
+		t.Error("entry with a missing chunk was served")
+	}
+}
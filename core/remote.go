@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote DevTools endpoints (CHROME_REMOTE_URLS) to render on instead of
+// spawning local Chrome, e.g. a browserless or Chrome sidecar. Either the
+// ws:// debugger URL or the http:// address serving /json/version works.
+// Each worker is bound to the least loaded healthy backend when it starts.
+var renderBackends []*renderBackend
+
+var (
+	// Workers (sessions) one backend may hold (CHROME_REMOTE_MAX_SESSIONS)
+	backendSessionLimit int
+	// Consecutive failures after which a backend is ejected
+	backendMaxFailures = 3
+	// How long an ejected backend is avoided before it is probed again
+	backendEjectTime = 30 * time.Second
+
+	backendClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+type renderBackend struct {
+	endpoint string
+
+	mu           sync.Mutex
+	sessions     int // workers bound to it
+	failures     int // consecutive failed probes or launches
+	ejectedUntil time.Time
+}
+
+func init() {
+	backendSessionLimit = envInt("CHROME_REMOTE_MAX_SESSIONS", 10, 1, 10000)
+	for _, raw := range strings.Split(os.Getenv("CHROME_REMOTE_URLS"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			log.Fatalf("Invalid CHROME_REMOTE_URLS entry %q", raw)
+		}
+		switch u.Scheme {
+		case "ws", "wss", "http", "https":
+		default:
+			log.Fatalf("Invalid CHROME_REMOTE_URLS entry %q: scheme must be ws, wss, http or https", raw)
+		}
+		renderBackends = append(renderBackends, &renderBackend{endpoint: raw})
+	}
+	if len(renderBackends) > 0 {
+		log.Printf("Rendering on %d remote Chrome endpoints, up to %d sessions each", len(renderBackends), backendSessionLimit)
+	}
+}
+
+// acquireBackend binds a new worker to the healthy backend with the fewest
+// sessions, or returns nil when every backend is full or ejected.
+func acquireBackend() *renderBackend {
+	var best *renderBackend
+	bestSessions := 0
+	for _, b := range renderBackends {
+		b.mu.Lock()
+		ok := b.available() && b.sessions < backendSessionLimit
+		sessions := b.sessions
+		b.mu.Unlock()
+		if ok && (best == nil || sessions < bestSessions) {
+			best, bestSessions = b, sessions
+		}
+	}
+	if best != nil {
+		best.mu.Lock()
+		best.sessions++
+		best.mu.Unlock()
+	}
+	return best
+}
+
+func (b *renderBackend) release() {
+	b.mu.Lock()
+	b.sessions--
+	b.mu.Unlock()
+}
+
+// available reports whether the backend is not ejected. Callers hold b.mu.
+func (b *renderBackend) available() bool {
+	return time.Now().After(b.ejectedUntil)
+}
+
+func (b *renderBackend) healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.available()
+}
+
+// fail records a failed probe or browser launch and ejects the backend once
+// backendMaxFailures happen in a row.
+func (b *renderBackend) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= backendMaxFailures && b.available() {
+		b.ejectedUntil = time.Now().Add(backendEjectTime)
+		log.Printf("Ejecting Chrome backend %s for %v: %v", b.endpoint, backendEjectTime, err)
+	}
+}
+
+func (b *renderBackend) succeed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= backendMaxFailures {
+		log.Printf("Chrome backend %s is healthy again", b.endpoint)
+	}
+	b.failures = 0
+	b.ejectedUntil = time.Time{}
+}
+
+// probe asks the backend for its /json/version document.
+func (b *renderBackend) probe(ctx context.Context) error {
+	u, _ := url.Parse(b.endpoint)
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = "/json/version" // keep the query, it may carry an access token
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("backend answered %s", resp.Status)
+	}
+	return nil
+}
+
+// checkBackends probes every backend every 10 seconds, ejecting failing ones
+// and readmitting them once they answer again.
+func checkBackends() {
+	if len(renderBackends) == 0 {
+		return
+	}
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, b := range renderBackends {
+				if err := b.probe(context.Background()); err != nil {
+					b.fail(err)
+				} else {
+					b.succeed()
+				}
+			}
+		case <-shutdownChan:
+			return
+		}
+	}
+}
+
+// healthyBackends counts backends not currently ejected.
+func healthyBackends() int {
+	n := 0
+	for _, b := range renderBackends {
+		if b.healthy() {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+)
+
+// diffReportTemplate renders a diff run as a single HTML file with every image
+// inlined, so CI systems can archive it as one artifact. Pages are rendered
+// one at a time, so only one page's images are read back into memory.
+var diffReportTemplate = template.Must(template.New("report").Parse(`{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>webshot visual diff report</title>
+<style>
+  body { font-family: system-ui, sans-serif; margin: 2rem; color: #1f2933; }
+  .summary span { display: inline-block; margin-right: 1.5rem; font-weight: 600; }
+  .pass { color: #2f855a; } .fail { color: #c53030; }
+  section { border-top: 1px solid #d2d6dc; padding: 1rem 0; }
+  .images { display: grid; grid-template-columns: repeat(3, 1fr); gap: 1rem; }
+  .images figure { margin: 0; }
+  .images img { width: 100%; border: 1px solid #d2d6dc; }
+  figcaption { font-size: .85rem; color: #52606d; margin-bottom: .25rem; }
+  .error { background: #fff5f5; padding: .5rem; border-radius: 4px; }
+</style>
+</head>
+<body>
+<h1>Visual diff report</h1>
+<p class="summary">
+  <span>{{len .Pages}} pages</span>
+  <span class="pass">{{.Passed}} passed</span>
+  <span class="fail">{{.Failed}} failed</span>
+  <span>threshold {{printf "%.2f" .Threshold}}%</span>
+  <span>{{.Started.Format "2006-01-02 15:04:05 MST"}}, {{printf "%.1f" .Duration}}s</span>
+</p>
+{{end}}
+{{define "page"}}
+<section>
+  <h2 class="{{if .Passed}}pass{{else}}fail{{end}}">{{if .Passed}}PASS{{else}}FAIL{{end}} &middot; {{.Name}}</h2>
+  {{if .Error}}<p class="error">{{.Error}}</p>{{else}}<p>{{printf "%.3f" .DiffPercent}}% of pixels differ</p>{{end}}
+  <div class="images">
+    <figure><figcaption>Before &middot; {{.Before}}</figcaption>{{with .BeforeSrc}}<img src="{{.}}" alt="before">{{end}}</figure>
+    <figure><figcaption>After &middot; {{.After}}</figcaption>{{with .AfterSrc}}<img src="{{.}}" alt="after">{{end}}</figure>
+    <figure><figcaption>Diff</figcaption>{{with .DiffSrc}}<img src="{{.}}" alt="diff">{{end}}</figure>
+  </div>
+</section>
+{{end}}
+{{define "foot"}}
+</body>
+</html>
+{{end}}`))
+
+type diffReportPage struct {
+	*diffPage
+	BeforeSrc template.URL
+	AfterSrc  template.URL
+	DiffSrc   template.URL
+}
+
+// dataURI inlines a spooled image; one that was never written is left out.
+func dataURI(file string) template.URL {
+	if file == "" {
+		return ""
+	}
+	img, err := os.ReadFile(file)
+	if err != nil || len(img) == 0 {
+		return ""
+	}
+	return template.URL("data:" + http.DetectContentType(img) + ";base64," + base64.StdEncoding.EncodeToString(img))
+}
+
+func writeDiffReport(w io.Writer, run *diffRun) error {
+	if err := diffReportTemplate.ExecuteTemplate(w, "head", run); err != nil {
+		return err
+	}
+	for _, p := range run.Pages {
+		page := diffReportPage{
+			diffPage:  p,
+			BeforeSrc: dataURI(p.beforeFile),
+			AfterSrc:  dataURI(p.afterFile),
+			DiffSrc:   dataURI(p.diffFile),
+		}
+		if err := diffReportTemplate.ExecuteTemplate(w, "page", page); err != nil {
+			return err
+		}
+	}
+	return diffReportTemplate.ExecuteTemplate(w, "foot", run)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// writeDiffJUnit renders a diff run as JUnit XML: one test case per page,
+// failing when the diff percentage exceeds the threshold and erroring when
+// the page could not be captured.
+func writeDiffJUnit(w io.Writer, run *diffRun) error {
+	suite := junitTestSuite{
+		Name:      "webshot.visual",
+		Tests:     len(run.Pages),
+		Time:      fmt.Sprintf("%.3f", run.Duration),
+		Timestamp: run.Started.Format("2006-01-02T15:04:05"),
+	}
+
+	for _, p := range run.Pages {
+		tc := junitTestCase{
+			Name:      p.Name,
+			ClassName: "webshot.visual",
+			SystemOut: fmt.Sprintf("before=%s after=%s diff=%.3f%%", p.Before, p.After, p.DiffPercent),
+		}
+		switch {
+		case p.Error != "":
+			suite.Errors++
+			tc.Error = &junitFailure{Message: p.Error, Type: "CaptureError"}
+		case !p.Passed:
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%.3f%% of pixels differ (threshold %.3f%%)", p.DiffPercent, run.Threshold),
+				Type:    "VisualDiff",
+				Body:    fmt.Sprintf("before: %s\nafter: %s", p.Before, p.After),
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}})
+}
+
+// writeDiffTAP renders a diff run in the Test Anything Protocol (version 13).
+func writeDiffTAP(w io.Writer, run *diffRun) error {
+	if _, err := fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(run.Pages)); err != nil {
+		return err
+	}
+	for i, p := range run.Pages {
+		status := "ok"
+		if !p.Passed {
+			status = "not ok"
+		}
+		fmt.Fprintf(w, "%s %d - %s\n", status, i+1, p.Name)
+		fmt.Fprintf(w, "  ---\n  before: %q\n  after: %q\n  diff_percent: %.3f\n  threshold: %.3f\n", p.Before, p.After, p.DiffPercent, run.Threshold)
+		if p.Error != "" {
+			fmt.Fprintf(w, "  error: %q\n", p.Error)
+		}
+		if _, err := io.WriteString(w, "  ...\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http"
+)
+
+// toRGBA returns img as *image.RGBA, converting only when it is not one.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// scaleImage resizes img to w x h by area averaging: every target pixel is
+// the mean of the source pixels it covers, which keeps text and thin lines
+// legible when shrinking screenshots. Enlarging repeats pixels.
+func scaleImage(img image.Image, w, h int) *image.RGBA {
+	src := toRGBA(img)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2], dst.Pix[j+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// resizeCapture scales a PNG down to fit box ("WxH", 0 for no limit on that
+// side), keeping its aspect ratio. Images that already fit are returned as
+// they are.
+func resizeCapture(data []byte, box string) ([]byte, error) {
+	var maxW, maxH int
+	if _, err := fmt.Sscanf(box, "%dx%d", &maxW, &maxH); err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	if scale == 1 {
+		return data, nil
+	}
+	return pngBytes(&pngEncoder, scaleImage(img, max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))))
+}
+
+// cropCapture cuts r out of a PNG, clipped to the image. It fails if r lies
+// entirely outside it.
+func cropCapture(data []byte, r image.Rectangle) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	r = r.Add(b.Min).Intersect(b)
+	if r.Empty() {
+		return nil, &captureError{status: http.StatusBadRequest, message: fmt.Sprintf("'crop' lies outside the %dx%d image", b.Dx(), b.Dy())}
+	}
+	if r == b {
+		return data, nil
+	}
+	crop := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(crop, crop.Bounds(), img, r.Min, draw.Src)
+	return pngBytes(&pngEncoder, crop)
+}
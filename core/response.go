@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	_ "image/png"
+	"io"
+	"net/http"
+	"time"
+)
+
+// captureResponse is the response=json body: the image with what is known
+// about it, plus the report sections the capture asked for.
+type captureResponse struct {
+	ID           string         `json:"id"`
+	ImageBase64  string         `json:"image_base64,omitempty"` // streamed by writeCaptureJSON
+	ContentType  string         `json:"content_type"`
+	Width        int            `json:"width"`
+	Height       int            `json:"height"`
+	FinalURL     string         `json:"final_url,omitempty"`
+	TargetStatus int            `json:"target_status,omitempty"`
+	Timings      captureTimings `json:"timings"`
+	Cache        string         `json:"cache"` // HIT, MISS or STALE, as X-Cache
+	Partial      bool           `json:"partial,omitempty"`
+
+	*pageReport
+}
+
+type captureTimings struct {
+	RenderMS int64 `json:"render_ms"` // when cached, of the original capture
+	TotalMS  int64 `json:"total_ms"`
+}
+
+// writeCaptureJSON answers a capture with a captureResponse. The headers
+// HandleScreenshot set for the image still apply. The image is base64-encoded
+// straight into the (chunked) response rather than into a string the size of
+// a full-page capture and then again into the encoder's buffer.
+func writeCaptureJSON(ctx context.Context, writer http.ResponseWriter, id string, res *screenshotResult, cache string, started time.Time) {
+	body := captureResponse{
+		ID:           id,
+		ContentType:  "image/png",
+		FinalURL:     res.finalURL,
+		TargetStatus: res.status,
+		Timings: captureTimings{
+			RenderMS: res.renderTime.Milliseconds(),
+			TotalMS:  time.Since(started).Milliseconds(),
+		},
+		Cache:      cache,
+		Partial:    res.partial,
+		pageReport: res.report,
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(res.data)); err == nil {
+		body.Width, body.Height = cfg.Width, cfg.Height
+	}
+	if res.report != nil {
+		res.report.mu.Lock()
+		defer res.report.mu.Unlock()
+	}
+	rest, err := json.Marshal(body)
+	if err != nil {
+		http.Error(writer, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+
+	// {"image_base64":"…", followed by the other fields of rest
+	io.WriteString(writer, `{"image_base64":"`)
+	enc := base64.NewEncoder(base64.StdEncoding, contextWriter{ctx, writer})
+	if _, err := enc.Write(res.data); err != nil {
+		return
+	}
+	if err := enc.Close(); err != nil {
+		return
+	}
+	io.WriteString(writer, `",`)
+	writer.Write(rest[1:])
+	io.WriteString(writer, "\n")
+}
+
+// streamChunk bounds how much of a body is written between checks that the
+// client is still there.
+const streamChunk = 64 << 10
+
+// contextReader reads at most streamChunk at a time and fails once ctx is
+// done, so a response copied from it stops as soon as the client goes away
+// instead of pushing the rest of a large capture into a dead connection.
+type contextReader struct {
+	ctx context.Context
+	*bytes.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > streamChunk {
+		p = p[:streamChunk]
+	}
+	return r.Reader.Read(p)
+}
+
+// WriteTo is hidden so copies go through Read.
+func (r contextReader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
+// contextWriter is contextReader for writes.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
@@ -0,0 +1,343 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal S3 API client signing requests with AWS Signature
+// Version 4. It speaks to AWS S3 and to compatible stores (MinIO, R2, and
+// Google Cloud Storage through its interoperability endpoint with HMAC keys).
+// Objects are addressed path-style: <endpoint>/<bucket>/<key>.
+type s3Client struct {
+	sigV4
+	endpoint *url.URL
+	bucket   string
+	client   *http.Client
+}
+
+// sigV4 signs requests to an AWS service with AWS Signature Version 4.
+type sigV4 struct {
+	service   string
+	region    string
+	accessKey string
+	secretKey string
+	// sessionToken is sent for temporary credentials (AWS_SESSION_TOKEN)
+	sessionToken string
+}
+
+// s3ClientForBucket connects to bucket with the S3_* endpoint and credentials.
+func s3ClientForBucket(bucket string) (*s3Client, error) {
+	return newS3Client(os.Getenv("S3_ENDPOINT"), bucket, envOr("S3_REGION", "us-east-1"),
+		os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"))
+}
+
+func newS3Client(endpoint, bucket, region, accessKey, secretKey string) (*s3Client, error) {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	return &s3Client{
+		sigV4:    sigV4{service: "s3", region: region, accessKey: accessKey, secretKey: secretKey},
+		endpoint: u,
+		bucket:   bucket,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func (c *s3Client) String() string {
+	return c.endpoint.Host + "/" + c.bucket
+}
+
+func (c *s3Client) ObjectURL(key string) string {
+	return c.objectURL(key).String()
+}
+
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = awsURIEncode(u.Path, false)
+	return &u
+}
+
+func (c *s3Client) Put(ctx context.Context, key string, data []byte, contentType string, meta map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(key).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range meta {
+		req.Header.Set("X-Amz-Meta-"+k, v)
+	}
+	resp, err := c.do(req, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) Get(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readObject(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, objectMeta(resp.Header, "x-amz-meta-"), nil
+}
+
+// objectMeta collects the headers starting with prefix (lower case).
+func objectMeta(header http.Header, prefix string) map[string]string {
+	meta := make(map[string]string)
+	for name, values := range header {
+		if k, ok := strings.CutPrefix(strings.ToLower(name), prefix); ok && len(values) > 0 {
+			meta[k] = values[0]
+		}
+	}
+	return meta
+}
+
+func (c *s3Client) Head(ctx context.Context, key string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectMeta(resp.Header, "x-amz-meta-"), nil
+}
+
+func (c *s3Client) List(ctx context.Context, prefix string) ([]string, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	return listBucketV2(ctx, u, prefix, func(req *http.Request) (*http.Response, error) {
+		return c.do(req, nil)
+	})
+}
+
+// listBucketV2 pages through a ListObjectsV2 listing of bucket, which S3 and
+// the GCS XML API both speak, following continuation tokens.
+func listBucketV2(ctx context.Context, bucket url.URL, prefix string, do func(*http.Request) (*http.Response, error)) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		u := bucket
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(q)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (c *s3Client) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, nil)
+	if err != nil {
+		if isBlobStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) Presign(key string, expiry time.Duration) (string, error) {
+	now := time.Now().UTC()
+	u := c.objectURL(key)
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", c.accessKey+"/"+c.scope(now))
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", fmt.Sprint(int(expiry.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.RawPath,
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	q.Set("X-Amz-Signature", c.signature(now, canonical))
+	u.RawQuery = canonicalQuery(q)
+	return u.String(), nil
+}
+
+func (c *s3Client) do(req *http.Request, body []byte) (*http.Response, error) {
+	c.sign(req, body)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, &blobError{service: "s3", status: resp.StatusCode, body: string(msg)}
+	}
+	return resp, nil
+}
+
+// sign adds the SigV4 Authorization header to req.
+func (c sigV4) sign(req *http.Request, body []byte) {
+	now := time.Now().UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, c.scope(now), signedHeaders, c.signature(now, canonical)))
+}
+
+func (c sigV4) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + c.region + "/" + c.service + "/aws4_request"
+}
+
+func (c sigV4) signature(t time.Time, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + c.scope(t) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, c.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, keeping
+// '/' unless encodeSlash is set, as SigV4 requires.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
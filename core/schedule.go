@@ -0,0 +1,482 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recurring captures registered with POST /schedules. Definitions and run
+// history persist in SCHEDULES_FILE; the images of each run go to
+// SCHEDULE_STORE: "dir" (files under SCHEDULE_DIR, the default) or "s3" (the
+// S3_* bucket under S3_SCHEDULE_PREFIX).
+type schedule struct {
+	ID      string            `json:"id"`
+	URL     string            `json:"url"`
+	Cron    string            `json:"cron"`
+	Options map[string]string `json:"options,omitempty"` // /get parameters
+	Retries int               `json:"retries"`           // extra attempts per run
+	Paused  bool              `json:"paused,omitempty"`
+	KeyName string            `json:"key,omitempty"` // API key the runs are made with
+	Created time.Time         `json:"created"`
+	NextRun time.Time         `json:"next_run"`
+	History []*scheduleRun    `json:"history"` // newest first
+	Monitor *monitorConfig    `json:"monitor,omitempty"`
+
+	// Windows and blackouts skip runs; Timezone also applies to Cron
+	executionPolicy
+
+	owner   string
+	cron    *cronSpec
+	running bool
+}
+
+type scheduleRun struct {
+	ID         string    `json:"id"`
+	Started    time.Time `json:"started"`
+	Status     string    `json:"status"` // ok, failed or skipped
+	Attempts   int       `json:"attempts,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	FinalURL   string    `json:"final_url,omitempty"`
+	Bytes      int       `json:"bytes,omitempty"`
+	Image      string    `json:"image,omitempty"`
+
+	// Monitors only: change against the previous capture
+	DiffPercent *float64 `json:"diff_percent,omitempty"`
+	Changed     bool     `json:"changed,omitempty"`
+	Diff        string   `json:"diff,omitempty"`
+	AlertError  string   `json:"alert_error,omitempty"`
+}
+
+var (
+	// Schedules by owner, as for credentials
+	schedules      map[string][]*schedule
+	schedulesLock  sync.Mutex
+	schedulesFile  string
+	scheduleImages objectStore
+
+	// Runs kept per schedule; older ones are deleted with their images
+	scheduleHistory = 50
+	// Delay before the first retry of a failed run, doubling per attempt
+	scheduleRetryDelay = 30 * time.Second
+
+	errRunSkipped = errors.New("run skipped")
+)
+
+func init() {
+	scheduleHistory = envInt("SCHEDULE_HISTORY", scheduleHistory, 1, 10000)
+
+	store, err := openObjectStore(envOr("SCHEDULE_STORE", "dir"), envOr("SCHEDULE_DIR", "schedules"), envOr("S3_SCHEDULE_PREFIX", "webshot/schedules/"))
+	if err != nil {
+		log.Fatalf("Invalid SCHEDULE_STORE configuration: %v", err)
+	}
+	scheduleImages = store
+
+	schedules = make(map[string][]*schedule)
+	schedulesFile = os.Getenv("SCHEDULES_FILE")
+	if schedulesFile == "" {
+		return
+	}
+	data, err := os.ReadFile(schedulesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Failed to read SCHEDULES_FILE: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		log.Fatalf("Invalid SCHEDULES_FILE: %v", err)
+	}
+	now := time.Now()
+	for owner, list := range schedules {
+		for _, s := range list {
+			if err := s.compile(owner); err != nil {
+				log.Fatalf("Invalid schedule %s/%s: %v", owner, s.ID, err)
+			}
+			// Runs missed while the server was down are not caught up
+			if s.NextRun.Before(now) {
+				s.NextRun = s.next(now)
+			}
+		}
+	}
+}
+
+// saveSchedules persists every schedule; callers must hold schedulesLock.
+func saveSchedules() {
+	if schedulesFile == "" {
+		return
+	}
+	data, err := json.Marshal(schedules)
+	if err == nil {
+		err = os.WriteFile(schedulesFile, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to save schedules: %v", err)
+	}
+}
+
+func (s *schedule) compile(owner string) error {
+	s.owner = owner
+	if err := s.executionPolicy.compile(); err != nil {
+		return err
+	}
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+	s.cron = cron
+	if s.Retries < 0 || s.Retries > 5 {
+		return fmt.Errorf("retries must be between 0 and 5")
+	}
+	if s.Monitor != nil {
+		return s.Monitor.compile()
+	}
+	return nil
+}
+
+// imageKey is where the image of run is stored.
+func (s *schedule) imageKey(run string) string {
+	return url.PathEscape(s.owner) + "/" + s.ID + "/" + run + ".png"
+}
+
+// deleteImages removes what run stored.
+func (s *schedule) deleteImages(ctx context.Context, run *scheduleRun) {
+	if run.Image != "" {
+		scheduleImages.Delete(ctx, s.imageKey(run.ID))
+	}
+	if run.Diff != "" {
+		scheduleImages.Delete(ctx, s.imageKey(run.ID+".diff"))
+	}
+}
+
+// next is the first run time after t, zero if the expression never fires.
+func (s *schedule) next(t time.Time) time.Time {
+	return s.cron.next(t.In(s.location))
+}
+
+// request rebuilds the capture request a run makes, authenticated as the
+// key that created the schedule.
+func (s *schedule) request(ctx context.Context) (*http.Request, error) {
+	if s.KeyName != "" {
+		key := apiKeyNamed(s.KeyName)
+		if key == nil {
+			return nil, fmt.Errorf("API key %s no longer exists", s.KeyName)
+		}
+		ctx = context.WithValue(ctx, apiKeyContextKey{}, key)
+	}
+	query := url.Values{}
+	for name, value := range s.Options {
+		query.Set(name, value)
+	}
+	query.Set("url", s.URL)
+	return http.NewRequestWithContext(ctx, http.MethodGet, "/get?"+query.Encode(), nil)
+}
+
+// runSchedules starts due schedules every 15 seconds until shutdown.
+func runSchedules() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			schedulesLock.Lock()
+			for _, list := range schedules {
+				for _, s := range list {
+					if s.Paused || s.running || s.NextRun.IsZero() || s.NextRun.After(now) {
+						continue
+					}
+					s.running = true
+					s.NextRun = s.next(now)
+					go s.run(now)
+				}
+			}
+			schedulesLock.Unlock()
+		case <-shutdownChan:
+			return
+		}
+	}
+}
+
+// run captures the page once, retrying failures that are not the request's
+// fault, stores the image and records the outcome in the history.
+func (s *schedule) run(now time.Time) {
+	run := &scheduleRun{ID: now.UTC().Format("20060102T150405Z"), Started: now.UTC(), Status: "failed"}
+	data, err := s.capture(run)
+	run.DurationMS = time.Since(now).Milliseconds()
+
+	switch {
+	case err == errRunSkipped:
+		run.Status, run.Error = "skipped", "outside the schedule's execution windows"
+	case err != nil:
+		run.Error = err.Error()
+		log.Printf("Scheduled capture %s/%s of %s failed: %v", s.owner, s.ID, s.URL, err)
+	default:
+		key := s.imageKey(run.ID)
+		if err := scheduleImages.Put(context.Background(), key, data, "image/png"); err != nil {
+			run.Error = "storing capture: " + err.Error()
+			log.Printf("Error storing scheduled capture %s: %v", key, err)
+			break
+		}
+		run.Status, run.Bytes = "ok", len(data)
+		run.Image = "/schedules/" + s.ID + "/runs/" + run.ID
+		if s.Monitor != nil {
+			s.compareRun(run, data)
+		}
+	}
+
+	schedulesLock.Lock()
+	defer schedulesLock.Unlock()
+	s.running = false
+	if findSchedule(s.owner, s.ID) != s {
+		// Deleted while running
+		s.deleteImages(context.Background(), run)
+		return
+	}
+	s.History = append([]*scheduleRun{run}, s.History...)
+	for len(s.History) > scheduleHistory {
+		old := s.History[len(s.History)-1]
+		s.History = s.History[:len(s.History)-1]
+		s.deleteImages(context.Background(), old)
+	}
+	saveSchedules()
+}
+
+func (s *schedule) capture(run *scheduleRun) ([]byte, error) {
+	if !s.permits(run.Started) {
+		return nil, errRunSkipped
+	}
+	r, err := s.request(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if quotaExceeded(r.Context()) {
+		return nil, errors.New("capture quota exceeded")
+	}
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	opts.refresh = true
+
+	delay := scheduleRetryDelay
+	for {
+		run.Attempts++
+		res, err := screenshotFor(r.Context(), opts)
+		if err == nil {
+			run.FinalURL = res.finalURL
+			return res.data, nil
+		}
+		var ce *captureError
+		if run.Attempts > s.Retries || (errors.As(err, &ce) && ce.status < 500) {
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-shutdownChan:
+			return nil, err
+		}
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// findSchedule returns the caller's schedule id; callers must hold
+// schedulesLock.
+func findSchedule(owner, id string) *schedule {
+	for _, s := range schedules[owner] {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// HandleSchedules lists the caller's schedules (GET) or registers one (POST)
+// from {"url","cron","options","retries","timezone","windows","blackouts",
+// "monitor"}.
+func HandleSchedules(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "schedules") {
+		return
+	}
+	owner := credentialOwner(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		schedulesLock.Lock()
+		list := append([]*schedule{}, schedules[owner]...)
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(list)
+		schedulesLock.Unlock()
+
+	case http.MethodPost:
+		s := &schedule{Retries: 2}
+		if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 64<<10)).Decode(s); err != nil {
+			http.Error(writer, "Invalid schedule JSON", http.StatusBadRequest)
+			return
+		}
+		if err := s.compile(owner); err != nil {
+			http.Error(writer, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.Options["url"]; ok {
+			http.Error(writer, "Invalid schedule: url belongs outside options", http.StatusBadRequest)
+			return
+		}
+		if err := checkTargetURL(s.URL); err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+		s.ID, s.Created, s.History, s.KeyName = randomID(), time.Now().UTC(), []*scheduleRun{}, ""
+		if key := apiKeyFrom(r.Context()); key != nil {
+			s.KeyName = key.Name
+		}
+		// Validate the capture options the way every run will parse them
+		req, err := s.request(r.Context())
+		if err == nil {
+			_, err = parseCaptureOptions(req)
+		}
+		if err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+		if s.NextRun = s.next(time.Now()); s.NextRun.IsZero() {
+			http.Error(writer, "Invalid schedule: cron expression never fires", http.StatusBadRequest)
+			return
+		}
+
+		schedulesLock.Lock()
+		schedules[owner] = append(schedules[owner], s)
+		saveSchedules()
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Location", "/schedules/"+s.ID)
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(s)
+		schedulesLock.Unlock()
+		log.Printf("Scheduled %s for %s (%s), next run %s", s.URL, owner, s.Cron, s.NextRun.Format(time.RFC3339))
+
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleSchedule returns a schedule with its run history (GET), pauses or
+// resumes it with {"paused":bool} (PATCH), or removes it and its stored
+// images (DELETE).
+func HandleSchedule(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "schedules") {
+		return
+	}
+	owner := credentialOwner(r.Context())
+
+	schedulesLock.Lock()
+	defer schedulesLock.Unlock()
+	s := findSchedule(owner, r.PathValue("id"))
+	if s == nil {
+		http.Error(writer, "Schedule not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(s)
+
+	case http.MethodPatch:
+		var patch struct {
+			Paused *bool `json:"paused"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 4<<10)).Decode(&patch); err != nil || patch.Paused == nil {
+			http.Error(writer, `Expected {"paused":true|false}`, http.StatusBadRequest)
+			return
+		}
+		s.Paused = *patch.Paused
+		if !s.Paused {
+			s.NextRun = s.next(time.Now())
+		}
+		saveSchedules()
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(s)
+
+	case http.MethodDelete:
+		list := schedules[owner]
+		for i, existing := range list {
+			if existing == s {
+				schedules[owner] = append(list[:i:i], list[i+1:]...)
+				break
+			}
+		}
+		saveSchedules()
+		for _, run := range s.History {
+			s.deleteImages(r.Context(), run)
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.Header().Set("Allow", "GET, PATCH, DELETE")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleScheduleRun serves the image a scheduled run captured, or with a
+// /diff suffix the difference image of a monitor run.
+func HandleScheduleRun(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "schedules") {
+		return
+	}
+	owner := credentialOwner(r.Context())
+	diff := strings.HasSuffix(r.URL.Path, "/diff")
+
+	schedulesLock.Lock()
+	var run *scheduleRun
+	var key string
+	if s := findSchedule(owner, r.PathValue("id")); s != nil {
+		for _, candidate := range s.History {
+			if candidate.ID != r.PathValue("run") {
+				continue
+			}
+			if !diff && candidate.Image != "" {
+				run, key = candidate, s.imageKey(candidate.ID)
+			} else if diff && candidate.Diff != "" {
+				run, key = candidate, s.imageKey(candidate.ID+".diff")
+			}
+		}
+	}
+	schedulesLock.Unlock()
+	if run == nil {
+		http.Error(writer, "Run not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := scheduleImages.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, errObjectNotFound) {
+			http.Error(writer, "Run image no longer stored", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading scheduled capture: %v", err)
+		http.Error(writer, "Error loading capture", http.StatusBadGateway)
+		return
+	}
+	writer.Header().Set("Content-Type", "image/png")
+	serveImage(writer, r, data, run.Started)
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Stores whose contents let someone act as a tenant's users (secrets, session
+// profiles, OAuth credentials) are sealed at rest with AES-256-GCM under a
+// master key: SECRETS_KEY (32 random bytes, base64, e.g. from `openssl rand
+// -base64 32`), or a data key wrapped by AWS KMS (SECRETS_KMS_KEY, the
+// base64 CiphertextBlob) that is unwrapped once at startup.
+var (
+	secretsKeyOnce sync.Once
+	secretsAEAD    cipher.AEAD
+)
+
+// secretsCipher returns the master key's AEAD, nil if none is configured.
+// It is loaded on first use, as stores read in their own init.
+func secretsCipher() cipher.AEAD {
+	secretsKeyOnce.Do(func() {
+		raw, wrapped := os.Getenv("SECRETS_KEY"), os.Getenv("SECRETS_KMS_KEY")
+		var key []byte
+		var err error
+		switch {
+		case raw != "" && wrapped != "":
+			log.Fatalf("Set one of SECRETS_KEY and SECRETS_KMS_KEY")
+		case raw != "":
+			key, err = base64.StdEncoding.DecodeString(raw)
+		case wrapped != "":
+			var blob []byte
+			if blob, err = base64.StdEncoding.DecodeString(wrapped); err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				key, err = kmsDecrypt(ctx, blob)
+				cancel()
+			}
+			if err != nil {
+				log.Fatalf("Cannot unwrap SECRETS_KMS_KEY: %v", err)
+			}
+		default:
+			return
+		}
+		if err != nil || len(key) != 32 {
+			log.Fatalf("Invalid master key: want 32 bytes, base64 encoded")
+		}
+		block, err := aes.NewCipher(key)
+		if err == nil {
+			secretsAEAD, err = cipher.NewGCM(block)
+		}
+		if err != nil {
+			log.Fatalf("Invalid master key: %v", err)
+		}
+	})
+	return secretsAEAD
+}
+
+var errNoSecretsKey = errors.New("no master key (SECRETS_KEY or SECRETS_KMS_KEY)")
+
+// seal encrypts plaintext with a random nonce, which it prepends. label names
+// what is sealed, so one store's data cannot be passed off as another's.
+func seal(label string, plaintext []byte) ([]byte, error) {
+	aead := secretsCipher()
+	if aead == nil {
+		return nil, errNoSecretsKey
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(label)), nil
+}
+
+// unseal reverses seal, failing if the data was sealed under another key or
+// label or has been tampered with.
+func unseal(label string, sealed []byte) ([]byte, error) {
+	aead := secretsCipher()
+	if aead == nil {
+		return nil, errNoSecretsKey
+	}
+	n := aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("sealed data is truncated")
+	}
+	plaintext, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(label))
+	if err != nil {
+		return nil, errors.New("cannot decrypt: wrong master key or corrupted data")
+	}
+	return plaintext, nil
+}
+
+var (
+	// Named secrets by owner and name, each sealed on its own so values
+	// are only decrypted when used (SECRETS_FILE)
+	secrets     map[string]map[string][]byte
+	secretsLock sync.RWMutex
+	secretsFile string
+)
+
+func init() {
+	secrets = make(map[string]map[string][]byte)
+
+	secretsFile = os.Getenv("SECRETS_FILE")
+	if secretsFile == "" {
+		return
+	}
+	if secretsCipher() == nil {
+		log.Fatalf("SECRETS_FILE needs SECRETS_KEY or SECRETS_KMS_KEY")
+	}
+	data, err := os.ReadFile(secretsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Failed to read SECRETS_FILE: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		log.Fatalf("Invalid SECRETS_FILE: %v", err)
+	}
+}
+
+// saveSecrets persists the store; callers must hold secretsLock.
+func saveSecrets() {
+	if secretsFile == "" {
+		return
+	}
+	data, err := json.Marshal(secrets)
+	if err == nil {
+		err = os.WriteFile(secretsFile, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to save secrets: %v", err)
+	}
+}
+
+func secretLabel(owner, name string) string {
+	return "webshot secret " + owner + "/" + name
+}
+
+// secretValue decrypts owner's secret name.
+func secretValue(owner, name string) (string, error) {
+	secretsLock.RLock()
+	sealed, ok := secrets[owner][name]
+	secretsLock.RUnlock()
+	if !ok {
+		return "", &captureError{status: http.StatusBadRequest, message: "Unknown secret " + name}
+	}
+	value, err := unseal(secretLabel(owner, name), sealed)
+	if err != nil {
+		log.Printf("Secret %s/%s: %v", owner, name, err)
+		return "", &captureError{status: http.StatusInternalServerError, message: "Cannot decrypt secret " + name}
+	}
+	return string(value), nil
+}
+
+// HandleSecrets lists (GET), stores or replaces (POST) and removes (DELETE
+// ?name=) the caller's secrets, such as passwords login steps refer to.
+// Values are write-only.
+func HandleSecrets(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "secrets") {
+		return
+	}
+	if secretsCipher() == nil {
+		http.Error(writer, "Secrets need a master key (SECRETS_KEY or SECRETS_KMS_KEY)", http.StatusNotImplemented)
+		return
+	}
+	owner := credentialOwner(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		type summary struct {
+			Name string `json:"name"`
+		}
+		secretsLock.RLock()
+		names := slices.Sorted(maps.Keys(secrets[owner]))
+		secretsLock.RUnlock()
+		list := []summary{}
+		for _, name := range names {
+			list = append(list, summary{name})
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(list)
+
+	case http.MethodPost:
+		var req struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 16<<10)).Decode(&req); err != nil {
+			http.Error(writer, "Invalid secret JSON", http.StatusBadRequest)
+			return
+		}
+		if !storeName.MatchString(req.Name) || req.Value == "" {
+			http.Error(writer, "Invalid secret: name must be 1-64 letters, digits, '.', '_' or '-' and value is required", http.StatusBadRequest)
+			return
+		}
+		sealed, err := seal(secretLabel(owner, req.Name), []byte(req.Value))
+		if err != nil {
+			log.Printf("Failed to seal secret: %v", err)
+			http.Error(writer, "Failed to store secret", http.StatusInternalServerError)
+			return
+		}
+
+		secretsLock.Lock()
+		if secrets[owner] == nil {
+			secrets[owner] = make(map[string][]byte)
+		}
+		secrets[owner][req.Name] = sealed
+		saveSecrets()
+		secretsLock.Unlock()
+
+		writer.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		secretsLock.Lock()
+		_, found := secrets[owner][name]
+		if found {
+			delete(secrets[owner], name)
+			saveSecrets()
+		}
+		secretsLock.Unlock()
+
+		if !found {
+			http.Error(writer, "Secret not found", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+// useMasterKey seals with key for the duration of the test.
+func useMasterKey(t *testing.T, key []byte) {
+	t.Helper()
+	saved := secretsCipher()
+	t.Cleanup(func() { secretsAEAD = saved })
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secretsAEAD, err = cipher.NewGCM(block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	useMasterKey(t, bytes.Repeat([]byte{7}, 32))
+	plaintext := []byte("hunter2")
+
+	a, err := seal("webshot secret tenant:acme/db", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := seal("webshot secret tenant:acme/db", plaintext)
+	if bytes.Equal(a, b) {
+		t.Error("sealing twice gave the same ciphertext: nonce reused")
+	}
+	if bytes.Contains(a, plaintext) {
+		t.Error("sealed data contains the plaintext")
+	}
+
+	got, err := unseal("webshot secret tenant:acme/db", a)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("unseal = %q, %v", got, err)
+	}
+}
+
+func TestUnsealRejects(t *testing.T) {
+	useMasterKey(t, bytes.Repeat([]byte{7}, 32))
+	sealed, err := seal("webshot secret tenant:acme/db", []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		label string
+		data  []byte
+	}{
+		{"other label", "webshot secret key:acme/db", sealed},
+		{"tampered", "webshot secret tenant:acme/db", flipped},
+		{"truncated", "webshot secret tenant:acme/db", sealed[:5]},
+		{"empty", "webshot secret tenant:acme/db", nil},
+	}
+	for _, tt := range tests {
+		if _, err := unseal(tt.label, tt.data); err == nil {
+			t.Errorf("%s: unseal succeeded", tt.name)
+		}
+	}
+
+	useMasterKey(t, bytes.Repeat([]byte{8}, 32))
+	if _, err := unseal("webshot secret tenant:acme/db", sealed); err == nil {
+		t.Error("unsealed under another master key")
+	}
+}
+
+func TestSealWithoutMasterKey(t *testing.T) {
+	saved := secretsCipher()
+	defer func() { secretsAEAD = saved }()
+	secretsAEAD = nil
+
+	if _, err := seal("label", []byte("x")); err != errNoSecretsKey {
+		t.Errorf("seal = %v, want errNoSecretsKey", err)
+	}
+	if _, err := unseal("label", []byte("x")); err != errNoSecretsKey {
+		t.Errorf("unseal = %v, want errNoSecretsKey", err)
+	}
+}
@@ -0,0 +1,416 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/chromedp"
+)
+
+// sessionProfile is a tenant's named browser session: the cookies and
+// localStorage left by a login scenario, restored into every capture with
+// profile=<name> and updated from it, so recurring captures of dashboards
+// stay logged in. The login's own inputs are not kept.
+type sessionProfile struct {
+	Name    string                       `json:"name"`
+	Match   []string                     `json:"match"` // same syntax as URL_ALLOWLIST
+	Cookies []*network.CookieParam       `json:"cookies"`
+	Storage map[string]map[string]string `json:"local_storage,omitempty"` // origin -> key -> value
+	Created time.Time                    `json:"created"`
+	Updated time.Time                    `json:"updated"`
+
+	owner string
+	rules urlRules
+}
+
+// loginScenario signs in to create a profile: load URL, then run Steps.
+type loginScenario struct {
+	URL   string      `json:"url"`
+	Steps []loginStep `json:"steps"`
+}
+
+// loginStep is one of fill (type Value, or the caller's stored Secret, into
+// Selector), click (Selector), wait (until Selector is visible) or sleep (MS
+// milliseconds).
+type loginStep struct {
+	Action   string `json:"action"`
+	Selector string `json:"selector,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+	MS       int    `json:"ms,omitempty"`
+}
+
+const maxLoginSteps = 50
+
+var (
+	// Session profiles by owner (SESSION_PROFILES_FILE, sealed with the
+	// master key). The lock also guards each profile's session state.
+	sessionProfiles     map[string][]*sessionProfile
+	sessionProfilesLock sync.RWMutex
+	sessionProfilesFile string
+
+	storeName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+const sessionProfilesLabel = "webshot session profiles"
+
+func init() {
+	sessionProfiles = make(map[string][]*sessionProfile)
+
+	sessionProfilesFile = os.Getenv("SESSION_PROFILES_FILE")
+	if sessionProfilesFile == "" {
+		return
+	}
+	if secretsCipher() == nil {
+		log.Fatalf("SESSION_PROFILES_FILE needs SECRETS_KEY or SECRETS_KMS_KEY: session cookies are as good as passwords")
+	}
+	data, err := os.ReadFile(sessionProfilesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Failed to read SESSION_PROFILES_FILE: %v", err)
+		}
+		return
+	}
+	if data, err = unseal(sessionProfilesLabel, data); err != nil {
+		log.Fatalf("Failed to read SESSION_PROFILES_FILE: %v", err)
+	}
+	if err := json.Unmarshal(data, &sessionProfiles); err != nil {
+		log.Fatalf("Invalid SESSION_PROFILES_FILE: %v", err)
+	}
+	for owner, list := range sessionProfiles {
+		for _, p := range list {
+			if err := p.compile(owner); err != nil {
+				log.Fatalf("Invalid session profile %s/%s: %v", owner, p.Name, err)
+			}
+		}
+	}
+}
+
+// saveSessionProfiles persists the store; callers must hold
+// sessionProfilesLock.
+func saveSessionProfiles() {
+	if sessionProfilesFile == "" {
+		return
+	}
+	data, err := json.Marshal(sessionProfiles)
+	if err == nil {
+		data, err = seal(sessionProfilesLabel, data)
+	}
+	if err == nil {
+		err = os.WriteFile(sessionProfilesFile, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to save session profiles: %v", err)
+	}
+}
+
+func (p *sessionProfile) compile(owner string) error {
+	p.owner = owner
+	if !storeName.MatchString(p.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	if len(p.Match) == 0 {
+		return fmt.Errorf("match must list the sites the session is used for")
+	}
+	var err error
+	p.rules, err = parseURLRules(strings.Join(p.Match, ","))
+	return err
+}
+
+func (p *sessionProfile) matches(raw string) bool {
+	return p.rules.match(raw)
+}
+
+// sessionProfileFor returns the caller's profile name for target. Errors are
+// *captureError.
+func sessionProfileFor(ctx context.Context, name, target string) (*sessionProfile, error) {
+	sessionProfilesLock.RLock()
+	defer sessionProfilesLock.RUnlock()
+	for _, p := range sessionProfiles[credentialOwner(ctx)] {
+		if p.Name != name {
+			continue
+		}
+		if !p.matches(target) {
+			return nil, &captureError{status: http.StatusBadRequest, message: fmt.Sprintf("Session profile %q is not for this URL", name)}
+		}
+		return p, nil
+	}
+	return nil, &captureError{status: http.StatusNotFound, message: fmt.Sprintf("Unknown session profile %q", name)}
+}
+
+// restoreStorage puts a profile's localStorage back, on the first load of
+// each origin in the tab.
+const restoreStorage = `(function(storage) {
+	var items = storage[location.origin];
+	if (!items) return;
+	for (var key in items) {
+		if (localStorage.getItem(key) === null) localStorage.setItem(key, items[key]);
+	}
+})(%s)`
+
+// restore loads the profile into a fresh browser context before navigation.
+func (p *sessionProfile) restore() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		sessionProfilesLock.RLock()
+		cookies := slices.Clone(p.Cookies)
+		local, err := json.Marshal(p.Storage)
+		sessionProfilesLock.RUnlock()
+		if err != nil {
+			return err
+		}
+		if len(cookies) > 0 {
+			if err := network.SetCookies(cookies).Do(ctx); err != nil {
+				return err
+			}
+		}
+		_, err = page.AddScriptToEvaluateOnNewDocument(fmt.Sprintf(restoreStorage, local)).Do(ctx)
+		return err
+	})
+}
+
+// record replaces the profile's cookies with those of ctx's browser context
+// and its localStorage for the page's origin with the page's.
+func (p *sessionProfile) record() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		c := chromedp.FromContext(ctx)
+		cookies, err := storage.GetCookies().WithBrowserContextID(c.BrowserContextID).Do(cdp.WithExecutor(ctx, c.Browser))
+		if err != nil {
+			return err
+		}
+		var local struct {
+			Origin string            `json:"origin"`
+			Items  map[string]string `json:"items"`
+		}
+		// Pages on opaque origins have no localStorage; keep what there is
+		localErr := chromedp.Evaluate(`({origin: location.origin, items: Object.fromEntries(Object.entries(localStorage))})`, &local).Do(ctx)
+
+		sessionProfilesLock.Lock()
+		defer sessionProfilesLock.Unlock()
+		p.Cookies = nil
+		for _, ck := range cookies {
+			param := &network.CookieParam{
+				Name: ck.Name, Value: ck.Value, Domain: ck.Domain, Path: ck.Path,
+				Secure: ck.Secure, HTTPOnly: ck.HTTPOnly, SameSite: ck.SameSite,
+				Priority: ck.Priority, SourceScheme: ck.SourceScheme, SourcePort: ck.SourcePort,
+				PartitionKey: ck.PartitionKey,
+			}
+			if !ck.Session {
+				expires := cdp.TimeSinceEpoch(time.Unix(int64(ck.Expires), 0))
+				param.Expires = &expires
+			}
+			p.Cookies = append(p.Cookies, param)
+		}
+		if localErr == nil && local.Origin != "null" && p.matches(local.Origin) {
+			if p.Storage == nil {
+				p.Storage = make(map[string]map[string]string)
+			}
+			p.Storage[local.Origin] = local.Items
+		}
+		p.Updated = time.Now()
+		return nil
+	})
+}
+
+// update records what a capture changed in the session, e.g. refreshed
+// cookies, from its still open tab and saves the store.
+func (p *sessionProfile) update(tabCtx context.Context) {
+	ctx, cancel := context.WithTimeout(tabCtx, 5*time.Second)
+	defer cancel()
+	if err := chromedp.Run(ctx, p.record()); err != nil {
+		log.Printf("Failed to update session profile %s/%s: %v", p.owner, p.Name, err)
+		return
+	}
+	sessionProfilesLock.Lock()
+	saveSessionProfiles()
+	sessionProfilesLock.Unlock()
+}
+
+func (s loginScenario) validate() error {
+	if s.URL == "" {
+		return fmt.Errorf("login.url is required")
+	}
+	if len(s.Steps) > maxLoginSteps {
+		return fmt.Errorf("at most %d login steps", maxLoginSteps)
+	}
+	for i, step := range s.Steps {
+		switch {
+		case step.Action == "sleep" && (step.MS <= 0 || step.MS > 30000):
+			return fmt.Errorf("step %d: sleep needs ms between 1 and 30000", i+1)
+		case step.Action == "sleep":
+		case step.Action != "fill" && step.Action != "click" && step.Action != "wait":
+			return fmt.Errorf("step %d: action must be fill, click, wait or sleep", i+1)
+		case step.Selector == "":
+			return fmt.Errorf("step %d: %s needs a selector", i+1, step.Action)
+		case step.Secret != "" && (step.Action != "fill" || step.Value != ""):
+			return fmt.Errorf("step %d: secret replaces the value of a fill", i+1)
+		}
+	}
+	return nil
+}
+
+// actions returns the steps to run, with owner's secrets filled in. Errors
+// are *captureError.
+func (s loginScenario) actions(owner string) (chromedp.Tasks, error) {
+	var tasks chromedp.Tasks
+	for _, step := range s.Steps {
+		switch step.Action {
+		case "fill":
+			value := step.Value
+			if step.Secret != "" {
+				var err error
+				if value, err = secretValue(owner, step.Secret); err != nil {
+					return nil, err
+				}
+			}
+			tasks = append(tasks, chromedp.SendKeys(step.Selector, value, chromedp.ByQuery))
+		case "click":
+			tasks = append(tasks, chromedp.Click(step.Selector, chromedp.ByQuery))
+		case "wait":
+			tasks = append(tasks, chromedp.WaitVisible(step.Selector, chromedp.ByQuery))
+		case "sleep":
+			tasks = append(tasks, chromedp.Sleep(time.Duration(step.MS)*time.Millisecond))
+		}
+	}
+	return tasks, nil
+}
+
+// login runs s in a fresh browser context, the way a capture loads a page,
+// and records the session it ends with into p. Errors are *captureError.
+func (p *sessionProfile) login(ctx context.Context, s loginScenario, client string) error {
+	steps, err := s.actions(p.owner)
+	if err != nil {
+		return err
+	}
+	opts := newCaptureOptions(ctx, s.URL, 1280, 720)
+	opts.client, opts.isolated = client, true
+	return inspectPage(ctx, opts, nil, chromedp.Tasks{
+		steps,
+		chromedp.Sleep(defaults.settleDelay),
+		p.record(),
+	})
+}
+
+// HandleProfiles lists (GET), creates or replaces by logging in (POST) and
+// removes (DELETE ?name=) the caller's session profiles. Cookies and storage
+// are never returned.
+func HandleProfiles(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "profiles") {
+		return
+	}
+	owner := credentialOwner(r.Context())
+
+	type summary struct {
+		Name    string    `json:"name"`
+		Match   []string  `json:"match"`
+		Cookies int       `json:"cookies"`
+		Origins []string  `json:"origins"`
+		Created time.Time `json:"created"`
+		Updated time.Time `json:"updated"`
+	}
+	// Callers hold sessionProfilesLock
+	summarize := func(p *sessionProfile) summary {
+		origins := []string{}
+		for origin := range p.Storage {
+			origins = append(origins, origin)
+		}
+		slices.Sort(origins)
+		return summary{p.Name, p.Match, len(p.Cookies), origins, p.Created, p.Updated}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := []summary{}
+		sessionProfilesLock.RLock()
+		for _, p := range sessionProfiles[owner] {
+			list = append(list, summarize(p))
+		}
+		sessionProfilesLock.RUnlock()
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(list)
+
+	case http.MethodPost:
+		var req struct {
+			Name  string        `json:"name"`
+			Match []string      `json:"match"`
+			Login loginScenario `json:"login"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(writer, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(writer, "Invalid profile JSON", http.StatusBadRequest)
+			return
+		}
+		p := &sessionProfile{Name: req.Name, Match: req.Match}
+		err := p.compile(owner)
+		if err == nil {
+			err = req.Login.validate()
+		}
+		if err != nil {
+			http.Error(writer, "Invalid profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.login(r.Context(), req.Login, clientID(r)); err != nil {
+			failCapture(writer, r, err)
+			return
+		}
+		p.Created = p.Updated
+
+		sessionProfilesLock.Lock()
+		list := sessionProfiles[owner]
+		replaced := false
+		for i, existing := range list {
+			if existing.Name == p.Name {
+				list[i], replaced = p, true
+			}
+		}
+		if !replaced {
+			list = append(list, p)
+		}
+		sessionProfiles[owner] = list
+		saveSessionProfiles()
+		created := summarize(p)
+		sessionProfilesLock.Unlock()
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(created)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		sessionProfilesLock.Lock()
+		list := sessionProfiles[owner]
+		found := false
+		for i, p := range list {
+			if p.Name == name {
+				sessionProfiles[owner] = append(list[:i:i], list[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if found {
+			saveSessionProfiles()
+		}
+		sessionProfilesLock.Unlock()
+
+		if !found {
+			http.Error(writer, "Session profile not found", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
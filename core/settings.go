@@ -0,0 +1,56 @@
+package core
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// settings are the service-wide capture defaults. They are read from the
+// environment once at startup and never change afterwards, so request paths
+// read them without locking or further os.Getenv calls.
+type settings struct {
+	quality       int           // JPEG-style quality passed to Chrome (SCREENSHOT_QUALITY)
+	settleDelay   time.Duration // pause after the page is ready (SETTLE_DELAY_MS)
+	timeout       time.Duration // whole-capture timeout (SCREENSHOT_TIMEOUT)
+	workerTimeout time.Duration // wait for a free worker (WORKER_TIMEOUT)
+	cacheTTL      time.Duration // default cache lifetime (CACHE_DURATION_SECONDS)
+	maxCacheTTL   time.Duration // upper bound for ttl= overrides (CACHE_MAX_TTL_SECONDS)
+	isolated      bool          // every capture in its own incognito context (CAPTURE_ISOLATED)
+}
+
+var defaults settings
+
+func init() {
+	defaults = loadSettings()
+	log.Printf("webshot defaults: quality %d, settle %v, timeout %v, worker timeout %v, cache %v",
+		defaults.quality, defaults.settleDelay, defaults.timeout, defaults.workerTimeout, defaults.cacheTTL)
+}
+
+func loadSettings() settings {
+	return settings{
+		quality:       envInt("SCREENSHOT_QUALITY", 90, 1, 100),
+		settleDelay:   time.Duration(envInt("SETTLE_DELAY_MS", 1000, 0, 60000)) * time.Millisecond,
+		timeout:       time.Duration(envInt("SCREENSHOT_TIMEOUT", 45, 1, 3600)) * time.Second,
+		workerTimeout: time.Duration(envInt("WORKER_TIMEOUT", 15, 1, 3600)) * time.Second,
+		cacheTTL:      time.Duration(envInt("CACHE_DURATION_SECONDS", 300, 1, 30*86400)) * time.Second,
+		maxCacheTTL:   time.Duration(envInt("CACHE_MAX_TTL_SECONDS", 0, 0, 30*86400)) * time.Second,
+		isolated:      os.Getenv("CAPTURE_ISOLATED") == "true",
+	}
+}
+
+// envInt reads an integer variable, falling back when it is unset or outside
+// [lo, hi].
+func envInt(name string, fallback, lo, hi int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	val, err := strconv.Atoi(v)
+	if err != nil || val < lo || val > hi {
+		log.Printf("Ignoring invalid %s=%q", name, v)
+		return fallback
+	}
+	return val
+}
@@ -1,19 +1,23 @@
 package core
 
 import (
+	"bytes"
 	"context"
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 )
 
@@ -23,6 +27,7 @@ var (
 	maxWorkers     int
 	workers        []*chromeWorker
 	workersLock    sync.RWMutex
+	liveWorkers    int // started workers, guarded by workersLock
 	shutdownOnce   sync.Once
 	shutdownChan   chan struct{}
 	
@@ -33,23 +38,58 @@ var (
 	timeoutRequests int64
 	
 	// Cache for screenshots
-	screenCache     sync.Map // map[string]*cacheEntry
+	screenCache     captureCache // memory or Redis, see cache.go
 	cacheEnabled    bool
-	cacheDuration   time.Duration
+
+	// Serve expired entries this much longer while refreshing them
+	// (CACHE_STALE_WHILE_REVALIDATE_SECONDS, 0 = off)
+	staleWhileRevalidate time.Duration
+	revalidating         sync.Map // cache keys with a refresh in flight
+
+	// Elastic pool: keep minWorkers running, grow towards maxWorkers once a
+	// request has waited scaleUpWait, retire workers idle for workerIdleTimeout
+	minWorkers        int
+	scaleUpWait       time.Duration
+	workerIdleTimeout time.Duration
+
+	// Chrome's own HTTP cache, persisted per worker (CHROME_CACHE_DIR)
+	chromeCacheDir  string
+	chromeCacheSize int64
 )
 
 type chromeWorker struct {
 	id       int
+	backend  *renderBackend // remote Chrome, nil for a local one
 	allocCtx context.Context
 	cancel   context.CancelFunc
 	busy     atomic.Bool
 	lastUsed time.Time
+	started  time.Time
+	captures int // acquisitions since started, for recycling
+	acquired time.Time
+	client   string // holder, for fair scheduling
 	mu       sync.Mutex
+
+	// Long-lived browser that captures open tabs in, see tabs.go
+	browserCtx    context.Context
+	browserCancel context.CancelFunc
+
+	// Chrome's user data directory, see profiledir.go; empty for remote ones
+	profileDir string
+
+	pid       atomic.Int64 // running browser process, see workermem.go
+	overLimit atomic.Bool  // killed for memory, recycle on release
+	broken    atomic.Bool  // renderer failed a capture, recycle on release
 }
 
 type cacheEntry struct {
-	data      []byte
-	timestamp time.Time
+	url        string // captured URL, for purging
+	data       []byte
+	timestamp  time.Time
+	moderation *moderationResult
+	cost       time.Duration // render time, used by the admission policy
+	finalURL   string        // url after redirects
+	status     int           // the target's HTTP status, 0 if unknown
 }
 
 func init() {
@@ -61,82 +101,282 @@ func init() {
 		}
 	}
 
+	defaultMinWorkers := 2
+	if clusterRole == "api" {
+		defaultMinWorkers = 0 // captures render on the renderer nodes
+	}
+	minWorkers = envInt("MIN_CHROME_WORKERS", defaultMinWorkers, 0, maxWorkers)
+	maxQueueDepth = envInt("CAPTURE_QUEUE_MAX_DEPTH", 10*maxWorkers, 0, 1<<20)
+	clientMaxConcurrency = envInt("CLIENT_MAX_CONCURRENCY", 0, 0, maxWorkers)
+	scaleUpWait = time.Duration(envInt("WORKER_SCALE_UP_WAIT_MS", 250, 0, 60000)) * time.Millisecond
+	workerIdleTimeout = time.Duration(envInt("WORKER_IDLE_TIMEOUT_SECONDS", 300, 0, 86400)) * time.Second
+
 	// Enable caching (reduces duplicate requests)
 	cacheEnabled = true
 	if ce := os.Getenv("CACHE_ENABLED"); ce == "false" || ce == "0" {
 		cacheEnabled = false
 	}
 
-	// Cache duration (default 5 minutes)
-	cacheDuration = 5 * time.Minute
-	if cd := os.Getenv("CACHE_DURATION_SECONDS"); cd != "" {
-		if val, err := strconv.Atoi(cd); err == nil && val > 0 {
-			cacheDuration = time.Duration(val) * time.Second
+	if swr := os.Getenv("CACHE_STALE_WHILE_REVALIDATE_SECONDS"); swr != "" {
+		if val, err := strconv.Atoi(swr); err == nil && val > 0 {
+			staleWhileRevalidate = time.Duration(val) * time.Second
+		}
+	}
+
+	chromeCacheDir = os.Getenv("CHROME_CACHE_DIR")
+	chromeCacheSize = 256 << 20
+	if cs := os.Getenv("CHROME_CACHE_SIZE_MB"); cs != "" {
+		if val, err := strconv.Atoi(cs); err == nil && val > 0 {
+			chromeCacheSize = int64(val) << 20
 		}
 	}
 
 	shutdownChan = make(chan struct{})
+}
+
+// Start launches the Chrome worker pool and the background jobs (cache
+// cleanup, worker upkeep, schedules, render jobs). It is called once, after
+// every package init has read the configuration and before serving. An
+// error means local workers cannot run here, e.g. no usable Chrome.
+func Start() error {
+	// Local workers need a working Chrome; remote backends bring their own
+	if len(renderBackends) == 0 && clusterRole != "api" {
+		if err := checkChrome(); err != nil {
+			return err
+		}
+		if err := configureSandbox(); err != nil {
+			return err
+		}
+		if err := setupProfileDirs(); err != nil {
+			return err
+		}
+	}
+
 	initializeWorkerPool()
+	go warmUpWorkers()
 
 	// Start background cleanup goroutine
 	go cleanupExpiredCache()
 	go monitorWorkers()
+	go checkWorkerHealth()
+	go monitorWorkerMemory()
+	go checkBackends()
+	go checkProxyPools()
+	go runSchedules()
+	consumeRenderJobs()
 
-	log.Printf("webshot initialized with %d Chrome workers, cache: %v (%v)", 
-		maxWorkers, cacheEnabled, cacheDuration)
+	log.Printf("webshot initialized with %d-%d Chrome workers, cache: %v (%v)", 
+		minWorkers, maxWorkers, cacheEnabled, defaults.cacheTTL)
+	return nil
 }
 
 func initializeWorkerPool() {
 	workerPool = make(chan *chromeWorker, maxWorkers)
 	workers = make([]*chromeWorker, maxWorkers)
 
-	for i := 0; i < maxWorkers; i++ {
-		worker := createWorker(i)
-		workers[i] = worker
-		workerPool <- worker
+	for i := 0; i < minWorkers; i++ {
+		if worker := startWorker(); worker != nil {
+			workerPool <- worker
+		}
+	}
+}
+
+// startWorker fills a free slot with a new worker, or returns nil when the
+// pool is already at maxWorkers or shutting down.
+func startWorker() *chromeWorker {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+
+	select {
+	case <-shutdownChan:
+		return nil
+	default:
+	}
+	for i, w := range workers {
+		if w == nil {
+			worker := createWorker(i)
+			if worker == nil {
+				return nil // every remote backend is full or ejected
+			}
+			workers[i] = worker
+			liveWorkers++
+			return worker
+		}
+	}
+	return nil
+}
+
+// stopWorker cancels an idle worker's allocator, shutting its Chrome down,
+// and frees its slot.
+func stopWorker(worker *chromeWorker) {
+	workersLock.Lock()
+	workers[worker.id] = nil
+	liveWorkers--
+	workersLock.Unlock()
+	worker.closeBrowser()
+	worker.cancel() // waits for Chrome to exit
+	removeProfileDir(worker.profileDir)
+	if worker.backend != nil {
+		worker.backend.release()
 	}
 }
 
 func createWorker(id int) *chromeWorker {
-	opts := append(chromedp.DefaultExecAllocatorOptions[:],
-		chromedp.Flag("disable-gpu", true),
-		chromedp.Flag("no-sandbox", true),
-		chromedp.Flag("disable-dev-shm-usage", true),
-		chromedp.Flag("disable-extensions", true),
-		chromedp.Flag("disable-background-networking", true),
-		chromedp.Flag("disable-default-apps", true),
-		chromedp.Flag("disable-sync", true),
-		chromedp.Flag("disable-translate", true),
-		chromedp.Flag("hide-scrollbars", true),
-		chromedp.Flag("metrics-recording-only", true),
-		chromedp.Flag("mute-audio", true),
-		chromedp.Flag("no-first-run", true),
-		chromedp.Flag("safebrowsing-disable-auto-update", true),
-		chromedp.Flag("disable-setuid-sandbox", true),
-		chromedp.Flag("disable-web-security", true),
-		chromedp.Flag("disable-features", "site-per-process,TranslateUI,BlinkGenPropertyTrees"),
-		chromedp.Flag("headless", true),
-	)
+	if len(renderBackends) > 0 {
+		backend := acquireBackend()
+		if backend == nil {
+			return nil
+		}
+		allocCtx, cancel := chromedp.NewRemoteAllocator(context.Background(), backend.endpoint)
+		return &chromeWorker{
+			id:       id,
+			allocCtx: allocCtx,
+			cancel:   cancel,
+			backend:  backend,
+			lastUsed: time.Now(),
+			started:  time.Now(),
+		}
+	}
+
+	opts := append(chromedp.DefaultExecAllocatorOptions[:], chromeFlagOptions()...)
+
+	if chromePath != "" {
+		opts = append(opts, chromedp.ExecPath(chromePath))
+	}
+
+	profileDir, err := newProfileDir(id)
+	if err != nil {
+		log.Printf("Error creating Chrome profile for worker %d: %v", id, err)
+	}
+	if profileDir != "" {
+		opts = append(opts,
+			chromedp.UserDataDir(profileDir),
+			chromedp.Env("TMPDIR="+filepath.Join(profileDir, "tmp")),
+		)
+	}
+
+	// Persistent per-worker HTTP cache so shared framework/CDN assets are not
+	// re-downloaded on every capture
+	if chromeCacheDir != "" {
+		dir := filepath.Join(chromeCacheDir, fmt.Sprintf("worker-%d", id))
+		opts = append(opts,
+			chromedp.Flag("disk-cache-dir", dir),
+			chromedp.Flag("disk-cache-size", strconv.FormatInt(chromeCacheSize, 10)),
+		)
+	}
 
 	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
 
 	return &chromeWorker{
-		id:       id,
-		allocCtx: allocCtx,
-		cancel:   cancel,
-		lastUsed: time.Now(),
+		id:         id,
+		allocCtx:   allocCtx,
+		cancel:     cancel,
+		lastUsed:   time.Now(),
+		started:    time.Now(),
+		profileDir: profileDir,
 	}
 }
 
-func getWorker(timeout time.Duration) (*chromeWorker, error) {
-	select {
-	case worker := <-workerPool:
-		worker.busy.Store(true)
-		return worker, nil
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("no worker available within timeout")
-	case <-shutdownChan:
-		return nil, fmt.Errorf("service is shutting down")
+// getWorker waits for a free worker, queued by priority and client behind
+// the requests already waiting, and gives up with ctx's error once ctx ends.
+// When the queue is full it fails at once with a 429 *captureError.
+func getWorker(ctx context.Context, prio capturePriority, client string, timeout time.Duration) (*chromeWorker, error) {
+	waiter, err := captureQueue.enqueue(prio, client)
+	if err != nil {
+		return nil, err
+	}
+	worker, err := waitForWorker(ctx, waiter, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if worker.allocCtx.Err() != nil {
+		// Allocator died since the last health check
+		atomic.AddInt64(&replacedWorkers, 1)
+		replacement := replaceWorker(worker)
+		if replacement == nil {
+			captureQueue.finished(worker)
+			return nil, fmt.Errorf("no worker available")
+		}
+		replacement.client, replacement.acquired = worker.client, worker.acquired
+		worker = replacement
+	}
+	worker.busy.Store(true)
+	worker.captures++
+	return worker, nil
+}
+
+func waitForWorker(ctx context.Context, waiter *workerWaiter, timeout time.Duration) (*chromeWorker, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	// Only grow the pool once the queue wait is sustained, so short bursts
+	// are absorbed by the workers already running (or at once if none are).
+	// The new worker goes to whoever is first in line, not necessarily us.
+	wait := scaleUpWait
+	if workerCount() == 0 {
+		wait = 0
+	}
+	grow := time.NewTimer(wait)
+	defer grow.Stop()
+
+	for {
+		select {
+		case worker := <-waiter.ch:
+			return worker, nil
+		case <-grow.C:
+			if worker := startWorker(); worker != nil {
+				log.Printf("Scaled up to %d Chrome workers", workerCount())
+				handOff(worker)
+			}
+		case <-deadline.C:
+			if worker := captureQueue.cancel(waiter); worker != nil {
+				return worker, nil
+			}
+			return nil, fmt.Errorf("no worker available within timeout")
+		case <-ctx.Done():
+			// Handed a worker just now: it goes to the next in line
+			if worker := captureQueue.cancel(waiter); worker != nil {
+				releaseWorker(worker)
+			}
+			return nil, ctx.Err()
+		case <-shutdownChan:
+			if worker := captureQueue.cancel(waiter); worker != nil {
+				releaseWorker(worker)
+			}
+			return nil, fmt.Errorf("service is shutting down")
+		}
+	}
+}
+
+func workerCount() int {
+	workersLock.RLock()
+	defer workersLock.RUnlock()
+	return liveWorkers
+}
+
+// retireIdleWorkers stops pooled workers unused for workerIdleTimeout while
+// more than minWorkers are running.
+func retireIdleWorkers() {
+	if workerIdleTimeout == 0 {
+		return
+	}
+	retired := 0
+	for n := len(workerPool); n > 0; n-- {
+		select {
+		case worker := <-workerPool:
+			if workerCount() > minWorkers && time.Since(worker.lastUsed) > workerIdleTimeout {
+				stopWorker(worker)
+				retired++
+			} else {
+				handOff(worker)
+			}
+		default:
+			n = 1 // drained by concurrent requests
+		}
+	}
+	if retired > 0 {
+		log.Printf("Retired %d idle Chrome workers, %d running", retired, workerCount())
 	}
 }
 
@@ -144,13 +384,12 @@ func releaseWorker(worker *chromeWorker) {
 	if worker != nil {
 		worker.busy.Store(false)
 		worker.lastUsed = time.Now()
-		select {
-		case workerPool <- worker:
-			// Worker returned to pool
-		default:
-			// Pool is full (shouldn't happen, but defensive)
-			log.Printf("Warning: Worker pool full, worker %d not returned", worker.id)
+		captureQueue.finished(worker)
+		// The request is done with it, so this is the safe point to recycle
+		if worker = recycleIfDue(worker); worker == nil {
+			return
 		}
+		handOff(worker)
 	}
 }
 
@@ -161,18 +400,12 @@ func cleanupExpiredCache() {
 	for {
 		select {
 		case <-ticker.C:
+			tileSets.sweep(defaults.cacheTTL)
 			if !cacheEnabled {
 				continue
 			}
-			now := time.Now()
-			screenCache.Range(func(key, value interface{}) bool {
-				if entry, ok := value.(*cacheEntry); ok {
-					if now.Sub(entry.timestamp) > cacheDuration {
-						screenCache.Delete(key)
-					}
-				}
-				return true
-			})
+			screenCache.sweep(cacheRetention())
+			sweepFailures()
 		case <-shutdownChan:
 			return
 		}
@@ -191,19 +424,15 @@ func monitorWorkers() {
 			failed := atomic.LoadInt64(&failedRequests)
 			timeouts := atomic.LoadInt64(&timeoutRequests)
 			
-			log.Printf("Stats: Active=%d, Total=%d, Failed=%d, Timeouts=%d, Workers=%d", 
-				active, total, failed, timeouts, maxWorkers)
+			retireIdleWorkers()
+			log.Printf("Stats: Active=%d, Total=%d, Failed=%d, Timeouts=%d, Workers=%d/%d", 
+				active, total, failed, timeouts, workerCount(), maxWorkers)
 		case <-shutdownChan:
 			return
 		}
 	}
 }
 
-func getCacheKey(url string, width, height int) string {
-	hash := md5.Sum([]byte(fmt.Sprintf("%s:%dx%d", url, width, height)))
-	return hex.EncodeToString(hash[:])
-}
-
 func Shutdown() {
 	shutdownOnce.Do(func() {
 		log.Println("webshot: Shutting down Chrome worker pool...")
@@ -217,6 +446,9 @@ func Shutdown() {
 				worker.cancel()
 			}
 		}
+		if profileRunDir != "" {
+			os.RemoveAll(profileRunDir)
+		}
 		log.Println("webshot: Worker pool shutdown complete")
 	})
 }
@@ -234,115 +466,696 @@ func HandleScreenshot(writer http.ResponseWriter, r *http.Request) {
 
 	atomic.AddInt64(&totalRequests, 1)
 	atomic.AddInt64(&activeRequests, 1)
+	started := time.Now()
+
+	if !requireFeature(writer, r, "screenshot") {
+		return
+	}
+
+	switch r.URL.Query().Get("on_error") {
+	case "", "text", "image":
+	default:
+		http.Error(writer, "'on_error' must be text or image", http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Query().Get("response") {
+	case "", "image", "json":
+	default:
+		http.Error(writer, "'response' must be image or json", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		failCapture(writer, r, err)
+		return
+	}
+	upload, err := parseUploadTarget(r)
+	if err != nil {
+		failCapture(writer, r, err)
+		return
+	}
+	disposition, err := parseContentDisposition(r)
+	if err != nil {
+		failCapture(writer, r, err)
+		return
+	}
+	if r.URL.Query().Has("viewports") {
+		handleViewports(writer, r, opts, upload)
+		return
+	}
+	ocr := r.URL.Query().Get("ocr") == "true"
+	if ocr && !apiKeyFrom(r.Context()).allows("ocr") {
+		failCapture(writer, r, &captureError{status: http.StatusForbidden, message: "API key is not allowed to use ocr"})
+		return
+	}
+	if ocr && captureRecognizer == nil {
+		failCapture(writer, r, &captureError{status: http.StatusNotImplemented, message: "OCR is not configured"})
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" && format != "png" {
+		failCapture(writer, r, &captureError{status: http.StatusBadRequest, message: "Unsupported format, only png is available"})
+		return
+	}
+	profile := tenantProfileFor(r.Context())
+	if !profile.allowsFormat("png") {
+		failCapture(writer, r, &captureError{status: http.StatusForbidden, message: "Format png is not allowed for this tenant"})
+		return
+	}
+
+	res, err := screenshotFor(r.Context(), opts)
+	if err != nil {
+		failCapture(writer, r, err)
+		return
+	}
+	id := getCacheKey(opts)
+	// Text of a partial capture would stand in for the full one
+	if ocr && !res.partial {
+		if _, err := captureText(r.Context(), id, res.data); err != nil {
+			failCapture(writer, r, err)
+			return
+		}
+		writer.Header().Set("X-OCR-Text", "/captures/"+id+"/text")
+	}
+	if !opts.crop.Empty() {
+		var data []byte
+		err := runEncoder(r.Context(), func() (err error) {
+			data, err = cropCapture(res.data, opts.crop)
+			return err
+		})
+		if err != nil {
+			failCapture(writer, r, err)
+			return
+		}
+		// res may be shared with other callers of the same capture
+		cropped := *res
+		cropped.data = data
+		res = &cropped
+	}
+
+	cache := "MISS"
+	if res.stale {
+		cache = "STALE"
+	} else if res.cacheHit {
+		cache = "HIT"
+	}
+	writer.Header().Set("X-Cache", cache)
+	setModerationHeaders(writer, res.moderation)
+	if res.report != nil && opts.console {
+		writer.Header().Set("X-Console-Errors", strconv.Itoa(res.report.consoleErrors()))
+	}
+	if res.report != nil && opts.requests {
+		writer.Header().Set("X-Failed-Requests", strconv.Itoa(res.report.failedRequests()))
+	}
+	if res.report != nil && opts.tls {
+		if expiry := res.report.certExpiry(); !expiry.IsZero() {
+			writer.Header().Set("X-TLS-Cert-Expires", expiry.Format(http.TimeFormat))
+		}
+	}
+	writer.Header().Set("X-Capture-ID", id)
+	if res.finalURL != "" {
+		writer.Header().Set("X-Final-URL", res.finalURL)
+	}
+	if res.status != 0 {
+		writer.Header().Set("X-Target-Status", strconv.Itoa(res.status))
+	}
+	maxAge := profile.cacheTTL()
+	if opts.ttl > 0 {
+		maxAge = opts.ttl
+	}
+	if res.partial {
+		writer.Header().Set("X-Partial", "true")
+		writer.Header().Set("Cache-Control", "no-store")
+	} else {
+		writer.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	}
+	if upload != nil {
+		writeUploadJSON(writer, r, upload, id, res, cache)
+		return
+	}
+	if r.URL.Query().Get("response") == "json" {
+		writeCaptureJSON(r.Context(), writer, id, res, cache, started)
+		return
+	}
+	writer.Header().Set("Content-Type", "image/png")
+	if disposition != nil {
+		disposition.set(writer, opts.url, id, res.data, res.created)
+	}
+	serveImage(writer, r, res.data, res.created)
+}
+
+// serveImage writes an image with a content-hash ETag and Last-Modified,
+// answering conditional requests with 304 so CDNs and browsers can revalidate
+// instead of downloading identical bytes again. The body is written in chunks
+// and abandoned once the client disconnects.
+func serveImage(writer http.ResponseWriter, r *http.Request, data []byte, modified time.Time) {
+	sum := sha256.Sum256(data)
+	writer.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(writer, r, "", modified, contextReader{r.Context(), bytes.NewReader(data)})
+}
 
-	url := r.URL.Query().Get("url")
-	if url == "" {
-		http.Error(writer, "'url' parameter is required", http.StatusBadRequest)
+// HandleCapture serves a stored capture by the id reported in X-Capture-ID,
+// so reviewers can look at exactly what was annotated.
+func HandleCapture(writer http.ResponseWriter, r *http.Request) {
+	disposition, err := parseContentDisposition(r)
+	if err != nil {
+		writeCaptureError(writer, err)
 		return
 	}
+	// Object stores can serve the bytes themselves, but without our headers
+	if rc, ok := screenCache.(redirectingCache); ok && disposition == nil && validCaptureID(r.PathValue("id")) {
+		if target, ok := rc.redirectURL(r.PathValue("id")); ok {
+			http.Redirect(writer, r, target, http.StatusFound)
+			return
+		}
+	}
+
+	entry, ok := screenCache.get(r.PathValue("id"))
+	if !ok {
+		http.Error(writer, "Capture not found or expired", http.StatusNotFound)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "image/png")
+	if disposition != nil {
+		disposition.set(writer, entry.url, r.PathValue("id"), entry.data, entry.timestamp)
+	}
+	setModerationHeaders(writer, entry.moderation)
+	serveImage(writer, r, entry.data, entry.timestamp)
+}
 
+// parseDimensions reads the optional width/height query parameters, falling
+// back to the tenant's defaults (1280x720) for missing or out-of-range values.
+func parseDimensions(r *http.Request) (int, int) {
 	width, height := 1280, 720
+	maxWidth, maxHeight := maxDimensions(r.Context())
+	if p := tenantProfileFor(r.Context()); p != nil {
+		if p.DefaultWidth > 0 {
+			width = p.DefaultWidth
+		}
+		if p.DefaultHeight > 0 {
+			height = p.DefaultHeight
+		}
+		width, height = min(width, maxWidth), min(height, maxHeight)
+	}
+
 	if w := r.URL.Query().Get("width"); w != "" {
-		if val, err := strconv.Atoi(w); err == nil && val > 0 && val <= 3840 {
+		if val, err := strconv.Atoi(w); err == nil && val > 0 && val <= maxWidth {
 			width = val
 		}
 	}
 	if h := r.URL.Query().Get("height"); h != "" {
-		if val, err := strconv.Atoi(h); err == nil && val > 0 && val <= 2160 {
+		if val, err := strconv.Atoi(h); err == nil && val > 0 && val <= maxHeight {
 			height = val
 		}
 	}
+	return width, height
+}
+
+// maxDimensions is the largest viewport the caller may ask for: 3840x2160
+// or their tenant's max_width/max_height.
+func maxDimensions(ctx context.Context) (int, int) {
+	maxWidth, maxHeight := 3840, 2160
+	if p := tenantProfileFor(ctx); p != nil {
+		if p.MaxWidth > 0 {
+			maxWidth = min(maxWidth, p.MaxWidth)
+		}
+		if p.MaxHeight > 0 {
+			maxHeight = min(maxHeight, p.MaxHeight)
+		}
+	}
+	return maxWidth, maxHeight
+}
+
+
+type screenshotResult struct {
+	data       []byte
+	moderation *moderationResult
+	cacheHit   bool
+	stale      bool          // served past its TTL while a refresh runs
+	partial    bool          // captured at the deadline, page still loading
+	created    time.Time     // when the image was rendered
+	renderTime time.Duration // how long rendering took
+	finalURL   string        // url after redirects
+	status     int           // the target's HTTP status, 0 if unknown
+	report     *pageReport   // set for fresh captures
+	cached     bool          // stored in the cache by this capture
+}
+
+// captureError carries the HTTP status and client-facing message for a
+// screenshot that could not be produced.
+type captureError struct {
+	status       int
+	message      string
+	moderation   *moderationResult
+	quarantineID string
+	retryAfter   time.Duration
+	cached       bool // replayed from the negative cache
+	targetStatus int  // the status that failed a fail_on_status capture
+}
+
+func (e *captureError) Error() string {
+	return e.message
+}
+
+func writeCaptureError(writer http.ResponseWriter, err error) {
+	ce, ok := err.(*captureError)
+	if !ok {
+		http.Error(writer, "Error capturing screenshot", http.StatusInternalServerError)
+		return
+	}
+	setCaptureErrorHeaders(writer, ce)
+	http.Error(writer, ce.message, ce.status)
+}
+
+func setCaptureErrorHeaders(writer http.ResponseWriter, ce *captureError) {
+	setModerationHeaders(writer, ce.moderation)
+	if ce.quarantineID != "" {
+		writer.Header().Set("X-Quarantine-ID", ce.quarantineID)
+	}
+	if ce.retryAfter > 0 {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ce.retryAfter.Seconds()))))
+	}
+	if ce.cached {
+		writer.Header().Set("X-Cache", "NEGATIVE")
+	}
+	if ce.targetStatus != 0 {
+		writer.Header().Set("X-Target-Status", strconv.Itoa(ce.targetStatus))
+	}
+}
+
+// screenshotFor returns a screenshot for opts, served from the cache when fresh
+// or captured on a pooled worker, moderated and cached otherwise. Errors are
+// always *captureError.
+func screenshotFor(ctx context.Context, opts captureOptions) (*screenshotResult, error) {
+	url := opts.url
+	if err := checkTargetURL(url); err != nil {
+		return nil, err
+	}
+	if err := checkTenantURL(ctx, url); err != nil {
+		return nil, err
+	}
+	cacheKey := getCacheKey(opts)
+	ttl := opts.ttl
+	if ttl == 0 {
+		ttl = tenantProfileFor(ctx).cacheTTL()
+	}
 
 	// Check cache first
-	if cacheEnabled {
-		cacheKey := getCacheKey(url, width, height)
-		if cached, ok := screenCache.Load(cacheKey); ok {
-			if entry, ok := cached.(*cacheEntry); ok {
-				if time.Since(entry.timestamp) < cacheDuration {
-					writer.Header().Set("Content-Type", "image/png")
-					writer.Header().Set("X-Cache", "HIT")
-					writer.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cacheDuration.Seconds())))
-					writer.WriteHeader(http.StatusOK)
-					writer.Write(entry.data)
-					return
+	if cacheEnabled && !opts.refresh {
+		recordCacheAccess(cacheKey)
+		lookup := time.Now()
+		entry, ok := screenCache.get(cacheKey)
+		timingFrom(ctx).since("cache", lookup)
+		if ok {
+			age := time.Since(entry.timestamp)
+			if age < ttl+staleWhileRevalidate {
+				res := &screenshotResult{
+					data:       entry.data,
+					moderation: entry.moderation,
+					cacheHit:   true,
+					created:    entry.timestamp,
+					renderTime: entry.cost,
+					finalURL:   entry.finalURL,
+					status:     entry.status,
+				}
+				if age >= ttl {
+					// Serve the expired image now and refresh it behind the response
+					res.stale = true
+					revalidate(ctx, opts, cacheKey)
 				}
+				recordUsage(ctx, 1, 0)
+				if err := checkTargetStatus(opts, res); err != nil {
+					return nil, err
+				}
+				return res, nil
 			}
 		}
 	}
 
-	timeout := 45 * time.Second
-	if t := os.Getenv("SCREENSHOT_TIMEOUT"); t != "" {
-		if val, err := strconv.Atoi(t); err == nil && val > 0 {
-			timeout = time.Duration(val) * time.Second
+	if !opts.refresh {
+		if failure, ok := cachedFailure(cacheKey); ok {
+			return nil, failure
 		}
 	}
 
-	workerTimeout := 15 * time.Second
-	if wt := os.Getenv("WORKER_TIMEOUT"); wt != "" {
-		if val, err := strconv.Atoi(wt); err == nil && val > 0 {
-			workerTimeout = time.Duration(val) * time.Second
+	// Partial captures are only shared with callers who accept them
+	flight := cacheKey
+	if opts.partial {
+		flight += "/partial"
+	}
+	if opts.wantsReport() {
+		flight += "/report"
+	}
+	res, err := captureFlights.do(ctx, flight, func(ctx context.Context) (*screenshotResult, error) {
+		return renderCapture(ctx, opts, cacheKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordUsage(ctx, 1, 0)
+	if err := checkTargetStatus(opts, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkTargetStatus fails a capture whose target answered with a status the
+// caller listed in fail_on_status.
+func checkTargetStatus(opts captureOptions, res *screenshotResult) error {
+	if !opts.rejectsStatus(res.status) {
+		return nil
+	}
+	return &captureError{
+		status:       http.StatusBadGateway,
+		message:      fmt.Sprintf("Target responded with HTTP %d", res.status),
+		moderation:   res.moderation,
+		targetStatus: res.status,
+	}
+}
+
+// revalidate re-renders a stale entry in the background, at most once per key
+// at a time. The refresh keeps the caller's identity for egress accounting but
+// not its cancellation.
+func revalidate(ctx context.Context, opts captureOptions, cacheKey string) {
+	if _, busy := revalidating.LoadOrStore(cacheKey, struct{}{}); busy {
+		return
+	}
+	go func() {
+		defer revalidating.Delete(cacheKey)
+		_, err := captureFlights.do(context.WithoutCancel(ctx), cacheKey, func(ctx context.Context) (*screenshotResult, error) {
+			return renderCapture(ctx, opts, cacheKey)
+		})
+		if err != nil {
+			log.Printf("Background refresh of %s failed: %v", opts.url, err)
+		}
+	}()
+}
+
+// renderCapture captures opts on a pooled worker, moderates the result and
+// stores it under cacheKey. API nodes of a cluster hand it to a renderer.
+func renderCapture(ctx context.Context, opts captureOptions, cacheKey string) (*screenshotResult, error) {
+	if clusterRole == "api" {
+		return renderOnCluster(ctx, opts, cacheKey)
+	}
+	url := opts.url
+	meter := newEgressMeter(ctx)
+	if over, wait := meter.over(); over {
+		return nil, &captureError{
+			status:     http.StatusTooManyRequests,
+			message:    "Egress budget exhausted, please retry later",
+			retryAfter: wait,
 		}
 	}
 
-	// Get worker from pool
-	worker, err := getWorker(workerTimeout)
+	timeout, workerTimeout := defaults.timeout, defaults.workerTimeout
+
+	queued := time.Now()
+	release, err := acquireHost(ctx, url, workerTimeout)
 	if err != nil {
-		log.Printf("Failed to get worker for %s: %v", url, err)
-		atomic.AddInt64(&timeoutRequests, 1)
 		atomic.AddInt64(&failedRequests, 1)
-		http.Error(writer, "Server busy, please retry later", http.StatusServiceUnavailable)
-		return
+		return nil, err
 	}
-	defer releaseWorker(worker)
+	defer release()
 
-	// Capture screenshot
-	buf, err := captureScreenshot(worker, url, width, height, timeout)
+	// Capture on a pooled worker, once more on another if the renderer broke
+	var buf []byte
+	var renderTime time.Duration
+	var report *pageReport
+	transient, partial := false, false
+	for attempt := 1; ; attempt++ {
+		var worker *chromeWorker
+		if worker, err = workerFor(ctx, opts, workerTimeout); err != nil {
+			return nil, err
+		}
+		timingFrom(ctx).since("queue", queued)
+
+		started := time.Now()
+		report = opts.newReport()
+		buf, partial, err = captureScreenshot(ctx, worker, opts, timeout, meter, report)
+		renderTime = time.Since(started)
+		// The caller canceling closes the tab; the worker is fine
+		transient = err != nil && ctx.Err() == nil && !(meter != nil && meter.exhausted.Load()) && transientRenderError(worker, err)
+		if transient {
+			worker.broken.Store(true)
+		}
+		releaseWorker(worker)
+		if !transient || attempt == 2 {
+			break
+		}
+		log.Printf("Renderer failed capturing %s, retrying on another worker: %v", url, err)
+		atomic.AddInt64(&retriedRequests, 1)
+		queued = time.Now()
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, captureCanceled()
+	}
 	if err != nil {
 		log.Printf("Error capturing screenshot (%s): %v", url, err)
 		atomic.AddInt64(&failedRequests, 1)
-		
+
+		if meter != nil && meter.exhausted.Load() {
+			return nil, &captureError{status: http.StatusTooManyRequests, message: "Egress budget exhausted during capture"}
+		}
+		if ce, ok := err.(*captureError); ok {
+			// The page broke one of the caller's rules
+			rememberFailure(cacheKey, url, ce)
+			return nil, ce
+		}
+
+		failure := &captureError{status: http.StatusInternalServerError, message: "Error capturing screenshot"}
+		if transient {
+			// The renderer broke; nothing is known about the target
+			return nil, failure
+		}
 		if err == context.DeadlineExceeded {
 			atomic.AddInt64(&timeoutRequests, 1)
-			http.Error(writer, "Screenshot timeout - page took too long to load", http.StatusRequestTimeout)
-		} else {
-			http.Error(writer, "Error capturing screenshot", http.StatusInternalServerError)
+			failure = &captureError{status: http.StatusRequestTimeout, message: "Screenshot timeout - page took too long to load"}
 		}
-		return
+		rememberFailure(cacheKey, url, failure)
+		return nil, failure
 	}
 
-	// Cache the result
-	if cacheEnabled && len(buf) > 0 {
-		cacheKey := getCacheKey(url, width, height)
-		screenCache.Store(cacheKey, &cacheEntry{
-			data:      buf,
-			timestamp: time.Now(),
-		})
+	return finishCapture(ctx, opts, cacheKey, buf, partial, renderTime, report)
+}
+
+// finishCapture runs a rendered image through moderation and the requested
+// post-processing (on the encode pool), and caches it.
+func finishCapture(ctx context.Context, opts captureOptions, cacheKey string, buf []byte, partial bool, renderTime time.Duration, report *pageReport) (*screenshotResult, error) {
+	url := opts.url
+
+	// Score the capture before it can be cached or served
+	verdict, err := moderateCapture(ctx, buf)
+	if err != nil {
+		log.Printf("Moderation failed for %s: %v", url, err)
+		if !moderationFailOpen {
+			atomic.AddInt64(&failedRequests, 1)
+			return nil, &captureError{status: http.StatusServiceUnavailable, message: "Content moderation unavailable"}
+		}
+	}
+	if verdict.flagged() {
+		switch moderationAction {
+		case "quarantine":
+			id := cacheKey
+			if err := quarantineCapture(id, url, buf, verdict); err != nil {
+				log.Printf("Failed to quarantine capture of %s: %v", url, err)
+			}
+			return nil, &captureError{
+				status:       http.StatusUnavailableForLegalReasons,
+				message:      "Capture quarantined pending review",
+				moderation:   verdict,
+				quarantineID: id,
+			}
+		case "refuse":
+			return nil, &captureError{
+				status:     http.StatusUnavailableForLegalReasons,
+				message:    "Capture refused by content policy",
+				moderation: verdict,
+			}
+		}
 	}
 
-	writer.Header().Set("Content-Type", "image/png")
-	writer.Header().Set("X-Cache", "MISS")
-	writer.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cacheDuration.Seconds())))
-	writer.WriteHeader(http.StatusOK)
-	writer.Write(buf)
+	if opts.resize != "" || opts.watermark != nil || opts.optimize {
+		if err := runEncoder(ctx, func() (err error) {
+			buf, err = processCapture(opts, buf)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Cache the result; partial captures are not what the next caller asked for
+	created, cached := time.Now(), false
+	finalURL, status := report.document()
+	if partial {
+		atomic.AddInt64(&timeoutRequests, 1)
+	} else if cacheEnabled && !opts.noStore && len(buf) > 0 && !opts.rejectsStatus(status) && admitToCache(cacheKey, renderTime) {
+		defer timingFrom(ctx).since("cache", time.Now())
+		screenCache.set(cacheKey, &cacheEntry{
+			url:        url,
+			data:       buf,
+			timestamp:  created,
+			moderation: verdict,
+			cost:       renderTime,
+			finalURL:   finalURL,
+			status:     status,
+		}, cacheRetention())
+		cached = true
+	}
+
+	return &screenshotResult{
+		data:       buf,
+		moderation: verdict,
+		created:    created,
+		partial:    partial,
+		renderTime: renderTime,
+		finalURL:   finalURL,
+		status:     status,
+		report:     report,
+		cached:     cached,
+	}, nil
+}
+
+// processCapture applies the requested resize, watermark and optimization to
+// a rendered image. It runs on the encode pool. Errors are *captureError.
+func processCapture(opts captureOptions, buf []byte) ([]byte, error) {
+	url := opts.url
+	var err error
+	if opts.resize != "" {
+		if buf, err = resizeCapture(buf, opts.resize); err != nil {
+			log.Printf("Failed to resize capture of %s: %v", url, err)
+			atomic.AddInt64(&failedRequests, 1)
+			return nil, &captureError{status: http.StatusInternalServerError, message: "Error resizing screenshot"}
+		}
+	}
+
+	if opts.watermark != nil {
+		if buf, err = watermarkCapture(buf, opts.watermark); err != nil {
+			log.Printf("Failed to watermark capture of %s: %v", url, err)
+			atomic.AddInt64(&failedRequests, 1)
+			return nil, &captureError{status: http.StatusInternalServerError, message: "Error watermarking screenshot"}
+		}
+	}
+
+	if opts.optimize {
+		if optimized, err := optimizePNG(buf); err != nil {
+			log.Printf("Failed to optimize capture of %s: %v", url, err)
+		} else {
+			buf = optimized
+		}
+	}
+	return buf, nil
 }
 
-func captureScreenshot(worker *chromeWorker, url string, width, height int, timeout time.Duration) ([]byte, error) {
+// captureScreenshot renders opts on worker. With opts.partial, a capture that
+// runs out of time returns whatever is rendered by then and partial is set.
+// What the page does meanwhile is collected in report. The tab closes as soon
+// as parent ends.
+func captureScreenshot(parent context.Context, worker *chromeWorker, opts captureOptions, timeout time.Duration, meter *egressMeter, report *pageReport) (buf []byte, partial bool, err error) {
 	worker.mu.Lock()
 	defer worker.mu.Unlock()
 
-	ctx, cancel := chromedp.NewContext(worker.allocCtx)
+	tabCtx, ctx, cancel, err := openTab(parent, worker, opts, timeout, meter)
+	if err != nil {
+		return nil, false, err
+	}
 	defer cancel()
 
-	ctx, timeoutCancel := context.WithTimeout(ctx, timeout)
-	defer timeoutCancel()
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	if err := chromedp.Run(ctx, report.enable(abort)); err != nil {
+		return nil, false, err
+	}
+	if opts.preferSpeed {
+		buf, err = captureAtFirstPaint(ctx, opts)
+	} else {
+		buf, err = captureFullPage(ctx, opts)
+	}
+	if ce, ok := context.Cause(ctx).(*captureError); ok && err != nil {
+		return nil, false, ce
+	}
+	opts.pooledProxy.record(err)
+
+	if err == context.DeadlineExceeded && opts.partial {
+		// Best effort: grab what is on screen now, on the still-open tab
+		partialCtx, partialCancel := context.WithTimeout(tabCtx, 5*time.Second)
+		defer partialCancel()
+		var shot []byte
+		if perr := chromedp.Run(partialCtx, chromedp.FullScreenshot(&shot, opts.quality)); perr == nil {
+			return shot, true, nil
+		}
+	}
+	return buf, false, err
+}
 
+// captureFullPage loads the page, lets it settle and captures it in full.
+func captureFullPage(ctx context.Context, opts captureOptions) ([]byte, error) {
 	var buf []byte
-	err := chromedp.Run(ctx,
-		emulation.SetDeviceMetricsOverride(int64(width), int64(height), 1.0, false),
-		chromedp.Navigate(url),
+	timing, started := timingFrom(ctx), time.Now()
+	actions := []chromedp.Action{
+		prepareTab(opts),
+		chromedp.Navigate(opts.url),
 		chromedp.WaitReady("body", chromedp.ByQuery),
-		chromedp.Sleep(1*time.Second),
-		chromedp.FullScreenshot(&buf, 90),
+		chromedp.Sleep(defaults.settleDelay),
+	}
+	if opts.dismissConsent {
+		actions = append(actions, dismissConsent())
+	}
+	if opts.translateTo != "" {
+		actions = append(actions, translatePage(opts.translateTo), chromedp.Sleep(200*time.Millisecond))
+	}
+	actions = append(actions, markStage(timing, "nav", &started), chromedp.FullScreenshot(&buf, opts.quality), markStage(timing, "render", &started))
+	err := chromedp.Run(ctx, actions...)
+
+	return buf, err
+}
+
+// captureAtFirstPaint starts navigation without waiting for the load event and
+// grabs the viewport as soon as the page reports its first meaningful (or,
+// failing that, contentful) paint, or once the render budget runs out.
+func captureAtFirstPaint(ctx context.Context, opts captureOptions) ([]byte, error) {
+	painted := make(chan struct{})
+	var once sync.Once
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if e, ok := ev.(*page.EventLifecycleEvent); ok {
+			switch e.Name {
+			case "firstMeaningfulPaint", "firstContentfulPaint", "load":
+				once.Do(func() { close(painted) })
+			}
+		}
+	})
+
+	var buf []byte
+	timing, started := timingFrom(ctx), time.Now()
+	err := chromedp.Run(ctx,
+		prepareTab(opts),
+		page.SetLifecycleEventsEnabled(true),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			_, _, errText, err := page.Navigate(opts.url).Do(ctx)
+			if err == nil && errText != "" {
+				err = fmt.Errorf("navigation failed: %s", errText)
+			}
+			return err
+		}),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			select {
+			case <-painted:
+			case <-time.After(opts.budget):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		}),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			if !opts.dismissConsent {
+				return nil
+			}
+			return dismissConsent().Do(ctx)
+		}),
+		markStage(timing, "nav", &started),
+		chromedp.CaptureScreenshot(&buf),
+		markStage(timing, "render", &started),
 	)
 
 	return buf, err
@@ -353,8 +1166,21 @@ func HandleHealth(writer http.ResponseWriter, r *http.Request) {
 	total := atomic.LoadInt64(&totalRequests)
 	failed := atomic.LoadInt64(&failedRequests)
 	timeouts := atomic.LoadInt64(&timeoutRequests)
+	coalesced := atomic.LoadInt64(&coalescedRequests)
+	canceled := atomic.LoadInt64(&canceledRequests)
+	retried := atomic.LoadInt64(&retriedRequests)
+	replaced := atomic.LoadInt64(&replacedWorkers)
+	recycled := atomic.LoadInt64(&recycledWorkers)
+	killed := atomic.LoadInt64(&memoryKills)
+	rssMB := atomic.LoadInt64(&chromeRSS) >> 20
+	backends, healthyBackendCount := len(renderBackends), healthyBackends()
+	proxyCount, healthyProxyCount := pooledProxies()
+	queued := queuedRequests()
+	queuedEnc := atomic.LoadInt64(&queuedEncodes)
 	
-	availableWorkers := len(workerPool)
+	// Idle workers plus the room left to scale up
+	live := workerCount()
+	availableWorkers := len(workerPool) + maxWorkers - live
 	
 	status := "healthy"
 	statusCode := http.StatusOK
@@ -364,8 +1190,23 @@ func HandleHealth(writer http.ResponseWriter, r *http.Request) {
 		statusCode = http.StatusTooManyRequests
 	}
 	
-	response := fmt.Sprintf(`{"status":"%s","active_requests":%d,"total_requests":%d,"failed_requests":%d,"timeout_requests":%d,"available_workers":%d,"max_workers":%d}`,
-		status, active, total, failed, timeouts, availableWorkers, maxWorkers)
+	// deep=true also renders a page, proving Chrome actually works
+	deep := ""
+	if r.URL.Query().Get("deep") == "true" {
+		result := checkDeepHealth(r.Context())
+		switch {
+		case result.OK:
+		case result.Busy:
+			status, statusCode = "degraded", http.StatusTooManyRequests
+		default:
+			status, statusCode = "unhealthy", http.StatusServiceUnavailable
+		}
+		data, _ := json.Marshal(result)
+		deep = `,"deep":` + string(data)
+	}
+	
+	response := fmt.Sprintf(`{"status":"%s","active_requests":%d,"queued_requests":%d,"queued_encodes":%d,"total_requests":%d,"failed_requests":%d,"timeout_requests":%d,"coalesced_requests":%d,"canceled_requests":%d,"retried_requests":%d,"available_workers":%d,"live_workers":%d,"max_workers":%d,"replaced_workers":%d,"recycled_workers":%d,"memory_kills":%d,"chrome_rss_mb":%d,"render_backends":%d,"healthy_backends":%d,"pooled_proxies":%d,"healthy_proxies":%d%s}`,
+		status, active, queued, queuedEnc, total, failed, timeouts, coalesced, canceled, retried, availableWorkers, live, maxWorkers, replaced, recycled, killed, rssMB, backends, healthyBackendCount, proxyCount, healthyProxyCount, deep)
 	
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(statusCode)
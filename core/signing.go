@@ -0,0 +1,173 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// Shared secret for signed URLs (URL_SIGNING_SECRET); empty disables signing
+	signingSecret []byte
+
+	// Longest lifetime /sign gives a URL (SIGN_MAX_TTL_SECONDS)
+	signMaxTTL time.Duration
+
+	// API keys by the id signed URLs name them with
+	signersByID map[string]*apiKey
+)
+
+func init() {
+	signingSecret = []byte(os.Getenv("URL_SIGNING_SECRET"))
+	signMaxTTL = time.Duration(envInt("SIGN_MAX_TTL_SECONDS", 7*24*3600, 1, 365*24*3600)) * time.Second
+
+	signersByID = make(map[string]*apiKey, len(apiKeys))
+	for _, k := range apiKeys {
+		signersByID[signerID(k)] = k
+	}
+}
+
+// signerID identifies a key in the URLs it signs. It is derived from the key
+// itself, so unlike its name it is unique, and keyed with the signing secret
+// so it reveals nothing about the key.
+func signerID(k *apiKey) string {
+	mac := hmac.New(sha256.New, signingSecret)
+	mac.Write([]byte("signer:" + k.Key))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// Endpoints a signed URL may point at, with the feature the signing key
+// needs for each; signed URLs are for embedding, so they only ever GET.
+var signablePaths = map[string]string{
+	"/get":     "screenshot",
+	"/tiles":   "tiles",
+	"/meta":    "meta",
+	"/preview": "preview",
+	"/a11y":    "a11y",
+	"/perf":    "perf",
+	"/phash":   "phash",
+}
+
+// canonicalRequest is what gets signed: the method and path plus every query
+// parameter except sig and api_key, sorted by name. The parameters include
+// signer, the id of the key that signed, so the URL acts as that key.
+func canonicalRequest(method, path string, query url.Values) string {
+	params := url.Values{}
+	for k, v := range query {
+		if k == "sig" || k == "api_key" {
+			continue
+		}
+		params[k] = v
+	}
+	return method + " " + path + "?" + params.Encode()
+}
+
+func signRequest(method, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, signingSecret)
+	mac.Write([]byte(canonicalRequest(method, path, query)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedRequest checks sig and expires on r and returns the key that
+// signed it, nil if auth is disabled. It returns ok=false with a reason when
+// the request carries a signature that does not verify.
+func verifySignedRequest(r *http.Request) (key *apiKey, ok bool, reason string) {
+	query := r.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, false, "Signed URL requires a numeric 'expires' parameter"
+	}
+	if time.Now().Unix() > expires {
+		return nil, false, "Signed URL has expired"
+	}
+
+	got, err := hex.DecodeString(query.Get("sig"))
+	if err != nil {
+		return nil, false, "Invalid URL signature"
+	}
+	want, _ := hex.DecodeString(signRequest(r.Method, r.URL.Path, query))
+	if !hmac.Equal(got, want) {
+		return nil, false, "Invalid URL signature"
+	}
+
+	if !authEnabled {
+		return nil, true, ""
+	}
+	if key = signersByID[query.Get("signer")]; key == nil {
+		return nil, false, "Signed URL's key no longer exists"
+	}
+	return key, true, ""
+}
+
+// HandleSign returns a signed, expiring URL for the endpoint and parameters
+// given, e.g. /sign?path=/get&url=https://example.com&ttl=3600. The URL acts
+// as the caller's key, so it only signs what that key may do itself.
+func HandleSign(writer http.ResponseWriter, r *http.Request) {
+	if len(signingSecret) == 0 {
+		http.Error(writer, "URL signing is not configured", http.StatusNotFound)
+		return
+	}
+	if !requireFeature(writer, r, "sign") {
+		return
+	}
+
+	query := r.URL.Query()
+	path := query.Get("path")
+	if path == "" {
+		path = "/get"
+	}
+
+	ttl := min(time.Hour, signMaxTTL)
+	if t := query.Get("ttl"); t != "" {
+		val, err := strconv.Atoi(t)
+		if err != nil || val <= 0 || time.Duration(val)*time.Second > signMaxTTL {
+			http.Error(writer, "'ttl' must be between 1 and "+strconv.Itoa(int(signMaxTTL.Seconds()))+" seconds", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(val) * time.Second
+	}
+
+	key := apiKeyFrom(r.Context())
+	feature, ok := signablePaths[path]
+	if !ok {
+		http.Error(writer, "'path' must be one of /get, /tiles, /meta, /preview, /a11y, /perf or /phash", http.StatusBadRequest)
+		return
+	}
+	if !key.allows(feature) {
+		http.Error(writer, "API key is not allowed to use "+feature, http.StatusForbidden)
+		return
+	}
+	if target := query.Get("url"); target != "" {
+		err := checkTargetURL(target)
+		if err == nil {
+			err = checkTenantURL(r.Context(), target)
+		}
+		if err != nil {
+			failCapture(writer, r, err)
+			return
+		}
+	}
+
+	query.Del("path")
+	query.Del("ttl")
+	query.Del("api_key")
+	query.Del("signer")
+	if key != nil {
+		query.Set("signer", signerID(key))
+	}
+	query.Set("expires", strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	query.Set("sig", signRequest(http.MethodGet, path, query))
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]string{
+		"url":     path + "?" + query.Encode(),
+		"expires": query.Get("expires"),
+	})
+}
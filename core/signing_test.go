@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSigning configures secret and keys for the duration of the test.
+func useSigning(t *testing.T, secret string, keys ...*apiKey) {
+	t.Helper()
+	useAPIKeys(t, keys...)
+	saved, savedSigners := signingSecret, signersByID
+	t.Cleanup(func() { signingSecret, signersByID = saved, savedSigners })
+
+	signingSecret = []byte(secret)
+	signersByID = make(map[string]*apiKey)
+	for _, k := range keys {
+		signersByID[signerID(k)] = k
+	}
+}
+
+func signedQuery(method, path string, key *apiKey, expires time.Time, params url.Values) url.Values {
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+	if key != nil {
+		q.Set("signer", signerID(key))
+	}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", signRequest(method, path, q))
+	return q
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	q := url.Values{"url": {"https://example.com"}, "width": {"800"}, "sig": {"abc"}, "api_key": {"secret"}}
+	got := canonicalRequest(http.MethodGet, "/get", q)
+	want := "GET /get?url=https%3A%2F%2Fexample.com&width=800"
+	if got != want {
+		t.Errorf("canonicalRequest = %q, want %q", got, want)
+	}
+	if canonicalRequest(http.MethodDelete, "/get", q) == got {
+		t.Error("the method is not part of the canonical request")
+	}
+}
+
+func TestVerifySignedRequest(t *testing.T) {
+	alpha := &apiKey{Key: "alpha-secret", Name: "alpha"}
+	beta := &apiKey{Key: "beta-secret", Name: "beta"}
+	useSigning(t, "signing-secret", alpha, beta)
+
+	future := time.Now().Add(time.Hour)
+	params := url.Values{"url": {"https://example.com"}}
+	valid := signedQuery(http.MethodGet, "/get", alpha, future, params)
+
+	tamper := func(f func(q url.Values)) url.Values {
+		q := url.Values{}
+		for k, v := range valid {
+			q[k] = append([]string(nil), v...)
+		}
+		f(q)
+		return q
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		key    *apiKey // nil = rejected
+	}{
+		{"valid", http.MethodGet, "/get", valid, alpha},
+		{"expired", http.MethodGet, "/get", signedQuery(http.MethodGet, "/get", alpha, time.Now().Add(-time.Minute), params), nil},
+		{"other method", http.MethodPost, "/get", valid, nil},
+		{"other path", http.MethodGet, "/tiles", valid, nil},
+		{"changed url", http.MethodGet, "/get", tamper(func(q url.Values) { q.Set("url", "https://evil.test") }), nil},
+		{"added param", http.MethodGet, "/get", tamper(func(q url.Values) { q.Set("full_page", "true") }), nil},
+		{"extended expiry", http.MethodGet, "/get", tamper(func(q url.Values) { q.Set("expires", "99999999999") }), nil},
+		{"swapped signer", http.MethodGet, "/get", tamper(func(q url.Values) { q.Set("signer", signerID(beta)) }), nil},
+		{"signer by name", http.MethodGet, "/get", signedQuery(http.MethodGet, "/get", nil, future, url.Values{"signer": {"alpha"}}), nil},
+		{"no signer", http.MethodGet, "/get", signedQuery(http.MethodGet, "/get", nil, future, params), nil},
+		{"garbage sig", http.MethodGet, "/get", tamper(func(q url.Values) { q.Set("sig", "zz") }), nil},
+		{"api_key is ignored", http.MethodGet, "/get", tamper(func(q url.Values) { q.Set("api_key", "x") }), alpha},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path+"?"+tt.query.Encode(), nil)
+		key, ok, reason := verifySignedRequest(r)
+		switch {
+		case tt.key != nil && (!ok || key != tt.key):
+			t.Errorf("%s: rejected (%s), want key %s", tt.name, reason, tt.key.Name)
+		case tt.key == nil && ok:
+			t.Errorf("%s: accepted as %v", tt.name, key)
+		}
+	}
+}
+
+func TestSignerIDIsUniqueAndOpaque(t *testing.T) {
+	a := &apiKey{Key: "secret-a", Name: "same"}
+	b := &apiKey{Key: "secret-b", Name: "same"}
+	useSigning(t, "signing-secret")
+	if signerID(a) == signerID(b) {
+		t.Error("keys with the same name share a signer id")
+	}
+	if strings.Contains(signerID(a), "secret") || strings.Contains(signerID(a), "same") {
+		t.Errorf("signer id %q reveals the key", signerID(a))
+	}
+}
+
+func TestHandleSign(t *testing.T) {
+	full := &apiKey{Key: "full-secret", Name: "full"}
+	limited := &apiKey{Key: "limited-secret", Name: "limited", Features: []string{"sign", "screenshot"}}
+	useSigning(t, "signing-secret", full, limited)
+
+	tests := []struct {
+		name   string
+		key    *apiKey
+		query  string
+		status int
+	}{
+		{"default", full, "url=https://example.com", http.StatusOK},
+		{"tiles", full, "path=/tiles&url=https://example.com&ttl=60", http.StatusOK},
+		{"longest ttl", full, "url=https://example.com&ttl=" + strconv.Itoa(int(signMaxTTL.Seconds())), http.StatusOK},
+		{"ttl too long", full, "url=https://example.com&ttl=" + strconv.Itoa(int(signMaxTTL.Seconds())+1), http.StatusBadRequest},
+		{"negative ttl", full, "url=https://example.com&ttl=-1", http.StatusBadRequest},
+		{"unsignable path", full, "path=/sign&url=https://example.com", http.StatusBadRequest},
+		{"feature not allowed", limited, "path=/tiles&url=https://example.com", http.StatusForbidden},
+		{"not a web url", full, "url=file:///etc/passwd", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/sign?"+tt.query, nil)
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, tt.key))
+		w := httptest.NewRecorder()
+		HandleSign(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		// The URL handed out verifies as the key that asked for it
+		var signed struct{ URL string }
+		json.NewDecoder(w.Body).Decode(&signed)
+		key, ok, reason := verifySignedRequest(httptest.NewRequest(http.MethodGet, signed.URL, nil))
+		if !ok || key != tt.key {
+			t.Errorf("%s: signed URL %s does not verify: %s", tt.name, signed.URL, reason)
+		}
+	}
+}
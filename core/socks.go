@@ -0,0 +1,181 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Chrome speaks SOCKS5 but not its username/password authentication, so a
+// capture through an authenticated SOCKS5 proxy goes through a local relay:
+// Chrome connects to it without credentials and it authenticates upstream
+// (RFC 1929), then passes the connection through untouched.
+var (
+	socksRelays     = make(map[string]*socksRelay) // by upstream URL
+	socksRelaysLock sync.Mutex
+
+	// Relays nobody has connected through for this long are closed
+	socksRelayIdle = 10 * time.Minute
+)
+
+type socksRelay struct {
+	upstream *url.URL
+	listener net.Listener
+
+	mu       sync.Mutex
+	lastUsed time.Time
+}
+
+// chromeProxyServer is the proxy server setting that routes Chrome through u.
+func chromeProxyServer(u *url.URL) (string, error) {
+	if u.Scheme != "socks5" || u.User == nil {
+		return proxyServer(u), nil
+	}
+	relay, err := socksRelayFor(u)
+	if err != nil {
+		return "", err
+	}
+	return "socks5://" + relay.listener.Addr().String(), nil
+}
+
+func socksRelayFor(u *url.URL) (*socksRelay, error) {
+	socksRelaysLock.Lock()
+	defer socksRelaysLock.Unlock()
+	if relay, ok := socksRelays[u.String()]; ok {
+		relay.mu.Lock()
+		relay.lastUsed = time.Now()
+		relay.mu.Unlock()
+		return relay, nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("starting SOCKS relay: %w", err)
+	}
+	relay := &socksRelay{upstream: u, listener: l, lastUsed: time.Now()}
+	socksRelays[u.String()] = relay
+	go relay.serve()
+	go relay.expire()
+	return relay, nil
+}
+
+func (r *socksRelay) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.lastUsed = time.Now()
+		r.mu.Unlock()
+		go r.relay(conn)
+	}
+}
+
+// expire closes the relay once it has been idle for socksRelayIdle or the
+// service shuts down. Connections in flight are left to finish.
+func (r *socksRelay) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			idle := time.Since(r.lastUsed) > socksRelayIdle
+			r.mu.Unlock()
+			if !idle {
+				continue
+			}
+		case <-shutdownChan:
+		}
+		socksRelaysLock.Lock()
+		delete(socksRelays, r.upstream.String())
+		socksRelaysLock.Unlock()
+		r.listener.Close()
+		return
+	}
+}
+
+func (r *socksRelay) relay(client net.Conn) {
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := acceptSocksGreeting(client); err != nil {
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", proxyAddr(r.upstream), 10*time.Second)
+	if err != nil {
+		log.Printf("SOCKS relay: cannot reach %s: %v", r.upstream.Host, err)
+		client.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}) // general failure
+		return
+	}
+	defer upstream.Close()
+	upstream.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := socksLogin(upstream, r.upstream.User); err != nil {
+		log.Printf("SOCKS relay: %s: %v", r.upstream.Host, err)
+		client.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0}) // not allowed
+		return
+	}
+	client.SetDeadline(time.Time{})
+	upstream.SetDeadline(time.Time{})
+
+	// The CONNECT request and the reply to it pass through as they are
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(upstream, client); done <- struct{}{} }()
+	go func() { io.Copy(client, upstream); done <- struct{}{} }()
+	<-done
+}
+
+// acceptSocksGreeting reads the client's method offer and selects "no
+// authentication".
+func acceptSocksGreeting(c net.Conn) error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	if head[0] != 5 {
+		return errors.New("not SOCKS5")
+	}
+	if _, err := io.ReadFull(c, make([]byte, head[1])); err != nil {
+		return err
+	}
+	_, err := c.Write([]byte{5, 0})
+	return err
+}
+
+// socksLogin offers username/password authentication to the upstream proxy
+// and performs it.
+func socksLogin(c net.Conn, user *url.Userinfo) error {
+	name, password := user.Username(), ""
+	if p, ok := user.Password(); ok {
+		password = p
+	}
+	if len(name) > 255 || len(password) > 255 {
+		return errors.New("SOCKS credentials too long")
+	}
+	if _, err := c.Write([]byte{5, 1, 2}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[1] != 2 {
+		return errors.New("proxy does not accept username/password authentication")
+	}
+	msg := append([]byte{1, byte(len(name))}, name...)
+	msg = append(append(msg, byte(len(password))), password...)
+	if _, err := c.Write(msg); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("proxy rejected the credentials")
+	}
+	return nil
+}
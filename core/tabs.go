@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+)
+
+// Storage cleared for every origin a capture visited. The HTTP cache is
+// deliberately kept so repeat captures stay fast.
+const resetStorageTypes = "cookies,file_systems,indexeddb,local_storage,websql,service_workers,cache_storage,shared_storage,storage_buckets"
+
+// newTab opens a tab in the worker's long-lived browser, launching Chrome
+// first if it is not running or has crashed, and routes it through proxy if
+// set. An isolated tab gets a fresh incognito browser context of its own.
+// The returned cancel closes the tab and resets the state the capture left
+// behind. Callers hold w.mu.
+func (w *chromeWorker) newTab(proxy *url.URL, isolated bool) (context.Context, context.CancelFunc, error) {
+	if !w.browserRunning() {
+		if err := w.launchBrowser(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// A remote browser may be shared with other workers or services, so
+	// its tabs get their own browser context, disposed with the tab, rather
+	// than clearing state browser-wide. Proxies are set per browser context
+	// too. Cookies, storage, cache and service workers of an isolated
+	// capture live and die with its context, so nothing is shared either way.
+	if w.backend != nil || proxy != nil || isolated {
+		var opts []chromedp.CreateBrowserContextOption
+		if proxy != nil {
+			server, err := chromeProxyServer(proxy)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts = append(opts, func(p *target.CreateBrowserContextParams) *target.CreateBrowserContextParams {
+				return p.WithProxyServer(server)
+			})
+		}
+		ctx, cancel := chromedp.NewContext(w.browserCtx, chromedp.WithNewBrowserContext(opts...))
+		return ctx, cancel, nil
+	}
+
+	ctx, cancel := chromedp.NewContext(w.browserCtx)
+	var mu sync.Mutex
+	origins := make(map[string]bool)
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if e, ok := ev.(*network.EventRequestWillBeSent); ok && e.Type == network.ResourceTypeDocument {
+			if u, err := url.Parse(e.Request.URL); err == nil && u.Host != "" {
+				mu.Lock()
+				origins[u.Scheme+"://"+u.Host] = true
+				mu.Unlock()
+			}
+		}
+	})
+
+	return ctx, func() {
+		cancel()
+		mu.Lock()
+		defer mu.Unlock()
+		w.resetBrowser(origins)
+	}, nil
+}
+
+func (w *chromeWorker) browserRunning() bool {
+	if w.browserCtx == nil || w.browserCtx.Err() != nil {
+		return false
+	}
+	select {
+	case <-chromedp.FromContext(w.browserCtx).Browser.LostConnection:
+		return false
+	default:
+		return true
+	}
+}
+
+func (w *chromeWorker) launchBrowser() error {
+	w.closeBrowser()
+	ctx, cancel := chromedp.NewContext(w.allocCtx)
+	if err := chromedp.Run(ctx); err != nil {
+		cancel()
+		if w.backend != nil {
+			w.backend.fail(err)
+		}
+		return err
+	}
+	w.browserCtx, w.browserCancel = ctx, cancel
+	if p := chromedp.FromContext(ctx).Browser.Process(); p != nil {
+		w.pid.Store(int64(p.Pid))
+	}
+	return nil
+}
+
+func (w *chromeWorker) closeBrowser() {
+	if w.browserCancel != nil {
+		w.browserCancel()
+	}
+	w.browserCtx, w.browserCancel = nil, nil
+	w.pid.Store(0)
+}
+
+// resetBrowser clears cookies, granted permissions and storage for the
+// visited origins and closes any tabs a page opened, so nothing leaks into
+// the next capture. If that fails the browser is closed and relaunched on
+// next use.
+func (w *chromeWorker) resetBrowser(origins map[string]bool) {
+	if !w.browserRunning() {
+		return
+	}
+	c := chromedp.FromContext(w.browserCtx)
+	ctx, cancel := context.WithTimeout(w.browserCtx, 5*time.Second)
+	defer cancel()
+	ctx = cdp.WithExecutor(ctx, c.Browser)
+
+	err := storage.ClearCookies().Do(ctx)
+	if err == nil {
+		err = browser.ResetPermissions().Do(ctx)
+	}
+	for origin := range origins {
+		if err != nil {
+			break
+		}
+		err = storage.ClearDataForOrigin(origin, resetStorageTypes).Do(ctx)
+	}
+	if err == nil {
+		var infos []*target.Info
+		if infos, err = target.GetTargets().Do(ctx); err == nil {
+			for _, info := range infos {
+				if info.Type == "page" && info.TargetID != c.Target.TargetID && !strings.HasPrefix(info.URL, "devtools://") {
+					target.CloseTarget(info.TargetID).Do(ctx)
+				}
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Worker %d could not reset its browser, restarting it: %v", w.id, err)
+		w.closeBrowser()
+	}
+}
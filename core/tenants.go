@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// tenantProfile holds the defaults and limits shared by every API key that
+// belongs to one tenant (team).
+type tenantProfile struct {
+	DefaultWidth    int        `json:"default_width,omitempty"`
+	DefaultHeight   int        `json:"default_height,omitempty"`
+	MaxWidth        int        `json:"max_width,omitempty"`
+	MaxHeight       int        `json:"max_height,omitempty"`
+	AllowedFormats  []string   `json:"allowed_formats,omitempty"`
+	CacheTTLSeconds int        `json:"cache_ttl_seconds,omitempty"`
+	AllowedDomains  []string   `json:"allowed_domains,omitempty"` // same syntax as URL_ALLOWLIST
+	Watermark       *watermark `json:"watermark,omitempty"`
+	// Where the tenant's captures are uploaded unless a request says store=none
+	Upload *uploadTarget `json:"upload,omitempty"`
+
+	domainRules urlRules
+}
+
+var (
+	// Tenant profiles by name (TENANTS_FILE); keys reference them via "tenant"
+	tenantProfiles map[string]*tenantProfile
+	maxTenantTTL   time.Duration
+)
+
+func init() {
+	tenantProfiles = make(map[string]*tenantProfile)
+
+	path := os.Getenv("TENANTS_FILE")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read TENANTS_FILE: %v", err)
+	}
+	if err := json.Unmarshal(data, &tenantProfiles); err != nil {
+		log.Fatalf("Invalid TENANTS_FILE: %v", err)
+	}
+
+	for name, p := range tenantProfiles {
+		if p.domainRules, err = parseURLRules(strings.Join(p.AllowedDomains, ",")); err != nil {
+			log.Fatalf("Invalid allowed_domains for tenant %s: %v", name, err)
+		}
+		maxTenantTTL = max(maxTenantTTL, time.Duration(p.CacheTTLSeconds)*time.Second)
+		if p.Watermark != nil {
+			if err := p.Watermark.load(name); err != nil {
+				log.Fatalf("Invalid watermark for tenant %s: %v", name, err)
+			}
+		}
+		if p.Upload != nil {
+			if err := p.Upload.check(); err != nil {
+				log.Fatalf("Invalid upload for tenant %s: %v", name, err)
+			}
+		}
+	}
+	for _, k := range apiKeys {
+		if _, ok := tenantProfiles[k.Tenant]; k.Tenant != "" && !ok {
+			log.Fatalf("API key %s references unknown tenant %q", k.Name, k.Tenant)
+		}
+	}
+	log.Printf("webshot loaded %d tenant profiles", len(tenantProfiles))
+}
+
+// tenantProfileFor returns the caller's profile, or nil for keys without one.
+func tenantProfileFor(ctx context.Context) *tenantProfile {
+	if key := apiKeyFrom(ctx); key != nil && key.Tenant != "" {
+		return tenantProfiles[key.Tenant]
+	}
+	return nil
+}
+
+// cacheTTL is how long the caller may be served a cached capture.
+func (p *tenantProfile) cacheTTL() time.Duration {
+	if p == nil || p.CacheTTLSeconds <= 0 {
+		return defaults.cacheTTL
+	}
+	return time.Duration(p.CacheTTLSeconds) * time.Second
+}
+
+// maxCacheTTL is the longest freshness any caller can ask for: the longest
+// tenant TTL, or CACHE_MAX_TTL_SECONDS for per-request ttl= overrides.
+func maxCacheTTL() time.Duration {
+	return max(defaults.cacheTTL, maxTenantTTL, defaults.maxCacheTTL)
+}
+
+// cacheRetention is how long entries stay in the cache: long enough for the
+// longest TTL plus the stale-while-revalidate window.
+func cacheRetention() time.Duration {
+	return maxCacheTTL() + staleWhileRevalidate
+}
+
+func (p *tenantProfile) allowsFormat(format string) bool {
+	if p == nil || len(p.AllowedFormats) == 0 {
+		return true
+	}
+	for _, f := range p.AllowedFormats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTenantURL applies the tenant's allowed_domains on top of the global
+// URL policy.
+func checkTenantURL(ctx context.Context, raw string) error {
+	p := tenantProfileFor(ctx)
+	if p == nil || len(p.domainRules) == 0 {
+		return nil
+	}
+	if p.domainRules.match(raw) {
+		return nil
+	}
+	return &captureError{status: http.StatusForbidden, message: "URL is not allowed for this tenant"}
+}
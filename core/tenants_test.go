@@ -0,0 +1,39 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCheckTenantURL(t *testing.T) {
+	useTenant(t, "acme", &tenantProfile{AllowedDomains: []string{"*.acme.test", "acme.test"}})
+	useTenant(t, "open", &tenantProfile{})
+	acme := keyContext(&apiKey{Name: "ci", Tenant: "acme"})
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		url  string
+		ok   bool
+	}{
+		{"allowed", acme, "https://www.acme.test/", true},
+		{"apex", acme, "https://acme.test/x", true},
+		{"other site", acme, "https://example.com/", false},
+		{"lookalike", acme, "https://acme.test.evil.example/", false},
+		{"no allowed_domains", keyContext(&apiKey{Name: "o", Tenant: "open"}), "https://example.com/", true},
+		{"no tenant", keyContext(&apiKey{Name: "k"}), "https://example.com/", true},
+		{"no key", context.Background(), "https://example.com/", true},
+	}
+	for _, tt := range tests {
+		err := checkTenantURL(tt.ctx, tt.url)
+		var ce *captureError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !tt.ok && (!errors.As(err, &ce) || ce.status != http.StatusForbidden):
+			t.Errorf("%s: checkTenantURL = %v, want 403", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tileSize    = 254
+	tileOverlap = 1
+)
+
+var (
+	// Deep-zoom pyramids keyed by capture id, kept for the cache duration in
+	// an LRU of at most TILE_CACHE_MAX_MB of encoded tiles
+	tileSets *tileStore
+)
+
+func init() {
+	tileSets = newTileStore(int64(envInt("TILE_CACHE_MAX_MB", 256, 1, 1<<20)) << 20)
+}
+
+// tilePyramid holds the encoded tiles of every level of a Deep Zoom (DZI)
+// pyramid. Level 0 is a single pixel and the last level is the
+// full-resolution capture.
+type tilePyramid struct {
+	url     string
+	levels  []tileLevel
+	width   int
+	height  int
+	size    int64 // bytes of PNG tiles
+	created time.Time
+}
+
+type tileLevel struct {
+	cols, rows int
+	tiles      [][]byte // PNGs, row by row
+}
+
+// buildTilePyramid cuts and encodes every tile of data, a capture, from the
+// full-resolution level down, so only two levels are ever decoded at once.
+// It is CPU-bound and runs on the encode pool.
+func buildTilePyramid(data []byte) (*tilePyramid, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	src = nil
+
+	maxLevel := 0
+	for size := max(b.Dx(), b.Dy()); size > 1; size = (size + 1) / 2 {
+		maxLevel++
+	}
+
+	p := &tilePyramid{levels: make([]tileLevel, maxLevel+1), width: b.Dx(), height: b.Dy(), created: time.Now()}
+	for l := maxLevel; l >= 0; l-- {
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		level := tileLevel{cols: (w + tileSize - 1) / tileSize, rows: (h + tileSize - 1) / tileSize}
+		for row := range level.rows {
+			for col := range level.cols {
+				tile, err := pngBytes(&pngEncoder, img.SubImage(tileBounds(w, h, col, row)))
+				if err != nil {
+					return nil, err
+				}
+				level.tiles = append(level.tiles, tile)
+				p.size += int64(len(tile))
+			}
+		}
+		p.levels[l] = level
+		if l > 0 {
+			img = halveImage(img)
+		}
+	}
+	return p, nil
+}
+
+// tileBounds is the DZI tile at (col, row) of a w by h level, including
+// overlap.
+func tileBounds(w, h, col, row int) image.Rectangle {
+	x0, y0 := col*tileSize, row*tileSize
+	if col > 0 {
+		x0 -= tileOverlap
+	}
+	if row > 0 {
+		y0 -= tileOverlap
+	}
+	x1 := min((col+1)*tileSize+tileOverlap, w)
+	y1 := min((row+1)*tileSize+tileOverlap, h)
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// halveImage downsamples img by two using a 2x2 box filter.
+func halveImage(img *image.RGBA) *image.RGBA {
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := (sw+1)/2, (sh+1)/2
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var r, g, b, a, n int
+			for dy := 0; dy < 2; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					sx, sy := 2*x+dx, 2*y+dy
+					if sx >= sw || sy >= sh {
+						continue
+					}
+					i := img.PixOffset(sx, sy)
+					r += int(img.Pix[i])
+					g += int(img.Pix[i+1])
+					b += int(img.Pix[i+2])
+					a += int(img.Pix[i+3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// tile returns the PNG of the tile at (col, row) of level.
+func (p *tilePyramid) tile(level, col, row int) ([]byte, bool) {
+	if level < 0 || level >= len(p.levels) {
+		return nil, false
+	}
+	l := p.levels[level]
+	if col < 0 || row < 0 || col >= l.cols || row >= l.rows {
+		return nil, false
+	}
+	return l.tiles[row*l.cols+col], true
+}
+
+// tileStore is an LRU of pyramids bounded by their total bytes.
+type tileStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	sets  map[string]*list.Element // id -> element holding *tileSet
+	lru   *list.List               // front is most recently used
+	bytes int64
+}
+
+type tileSet struct {
+	id      string
+	pyramid *tilePyramid
+}
+
+func newTileStore(maxBytes int64) *tileStore {
+	return &tileStore{maxBytes: maxBytes, sets: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (s *tileStore) get(id string) (*tilePyramid, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.sets[id]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*tileSet).pyramid, true
+}
+
+// add stores p as id unless a pyramid is there already, evicting the least
+// recently used ones to make room, and returns the stored pyramid.
+func (s *tileStore) add(id string, p *tilePyramid) *tilePyramid {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.sets[id]; ok {
+		s.lru.MoveToFront(elem)
+		return elem.Value.(*tileSet).pyramid
+	}
+	s.sets[id] = s.lru.PushFront(&tileSet{id: id, pyramid: p})
+	s.bytes += p.size
+	for s.bytes > s.maxBytes && s.lru.Len() > 1 {
+		s.remove(s.lru.Back())
+	}
+	return p
+}
+
+func (s *tileStore) remove(elem *list.Element) {
+	set := s.lru.Remove(elem).(*tileSet)
+	delete(s.sets, set.id)
+	s.bytes -= set.pyramid.size
+}
+
+// sweep drops pyramids older than ttl; the cache janitor calls it.
+func (s *tileStore) sweep(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for elem := s.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if time.Since(elem.Value.(*tileSet).pyramid.created) > ttl {
+			s.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// purge drops the pyramids of matching URLs and reports how many.
+func (s *tileStore) purge(match func(url string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for elem := s.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if match(elem.Value.(*tileSet).pyramid.url) {
+			s.remove(elem)
+			n++
+		}
+		elem = prev
+	}
+	return n
+}
+
+// HandleTiles captures a full page and answers with a DZI descriptor whose
+// tiles are served by HandleTile.
+func HandleTiles(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "tiles") {
+		return
+	}
+
+	opts, err := parseCaptureOptions(r)
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+	// Deep zoom is for the whole page, never an early viewport grab
+	opts.preferSpeed = false
+
+	// A pyramid another caller built is only served to callers who may
+	// capture its page, and counts as a capture like any cache hit
+	err = checkTargetURL(opts.url)
+	if err == nil {
+		err = checkTenantURL(r.Context(), opts.url)
+	}
+	if err != nil {
+		writeCaptureError(writer, err)
+		return
+	}
+
+	id := getCacheKey(opts)
+	pyramid, ok := tileSets.get(id)
+	if ok {
+		recordUsage(r.Context(), 1, 0)
+	} else {
+		res, err := screenshotFor(r.Context(), opts)
+		if err != nil {
+			writeCaptureError(writer, err)
+			return
+		}
+		err = runEncoder(r.Context(), func() (err error) {
+			pyramid, err = buildTilePyramid(res.data)
+			return err
+		})
+		if ce, ok := err.(*captureError); ok {
+			writeCaptureError(writer, ce)
+			return
+		}
+		if err != nil {
+			log.Printf("Error building tile pyramid (%s): %v", opts.url, err)
+			http.Error(writer, "Error building tile pyramid", http.StatusInternalServerError)
+			return
+		}
+		if pyramid.size > tileSets.maxBytes {
+			http.Error(writer, "Capture is too large to tile (TILE_CACHE_MAX_MB)", http.StatusRequestEntityTooLarge)
+			return
+		}
+		pyramid.url = opts.url
+		pyramid = tileSets.add(id, pyramid)
+	}
+
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.Header().Set("X-Tiles-ID", id)
+	fmt.Fprintf(writer, `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Url="/tiles/%s/" Format="png" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, id, tileOverlap, tileSize, pyramid.width, pyramid.height)
+}
+
+// HandleTile serves /tiles/{id}/{level}/{col}_{row}.png from a pyramid built
+// by HandleTiles.
+func HandleTile(writer http.ResponseWriter, r *http.Request) {
+	if !requireFeature(writer, r, "tiles") {
+		return
+	}
+	pyramid, ok := tileSets.get(r.PathValue("id"))
+	if !ok {
+		http.Error(writer, "Unknown or expired tile set", http.StatusNotFound)
+		return
+	}
+
+	level, err := strconv.Atoi(r.PathValue("level"))
+	if err != nil {
+		http.Error(writer, "Invalid tile level", http.StatusBadRequest)
+		return
+	}
+	colStr, rowStr, ok := strings.Cut(strings.TrimSuffix(r.PathValue("tile"), ".png"), "_")
+	col, colErr := strconv.Atoi(colStr)
+	row, rowErr := strconv.Atoi(rowStr)
+	if !ok || colErr != nil || rowErr != nil {
+		http.Error(writer, "Invalid tile name, expected {col}_{row}.png", http.StatusBadRequest)
+		return
+	}
+
+	tile, ok := pyramid.tile(level, col, row)
+	if !ok {
+		http.Error(writer, "Tile out of range", http.StatusNotFound)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "image/png")
+	writer.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(defaults.cacheTTL.Seconds())))
+	writer.Write(tile)
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildTilePyramid(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 600, 300))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+
+	p, err := buildTilePyramid(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 600 halves to 1 in ten steps, so levels 0-10
+	if len(p.levels) != 11 || p.width != 600 || p.height != 300 {
+		t.Fatalf("%d levels of %dx%d, want 11 of 600x300", len(p.levels), p.width, p.height)
+	}
+
+	tests := []struct {
+		level, cols, rows int
+		w, h              int // of the last tile
+	}{
+		{10, 3, 2, 600 - 2*tileSize + tileOverlap, 300 - tileSize + tileOverlap},
+		{9, 2, 1, 300 - tileSize + tileOverlap, 150},
+		{0, 1, 1, 1, 1},
+	}
+	var size int64
+	for _, l := range p.levels {
+		for _, tile := range l.tiles {
+			size += int64(len(tile))
+		}
+	}
+	if p.size != size {
+		t.Errorf("size %d, tiles hold %d bytes", p.size, size)
+	}
+	for _, tt := range tests {
+		l := p.levels[tt.level]
+		if l.cols != tt.cols || l.rows != tt.rows {
+			t.Errorf("level %d: %dx%d tiles, want %dx%d", tt.level, l.cols, l.rows, tt.cols, tt.rows)
+			continue
+		}
+		data, ok := p.tile(tt.level, tt.cols-1, tt.rows-1)
+		if !ok {
+			t.Errorf("level %d: last tile missing", tt.level)
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("level %d: %v", tt.level, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("level %d: last tile %dx%d, want %dx%d", tt.level, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+	}
+
+	for _, c := range [][3]int{{-1, 0, 0}, {11, 0, 0}, {10, 3, 0}, {10, 0, 2}, {10, -1, 0}} {
+		if _, ok := p.tile(c[0], c[1], c[2]); ok {
+			t.Errorf("tile(%d, %d, %d) exists", c[0], c[1], c[2])
+		}
+	}
+}
+
+func TestTileBounds(t *testing.T) {
+	tests := []struct {
+		w, h, col, row int
+		want           image.Rectangle
+	}{
+		{600, 300, 0, 0, image.Rect(0, 0, tileSize+tileOverlap, tileSize+tileOverlap)},
+		{600, 300, 1, 0, image.Rect(tileSize-tileOverlap, 0, 2*tileSize+tileOverlap, tileSize+tileOverlap)},
+		{600, 300, 2, 1, image.Rect(2*tileSize-tileOverlap, tileSize-tileOverlap, 600, 300)},
+		{10, 10, 0, 0, image.Rect(0, 0, 10, 10)},
+	}
+	for _, tt := range tests {
+		if got := tileBounds(tt.w, tt.h, tt.col, tt.row); got != tt.want {
+			t.Errorf("tileBounds(%d, %d, %d, %d) = %v, want %v", tt.w, tt.h, tt.col, tt.row, got, tt.want)
+		}
+	}
+}
+
+func TestHalveImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	img.SetRGBA(0, 0, color.RGBA{R: 100, A: 255})
+	img.SetRGBA(1, 0, color.RGBA{R: 200, A: 255})
+	img.SetRGBA(2, 0, color.RGBA{G: 50, A: 255})
+
+	half := halveImage(img)
+	if b := half.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("halved to %v, want 2x1", b)
+	}
+	if got := half.RGBAAt(0, 0); got != (color.RGBA{R: 150, A: 255}) {
+		t.Errorf("averaged pixel %v", got)
+	}
+	if got := half.RGBAAt(1, 0); got != (color.RGBA{G: 50, A: 255}) {
+		t.Errorf("edge pixel %v", got)
+	}
+}
+
+func TestTileStore(t *testing.T) {
+	pyramid := func(url string, size int64, age time.Duration) *tilePyramid {
+		return &tilePyramid{url: url, size: size, created: time.Now().Add(-age)}
+	}
+	s := newTileStore(100)
+	s.add("a", pyramid("https://a.test/", 40, 0))
+	s.add("b", pyramid("https://b.test/", 40, 0))
+	s.get("a") // b is now the least recently used
+	s.add("c", pyramid("https://c.test/", 40, 0))
+
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := s.get(id); ok != want {
+			t.Errorf("%s stored = %v, want %v", id, ok, want)
+		}
+	}
+	if s.bytes != 80 {
+		t.Errorf("bytes %d, want 80", s.bytes)
+	}
+
+	// A second build of the same capture keeps the first
+	first, _ := s.get("a")
+	if got := s.add("a", pyramid("https://a.test/", 10, 0)); got != first {
+		t.Error("add replaced a stored pyramid")
+	}
+
+	s.add("old", pyramid("https://old.test/", 10, time.Hour))
+	s.sweep(time.Minute)
+	if _, ok := s.get("old"); ok {
+		t.Error("sweep kept an expired pyramid")
+	}
+
+	if n := s.purge(func(url string) bool { return url == "https://c.test/" }); n != 1 {
+		t.Errorf("purge removed %d pyramids, want 1", n)
+	}
+	if _, ok := s.get("a"); !ok || s.bytes != 40 {
+		t.Errorf("after purge: a stored = %v, bytes %d; want true and 40", ok, s.bytes)
+	}
+}
+
+func TestTilesChecksURLPolicyOnCachedPyramids(t *testing.T) {
+	saved := tileSets
+	defer func() { tileSets = saved }()
+	tileSets = newTileStore(1 << 20)
+
+	useTenant(t, "acme", &tenantProfile{AllowedDomains: []string{"acme.test"}})
+	restricted := &apiKey{Key: "restricted-secret", Name: "restricted", Tenant: "acme"}
+	other := &apiKey{Key: "other-secret", Name: "other"}
+	useAPIKeys(t, restricted, other)
+
+	// Another caller has tiled the page already
+	target := "/tiles?url=" + url.QueryEscape("https://example.com/")
+	for _, k := range []*apiKey{restricted, other} {
+		opts, err := parseCaptureOptions(httptest.NewRequest(http.MethodGet, target, nil).WithContext(keyContext(k)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.preferSpeed = false
+		tileSets.add(getCacheKey(opts), &tilePyramid{url: opts.url, width: 1, height: 1, levels: []tileLevel{{cols: 1, rows: 1, tiles: [][]byte{{1}}}}, created: time.Now()})
+	}
+
+	captures := func(k *apiKey) int64 {
+		usageLock.Lock()
+		defer usageLock.Unlock()
+		return usageFor(k.Name, time.Now()).DayCaptures
+	}
+
+	before := captures(restricted)
+	w := httptest.NewRecorder()
+	HandleTiles(w, httptest.NewRequest(http.MethodGet, target, nil).WithContext(keyContext(restricted)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("tenant outside allowed_domains: status %d, want 403", w.Code)
+	}
+	if captures(restricted) != before {
+		t.Error("refused request was metered")
+	}
+
+	before = captures(other)
+	w = httptest.NewRecorder()
+	HandleTiles(w, httptest.NewRequest(http.MethodGet, target, nil).WithContext(keyContext(other)))
+	if w.Code != http.StatusOK || w.Header().Get("X-Tiles-ID") == "" {
+		t.Fatalf("cached pyramid: status %d", w.Code)
+	}
+	if captures(other) != before+1 {
+		t.Error("cached pyramid was not metered")
+	}
+
+	id := w.Header().Get("X-Tiles-ID")
+	tile := func(k *apiKey) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/tiles/"+id+"/0/0_0.png", nil).WithContext(keyContext(k))
+		r.SetPathValue("id", id)
+		r.SetPathValue("level", "0")
+		r.SetPathValue("tile", "0_0.png")
+		w := httptest.NewRecorder()
+		HandleTile(w, r)
+		return w
+	}
+	if w := tile(other); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Cache-Control"), "private") {
+		t.Errorf("tile: status %d, Cache-Control %q; want 200 and private", w.Code, w.Header().Get("Cache-Control"))
+	}
+	if w := tile(&apiKey{Name: "no-tiles", Features: []string{"screenshot"}}); w.Code != http.StatusForbidden {
+		t.Errorf("tile for a key without the tiles feature: status %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// serverTiming collects how long a request spent in each stage of a capture,
+// reported in the Server-Timing header: queue (waiting for a host slot and a
+// Chrome worker), nav (loading the page until it settles), render (taking
+// the screenshot), encode (post-processing) and cache (lookups and stores).
+type serverTiming struct {
+	mu     sync.Mutex
+	stages map[string]time.Duration
+}
+
+var timingStages = []string{"queue", "nav", "render", "encode", "cache"}
+
+type timingContextKey struct{}
+
+// timingFrom returns ctx's timing, or nil; add and since do nothing on nil.
+func timingFrom(ctx context.Context) *serverTiming {
+	t, _ := ctx.Value(timingContextKey{}).(*serverTiming)
+	return t
+}
+
+// withTimingOf gives ctx (a tab's) the timing of the request behind parent.
+func withTimingOf(ctx, parent context.Context) context.Context {
+	if t := timingFrom(parent); t != nil {
+		return context.WithValue(ctx, timingContextKey{}, t)
+	}
+	return ctx
+}
+
+func (t *serverTiming) add(stage string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.stages[stage] += d
+	t.mu.Unlock()
+}
+
+// since adds the time since started to stage.
+func (t *serverTiming) since(stage string, started time.Time) {
+	t.add(stage, time.Since(started))
+}
+
+// markStage is an action adding the time since *from to stage and
+// restarting *from, to split a chromedp.Run into stages.
+func markStage(t *serverTiming, stage string, from *time.Time) chromedp.Action {
+	return chromedp.ActionFunc(func(context.Context) error {
+		t.since(stage, *from)
+		*from = time.Now()
+		return nil
+	})
+}
+
+func (t *serverTiming) header(total time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var parts []string
+	for _, stage := range timingStages {
+		if d, ok := t.stages[stage]; ok {
+			parts = append(parts, fmt.Sprintf("%s;dur=%.1f", stage, float64(d.Microseconds())/1000))
+		}
+	}
+	parts = append(parts, fmt.Sprintf("total;dur=%.1f", float64(total.Microseconds())/1000))
+	return strings.Join(parts, ", ")
+}
+
+// timingWriter sets Server-Timing just before the headers go out.
+type timingWriter struct {
+	http.ResponseWriter
+	timing  *serverTiming
+	started time.Time
+	wrote   bool
+}
+
+func (w *timingWriter) setHeader() {
+	if !w.wrote {
+		w.wrote = true
+		w.Header().Set("Server-Timing", w.timing.header(time.Since(w.started)))
+	}
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	w.setHeader()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(p []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WithServerTiming adds a Server-Timing header to every response, with the
+// capture stages the request went through and its total time so far.
+func WithServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		timing := &serverTiming{stages: make(map[string]time.Duration)}
+		w := &timingWriter{ResponseWriter: writer, timing: timing, started: time.Now()}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), timingContextKey{}, timing)))
+		w.setHeader()
+	})
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	// Machine translation before capture (disabled unless TRANSLATE_URL is set).
+	// The endpoint speaks the LibreTranslate /translate API.
+	translateURL    string
+	translateAPIKey string
+	translateClient = &http.Client{Timeout: 20 * time.Second}
+
+	languageCode = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})?$`)
+)
+
+func init() {
+	translateURL = os.Getenv("TRANSLATE_URL")
+	translateAPIKey = os.Getenv("TRANSLATE_API_KEY")
+	if translateURL != "" {
+		log.Printf("webshot translation enabled: %s", translateURL)
+	}
+}
+
+// Text nodes are collected once, kept on the page, and rewritten in place so
+// the layout reflows exactly as it would for a translated site.
+const collectTextJS = `(() => {
+	const skip = new Set(['SCRIPT', 'STYLE', 'NOSCRIPT', 'TEMPLATE', 'CODE', 'PRE', 'TEXTAREA']);
+	const walker = document.createTreeWalker(document.body, NodeFilter.SHOW_TEXT, {
+		acceptNode: n => !n.nodeValue.trim() || skip.has(n.parentElement && n.parentElement.tagName)
+			? NodeFilter.FILTER_REJECT : NodeFilter.FILTER_ACCEPT
+	});
+	const nodes = [];
+	while (walker.nextNode()) nodes.push(walker.currentNode);
+	window.__webshotTextNodes = nodes;
+	return nodes.map(n => n.nodeValue.trim());
+})()`
+
+const applyTextJS = `((texts, lang) => {
+	(window.__webshotTextNodes || []).forEach((n, i) => {
+		if (texts[i] == null) return;
+		const v = n.nodeValue;
+		n.nodeValue = v.slice(0, v.length - v.trimStart().length) + texts[i] + v.slice(v.trimEnd().length);
+	});
+	document.documentElement.lang = lang;
+})(%s, %q)`
+
+// translatePage replaces the page's visible text with its translation into
+// target; it runs after the page is ready and before the screenshot.
+func translatePage(target string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var texts []string
+		if err := chromedp.Evaluate(collectTextJS, &texts).Do(ctx); err != nil {
+			return err
+		}
+		if len(texts) == 0 {
+			return nil
+		}
+
+		translated, err := translateTexts(ctx, texts, target)
+		if err != nil {
+			return fmt.Errorf("translate page: %w", err)
+		}
+		payload, _ := json.Marshal(translated)
+		return chromedp.Evaluate(fmt.Sprintf(applyTextJS, payload, target), nil).Do(ctx)
+	})
+}
+
+// translateTexts sends texts to the translation API in batches, preserving
+// order.
+func translateTexts(ctx context.Context, texts []string, target string) ([]string, error) {
+	const batchSize = 100
+	out := make([]string, 0, len(texts))
+
+	for start := 0; start < len(texts); start += batchSize {
+		batch := texts[start:min(start+batchSize, len(texts))]
+		body, _ := json.Marshal(map[string]interface{}{
+			"q":       batch,
+			"source":  "auto",
+			"target":  target,
+			"format":  "text",
+			"api_key": translateAPIKey,
+		})
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, translateURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := translateClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			TranslatedText []string `json:"translatedText"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("translation API returned %s", resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(res.TranslatedText) != len(batch) {
+			return nil, fmt.Errorf("translation API returned %d texts for %d", len(res.TranslatedText), len(batch))
+		}
+		out = append(out, res.TranslatedText...)
+	}
+	return out, nil
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// uploadTarget is where store= puts a capture (s3, gcs, azure or local):
+// the tenant's "upload" configuration, refined by the request's bucket and
+// key_prefix.
+type uploadTarget struct {
+	Store     string `json:"store"`
+	Bucket    string `json:"bucket,omitempty"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+}
+
+// uploadResponse answers a capture that was uploaded instead of returned.
+type uploadResponse struct {
+	ID           string    `json:"id"`
+	Store        string    `json:"store,omitempty"`
+	Bucket       string    `json:"bucket,omitempty"`
+	Key          string    `json:"key,omitempty"`
+	URL          string    `json:"url,omitempty"`
+	PresignedURL string    `json:"presigned_url,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	ContentType  string    `json:"content_type"`
+	Size         int       `json:"size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	FinalURL     string    `json:"final_url,omitempty"`
+	TargetStatus int       `json:"target_status,omitempty"`
+	Cache        string    `json:"cache"`
+	Partial      bool      `json:"partial,omitempty"`
+}
+
+var (
+	// Key prefix of every upload (S3_UPLOAD_PREFIX, for every backend)
+	uploadPrefix string
+	// Buckets requests may name by backend: the configured default, their
+	// tenant's, and S3_UPLOAD_BUCKETS, GCS_UPLOAD_BUCKETS or
+	// AZURE_UPLOAD_CONTAINERS (comma-separated)
+	uploadBuckets map[string]map[string]bool
+	// Lifetime of the presigned URL in upload responses (S3_UPLOAD_URL_SECONDS)
+	uploadURLExpiry time.Duration
+
+	uploadKeyPrefix = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*/?$`)
+)
+
+func init() {
+	uploadPrefix = envOr("S3_UPLOAD_PREFIX", "webshot/uploads/")
+	uploadBuckets = make(map[string]map[string]bool)
+	lists := map[string]string{"s3": "S3_UPLOAD_BUCKETS", "gcs": "GCS_UPLOAD_BUCKETS", "azure": "AZURE_UPLOAD_CONTAINERS"}
+	for _, kind := range blobKinds {
+		allowed := make(map[string]bool)
+		for _, b := range strings.Split(os.Getenv(lists[kind])+","+defaultBucket(kind), ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				allowed[b] = true
+			}
+		}
+		uploadBuckets[kind] = allowed
+	}
+	// SigV4 presigned URLs are valid for at most 7 days
+	uploadURLExpiry = time.Duration(envInt("S3_UPLOAD_URL_SECONDS", 3600, 1, 7*24*3600)) * time.Second
+}
+
+func (t *uploadTarget) check() error {
+	if t.Store != "local" && !slices.Contains(blobKinds, t.Store) {
+		return fmt.Errorf("store must be s3, gcs, azure or local")
+	}
+	if t.KeyPrefix != "" && (!uploadKeyPrefix.MatchString(t.KeyPrefix) || strings.Contains(t.KeyPrefix, "..")) {
+		return fmt.Errorf("invalid key_prefix %q", t.KeyPrefix)
+	}
+	return nil
+}
+
+// parseUploadTarget reads store, bucket and key_prefix; it returns nil when
+// the capture is returned as usual.
+func parseUploadTarget(r *http.Request) (*uploadTarget, error) {
+	q := r.URL.Query()
+	var target uploadTarget
+	if p := tenantProfileFor(r.Context()); p != nil && p.Upload != nil {
+		target = *p.Upload
+	}
+	tenantBucket := target.Bucket
+
+	switch q.Get("store") {
+	case "":
+		if target.Store == "" {
+			if q.Has("bucket") || q.Has("key_prefix") {
+				return nil, &captureError{status: http.StatusBadRequest, message: "'bucket' and 'key_prefix' need store"}
+			}
+			return nil, nil
+		}
+	case "none":
+		return nil, nil
+	case "s3", "gcs", "azure", "local":
+		if !apiKeyFrom(r.Context()).allows("upload") {
+			return nil, &captureError{status: http.StatusForbidden, message: "API key is not allowed to use upload"}
+		}
+		if q.Get("store") != target.Store {
+			// The tenant's bucket belongs to its own backend
+			target.Store, target.Bucket, tenantBucket = q.Get("store"), "", ""
+		}
+	default:
+		return nil, &captureError{status: http.StatusBadRequest, message: "'store' must be s3, gcs, azure, local or none"}
+	}
+	if target.Store == "local" {
+		if q.Has("bucket") || q.Has("key_prefix") {
+			return nil, &captureError{status: http.StatusBadRequest, message: "'bucket' and 'key_prefix' do not apply to store=local"}
+		}
+		return &uploadTarget{Store: "local"}, nil
+	}
+
+	if b := q.Get("bucket"); b != "" && b != tenantBucket {
+		if !uploadBuckets[target.Store][b] {
+			return nil, &captureError{status: http.StatusForbidden, message: "Bucket is not allowed"}
+		}
+		target.Bucket = b
+	}
+	if target.Bucket == "" {
+		target.Bucket = defaultBucket(target.Store)
+	}
+	if target.Bucket == "" {
+		return nil, &captureError{status: http.StatusNotImplemented, message: "Uploads to " + target.Store + " are not configured"}
+	}
+
+	// A request's key_prefix nests under the tenant's
+	if p := q.Get("key_prefix"); p != "" {
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+		target.KeyPrefix += p
+	}
+	if err := target.check(); err != nil {
+		return nil, &captureError{status: http.StatusBadRequest, message: "Invalid 'key_prefix'"}
+	}
+	return &target, nil
+}
+
+// writeUploadJSON uploads the capture to target and answers with where it
+// is. The headers HandleScreenshot set for the image still apply.
+func writeUploadJSON(writer http.ResponseWriter, r *http.Request, target *uploadTarget, id string, res *screenshotResult, cache string) {
+	body := newUploadResponse(id, res, cache)
+	if err := storeUpload(r.Context(), &body, target, id, res.data); err != nil {
+		failCapture(writer, r, err)
+		return
+	}
+	// The presigned URL expires; the response must not outlive it in caches
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(body)
+}
+
+// newUploadResponse describes a capture; storeUpload adds where it went.
+func newUploadResponse(id string, res *screenshotResult, cache string) uploadResponse {
+	body := uploadResponse{
+		ID:           id,
+		ContentType:  "image/png",
+		Size:         len(res.data),
+		FinalURL:     res.finalURL,
+		TargetStatus: res.status,
+		Cache:        cache,
+		Partial:      res.partial,
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(res.data)); err == nil {
+		body.Width, body.Height = cfg.Width, cfg.Height
+	}
+	return body
+}
+
+// storeUpload puts data where target says. Errors are *captureError.
+func storeUpload(ctx context.Context, body *uploadResponse, target *uploadTarget, id string, data []byte) error {
+	body.Store = target.Store
+	if target.Store == "local" {
+		return storeLocally(body, data)
+	}
+	return uploadToBucket(ctx, body, target, id, data)
+}
+
+func uploadToBucket(ctx context.Context, body *uploadResponse, target *uploadTarget, id string, data []byte) error {
+	client, err := openBlobClient(target.Store, target.Bucket)
+	if err != nil {
+		log.Printf("Upload to %s %s: %v", target.Store, target.Bucket, err)
+		return &captureError{status: http.StatusNotImplemented, message: "Uploads to " + target.Store + " are not configured"}
+	}
+	key := uploadPrefix + target.KeyPrefix + id + ".png"
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	if err := client.Put(ctx, key, data, "image/png", nil); err != nil {
+		log.Printf("Upload to %s/%s: %v", client, key, err)
+		return &captureError{status: http.StatusBadGateway, message: "Failed to upload capture"}
+	}
+	body.Bucket, body.Key, body.URL = target.Bucket, key, client.ObjectURL(key)
+
+	// GCS cannot sign without a service account key; the object URL remains
+	if signed, err := client.Presign(key, uploadURLExpiry); err == nil {
+		body.PresignedURL = signed
+		body.ExpiresAt = time.Now().Add(uploadURLExpiry).UTC().Truncate(time.Second)
+	} else {
+		log.Printf("Upload to %s/%s: presigning: %v", client, key, err)
+	}
+	return nil
+}
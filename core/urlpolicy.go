@@ -0,0 +1,173 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Target URL rules (URL_ALLOWLIST / URL_DENYLIST, comma separated)
+	urlAllowRules urlRules
+	urlDenyRules  urlRules
+)
+
+func init() {
+	var err error
+	if urlAllowRules, err = parseURLRules(os.Getenv("URL_ALLOWLIST")); err != nil {
+		log.Fatalf("Invalid URL_ALLOWLIST: %v", err)
+	}
+	if urlDenyRules, err = parseURLRules(os.Getenv("URL_DENYLIST")); err != nil {
+		log.Fatalf("Invalid URL_DENYLIST: %v", err)
+	}
+}
+
+// urlRule is one compiled rule. A glob's scheme, host and path are matched
+// separately; a "re:" rule is matched against the normalized URL.
+type urlRule struct {
+	re     *regexp.Regexp
+	scheme *regexp.Regexp
+	host   *regexp.Regexp
+	path   *regexp.Regexp // nil covers every path
+}
+
+type urlRules []urlRule
+
+// parseURLRules compiles a comma separated rule list. A rule prefixed with
+// "re:" is a regular expression matched against the URL as
+// scheme://host/path (see normalizeTargetURL); anything else is a glob of
+// the form [scheme://]host[/path]. In the host, * matches one label (or
+// part of one), so *.example.com covers www.example.com but neither
+// example.com nor a.b.example.com; in the path it matches any run of
+// characters. A rule without a path covers every path on the host.
+func parseURLRules(list string) (urlRules, error) {
+	var rules urlRules
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		var rule urlRule
+		var err error
+		if expr, ok := strings.CutPrefix(raw, "re:"); ok {
+			rule.re, err = regexp.Compile(expr)
+		} else {
+			rule, err = compileGlob(raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", raw, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func compileGlob(glob string) (urlRule, error) {
+	scheme := "https?"
+	if s, rest, ok := strings.Cut(glob, "://"); ok {
+		scheme, glob = globPart(strings.ToLower(s), "[a-z]*"), rest
+	}
+	host, path, hasPath := strings.Cut(glob, "/")
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return urlRule{}, fmt.Errorf("no host")
+	}
+
+	var rule urlRule
+	var err error
+	if rule.scheme, err = regexp.Compile("^" + scheme + "$"); err != nil {
+		return rule, err
+	}
+	if rule.host, err = regexp.Compile("^" + globPart(host, "[^./]*") + "$"); err != nil {
+		return rule, err
+	}
+	if hasPath {
+		rule.path, err = regexp.Compile("^/" + globPart(path, ".*") + "$")
+	}
+	return rule, err
+}
+
+// globPart quotes glob for a regular expression, turning * into star.
+func globPart(glob, star string) string {
+	parts := strings.Split(glob, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return strings.Join(parts, star)
+}
+
+// match reports whether any rule covers raw. Unparseable URLs match nothing.
+func (rules urlRules) match(raw string) bool {
+	scheme, host, path, ok := targetParts(raw)
+	if !ok {
+		return false
+	}
+	normalized := scheme + "://" + host + path
+	for _, rule := range rules {
+		if rule.re != nil {
+			if rule.re.MatchString(normalized) {
+				return true
+			}
+			continue
+		}
+		if rule.scheme.MatchString(scheme) && rule.host.MatchString(host) && (rule.path == nil || rule.path.MatchString(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTargetURL rejects anything that is not a plain http(s) URL and then
+// applies the configured deny and allow rules, deny first.
+func checkTargetURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return &captureError{status: http.StatusBadRequest, message: "Invalid 'url' parameter"}
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return &captureError{status: http.StatusBadRequest, message: "Only http and https URLs can be captured"}
+	}
+	if u.Host == "" {
+		return &captureError{status: http.StatusBadRequest, message: "Invalid 'url' parameter"}
+	}
+
+	if urlDenyRules.match(raw) {
+		return &captureError{status: http.StatusForbidden, message: "URL is blocked by policy"}
+	}
+	if len(urlAllowRules) > 0 && !urlAllowRules.match(raw) {
+		return &captureError{status: http.StatusForbidden, message: "URL is not in the allowlist"}
+	}
+	return nil
+}
+
+// normalizeTargetURL reduces a URL to scheme://host/path, the form rules
+// are matched against: scheme and host lowercased, the host without a
+// trailing dot and the path with dot segments resolved, as the browser
+// would request it.
+func normalizeTargetURL(raw string) string {
+	scheme, host, path, ok := targetParts(raw)
+	if !ok {
+		return raw
+	}
+	return scheme + "://" + host + path
+}
+
+func targetParts(raw string) (scheme, host, path string, ok bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", "", "", false
+	}
+	u = u.ResolveReference(&url.URL{})
+	path = u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.ToLower(u.Scheme), strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), path, true
+}
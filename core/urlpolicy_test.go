@@ -0,0 +1,87 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestURLRulesMatch(t *testing.T) {
+	tests := []struct {
+		rules string
+		url   string
+		want  bool
+	}{
+		{"example.com", "https://example.com/", true},
+		{"example.com", "http://EXAMPLE.com./a/b?q=1", true},
+		{"example.com", "https://www.example.com/", false},
+		{"example.com", "ftp://example.com/", false},
+		{"*.example.com", "https://www.example.com/", true},
+		{"*.example.com", "https://example.com/", false},
+		{"*.example.com", "https://a.b.example.com/", false},
+		{"*.example.com", "https://example.com.evil.test/", false},
+		{"*.example.com", "https://www.example.com@evil.test/", false},
+		{"*example.com", "https://evilexample.com/", true},
+		{"https://docs.example.com/*", "https://docs.example.com/guide/intro", true},
+		{"https://docs.example.com/*", "http://docs.example.com/guide", false},
+		{"example.com/public/*", "https://example.com/public/a", true},
+		{"example.com/public/*", "https://example.com/private/a", false},
+		{"example.com/public/*", "https://example.com/public/../private/a", false},
+		{"example.com/public/*", "https://example.com/private?x=/public/a", false},
+		{"10.0.0.1", "http://10.0.0.1:8080/", true},
+		{`re:^https://[a-z]+\.example\.com/`, "https://api.example.com/v1", true},
+		{`re:^https://[a-z]+\.example\.com/`, "https://API.example.com./v1", true},
+		{`re:^https://[a-z]+\.example\.com/`, "https://example.com/", false},
+		{"a.test, b.test", "https://b.test/", true},
+		{"example.com", "not a url", false},
+		{"", "https://example.com/", false},
+	}
+	for _, tt := range tests {
+		rules, err := parseURLRules(tt.rules)
+		if err != nil {
+			t.Errorf("parseURLRules(%q): %v", tt.rules, err)
+			continue
+		}
+		if got := rules.match(tt.url); got != tt.want {
+			t.Errorf("rules %q match %q = %v, want %v", tt.rules, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestParseURLRulesRejects(t *testing.T) {
+	for _, list := range []string{"re:(", "https://", "/path/only"} {
+		if _, err := parseURLRules(list); err == nil {
+			t.Errorf("parseURLRules(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestCheckTargetURL(t *testing.T) {
+	allow, deny := urlAllowRules, urlDenyRules
+	defer func() { urlAllowRules, urlDenyRules = allow, deny }()
+	urlAllowRules, _ = parseURLRules("*.example.com")
+	urlDenyRules, _ = parseURLRules("admin.example.com")
+
+	tests := []struct {
+		url    string
+		status int // 0 = allowed
+	}{
+		{"https://www.example.com/", 0},
+		{"https://admin.example.com/", http.StatusForbidden},
+		{"https://ADMIN.example.com./", http.StatusForbidden},
+		{"https://other.test/", http.StatusForbidden},
+		{"file:///etc/passwd", http.StatusBadRequest},
+		{"javascript:alert(1)", http.StatusBadRequest},
+		{"https:///nohost", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		err := checkTargetURL(tt.url)
+		var ce *captureError
+		switch {
+		case tt.status == 0 && err != nil:
+			t.Errorf("checkTargetURL(%q) = %v, want allowed", tt.url, err)
+		case tt.status != 0 && (!errors.As(err, &ce) || ce.status != tt.status):
+			t.Errorf("checkTargetURL(%q) = %v, want status %d", tt.url, err, tt.status)
+		}
+	}
+}
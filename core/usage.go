@@ -0,0 +1,191 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// tenantUsage is the consumption of one API key. Day and month counters reset
+// when the UTC day or month rolls over.
+type tenantUsage struct {
+	Tenant        string `json:"tenant"`
+	Day           string `json:"day"`
+	DayCaptures   int64  `json:"day_captures"`
+	DayBytes      int64  `json:"day_bytes"`
+	Month         string `json:"month"`
+	MonthCaptures int64  `json:"month_captures"`
+	MonthBytes    int64  `json:"month_bytes"`
+	TotalCaptures int64  `json:"total_captures"`
+	TotalBytes    int64  `json:"total_bytes"`
+}
+
+var (
+	// Usage per tenant (API key name, "anonymous" when auth is disabled)
+	usage          map[string]*tenantUsage
+	usageLock      sync.Mutex
+	usageFile      string
+	usageLastSaved time.Time
+)
+
+func init() {
+	usage = make(map[string]*tenantUsage)
+
+	usageFile = os.Getenv("USAGE_FILE")
+	if usageFile == "" {
+		return
+	}
+	data, err := os.ReadFile(usageFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read USAGE_FILE: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		log.Printf("Invalid USAGE_FILE, starting empty: %v", err)
+		usage = make(map[string]*tenantUsage)
+	}
+}
+
+func tenantName(ctx context.Context) string {
+	if key := apiKeyFrom(ctx); key != nil {
+		return key.Name
+	}
+	return "anonymous"
+}
+
+// usageFor returns the tenant's counters rolled over to the current period;
+// callers must hold usageLock.
+func usageFor(tenant string, now time.Time) *tenantUsage {
+	u, ok := usage[tenant]
+	if !ok {
+		u = &tenantUsage{Tenant: tenant}
+		usage[tenant] = u
+	}
+	if day := now.UTC().Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayCaptures, u.DayBytes = day, 0, 0
+	}
+	if month := now.UTC().Format("2006-01"); u.Month != month {
+		u.Month, u.MonthCaptures, u.MonthBytes = month, 0, 0
+	}
+	return u
+}
+
+func recordUsage(ctx context.Context, captures, bytes int64) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+
+	u := usageFor(tenantName(ctx), time.Now())
+	u.DayCaptures += captures
+	u.MonthCaptures += captures
+	u.TotalCaptures += captures
+	u.DayBytes += bytes
+	u.MonthBytes += bytes
+	u.TotalBytes += bytes
+
+	if usageFile != "" && time.Since(usageLastSaved) > 30*time.Second {
+		usageLastSaved = time.Now()
+		saveUsage()
+	}
+}
+
+// saveUsage snapshots the counters to USAGE_FILE; callers must hold usageLock.
+func saveUsage() {
+	data, err := json.Marshal(usage)
+	if err == nil {
+		err = os.WriteFile(usageFile, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to save usage: %v", err)
+	}
+}
+
+// quotaExceeded reports whether the caller's key has used up its daily or
+// monthly capture quota.
+func quotaExceeded(ctx context.Context) bool {
+	key := apiKeyFrom(ctx)
+	if key == nil || (key.DailyQuota == 0 && key.MonthlyQuota == 0) {
+		return false
+	}
+
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	u := usageFor(key.Name, time.Now())
+	return (key.DailyQuota > 0 && u.DayCaptures >= key.DailyQuota) ||
+		(key.MonthlyQuota > 0 && u.MonthCaptures >= key.MonthlyQuota)
+}
+
+// byteCountingWriter counts the response bytes written for usage accounting.
+type byteCountingWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *byteCountingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TrackUsage refuses requests from keys over quota and accounts the bytes
+// served; captures themselves are counted where they are produced.
+func TrackUsage(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if quotaExceeded(r.Context()) {
+			http.Error(writer, "Capture quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		counter := &byteCountingWriter{ResponseWriter: writer}
+		next(counter, r)
+		recordUsage(r.Context(), 0, counter.bytes)
+	}
+}
+
+// HandleUsage reports consumption: every tenant for keys with the admin
+// feature (or when auth is disabled), otherwise only the caller's own.
+func HandleUsage(writer http.ResponseWriter, r *http.Request) {
+	key := apiKeyFrom(r.Context())
+	now := time.Now()
+
+	usageLock.Lock()
+	var list []tenantUsage
+	if !authEnabled || key.has("admin") {
+		for name := range usage {
+			list = append(list, *usageFor(name, now))
+		}
+	} else {
+		list = append(list, *usageFor(tenantName(r.Context()), now))
+	}
+	usageLock.Unlock()
+
+	type tenantReport struct {
+		tenantUsage
+		DailyQuota   int64 `json:"daily_quota,omitempty"`
+		MonthlyQuota int64 `json:"monthly_quota,omitempty"`
+	}
+	quotas := make(map[string]*apiKey)
+	for _, k := range apiKeys {
+		quotas[k.Name] = k
+	}
+	reports := make([]tenantReport, 0, len(list))
+	for _, u := range list {
+		report := tenantReport{tenantUsage: u}
+		if k, ok := quotas[u.Tenant]; ok {
+			report.DailyQuota, report.MonthlyQuota = k.DailyQuota, k.MonthlyQuota
+		}
+		reports = append(reports, report)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(reports)
+}
@@ -0,0 +1,260 @@
+package core
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+const maxViewports = 10
+
+type viewport struct {
+	width, height int
+}
+
+func (v viewport) String() string {
+	return fmt.Sprintf("%dx%d", v.width, v.height)
+}
+
+// viewportManifest describes a viewports= capture: manifest.json in the ZIP,
+// or the response when the captures were stored.
+type viewportManifest struct {
+	URL          string          `json:"url"`
+	FinalURL     string          `json:"final_url,omitempty"`
+	TargetStatus int             `json:"target_status,omitempty"`
+	Captures     []viewportEntry `json:"captures"`
+}
+
+type viewportEntry struct {
+	Viewport string `json:"viewport"`
+	File     string `json:"file,omitempty"` // name in the ZIP
+	uploadResponse
+}
+
+// parseViewports reads a list such as "375x667,768x1024,1920x1080".
+func parseViewports(ctx context.Context, raw string) ([]viewport, error) {
+	maxWidth, maxHeight := maxDimensions(ctx)
+	var viewports []viewport
+	seen := make(map[viewport]bool)
+	for _, part := range strings.Split(raw, ",") {
+		w, h, ok := strings.Cut(strings.TrimSpace(part), "x")
+		width, werr := strconv.Atoi(w)
+		height, herr := strconv.Atoi(h)
+		if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 || width > maxWidth || height > maxHeight {
+			return nil, &captureError{status: http.StatusBadRequest, message: fmt.Sprintf("Invalid viewport %q, expected WIDTHxHEIGHT up to %dx%d", part, maxWidth, maxHeight)}
+		}
+		if v := (viewport{width, height}); !seen[v] {
+			seen[v] = true
+			viewports = append(viewports, v)
+		}
+	}
+	if len(viewports) > maxViewports {
+		return nil, &captureError{status: http.StatusBadRequest, message: fmt.Sprintf("At most %d viewports per request", maxViewports)}
+	}
+	return viewports, nil
+}
+
+// handleViewports answers a /get with viewports=: a ZIP of the captures, or
+// with store= a JSON manifest of where they were stored.
+func handleViewports(writer http.ResponseWriter, r *http.Request, opts captureOptions, upload *uploadTarget) {
+	viewports, err := parseViewports(r.Context(), r.URL.Query().Get("viewports"))
+	if err != nil {
+		failCapture(writer, r, err)
+		return
+	}
+	if upload == nil && r.URL.Query().Get("response") == "json" {
+		failCapture(writer, r, &captureError{status: http.StatusBadRequest, message: "'viewports' returns a ZIP, or a JSON manifest with store="})
+		return
+	}
+
+	results, err := renderViewports(r.Context(), opts, viewports)
+	if err != nil {
+		failCapture(writer, r, err)
+		return
+	}
+
+	manifest := viewportManifest{URL: opts.url, FinalURL: results[0].finalURL, TargetStatus: results[0].status}
+	for i, v := range viewports {
+		vopts := opts
+		vopts.width, vopts.height = v.width, v.height
+		id := getCacheKey(vopts)
+		entry := viewportEntry{Viewport: v.String(), uploadResponse: newUploadResponse(id, results[i], "MISS")}
+		if upload != nil {
+			if err := storeUpload(r.Context(), &entry.uploadResponse, upload, id, results[i].data); err != nil {
+				failCapture(writer, r, err)
+				return
+			}
+		} else {
+			entry.File = v.String() + ".png"
+		}
+		manifest.Captures = append(manifest.Captures, entry)
+	}
+
+	writer.Header().Set("Cache-Control", "no-store")
+	if upload != nil {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(manifest)
+		return
+	}
+
+	host := "capture"
+	if u, err := url.Parse(opts.url); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	writer.Header().Set("Content-Type", "application/zip")
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": host + "-viewports.zip"}))
+	if err := writeViewportZip(writer, manifest, results); err != nil {
+		log.Printf("Error writing viewports ZIP (%s): %v", opts.url, err)
+	}
+}
+
+// writeViewportZip stores each capture (PNGs do not compress further) under
+// its viewport, followed by manifest.json.
+func writeViewportZip(writer http.ResponseWriter, manifest viewportManifest, results []*screenshotResult) error {
+	zw := zip.NewWriter(writer)
+	for i, entry := range manifest.Captures {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: entry.File, Method: zip.Store, Modified: results[i].created})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(results[i].data); err != nil {
+			return err
+		}
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// renderViewports loads opts.url once, in one tab of one worker, and
+// captures it at each viewport in turn, resizing the page the way a user
+// resizing the window would. Each capture is post-processed and cached like
+// a /get at that size. Errors are *captureError.
+func renderViewports(ctx context.Context, opts captureOptions, viewports []viewport) ([]*screenshotResult, error) {
+	if err := checkTargetURL(opts.url); err != nil {
+		return nil, err
+	}
+	if err := checkTenantURL(ctx, opts.url); err != nil {
+		return nil, err
+	}
+	meter := newEgressMeter(ctx)
+	if over, wait := meter.over(); over {
+		return nil, &captureError{status: http.StatusTooManyRequests, message: "Egress budget exhausted, please retry later", retryAfter: wait}
+	}
+
+	queued := time.Now()
+	release, err := acquireHost(ctx, opts.url, defaults.workerTimeout)
+	if err != nil {
+		atomic.AddInt64(&failedRequests, 1)
+		return nil, err
+	}
+	defer release()
+
+	worker, err := workerFor(ctx, opts, defaults.workerTimeout)
+	if err != nil {
+		return nil, err
+	}
+	timingFrom(ctx).since("queue", queued)
+	first := opts
+	first.width, first.height = viewports[0].width, viewports[0].height
+	report := opts.newReport()
+	shots := make([][]byte, len(viewports))
+	renderTimes := make([]time.Duration, len(viewports))
+	err = func() error {
+		worker.mu.Lock()
+		defer worker.mu.Unlock()
+		// The page loads once; every later viewport only needs a settle
+		timeout := defaults.timeout + time.Duration(len(viewports))*(defaults.settleDelay+10*time.Second)
+		_, tabCtx, cancel, err := openTab(ctx, worker, first, timeout, meter)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		ctx, abort := context.WithCancelCause(tabCtx)
+		defer abort(nil)
+		if err := chromedp.Run(ctx, report.enable(abort)); err != nil {
+			return err
+		}
+		for i, v := range viewports {
+			started := time.Now()
+			if i == 0 {
+				shots[i], err = captureFullPage(ctx, first)
+			} else {
+				err = chromedp.Run(ctx,
+					emulation.SetDeviceMetricsOverride(int64(v.width), int64(v.height), 1.0, false),
+					chromedp.Sleep(defaults.settleDelay),
+					chromedp.FullScreenshot(&shots[i], opts.quality),
+				)
+			}
+			renderTimes[i] = time.Since(started)
+			if i > 0 {
+				timingFrom(ctx).add("render", renderTimes[i])
+			}
+			if ce, ok := context.Cause(ctx).(*captureError); ok && err != nil {
+				return ce
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	opts.pooledProxy.record(err)
+	if err != nil && ctx.Err() == nil && transientRenderError(worker, err) {
+		worker.broken.Store(true)
+	}
+	releaseWorker(worker)
+
+	if err != nil && ctx.Err() != nil {
+		return nil, captureCanceled()
+	}
+	if err != nil {
+		log.Printf("Error capturing viewports of %s: %v", opts.url, err)
+		atomic.AddInt64(&failedRequests, 1)
+		if ce, ok := err.(*captureError); ok {
+			return nil, ce
+		}
+		switch {
+		case meter != nil && meter.exhausted.Load():
+			return nil, &captureError{status: http.StatusTooManyRequests, message: "Egress budget exhausted during capture"}
+		case err == context.DeadlineExceeded:
+			atomic.AddInt64(&timeoutRequests, 1)
+			return nil, &captureError{status: http.StatusRequestTimeout, message: "Screenshot timeout - page took too long to load"}
+		}
+		return nil, &captureError{status: http.StatusInternalServerError, message: "Error capturing screenshot"}
+	}
+
+	results := make([]*screenshotResult, len(viewports))
+	for i, v := range viewports {
+		vopts := opts
+		vopts.width, vopts.height = v.width, v.height
+		if results[i], err = finishCapture(ctx, vopts, getCacheKey(vopts), shots[i], false, renderTimes[i], report); err != nil {
+			return nil, err
+		}
+	}
+	recordUsage(ctx, int64(len(viewports)), 0)
+	if err := checkTargetStatus(opts, results[0]); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
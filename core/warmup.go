@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	// Page each initial worker captures once before taking traffic
+	// (WARMUP_URL, empty = no warm-up), so the first real requests do not pay
+	// for Chrome starting and filling its font and code caches
+	warmupURL string
+
+	// Set once warm-up is done (at once without it); see HandleReady
+	warmedUp atomic.Bool
+)
+
+func init() {
+	warmupURL = os.Getenv("WARMUP_URL")
+	if warmupURL != "" && !strings.HasPrefix(warmupURL, "http://") && !strings.HasPrefix(warmupURL, "https://") && !strings.HasPrefix(warmupURL, "data:") {
+		log.Fatalf("Invalid WARMUP_URL %q: want an http(s) or data: URL", warmupURL)
+	}
+}
+
+// warmUpWorkers captures warmupURL on every idle worker, all at once, and
+// returns each to the pool when it is done. A failed warm-up is only logged:
+// the worker is as usable as it would have been without one.
+func warmUpWorkers() {
+	defer warmedUp.Store(true)
+	if warmupURL == "" {
+		return
+	}
+	started := time.Now()
+	var wg sync.WaitGroup
+	warmed := 0
+take:
+	for n := len(workerPool); n > 0; n-- {
+		var worker *chromeWorker
+		select {
+		case worker = <-workerPool:
+		default:
+			break take // taken by early requests, which warm them up themselves
+		}
+		warmed++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := warmUpWorker(worker); err != nil {
+				log.Printf("Warm-up of worker %d failed: %v", worker.id, err)
+			}
+			handOff(worker)
+		}()
+	}
+	wg.Wait()
+	log.Printf("webshot warmed up %d Chrome workers in %v", warmed, time.Since(started).Round(time.Millisecond))
+}
+
+func warmUpWorker(worker *chromeWorker) error {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	ctx, cancel, err := worker.newTab(nil, false)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	ctx, timeoutCancel := context.WithTimeout(ctx, defaults.timeout)
+	defer timeoutCancel()
+
+	var buf []byte
+	return chromedp.Run(ctx,
+		chromedp.Navigate(warmupURL),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		chromedp.Sleep(defaults.settleDelay),
+		chromedp.FullScreenshot(&buf, defaults.quality),
+	)
+}
+
+// HandleReady answers 200 once the service can take captures at full speed:
+// workers are warmed up and it is not shutting down. Point load balancer
+// readiness probes here and liveness probes at /health.
+func HandleReady(writer http.ResponseWriter, r *http.Request) {
+	ready := warmedUp.Load()
+	select {
+	case <-shutdownChan:
+		ready = false
+	default:
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		writer.Write([]byte(`{"ready":false}`))
+		return
+	}
+	writer.Write([]byte(`{"ready":true}`))
+}
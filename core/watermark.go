@@ -0,0 +1,141 @@
+package core
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// watermark is a tenant's overlay for every capture it takes, e.g.
+//
+//	"watermark": {"text": "PREVIEW", "position": "bottom-right", "opacity": 0.6}
+//
+// or {"image": "/etc/webshot/logo.png", "width": 120}. It is drawn before
+// the capture is cached, so watermarked captures are never shared with
+// other tenants.
+type watermark struct {
+	Text     string  `json:"text,omitempty"`
+	Image    string  `json:"image,omitempty"`    // PNG file
+	Position string  `json:"position,omitempty"` // top-left, top-right, bottom-left, bottom-right (default) or center
+	Opacity  float64 `json:"opacity,omitempty"`  // 0-1, default 0.5
+	Color    string  `json:"color,omitempty"`    // text colour, default #ffffff
+	Size     int     `json:"size,omitempty"`     // text scale in pixels per font pixel, default 3
+	Width    int     `json:"width,omitempty"`    // image width, default its own
+	Margin   int     `json:"margin,omitempty"`   // distance from the edges, default 16
+
+	id      string // names this configuration in cache keys
+	overlay *image.RGBA
+	mask    *image.Uniform
+}
+
+// load validates the configuration of tenant's watermark and renders its
+// overlay.
+func (wm *watermark) load(tenant string) error {
+	if (wm.Text == "") == (wm.Image == "") {
+		return fmt.Errorf("set one of text or image")
+	}
+	switch wm.Position {
+	case "":
+		wm.Position = "bottom-right"
+	case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+	default:
+		return fmt.Errorf("unknown position %q", wm.Position)
+	}
+	if wm.Opacity == 0 {
+		wm.Opacity = 0.5
+	}
+	if wm.Opacity < 0 || wm.Opacity > 1 {
+		return fmt.Errorf("opacity must be between 0 and 1")
+	}
+	if wm.Margin == 0 {
+		wm.Margin = 16
+	}
+	config, _ := json.Marshal(wm)
+	sum := sha256.New()
+	sum.Write(config)
+
+	if wm.Text != "" {
+		c, err := parseHexColor(cmp.Or(wm.Color, "#ffffff"))
+		if err != nil {
+			return err
+		}
+		scale := wm.Size
+		if scale <= 0 {
+			scale = 3
+		}
+		// A dark shadow keeps light text readable on light pages
+		wm.overlay = image.NewRGBA(image.Rect(0, 0, textWidth(wm.Text, scale)+scale, glyphHeight*scale+scale))
+		drawText(wm.overlay, scale, scale, wm.Text, scale, color.RGBA{0, 0, 0, 0xff})
+		drawText(wm.overlay, 0, 0, wm.Text, scale, c)
+	} else {
+		data, err := os.ReadFile(wm.Image)
+		if err != nil {
+			return err
+		}
+		sum.Write(data)
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("image: %v", err)
+		}
+		if b := img.Bounds(); wm.Width > 0 && wm.Width != b.Dx() {
+			wm.overlay = scaleImage(img, wm.Width, max(1, b.Dy()*wm.Width/b.Dx()))
+		} else {
+			wm.overlay = toRGBA(img)
+		}
+	}
+	wm.mask = image.NewUniform(color.Alpha{uint8(wm.Opacity*255 + 0.5)})
+	wm.id = tenant + "/" + hex.EncodeToString(sum.Sum(nil)[:6])
+	return nil
+}
+
+// apply draws the watermark onto img. Images smaller than the watermark get
+// it clipped.
+func (wm *watermark) apply(img *image.RGBA) {
+	b, o := img.Bounds(), wm.overlay.Bounds()
+	x, y := b.Min.X+wm.Margin, b.Min.Y+wm.Margin
+	if strings.HasSuffix(wm.Position, "right") {
+		x = b.Max.X - wm.Margin - o.Dx()
+	}
+	if strings.HasPrefix(wm.Position, "bottom") {
+		y = b.Max.Y - wm.Margin - o.Dy()
+	}
+	if wm.Position == "center" {
+		x, y = b.Min.X+(b.Dx()-o.Dx())/2, b.Min.Y+(b.Dy()-o.Dy())/2
+	}
+	r := image.Rect(x, y, x+o.Dx(), y+o.Dy())
+	draw.DrawMask(img, r, wm.overlay, o.Min, wm.mask, image.Point{}, draw.Over)
+}
+
+// watermarkCapture applies wm to a PNG.
+func watermarkCapture(data []byte, wm *watermark) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	rgba := toRGBA(img)
+	wm.apply(rgba)
+	return pngBytes(&pngEncoder, rgba)
+}
+
+// parseHexColor reads #rgb or #rrggbb.
+func parseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid colour %q, want #rrggbb", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
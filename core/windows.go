@@ -0,0 +1,189 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// timeWindow is a recurring daily span such as "Mon-Fri 02:00-05:00". Spans
+// whose end is before their start wrap past midnight; equal start and end
+// cover the whole day.
+type timeWindow struct {
+	days  [7]bool
+	start int // minutes after midnight
+	end   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseTimeWindow(spec string) (timeWindow, error) {
+	var w timeWindow
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("window %q: expected \"[days] HH:MM-HH:MM\"", spec)
+	}
+
+	if len(fields) == 1 {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	} else {
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok1 := weekdays[from]
+			last, ok2 := weekdays[to]
+			if !isRange {
+				last, ok2 = first, ok1
+			}
+			if !ok1 || !ok2 {
+				return w, fmt.Errorf("window %q: unknown day in %q", spec, part)
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return w, fmt.Errorf("window %q: expected a HH:MM-HH:MM span", spec)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, fmt.Errorf("window %q: %w", spec, err)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, fmt.Errorf("window %q: %w", spec, err)
+	}
+	return w, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	prev := (day + 6) % 7
+
+	switch {
+	case w.start == w.end:
+		return w.days[day]
+	case w.start < w.end:
+		return w.days[day] && m >= w.start && m < w.end
+	default:
+		return (w.days[day] && m >= w.start) || (w.days[prev] && m < w.end)
+	}
+}
+
+// executionPolicy restricts when heavy work (batch runs, schedules) may run:
+// inside one of Windows (if any are given) and outside every Blackout.
+type executionPolicy struct {
+	Windows   []string `json:"windows,omitempty"`
+	Blackouts []string `json:"blackouts,omitempty"`
+	Timezone  string   `json:"timezone,omitempty"`
+
+	windows   []timeWindow
+	blackouts []timeWindow
+	location  *time.Location
+}
+
+var (
+	// Server-wide blackout periods for batch work (BATCH_BLACKOUTS, ';' separated)
+	globalBlackouts []timeWindow
+)
+
+func init() {
+	for _, spec := range strings.Split(os.Getenv("BATCH_BLACKOUTS"), ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			log.Fatalf("Invalid BATCH_BLACKOUTS: %v", err)
+		}
+		globalBlackouts = append(globalBlackouts, w)
+	}
+}
+
+// compile parses the textual windows; it must be called before permits.
+func (p *executionPolicy) compile() error {
+	p.location = time.Local
+	if p.Timezone != "" {
+		loc, err := time.LoadLocation(p.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q", p.Timezone)
+		}
+		p.location = loc
+	}
+
+	p.windows, p.blackouts = nil, nil
+	for _, spec := range p.Windows {
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			return err
+		}
+		p.windows = append(p.windows, w)
+	}
+	for _, spec := range p.Blackouts {
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			return err
+		}
+		p.blackouts = append(p.blackouts, w)
+	}
+	return nil
+}
+
+func (p *executionPolicy) permits(t time.Time) bool {
+	local := t.In(p.location)
+	for _, b := range p.blackouts {
+		if b.contains(local) {
+			return false
+		}
+	}
+	for _, b := range globalBlackouts {
+		if b.contains(t.In(time.Local)) {
+			return false
+		}
+	}
+	if len(p.windows) == 0 {
+		return true
+	}
+	for _, w := range p.windows {
+		if w.contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextPermitted returns when work may next run, or ok=false when no such
+// minute exists within the coming week.
+func (p *executionPolicy) nextPermitted(now time.Time) (time.Time, bool) {
+	t := now.Truncate(time.Minute)
+	if p.permits(now) {
+		return now, true
+	}
+	for i := 0; i < 8*24*60; i++ {
+		t = t.Add(time.Minute)
+		if p.permits(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	// Probe idle workers this often (WORKER_HEALTH_CHECK_SECONDS, 0 = off)
+	workerHealthInterval time.Duration
+	// A probe taking longer than this counts as a hung Chrome
+	workerProbeTimeout = 10 * time.Second
+	// Budget of /health?deep=true, worker wait included
+	// (HEALTH_DEEP_TIMEOUT_SECONDS)
+	deepHealthTimeout time.Duration
+
+	// Recycle a worker after this many captures or this long
+	// (WORKER_MAX_CAPTURES, WORKER_MAX_AGE_MINUTES, 0 = never)
+	workerMaxCaptures int
+	workerMaxAge      time.Duration
+
+	replacedWorkers int64
+	recycledWorkers int64
+	retriedRequests int64
+)
+
+func init() {
+	workerHealthInterval = time.Duration(envInt("WORKER_HEALTH_CHECK_SECONDS", 60, 0, 86400)) * time.Second
+	workerMaxCaptures = envInt("WORKER_MAX_CAPTURES", 500, 0, 1<<30)
+	workerMaxAge = time.Duration(envInt("WORKER_MAX_AGE_MINUTES", 60, 0, 7*24*60)) * time.Minute
+	deepHealthTimeout = time.Duration(envInt("HEALTH_DEEP_TIMEOUT_SECONDS", 5, 1, 60)) * time.Second
+}
+
+// deepHealth is the outcome of /health?deep=true.
+type deepHealth struct {
+	OK         bool   `json:"ok"`
+	Busy       bool   `json:"busy,omitempty"` // no worker was free in time
+	Worker     *int   `json:"worker,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	Skipped    string `json:"skipped,omitempty"`
+}
+
+// deepHealthPage is small enough to render instantly and has text, so the
+// check exercises layout, fonts and the compositor rather than a blank tab.
+const deepHealthPage = "data:text/html,<title>health</title><p style='font:16px sans-serif'>webshot</p>"
+
+// checkDeepHealth renders deepHealthPage on a pooled worker, ahead of queued
+// captures, and checks that a PNG of the viewport comes back. A worker that
+// fails is marked broken and recycled.
+func checkDeepHealth(ctx context.Context) deepHealth {
+	if clusterRole == "api" {
+		return deepHealth{OK: true, Skipped: "captures render on the renderer nodes"}
+	}
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, deepHealthTimeout)
+	defer cancel()
+
+	var result deepHealth
+	worker, err := getWorker(ctx, priorityHigh, "health", deepHealthTimeout)
+	if err != nil {
+		result.Busy = true
+		result.Error = err.Error()
+		result.DurationMS = time.Since(started).Milliseconds()
+		return result
+	}
+	result.Worker = &worker.id
+	err = renderProbe(ctx, worker)
+	if err != nil {
+		worker.broken.Store(true)
+	}
+	releaseWorker(worker)
+
+	result.OK = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.DurationMS = time.Since(started).Milliseconds()
+	return result
+}
+
+func renderProbe(ctx context.Context, worker *chromeWorker) error {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	tabCtx, tabCancel, err := worker.newTab(nil, false)
+	if err != nil {
+		return err
+	}
+	defer tabCancel()
+	tabCtx, cancel := context.WithCancel(tabCtx)
+	defer cancel()
+	defer context.AfterFunc(ctx, cancel)()
+
+	var buf []byte
+	if err := chromedp.Run(tabCtx,
+		chromedp.Navigate(deepHealthPage),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		chromedp.CaptureScreenshot(&buf),
+	); err != nil {
+		return err
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("screenshot is not a PNG: %w", err)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return fmt.Errorf("empty %dx%d screenshot", cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// checkWorkerHealth periodically probes every idle worker with a blank
+// capture and replaces the ones whose Chrome crashed or hung.
+func checkWorkerHealth() {
+	if workerHealthInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(workerHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			probeIdleWorkers()
+		case <-shutdownChan:
+			return
+		}
+	}
+}
+
+// probeIdleWorkers takes each pooled worker out in turn, so probes never
+// race a capture, and returns it or its replacement.
+func probeIdleWorkers() {
+	for n := len(workerPool); n > 0; n-- {
+		var worker *chromeWorker
+		select {
+		case worker = <-workerPool:
+		default:
+			return // drained by concurrent requests
+		}
+		if worker = recycleIfDue(worker); worker == nil {
+			continue
+		}
+		if err := probeWorker(worker); err != nil {
+			log.Printf("Worker %d failed its health check, replacing it: %v", worker.id, err)
+			atomic.AddInt64(&replacedWorkers, 1)
+			if worker = replaceWorker(worker); worker == nil {
+				continue
+			}
+		}
+		// Back into the pool without touching lastUsed, so probes do not
+		// keep idle workers from being retired
+		handOff(worker)
+	}
+}
+
+func probeWorker(worker *chromeWorker) error {
+	if err := worker.allocCtx.Err(); err != nil {
+		return err
+	}
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	ctx, cancel, err := worker.newTab(nil, false)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	ctx, timeoutCancel := context.WithTimeout(ctx, workerProbeTimeout)
+	defer timeoutCancel()
+
+	var buf []byte
+	return chromedp.Run(ctx,
+		chromedp.Navigate("about:blank"),
+		chromedp.CaptureScreenshot(&buf),
+	)
+}
+
+// recycleIfDue replaces an idle worker that has reached its capture count or
+// age limit, since Chrome leaks memory over time, was killed for memory or
+// broke during a capture, is bound to an ejected remote backend, or has done
+// a capture with CHROME_PROFILE_ISOLATION=capture. Callers must own the worker,
+// i.e. it is not in the pool and no capture is using it.
+func recycleIfDue(worker *chromeWorker) *chromeWorker {
+	due := worker.overLimit.Load() || worker.broken.Load() ||
+		(worker.backend != nil && !worker.backend.healthy()) ||
+		(workerMaxCaptures > 0 && worker.captures >= workerMaxCaptures) ||
+		(workerMaxAge > 0 && time.Since(worker.started) >= workerMaxAge) ||
+		(profileIsolation == "capture" && worker.backend == nil && worker.captures > 0)
+	if !due {
+		return worker
+	}
+	atomic.AddInt64(&recycledWorkers, 1)
+	return replaceWorker(worker)
+}
+
+// replaceWorker stops a worker and starts a fresh one in its place. It
+// returns nil if the service is shutting down.
+func replaceWorker(worker *chromeWorker) *chromeWorker {
+	stopWorker(worker)
+	return startWorker()
+}
+
+// transientRenderError reports whether a capture failed because the renderer
+// or its connection broke rather than because of the page: a crashed tab, a
+// closed DevTools connection, or a browser that is gone. Such captures are
+// worth one retry on another worker.
+func transientRenderError(worker *chromeWorker, err error) bool {
+	if worker.overLimit.Load() {
+		return false // killed on purpose, the page is to blame
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		// Callers rule out their client hanging up, so only a crashed tab
+		// or the browser going away cancels them
+		return true
+	case errors.Is(err, chromedp.ErrChannelClosed),
+		errors.Is(err, chromedp.ErrInvalidTarget),
+		errors.Is(err, chromedp.ErrInvalidWebsocketMessage):
+		return true
+	}
+	if msg := err.Error(); strings.Contains(msg, "websocket") || strings.Contains(msg, "use of closed network connection") {
+		return true
+	}
+	return worker.allocCtx.Err() != nil || !worker.browserRunning()
+}
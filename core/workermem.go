@@ -0,0 +1,124 @@
+package core
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Kill a worker's Chrome once its process tree holds more than this
+	// (WORKER_MAX_RSS_MB, 0 = off). Only enforced where /proc is available.
+	workerMaxRSS int64
+
+	memoryKills int64
+	chromeRSS   int64 // bytes held by all Chrome trees at the last check
+)
+
+func init() {
+	workerMaxRSS = int64(envInt("WORKER_MAX_RSS_MB", 2048, 0, 1<<20)) << 20
+}
+
+// monitorWorkerMemory kills Chrome process trees that grow past workerMaxRSS,
+// failing the capture that caused it and marking the worker for recycling.
+func monitorWorkerMemory() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			checkWorkerMemory()
+		case <-shutdownChan:
+			return
+		}
+	}
+}
+
+func checkWorkerMemory() {
+	workersLock.RLock()
+	running := make([]*chromeWorker, 0, len(workers))
+	for _, w := range workers {
+		if w != nil && w.pid.Load() != 0 {
+			running = append(running, w)
+		}
+	}
+	workersLock.RUnlock()
+	if len(running) == 0 {
+		atomic.StoreInt64(&chromeRSS, 0)
+		return
+	}
+
+	procs, err := readProcs()
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, w := range running {
+		pid := int(w.pid.Load())
+		rss := procs.treeRSS(pid)
+		total += rss
+		if workerMaxRSS == 0 || rss <= workerMaxRSS {
+			continue
+		}
+		log.Printf("Worker %d Chrome uses %d MB (limit %d MB), killing it", w.id, rss>>20, workerMaxRSS>>20)
+		atomic.AddInt64(&memoryKills, 1)
+		w.overLimit.Store(true)
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+	}
+	atomic.StoreInt64(&chromeRSS, total)
+}
+
+// procTable is a snapshot of /proc: each process's parent and resident size.
+type procTable struct {
+	children map[int][]int
+	rss      map[int]int64
+}
+
+func readProcs() (*procTable, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	t := &procTable{children: make(map[int][]int), rss: make(map[int]int64)}
+	pageSize := int64(os.Getpagesize())
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces; fields resume after its ")"
+		i := strings.LastIndexByte(string(raw), ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(raw[i+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		pages, _ := strconv.ParseInt(fields[21], 10, 64)
+		t.children[ppid] = append(t.children[ppid], pid)
+		t.rss[pid] = pages * pageSize
+	}
+	return t, nil
+}
+
+// treeRSS sums the resident size of pid and all its descendants.
+func (t *procTable) treeRSS(pid int) int64 {
+	total := t.rss[pid]
+	for _, child := range t.children[pid] {
+		total += t.treeRSS(child)
+	}
+	return total
+}
@@ -0,0 +1,160 @@
+// Package testsite serves a small set of deterministic pages for end-to-end
+// tests: a static page, a client-rendered SPA, lazy-loaded images, slow
+// resources, redirects, an authenticated dashboard with a login form, a very
+// tall page, one carrying link-preview metadata and one behind a cookie banner.
+package testsite
+
+import (
+	"embed"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed pages/*.html
+var pages embed.FS
+
+// Credentials accepted by the authenticated pages and the token endpoint.
+const (
+	AccessToken  = "test-access-token"
+	RefreshToken = "test-refresh-token"
+	ClientID     = "webshot-test"
+	CookieName   = "session"
+)
+
+// Paths served by Handler.
+const (
+	Static   = "/"
+	SPA      = "/spa"
+	Lazy     = "/lazy"
+	Slow     = "/slow"
+	Huge     = "/huge"
+	Meta     = "/meta"        // description, canonical, OpenGraph and Twitter tags
+	Broken   = "/broken"      // logs an error, throws and loads a missing image
+	State    = "/state"       // logs and bumps a localStorage counter and cookie
+	Consent  = "/consent"     // cookie banner over a dimmed page; logs the choice
+	Redirect = "/redirect"    // 302 chain ending at Static
+	Auth     = "/auth"        // needs "Authorization: Bearer AccessToken"
+	Cookie   = "/auth/cookie" // needs the CookieName cookie set to AccessToken
+	Login    = "/login"       // form posting a token; AccessToken sets the cookie
+	Token    = "/oauth/token" // refresh_token grant issuing AccessToken
+)
+
+// New starts the test site on a loopback HTTP server.
+func New() *httptest.Server {
+	return httptest.NewServer(Handler())
+}
+
+// NewTLS starts the test site over HTTPS; use its Client() to trust it. OAuth
+// token endpoints must be HTTPS, so credential tests point at this one.
+func NewTLS() *httptest.Server {
+	return httptest.NewTLSServer(Handler())
+}
+
+// Handler routes every test page.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", page("index.html"))
+	mux.HandleFunc("GET /spa", page("spa.html"))
+	mux.HandleFunc("GET /lazy", page("lazy.html"))
+	mux.HandleFunc("GET /slow", page("slow.html"))
+	mux.HandleFunc("GET /huge", page("huge.html"))
+	mux.HandleFunc("GET /meta", page("meta.html"))
+	mux.HandleFunc("GET /broken", page("broken.html"))
+	mux.HandleFunc("GET /state", page("state.html"))
+	mux.HandleFunc("GET /consent", page("consent.html"))
+
+	mux.HandleFunc("GET /redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/redirect/step", http.StatusFound)
+	})
+	mux.HandleFunc("GET /redirect/step", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusMovedPermanently)
+	})
+
+	mux.HandleFunc("GET /auth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+AccessToken {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		page("auth.html")(w, r)
+	})
+	mux.HandleFunc("GET /auth/cookie", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(CookieName); err != nil || c.Value != AccessToken {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		page("auth.html")(w, r)
+	})
+
+	mux.HandleFunc("GET /login", page("login.html"))
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("token") != AccessToken {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: CookieName, Value: AccessToken, Path: "/", MaxAge: 3600, HttpOnly: true})
+		http.Redirect(w, r, Cookie, http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("POST /oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != RefreshToken || r.FormValue("client_id") != ClientID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": AccessToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+
+	// Solid-colour PNGs; ?color=rgb in hex shorthand, /slow/ variants wait ?ms first
+	mux.HandleFunc("GET /image.png", solidImage)
+	mux.HandleFunc("GET /slow/image.png", func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		solidImage(w, r)
+	})
+
+	return mux
+}
+
+func page(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := pages.ReadFile("pages/" + name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(data)
+	}
+}
+
+func solidImage(w http.ResponseWriter, r *http.Request) {
+	c := color.RGBA{0x88, 0x88, 0x88, 0xff}
+	if hex := strings.TrimPrefix(r.URL.Query().Get("color"), "#"); len(hex) == 3 {
+		if v, err := strconv.ParseUint(hex, 16, 16); err == nil {
+			c = color.RGBA{uint8(v>>8&0xf) * 17, uint8(v>>4&0xf) * 17, uint8(v&0xf) * 17, 0xff}
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, img)
+}
@@ -24,15 +24,53 @@ func main() {
 		os.Exit(0)
 	}()
 
+	// Configuration is read by the package's init; start the workers on it
+	if err := core.Start(); err != nil {
+		log.Fatalf("webshot: %v", err)
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("webshot - High-Performance Screenshot Service\nEndpoints:\n  /get?url=<URL>&width=<W>&height=<H>\n  /health"))
+		w.Write([]byte("webshot - High-Performance Screenshot Service\nEndpoints:\n  /get?url=<URL>&width=<W>&height=<H>\n  /tiles?url=<URL>&width=<W>&height=<H>\n  /health"))
 	})
 
-	http.HandleFunc("/get", core.HandleScreenshot)
+	// Every capture-facing endpoint is authenticated, rate limited and metered
+	protect := func(h http.HandlerFunc) http.HandlerFunc {
+		return core.RequireAPIKey(core.RateLimit(core.TrackUsage(h)))
+	}
+
+	http.HandleFunc("/get", protect(core.HandleScreenshot))
+	http.HandleFunc("/tiles", protect(core.HandleTiles))
+	http.HandleFunc("GET /tiles/{id}/{level}/{tile}", core.RequireAPIKey(core.HandleTile))
+	http.HandleFunc("GET /captures/{id}", protect(core.HandleCapture))
+	// Stored files are addressed by content hash and linked from pages
+	http.HandleFunc("GET /files/{id}", core.HandleFile)
+	http.HandleFunc("/captures/{id}/annotations", protect(core.HandleAnnotations))
+	http.HandleFunc("GET /captures/{id}/text", protect(core.HandleCaptureText))
+	http.HandleFunc("/diff", protect(core.HandleDiff))
+	http.HandleFunc("/sign", protect(core.HandleSign))
+	http.HandleFunc("/cdp", protect(core.HandleCDP))
+	http.HandleFunc("/meta", protect(core.HandleMeta))
+	http.HandleFunc("/preview", protect(core.HandlePreview))
+	http.HandleFunc("/a11y", protect(core.HandleA11y))
+	http.HandleFunc("/perf", protect(core.HandlePerf))
+	http.HandleFunc("/phash", protect(core.HandlePHash))
+	http.HandleFunc("GET /baselines", protect(core.HandleBaselines))
+	http.HandleFunc("/baselines/{name}", protect(core.HandleBaseline))
+	http.HandleFunc("/compare", protect(core.HandleCompare))
+	http.HandleFunc("/schedules", core.RequireAPIKey(core.RateLimit(core.HandleSchedules)))
+	http.HandleFunc("/schedules/{id}", core.RequireAPIKey(core.RateLimit(core.HandleSchedule)))
+	http.HandleFunc("GET /schedules/{id}/runs/{run}", core.RequireAPIKey(core.HandleScheduleRun))
+	http.HandleFunc("GET /schedules/{id}/runs/{run}/diff", core.RequireAPIKey(core.HandleScheduleRun))
+	http.HandleFunc("/credentials", core.RequireAPIKey(core.RateLimit(core.HandleCredentials)))
+	http.HandleFunc("/profiles", core.RequireAPIKey(core.RateLimit(core.HandleProfiles)))
+	http.HandleFunc("/secrets", core.RequireAPIKey(core.RateLimit(core.HandleSecrets)))
+	http.HandleFunc("/usage", core.RequireAPIKey(core.HandleUsage))
+	http.HandleFunc("DELETE /cache", core.RequireAPIKey(core.HandlePurge))
 	http.HandleFunc("/health", core.HandleHealth)
+	http.HandleFunc("/ready", core.HandleReady)
 	
 	log.Println("webshot service running at http://localhost:8080/")
 	log.Println("Use /health for monitoring and /get?url=<URL> for screenshots")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", core.WithCORS(core.WithServerTiming(http.DefaultServeMux))))
 }